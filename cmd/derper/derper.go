@@ -204,6 +204,7 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.Handle("clients", "Per-client traffic (JSON)", http.HandlerFunc(s.ServeDebugClients))
 
 	if *runSTUN {
 		go serveSTUN(listenHost)
@@ -99,6 +99,7 @@ func runPing(ctx context.Context, args []string) error {
 
 	n := 0
 	anyPong := false
+	hardNATNoted := false
 	for {
 		n++
 		bc.Ping(ip, pingArgs.tsmp)
@@ -133,6 +134,11 @@ func runPing(ctx context.Context, args []string) error {
 				extra = fmt.Sprintf(", %d", pr.PeerAPIPort)
 			}
 			fmt.Printf("pong from %s (%s%s) via %v in %v\n", pr.NodeName, pr.NodeIP, extra, via, latency)
+			if pr.DERPRegionID != 0 && !hardNATNoted &&
+				pr.LocalMappingVariesByDestIP.EqualBool(true) && pr.PeerMappingVariesByDestIP.EqualBool(true) {
+				hardNATNoted = true
+				fmt.Println("both endpoints behind hard NAT; relaying via DERP is expected")
+			}
 			if pingArgs.tsmp {
 				return nil
 			}
@@ -20,6 +20,8 @@ import (
 	"io"
 	"io/ioutil"
 	"time"
+
+	"github.com/golang/snappy"
 )
 
 // MaxPacketSize is the maximum size of a packet sent over DERP.
@@ -41,8 +43,39 @@ const (
 
 // ProtocolVersion is bumped whenever there's a wire-incompatible change.
 //   * version 1 (zero on wire): consistent box headers, in use by employee dev nodes a bit
-//   * version 2: received packets have src addrs in frameRecvPacket at beginning
-const ProtocolVersion = 2
+//   * version 2: received packets have src addrs in frameRecvPacket at beginning.
+//     Servers only send frameHealth and frameRestarting to version 2+ clients.
+//   * version 3: framePeerPresentEndpoints, frameSendPacketMulti and the
+//     compressed packet frames, which are only sent on connections that
+//     negotiated version 3+.
+const ProtocolVersion = 3
+
+// minProtocolVersion is the oldest protocol version that clients and
+// servers in this package are willing to speak.
+const minProtocolVersion = 1
+
+// negotiateProtocolVersion returns the highest protocol version
+// supported by both this side, which speaks [minProtocolVersion,
+// ProtocolVersion], and the peer, which speaks [peerMin, peerMax].
+// A zero peerMin or peerMax means version 1, as older peers sent
+// no version at all.
+func negotiateProtocolVersion(peerMin, peerMax int) (int, error) {
+	if peerMin == 0 {
+		peerMin = 1
+	}
+	if peerMax == 0 {
+		peerMax = 1
+	}
+	v := peerMax
+	if v > ProtocolVersion {
+		v = ProtocolVersion
+	}
+	if v < peerMin || v < minProtocolVersion {
+		return 0, fmt.Errorf("no common protocol version; peer supports [%d, %d], have [%d, %d]",
+			peerMin, peerMax, minProtocolVersion, ProtocolVersion)
+	}
+	return v, nil
+}
 
 // frameType is the one byte frame type at the beginning of the frame
 // header.  The second field is a big-endian uint32 describing the
@@ -115,8 +148,80 @@ const (
 	// and how long to try total. See ServerRestartingMessage docs for
 	// more details on how the client should interpret them.
 	frameRestarting = frameType(0x15)
+
+	// framePeerPresentEndpoints is like framePeerPresent, but also
+	// carries the ip:port endpoints the peer advertised when it
+	// connected (see the Endpoints ClientOpt). It's only sent to
+	// version 3+ watchers that declared they understand it; others
+	// get plain framePeerPresent frames.
+	framePeerPresentEndpoints = frameType(0x16) // 32B pub key + 0+ endpoints of 16B IP + 2B big endian port
+
+	// frameSendPacketMulti is like frameSendPacket, but for the
+	// server to fan the packet out to several destinations. It's
+	// only sent on version 3+ connections.
+	frameSendPacketMulti = frameType(0x17) // 1B key count + count*32B dest pub keys + packet bytes
+
+	// frameSendPacketCompressed and frameRecvPacketCompressed are
+	// like frameSendPacket and frameRecvPacket (v2), but with the
+	// packet bytes snappy-compressed. They're only sent on version
+	// 3+ connections whose client enabled compression (see the
+	// Compression ClientOpt), and only for packets that compression
+	// shrinks.
+	frameSendPacketCompressed = frameType(0x18) // 32B dest pub key + snappy packet bytes
+	frameRecvPacketCompressed = frameType(0x19) // 32B src pub key + snappy packet bytes
 )
 
+// maxSendMultiKeys is the most destination keys in one
+// frameSendPacketMulti frame.
+const maxSendMultiKeys = 64
+
+// compressPacket returns pkt snappy-compressed into buf (which it
+// grows as needed, so callers can reuse it), and whether it's worth
+// sending that way: it's not if pkt is a WireGuard transport data
+// packet, which is encrypted and so never shrinks, or if compressing
+// it didn't make it smaller.
+func compressPacket(buf *[]byte, pkt []byte) (enc []byte, ok bool) {
+	if looksLikeWireGuardData(pkt) {
+		return nil, false
+	}
+	if n := snappy.MaxEncodedLen(len(pkt)); cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	enc = snappy.Encode((*buf)[:cap(*buf)], pkt)
+	return enc, len(enc) < len(pkt)
+}
+
+// decompressPacket decodes the snappy-compressed packet enc into
+// dst if it's large enough, or else into newly allocated memory.
+func decompressPacket(dst, enc []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(enc)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxPacketSize {
+		return nil, fmt.Errorf("decompressed packet longer (%d) than max of %v", n, MaxPacketSize)
+	}
+	if cap(dst) < n {
+		dst = make([]byte, n)
+	}
+	return snappy.Decode(dst[:n], enc)
+}
+
+// looksLikeWireGuardData reports whether pkt looks like a WireGuard
+// transport data message: type 4 and three reserved zero bytes,
+// followed by the receiver index and counter.
+func looksLikeWireGuardData(pkt []byte) bool {
+	return len(pkt) >= 16 && pkt[0] == 4 && pkt[1] == 0 && pkt[2] == 0 && pkt[3] == 0
+}
+
+// peerEndpointLen is the length of each endpoint in a
+// framePeerPresentEndpoints frame.
+const peerEndpointLen = 16 + 2
+
+// maxPeerEndpoints is the most endpoints the server forwards for a
+// peer in a framePeerPresentEndpoints frame. Extra ones are dropped.
+const maxPeerEndpoints = 16
+
 var bin = binary.BigEndian
 
 func writeUint32(bw *bufio.Writer, v uint32) error {
@@ -6,22 +6,33 @@ package derp
 
 import (
 	"bufio"
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/nacl/box"
+	"inet.af/netaddr"
+	"tailscale.com/syncs"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
 // Client is a DERP client.
 type Client struct {
+	// recvTimeoutNanos, if non-zero, is the time.Duration Recv
+	// waits for a frame. See SetRecvTimeout.
+	// Atomically accessed; declared first for alignment reasons.
+	recvTimeoutNanos int64
+
 	serverKey   key.Public // of the DERP server; not a machine or node key
 	privateKey  key.Private
 	publicKey   key.Public // of privateKey
@@ -29,15 +40,30 @@ type Client struct {
 	nc          Conn
 	br          *bufio.Reader
 	meshKey     string
+	bearerToken string
 	canAckPings bool
 	isProber    bool
+	endpoints   []netaddr.IPPort
+	canPeerEPs  bool
+	compress    bool // whether to negotiate packet compression
+
+	wmu     sync.Mutex // hold while writing to bw
+	bw      *bufio.Writer
+	compBuf []byte // scratch space for compressing sends; guarded by wmu
 
-	wmu sync.Mutex // hold while writing to bw
-	bw  *bufio.Writer
+	// serverCompress is whether compress is set and the protocol
+	// version negotiated with the server has
+	// frameSendPacketCompressed. Set by Recv.
+	serverCompress syncs.AtomicBool
+
+	// serverSendMulti is whether the protocol version negotiated
+	// with the server has frameSendPacketMulti. Set by Recv.
+	serverSendMulti syncs.AtomicBool
 
 	// Owned by Recv:
-	peeked  int   // bytes to discard on next Recv
-	readErr error // sticky read error
+	peeked    int    // bytes to discard on next Recv
+	readErr   error  // sticky read error
+	decompBuf []byte // decompressed packet of the last Recv
 }
 
 // ClientOpt is an option passed to NewClient.
@@ -52,9 +78,13 @@ func (f clientOptFunc) update(o *clientOpt) { f(o) }
 // clientOpt are the options passed to newClient.
 type clientOpt struct {
 	MeshKey     string
+	BearerToken string
 	ServerPub   key.Public
 	CanAckPings bool
 	IsProber    bool
+	Endpoints   []netaddr.IPPort
+	CanPeerEPs  bool
+	Compress    bool
 }
 
 // MeshKey returns a ClientOpt to pass to the DERP server during connect to get
@@ -63,6 +93,17 @@ type clientOpt struct {
 // An empty key means to not use a mesh key.
 func MeshKey(key string) ClientOpt { return clientOptFunc(func(o *clientOpt) { o.MeshKey = key }) }
 
+// BearerToken returns a ClientOpt to pass token to the DERP server
+// during connect, for servers that authorize clients themselves
+// (see Server.SetBearerTokenVerifier), such as a hosted relay
+// admitting only its tenants. Like the mesh key, it's sent encrypted
+// to the server's key.
+//
+// An empty token means to not send one.
+func BearerToken(token string) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.BearerToken = token })
+}
+
 // IsProber returns a ClientOpt to pass to the DERP server during connect to
 // declare that this client is a a prober.
 func IsProber(v bool) ClientOpt { return clientOptFunc(func(o *clientOpt) { o.IsProber = v }) }
@@ -79,6 +120,33 @@ func CanAckPings(v bool) ClientOpt {
 	return clientOptFunc(func(o *clientOpt) { o.CanAckPings = v })
 }
 
+// Endpoints returns a ClientOpt to advertise eps to the DERP
+// server during connect as ip:ports the client may be directly
+// reachable at. The server forwards them to watchers that asked for
+// them with CanReceivePeerEndpoints, such as other DERP nodes in a
+// regional mesh.
+func Endpoints(eps []netaddr.IPPort) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.Endpoints = eps })
+}
+
+// CanReceivePeerEndpoints returns a ClientOpt to set whether a
+// watcher (see WatchConnectionChanges) declares it can decode peer
+// presence frames that include the peer's endpoints. If true, Recv
+// returns PeerPresentWithEndpoints messages instead of
+// PeerPresentMessage.
+func CanReceivePeerEndpoints(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.CanPeerEPs = v })
+}
+
+// Compression returns a ClientOpt to set whether the client
+// negotiates snappy compression of relayed packets with the server.
+// Compression is only applied to packets it shrinks, and never to
+// WireGuard data packets, which are encrypted; it's meant for links
+// where bandwidth is dearer than CPU.
+func Compression(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.Compress = v })
+}
+
 func NewClient(privateKey key.Private, nc Conn, brw *bufio.ReadWriter, logf logger.Logf, opts ...ClientOpt) (*Client, error) {
 	var opt clientOpt
 	for _, o := range opts {
@@ -99,8 +167,12 @@ func newClient(privateKey key.Private, nc Conn, brw *bufio.ReadWriter, logf logg
 		br:          brw.Reader,
 		bw:          brw.Writer,
 		meshKey:     opt.MeshKey,
+		bearerToken: opt.BearerToken,
 		canAckPings: opt.CanAckPings,
 		isProber:    opt.IsProber,
+		endpoints:   opt.Endpoints,
+		canPeerEPs:  opt.CanPeerEPs,
+		compress:    opt.Compress,
 	}
 	if opt.ServerPub.IsZero() {
 		if err := c.recvServerKey(); err != nil {
@@ -116,20 +188,58 @@ func newClient(privateKey key.Private, nc Conn, brw *bufio.ReadWriter, logf logg
 }
 
 func (c *Client) recvServerKey() error {
+	k, err := readServerKey(c.br)
+	if err != nil {
+		return err
+	}
+	c.serverKey = k
+	return nil
+}
+
+// readServerKey reads the frameServerKey frame that the server sends,
+// unauthenticated, as soon as a client connects.
+func readServerKey(br *bufio.Reader) (key.Public, error) {
 	var buf [40]byte
-	t, flen, err := readFrame(c.br, 1<<10, buf[:])
+	t, flen, err := readFrame(br, 1<<10, buf[:])
 	if err == io.ErrShortBuffer {
 		// For future-proofing, allow server to send more in its greeting.
 		err = nil
 	}
 	if err != nil {
-		return err
+		return zpub, err
 	}
 	if flen < uint32(len(buf)) || t != frameServerKey || string(buf[:len(magic)]) != magic {
-		return errors.New("invalid server greeting")
+		return zpub, errors.New("invalid server greeting")
 	}
-	copy(c.serverKey[:], buf[len(magic):])
-	return nil
+	var k key.Public
+	copy(k[:], buf[len(magic):])
+	return k, nil
+}
+
+// FetchServerKey connects to the DERP server speaking the raw DERP
+// protocol over TCP at addr ("host:port"), reads the public key it
+// announces upon connection, and disconnects. It's for setups that pin
+// the server key (see the ServerPublicKey ClientOpt) and want to learn
+// it ahead of time.
+//
+// The key is not authenticated; callers should only trust it as much
+// as they trust the network path to addr. Servers only reachable via
+// DERP-over-HTTP instead announce their key in their TLS MetaCert.
+func FetchServerKey(ctx context.Context, addr string) (key.Public, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return zpub, err
+	}
+	defer nc.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetReadDeadline(deadline)
+	}
+	k, err := readServerKey(bufio.NewReader(nc))
+	if err != nil {
+		return zpub, fmt.Errorf("derp.FetchServerKey: %w", err)
+	}
+	return k, nil
 }
 
 func (c *Client) parseServerInfo(b []byte) (*serverInfo, error) {
@@ -157,20 +267,46 @@ func (c *Client) parseServerInfo(b []byte) (*serverInfo, error) {
 }
 
 type clientInfo struct {
+	// Version is the client's maximum supported protocol version.
+	// It's sent by all clients, including those that predate
+	// MinVersion and MaxVersion.
 	Version int `json:"version,omitempty"`
 
+	// MinVersion and MaxVersion, if non-zero, are the range of
+	// protocol versions the client supports. If MaxVersion is zero,
+	// the server uses Version instead.
+	MinVersion int `json:"minVersion,omitempty"`
+	MaxVersion int `json:"maxVersion,omitempty"`
+
 	// MeshKey optionally specifies a pre-shared key used by
 	// trusted clients.  It's required to subscribe to the
 	// connection list & forward packets. It's empty for regular
 	// users.
 	MeshKey string `json:"meshKey,omitempty"`
 
+	// BearerToken optionally authorizes the client to a server
+	// with a bearer token verifier. It's empty for servers that
+	// don't need one.
+	BearerToken string `json:"bearerToken,omitempty"`
+
 	// CanAckPings is whether the client declares it's able to ack
 	// pings.
 	CanAckPings bool
 
 	// IsProber is whether this client is a prober.
 	IsProber bool `json:",omitempty"`
+
+	// Endpoints are the ip:ports the client advertises it may be
+	// directly reachable at, for the server to forward to watchers.
+	Endpoints []netaddr.IPPort `json:"endpoints,omitempty"`
+
+	// CanPeerPresentEndpoints is whether the client, if a watcher,
+	// understands framePeerPresentEndpoints.
+	CanPeerPresentEndpoints bool `json:",omitempty"`
+
+	// CanCompress is whether the client accepts
+	// frameRecvPacketCompressed frames.
+	CanCompress bool `json:",omitempty"`
 }
 
 func (c *Client) sendClientKey() error {
@@ -180,9 +316,16 @@ func (c *Client) sendClientKey() error {
 	}
 	msg, err := json.Marshal(clientInfo{
 		Version:     ProtocolVersion,
+		MinVersion:  minProtocolVersion,
+		MaxVersion:  ProtocolVersion,
 		MeshKey:     c.meshKey,
+		BearerToken: c.bearerToken,
 		CanAckPings: c.canAckPings,
 		IsProber:    c.isProber,
+		Endpoints:   c.endpoints,
+
+		CanPeerPresentEndpoints: c.canPeerEPs,
+		CanCompress:             c.compress,
 	})
 	if err != nil {
 		return err
@@ -196,7 +339,9 @@ func (c *Client) sendClientKey() error {
 	return writeFrame(c.bw, frameClientInfo, buf)
 }
 
-// ServerPublicKey returns the server's public key.
+// ServerPublicKey returns the server's public key. It's either the key
+// provided with the ServerPublicKey ClientOpt or, if none was, the key the
+// server announced upon connection.
 func (c *Client) ServerPublicKey() key.Public { return c.serverKey }
 
 // Send sends a packet to the Tailscale node identified by dstKey.
@@ -204,6 +349,71 @@ func (c *Client) ServerPublicKey() key.Public { return c.serverKey }
 // It is an error if the packet is larger than 64KB.
 func (c *Client) Send(dstKey key.Public, pkt []byte) error { return c.send(dstKey, pkt) }
 
+// SendContext is like Send, but bounds the write by ctx: it's given
+// ctx's deadline as a write deadline and abandoned if ctx is
+// canceled, in which case the returned error wraps ctx.Err().
+// Unlike ForwardPacket's write timeout, an abandoned write doesn't
+// close the connection. The frame is written to the connection in a
+// single call, bypassing c's write buffer, so if ctx is done before
+// any of it is written, c is untouched and the send can be retried.
+// (A TLS connection is the exception: crypto/tls fails all writes
+// after one times out.) If ctx is done mid-frame, c can't be written
+// to again, and later calls fail as after any other write error.
+func (c *Client) SendContext(ctx context.Context, dstKey key.Public, pkt []byte) (ret error) {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("derp.Send: %w", err)
+	}
+	if len(pkt) > MaxPacketSize {
+		return fmt.Errorf("derp.Send: packet too big: %d", len(pkt))
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("derp.Send: %w", err)
+	}
+	if d, ok := ctx.Deadline(); ok {
+		c.nc.SetWriteDeadline(d)
+	}
+	var done, exited chan struct{}
+	if ctx.Done() != nil {
+		// On cancellation, expire the deadline to abort the write.
+		done = make(chan struct{})
+		exited = make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				c.nc.SetWriteDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+	}
+	defer func() {
+		// Wait for the watcher to exit before clearing the
+		// deadline, so it can't set it again afterwards.
+		if done != nil {
+			close(done)
+			<-exited
+		}
+		c.nc.SetWriteDeadline(time.Time{})
+	}()
+
+	if err := c.sendDirectLocked(dstKey, pkt); err != nil {
+		ctxErr := ctx.Err()
+		if _, ok := ctx.Deadline(); ok && ctxErr == nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			// The write deadline beat ctx's own timer.
+			ctxErr = context.DeadlineExceeded
+		}
+		if ctxErr != nil {
+			return fmt.Errorf("derp.Send: %w (%v)", ctxErr, err)
+		}
+		return fmt.Errorf("derp.Send: %w", err)
+	}
+	return nil
+}
+
 func (c *Client) send(dstKey key.Public, pkt []byte) (ret error) {
 	defer func() {
 		if ret != nil {
@@ -217,17 +427,128 @@ func (c *Client) send(dstKey key.Public, pkt []byte) (ret error) {
 
 	c.wmu.Lock()
 	defer c.wmu.Unlock()
+	return c.sendLocked(dstKey, pkt)
+}
+
+// SendMulti sends pkt to each of the Tailscale nodes identified by
+// dstKeys, with a single flush. If the server supports it, the packet
+// is written once per up to 64 destinations for the server to fan
+// out; otherwise (including if SendMulti is called before Recv has
+// read the server's info) it's written once per destination, as by
+// Send.
+//
+// It is an error if the packet is larger than 64KB.
+func (c *Client) SendMulti(dstKeys []key.Public, pkt []byte) (ret error) {
+	defer func() {
+		if ret != nil {
+			ret = fmt.Errorf("derp.SendMulti: %w", ret)
+		}
+	}()
+
+	if len(pkt) > MaxPacketSize {
+		return fmt.Errorf("packet too big: %d", len(pkt))
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.serverSendMulti.Get() {
+		for _, dstKey := range dstKeys {
+			if err := c.writeSendPacketLocked(dstKey, pkt); err != nil {
+				return err
+			}
+		}
+		return c.bw.Flush()
+	}
+	for len(dstKeys) > 0 {
+		keys := dstKeys
+		if len(keys) > maxSendMultiKeys {
+			keys = keys[:maxSendMultiKeys]
+		}
+		dstKeys = dstKeys[len(keys):]
+		if err := writeFrameHeader(c.bw, frameSendPacketMulti, uint32(1+len(keys)*keyLen+len(pkt))); err != nil {
+			return err
+		}
+		if err := c.bw.WriteByte(byte(len(keys))); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if _, err := c.bw.Write(k[:]); err != nil {
+				return err
+			}
+		}
+		if _, err := c.bw.Write(pkt); err != nil {
+			return err
+		}
+	}
+	return c.bw.Flush()
+}
 
-	if err := writeFrameHeader(c.bw, frameSendPacket, uint32(len(dstKey)+len(pkt))); err != nil {
+// sendLocked writes a frameSendPacket of pkt to dstKey.
+//
+// c.wmu must be held.
+func (c *Client) sendLocked(dstKey key.Public, pkt []byte) error {
+	if err := c.writeSendPacketLocked(dstKey, pkt); err != nil {
 		return err
 	}
-	if _, err := c.bw.Write(dstKey[:]); err != nil {
+	return c.bw.Flush()
+}
+
+// sendDirectLocked is like sendLocked, but writes the frame to c.nc
+// in one call instead of through c.bw, whose first write error is
+// sticky. A write that fails before any of the frame is sent thus
+// leaves c usable. One that fails partway has corrupted the stream,
+// so c.bw is pointed at a writer that fails all later writes.
+//
+// c.wmu must be held.
+func (c *Client) sendDirectLocked(dstKey key.Public, pkt []byte) error {
+	if c.bw.Buffered() > 0 {
+		if err := c.bw.Flush(); err != nil {
+			return err
+		}
+	}
+	ft, pkt := c.sendPacketFrameLocked(pkt)
+	frame := make([]byte, frameHeaderLen, frameHeaderLen+len(dstKey)+len(pkt))
+	frame[0] = byte(ft)
+	bin.PutUint32(frame[1:], uint32(len(dstKey)+len(pkt)))
+	frame = append(frame, dstKey[:]...)
+	frame = append(frame, pkt...)
+	n, err := c.nc.Write(frame)
+	if err != nil && n > 0 {
+		c.bw.Reset(brokenWriter{fmt.Errorf("connection broken by partial write: %w", err)})
+	}
+	return err
+}
+
+// brokenWriter is an io.Writer that fails every write with err.
+type brokenWriter struct{ err error }
+
+func (w brokenWriter) Write([]byte) (int, error) { return 0, w.err }
+
+// sendPacketFrameLocked returns the frame type and payload with which
+// to send pkt: compressed, if the server accepts that and it helps.
+//
+// c.wmu must be held.
+func (c *Client) sendPacketFrameLocked(pkt []byte) (frameType, []byte) {
+	if c.serverCompress.Get() {
+		if enc, ok := compressPacket(&c.compBuf, pkt); ok {
+			return frameSendPacketCompressed, enc
+		}
+	}
+	return frameSendPacket, pkt
+}
+
+// writeSendPacketLocked writes a frameSendPacket frame to c.bw,
+// without flushing. c.wmu must be held.
+func (c *Client) writeSendPacketLocked(dstKey key.Public, pkt []byte) error {
+	ft, pkt := c.sendPacketFrameLocked(pkt)
+	if err := writeFrameHeader(c.bw, ft, uint32(len(dstKey)+len(pkt))); err != nil {
 		return err
 	}
-	if _, err := c.bw.Write(pkt); err != nil {
+	if _, err := c.bw.Write(dstKey[:]); err != nil {
 		return err
 	}
-	return c.bw.Flush()
+	_, err := c.bw.Write(pkt)
+	return err
 }
 
 func (c *Client) ForwardPacket(srcKey, dstKey key.Public, pkt []byte) (err error) {
@@ -352,8 +673,24 @@ type PeerPresentMessage key.Public
 
 func (PeerPresentMessage) msg() {}
 
+// PeerPresentWithEndpoints is like PeerPresentMessage, but also
+// includes the ip:ports the peer advertised when it connected. It's
+// only received by watchers that connected with
+// CanReceivePeerEndpoints(true).
+type PeerPresentWithEndpoints struct {
+	Key       key.Public
+	Endpoints []netaddr.IPPort // possibly empty
+}
+
+func (PeerPresentWithEndpoints) msg() {}
+
 // ServerInfoMessage is sent by the server upon first connect.
-type ServerInfoMessage struct{}
+type ServerInfoMessage struct {
+	// ProtocolVersion is the protocol version agreed on by the
+	// client and server. Frame types newer than this version must
+	// not be sent on the connection.
+	ProtocolVersion int
+}
 
 func (ServerInfoMessage) msg() {}
 
@@ -411,7 +748,26 @@ func (ServerRestartingMessage) msg() {}
 //
 // Once Recv returns an error, the Client is dead forever.
 func (c *Client) Recv() (m ReceivedMessage, err error) {
-	return c.recvTimeout(120 * time.Second)
+	timeout := defaultRecvTimeout
+	if d := atomic.LoadInt64(&c.recvTimeoutNanos); d > 0 {
+		timeout = time.Duration(d)
+	}
+	return c.recvTimeout(timeout)
+}
+
+// defaultRecvTimeout is how long Recv waits for a frame from the
+// server, unless changed with SetRecvTimeout. Servers send keep-alives
+// more often than this.
+const defaultRecvTimeout = 120 * time.Second
+
+// SetRecvTimeout sets how long Recv waits for a frame from the
+// server before failing. A non-positive d restores the default of
+// 120 seconds. It takes effect on the next call to Recv.
+//
+// Timeouts shorter than the server's keep-alive interval (60 seconds
+// from this package's server) fail idle connections.
+func (c *Client) SetRecvTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.recvTimeoutNanos, int64(d))
 }
 
 func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err error) {
@@ -469,18 +825,29 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 		default:
 			continue
 		case frameServerInfo:
-			// Server sends this at start-up. Currently unused.
-			// Just has a JSON message saying "version: 2",
-			// but the protocol seems extensible enough as-is without
-			// needing to wait an RTT to discover the version at startup.
-			// We'd prefer to give the connection to the client (magicsock)
-			// to start writing as soon as possible.
-			_, err := c.parseServerInfo(b)
+			// Server sends this at start-up, with the protocol
+			// version it agreed to speak. We don't wait for it
+			// before sending, as everything up to the current
+			// version can be sent without waiting an RTT to
+			// discover the version at startup. We'd prefer to
+			// give the connection to the client (magicsock) to
+			// start writing as soon as possible.
+			si, err := c.parseServerInfo(b)
 			if err != nil {
 				return nil, fmt.Errorf("invalid server info frame: %v", err)
 			}
-			// TODO: add the results of parseServerInfo to ServerInfoMessage if we ever need it.
-			return ServerInfoMessage{}, nil
+			ver := si.NegotiatedVersion
+			if ver == 0 {
+				// Older server that doesn't negotiate; it
+				// speaks its own Version.
+				ver, err = negotiateProtocolVersion(si.Version, si.Version)
+				if err != nil {
+					return nil, err
+				}
+			}
+			c.serverSendMulti.Set(ver >= 3)
+			c.serverCompress.Set(c.compress && ver >= 3)
+			return ServerInfoMessage{ProtocolVersion: ver}, nil
 		case frameKeepAlive:
 			// A one-way keep-alive message that doesn't require an acknowledgement.
 			// This predated framePing/framePong.
@@ -503,6 +870,21 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			copy(pg[:], b[:keyLen])
 			return pg, nil
 
+		case framePeerPresentEndpoints:
+			if n < keyLen || (n-keyLen)%peerEndpointLen != 0 {
+				c.logf("[unexpected] dropping malformed peerPresentEndpoints frame from DERP server")
+				continue
+			}
+			var pp PeerPresentWithEndpoints
+			copy(pp.Key[:], b[:keyLen])
+			for eb := b[keyLen:n]; len(eb) > 0; eb = eb[peerEndpointLen:] {
+				var ip16 [16]byte
+				copy(ip16[:], eb[:16])
+				ip := netaddr.IPFrom16(ip16).Unmap()
+				pp.Endpoints = append(pp.Endpoints, netaddr.IPPortFrom(ip, bin.Uint16(eb[16:])))
+			}
+			return pp, nil
+
 		case frameRecvPacket:
 			var rp ReceivedPacket
 			if n < keyLen {
@@ -513,6 +895,22 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			rp.Data = b[keyLen:n]
 			return rp, nil
 
+		case frameRecvPacketCompressed:
+			var rp ReceivedPacket
+			if n < keyLen {
+				c.logf("[unexpected] dropping short compressed packet from DERP server")
+				continue
+			}
+			copy(rp.Source[:], b[:keyLen])
+			data, derr := decompressPacket(c.decompBuf, b[keyLen:n])
+			if derr != nil {
+				c.logf("[unexpected] dropping bad compressed packet from DERP server: %v", derr)
+				continue
+			}
+			c.decompBuf = data
+			rp.Data = data
+			return rp, nil
+
 		case framePing:
 			var pm PingMessage
 			if n < 8 {
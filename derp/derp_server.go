@@ -76,6 +76,12 @@ func init() {
 const (
 	perClientSendQueueDepth = 32 // packets buffered for sending
 	writeTimeout            = 2 * time.Second
+
+	// perClientFanoutBytesPerSec and perClientFanoutBurst bound how
+	// many bytes per second a client can have the server copy out
+	// via frameSendPacketMulti, counting each destination.
+	perClientFanoutBytesPerSec = 4 << 20
+	perClientFanoutBurst       = maxSendMultiKeys * MaxPacketSize
 )
 
 // dupPolicy is a temporary (2021-08-30) mechanism to change the policy
@@ -108,6 +114,10 @@ type Server struct {
 	metaCert    []byte // the encoded x509 cert to send after LetsEncrypt cert+intermediate
 	dupPolicy   dupPolicy
 
+	// clientIdleTimeout, if non-zero, is how long a non-mesh client
+	// connection may go without activity before it's closed.
+	clientIdleTimeout time.Duration
+
 	// Counters:
 	packetsSent, bytesSent       expvar.Int
 	packetsRecv, bytesRecv       expvar.Int
@@ -137,12 +147,21 @@ type Server struct {
 	multiForwarderCreated        expvar.Int
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
-	avgQueueDuration             *uint64 // In milliseconds; accessed atomically
+	idleClientCloses             expvar.Int // connections closed by the client idle timeout
+	drainingRejects              expvar.Int // new connections refused while draining
+	bearerTokenRejects           expvar.Int // new connections refused by verifyBearerToken
+	clientAuthRejects            expvar.Int // new connections refused by clientAuthFunc
+	avgQueueDuration             *uint64    // In milliseconds; accessed atomically
 
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's local api.
 	verifyClients bool
 
+	// verifyBearerToken, if non-nil, is called with each new
+	// non-mesh client's bearer token, and rejects the client if it
+	// returns an error. See SetBearerTokenVerifier.
+	verifyBearerToken func(clientKey key.Public, token string) error
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -162,6 +181,24 @@ type Server struct {
 
 	// maps from netaddr.IPPort to a client's public key
 	keyOfAddr map[netaddr.IPPort]key.Public
+
+	// healthProblem is the problem set by SetHealthProblem, sent
+	// to every client. Empty means healthy.
+	healthProblem string
+
+	// draining is whether new non-mesh clients are refused.
+	// See SetDraining.
+	draining bool
+
+	// clientAuthFunc, if non-nil, is called with each new non-mesh
+	// client's key, and rejects the client if it returns an error.
+	// See SetClientAuthFunc.
+	clientAuthFunc func(clientKey key.Public) error
+
+	// restartTryFor is the Drain argument sent to clients in
+	// restarting frames. Each client's reconnect delay is in its
+	// sclient.restartIn.
+	restartTryFor time.Duration
 }
 
 // clientSet represents 1 or more *sclients.
@@ -325,6 +362,8 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("fanout_limit"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -346,6 +385,195 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// SetBearerTokenVerifier sets a func to authorize new clients by the
+// token they pass with BearerToken, which is empty if they didn't.
+// Clients for which verify returns an error are rejected before
+// they're admitted. Mesh peers, which authenticate with the mesh
+// key, aren't checked.
+//
+// It must be called before serving begins.
+func (s *Server) SetBearerTokenVerifier(verify func(clientKey key.Public, token string) error) {
+	s.verifyBearerToken = verify
+}
+
+// SetClientAuthFunc sets a func to authorize new clients by their
+// public key, such as to enforce a denylist of abusive keys. Clients
+// for which auth returns an error are rejected, with the error
+// logged, before they're admitted. Mesh peers aren't checked. A nil
+// auth, the default, admits all keys.
+//
+// Unlike the other setters, it may be called while serving; it
+// applies to clients that connect afterwards, and doesn't affect
+// those already connected.
+func (s *Server) SetClientAuthFunc(auth func(clientKey key.Public) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientAuthFunc = auth
+}
+
+// SetClientIdleTimeout sets how long a client connection may go
+// without activity before the server closes it. Activity is any frame
+// received from the client or any data packet sent to it; the
+// server's own keep-alives don't count. Mesh peers are exempt.
+// A zero duration, the default, disables the timeout.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientIdleTimeout(d time.Duration) {
+	s.clientIdleTimeout = d
+}
+
+// SetDraining sets whether the server is draining. While draining,
+// the server keeps serving clients that are already connected but
+// refuses new client connections, first sending them a health frame
+// explaining why so they move to another node in the region. Mesh
+// peers are still accepted. This lets operators empty a node slowly
+// before a restart or as part of a rolling deploy.
+func (s *Server) SetDraining(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = v
+}
+
+// Drain prepares the server for a restart. It starts draining (see
+// SetDraining) and sends every connected client other than mesh peers
+// a restarting frame (ServerRestartingMessage on the client side)
+// asking it to reconnect after its own random duration in
+// [0, reconnectIn), to smear out the reconnects, and to keep trying
+// for tryFor.
+//
+// Clients only act on that frame once their connection fails, so
+// Drain closes each client's connection once its own delay has
+// passed, if it's still connected. It returns nil once those clients
+// are gone, or ctx.Err() if ctx is done first. It doesn't close the
+// server; callers typically call Close next either way.
+func (s *Server) Drain(ctx context.Context, reconnectIn, tryFor time.Duration) error {
+	start := time.Now()
+	closeAt := map[*sclient]time.Time{}
+	s.mu.Lock()
+	s.draining = true
+	s.restartTryFor = tryFor
+	for _, set := range s.clients {
+		set.ForeachClient(func(c *sclient) {
+			if c.canMesh {
+				return
+			}
+			c.restartIn = 0
+			if reconnectIn > 0 {
+				c.restartIn = time.Duration(rand.Int63n(int64(reconnectIn)))
+			}
+			closeAt[c] = start.Add(c.restartIn)
+			c.requestRestartingWrite()
+		})
+	}
+	s.mu.Unlock()
+
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for {
+		now := time.Now()
+		for c, at := range closeAt {
+			if !now.Before(at) {
+				c.nc.Close()
+				delete(closeAt, c)
+			}
+		}
+		if s.numNonMeshClients() == 0 {
+			return nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// numNonMeshClients returns the number of connected clients that
+// aren't mesh peers.
+func (s *Server) numNonMeshClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, set := range s.clients {
+		set.ForeachClient(func(c *sclient) {
+			if !c.canMesh {
+				n++
+			}
+		})
+	}
+	return n
+}
+
+// restartParams returns the reconnect delay and retry duration that
+// Drain chose for c.
+func (c *sclient) restartParams() (reconnectIn, tryFor time.Duration) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.restartIn, c.s.restartTryFor
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// SetHealthProblem sets the server's health problem and sends it to
+// all connected clients, and to clients that connect later, as a
+// health frame (HealthMessage on the client side). Clients treat a
+// non-empty problem as the region being unhealthy, so operators can
+// use it to announce maintenance or overload and have clients
+// re-home. An empty problem clears it.
+func (s *Server) SetHealthProblem(problem string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if problem == s.healthProblem {
+		return
+	}
+	s.healthProblem = problem
+	for _, set := range s.clients {
+		set.ForeachClient(func(c *sclient) {
+			c.requestHealthUpdate()
+		})
+	}
+}
+
+// currentHealthProblem returns the problem set by SetHealthProblem.
+func (s *Server) currentHealthProblem() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.healthProblem
+}
+
+// TCPInfo is a subset of the kernel's statistics for the TCP
+// connection of a client. See Server.ClientTCPInfo.
+type TCPInfo struct {
+	RTT         time.Duration // smoothed round-trip time
+	RTTVar      time.Duration // round-trip time variance
+	Retransmits uint32        // total segments retransmitted
+	Lost        uint32        // segments currently presumed lost
+	SendCwnd    uint32        // congestion window, in segments
+}
+
+// ClientTCPInfo returns TCP statistics for the active connection of
+// the client with key k. It reports false if k isn't connected, or
+// TCP statistics aren't available: they're only implemented on Linux,
+// and only when the Conn passed to Accept is a TCP connection (such as
+// a *net.TCPConn) or, like a *tls.Conn as of Go 1.18, has a NetConn
+// method unwrapping to one.
+func (s *Server) ClientTCPInfo(k key.Public) (TCPInfo, bool) {
+	s.mu.Lock()
+	var c *sclient
+	if set, ok := s.clients[k]; ok {
+		c = set.ActiveClient()
+	}
+	s.mu.Unlock()
+	if c == nil {
+		return TCPInfo{}, false
+	}
+	return tcpInfo(c.nc)
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -507,17 +735,21 @@ func (s *Server) registerClient(c *sclient) {
 	}
 	s.keyOfAddr[c.remoteIPPort] = c.key
 	s.curClients.Add(1)
-	s.broadcastPeerStateChangeLocked(c.key, true)
+	s.broadcastPeerStateChangeLocked(c.key, true, c.advertisedEndpoints())
+	if s.healthProblem != "" {
+		c.requestHealthUpdate()
+	}
 }
 
 // broadcastPeerStateChangeLocked enqueues a message to all watchers
 // (other DERP nodes in the region, or trusted clients) that peer's
-// presence changed.
+// presence changed. If present, endpoints are the peer's advertised
+// endpoints, for watchers that want them.
 //
 // s.mu must be held.
-func (s *Server) broadcastPeerStateChangeLocked(peer key.Public, present bool) {
+func (s *Server) broadcastPeerStateChangeLocked(peer key.Public, present bool, endpoints []netaddr.IPPort) {
 	for w := range s.watchers {
-		w.peerStateChange = append(w.peerStateChange, peerConnState{peer: peer, present: present})
+		w.peerStateChange = append(w.peerStateChange, peerConnState{peer: peer, present: present, endpoints: endpoints})
 		go w.requestMeshUpdate()
 	}
 }
@@ -538,7 +770,7 @@ func (s *Server) unregisterClient(c *sclient) {
 			delete(s.clientsMesh, c.key)
 			s.notePeerGoneFromRegionLocked(c.key)
 		}
-		s.broadcastPeerStateChangeLocked(c.key, false)
+		s.broadcastPeerStateChangeLocked(c.key, false, nil)
 	case *dupClientSet:
 		if set.removeClient(c) {
 			s.dupClientConns.Add(-1)
@@ -614,8 +846,12 @@ func (s *Server) addWatcher(c *sclient) {
 	defer s.mu.Unlock()
 
 	// Queue messages for each already-connected client.
-	for peer := range s.clients {
-		c.peerStateChange = append(c.peerStateChange, peerConnState{peer: peer, present: true})
+	for peer, set := range s.clients {
+		var endpoints []netaddr.IPPort
+		if ac := set.ActiveClient(); ac != nil {
+			endpoints = ac.advertisedEndpoints()
+		}
+		c.peerStateChange = append(c.peerStateChange, peerConnState{peer: peer, present: true, endpoints: endpoints})
 	}
 
 	// And enroll the watcher in future updates (of both
@@ -640,6 +876,18 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	if err := s.verifyClient(clientKey, clientInfo); err != nil {
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
+	protoVersion, err := clientInfo.protocolVersion()
+	if err != nil {
+		return fmt.Errorf("client %x rejected: %v", clientKey, err)
+	}
+	canMesh := clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey
+	if !canMesh && s.isDraining() {
+		s.drainingRejects.Add(1)
+		if err := s.sendDraining(bw, clientKey, protoVersion); err != nil {
+			return fmt.Errorf("send draining to client %x: %v", clientKey, err)
+		}
+		return fmt.Errorf("client %x rejected: server draining", clientKey)
+	}
 
 	// At this point we trust the client so we don't time out.
 	nc.SetDeadline(time.Time{})
@@ -650,6 +898,7 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	remoteIPPort, _ := netaddr.ParseIPPort(remoteAddr)
 
 	c := &sclient{
+		lastActivity:   time.Now().UnixNano(),
 		connNum:        connNum,
 		s:              s,
 		key:            clientKey,
@@ -664,7 +913,11 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		sendQueue:      make(chan pkt, perClientSendQueueDepth),
 		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
 		peerGone:       make(chan key.Public),
-		canMesh:        clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
+		healthUpdate:   make(chan struct{}, 1),
+		restarting:     make(chan struct{}, 1),
+		canMesh:        canMesh,
+		protoVersion:   protoVersion,
+		fanoutLimiter:  rate.NewLimiter(perClientFanoutBytesPerSec, perClientFanoutBurst),
 	}
 
 	if c.canMesh {
@@ -677,7 +930,7 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	s.registerClient(c)
 	defer s.unregisterClient(c)
 
-	err = s.sendServerInfo(c.bw, clientKey)
+	err = s.sendServerInfo(c.bw, clientKey, protoVersion)
 	if err != nil {
 		return fmt.Errorf("send server info: %v", err)
 	}
@@ -719,11 +972,24 @@ func (c *sclient) run(ctx context.Context) error {
 			return fmt.Errorf("client %x: readFrameHeader: %w", c.key, err)
 		}
 		c.s.noteClientActivity(c)
+		c.noteActivity()
 		switch ft {
 		case frameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
 		case frameSendPacket:
 			err = c.handleFrameSendPacket(ft, fl)
+		case frameSendPacketCompressed:
+			if c.isV3() {
+				err = c.handleFrameSendPacket(ft, fl)
+			} else {
+				err = c.handleUnknownFrame(ft, fl)
+			}
+		case frameSendPacketMulti:
+			if c.isV3() {
+				err = c.handleFrameSendPacketMulti(ft, fl)
+			} else {
+				err = c.handleUnknownFrame(ft, fl)
+			}
 		case frameForwardPacket:
 			err = c.handleFrameForwardPacket(ft, fl)
 		case frameWatchConns:
@@ -811,6 +1077,7 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvForwardPacket: %v", c.key, err)
 	}
+	c.noteRecv(contents)
 	s.packetsForwardedIn.Add(1)
 
 	var dstLen int
@@ -858,10 +1125,42 @@ func (s *Server) notePeerSendLocked(src key.Public, dst *sclient) {
 func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	s := c.s
 
-	dstKey, contents, err := s.recvPacket(c.br, fl)
+	dstKey, contents, err := s.recvPacket(c.br, fl, ft == frameSendPacketCompressed)
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.noteRecv(contents)
+	return c.routePacket(dstKey, contents)
+}
+
+// handleFrameSendPacketMulti reads a "send packet" frame with
+// several destinations from the client and sends the packet to each.
+func (c *sclient) handleFrameSendPacketMulti(ft frameType, fl uint32) error {
+	s := c.s
+
+	dstKeys, contents, err := s.recvPacketMulti(c.br, fl)
+	if err != nil {
+		return fmt.Errorf("client %x: recvPacketMulti: %v", c.key, err)
+	}
+	now := time.Now()
+	for _, dstKey := range dstKeys {
+		c.noteRecv(contents)
+		if !c.fanoutLimiter.AllowN(now, len(contents)) {
+			s.recordDrop(contents, c.key, dstKey, dropReasonFanoutLimit)
+			continue
+		}
+		if err := c.routePacket(dstKey, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routePacket sends contents from c to the client with dstKey, or
+// to the mesh peer it's connected to. The memory of contents must
+// not be modified afterwards.
+func (c *sclient) routePacket(dstKey key.Public, contents []byte) error {
+	s := c.s
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -917,6 +1216,7 @@ const (
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonFanoutLimit                        // sender exceeded its frameSendPacketMulti byte budget
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.Public, reason dropReason) {
@@ -989,6 +1289,25 @@ func (c *sclient) requestPeerGoneWrite(peer key.Public) {
 	}
 }
 
+// requestHealthUpdate requests that c be sent the server's current
+// health problem. It doesn't block; if a request is already pending,
+// that one sends the latest problem.
+func (c *sclient) requestHealthUpdate() {
+	select {
+	case c.healthUpdate <- struct{}{}:
+	default:
+	}
+}
+
+// requestRestartingWrite requests that c be sent a restarting frame.
+// It doesn't block.
+func (c *sclient) requestRestartingWrite() {
+	select {
+	case c.restarting <- struct{}{}:
+	default:
+	}
+}
+
 func (c *sclient) requestMeshUpdate() {
 	if !c.canMesh {
 		panic("unexpected requestMeshUpdate")
@@ -1000,6 +1319,22 @@ func (c *sclient) requestMeshUpdate() {
 }
 
 func (s *Server) verifyClient(clientKey key.Public, info *clientInfo) error {
+	isMesh := s.meshKey != "" && info.MeshKey == s.meshKey
+	if s.verifyBearerToken != nil && !isMesh {
+		if err := s.verifyBearerToken(clientKey, info.BearerToken); err != nil {
+			s.bearerTokenRejects.Add(1)
+			return fmt.Errorf("bearer token: %w", err)
+		}
+	}
+	s.mu.Lock()
+	auth := s.clientAuthFunc
+	s.mu.Unlock()
+	if auth != nil && !isMesh {
+		if err := auth(clientKey); err != nil {
+			s.clientAuthRejects.Add(1)
+			return fmt.Errorf("client auth: %w", err)
+		}
+	}
 	if !s.verifyClients {
 		return nil
 	}
@@ -1078,15 +1413,52 @@ func (s *Server) noteClientActivity(c *sclient) {
 }
 
 type serverInfo struct {
+	// Version is the server's maximum supported protocol version.
 	Version int `json:"version,omitempty"`
+
+	// NegotiatedVersion is the protocol version the server picked
+	// for this connection from the client's supported range.
+	// It's zero from servers that predate version negotiation.
+	NegotiatedVersion int `json:"negotiatedVersion,omitempty"`
 }
 
-func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.Public) error {
+// protocolVersion returns the protocol version to speak with the client
+// that sent info.
+func (info *clientInfo) protocolVersion() (int, error) {
+	if info.MaxVersion == 0 {
+		// Older client that only sends its own version.
+		return negotiateProtocolVersion(info.Version, info.Version)
+	}
+	return negotiateProtocolVersion(info.MinVersion, info.MaxVersion)
+}
+
+// drainingProblem is the health problem sent to clients refused by
+// a draining server.
+const drainingProblem = "DERP server is draining and not accepting new connections; try another node"
+
+// sendDraining completes the handshake with a client that a draining
+// server is about to refuse and tells it why in a health frame.
+func (s *Server) sendDraining(bw *lazyBufioWriter, clientKey key.Public, protoVersion int) error {
+	if err := s.sendServerInfo(bw, clientKey, protoVersion); err != nil {
+		return err
+	}
+	if protoVersion >= 2 {
+		if err := writeFrame(bw.bw(), frameHealth, []byte(drainingProblem)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.Public, protoVersion int) error {
 	var nonce [24]byte
 	if _, err := crand.Read(nonce[:]); err != nil {
 		return err
 	}
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+	msg, err := json.Marshal(serverInfo{
+		Version:           ProtocolVersion,
+		NegotiatedVersion: protoVersion,
+	})
 	if err != nil {
 		return err
 	}
@@ -1144,7 +1516,10 @@ func (s *Server) recvClientKey(br *bufio.Reader) (clientKey key.Public, info *cl
 	return clientKey, info, nil
 }
 
-func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32) (dstKey key.Public, contents []byte, err error) {
+// recvPacket reads the body of a frameSendPacket frame, or of a
+// frameSendPacketCompressed frame if compressed, in which case the
+// returned contents are decompressed.
+func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32, compressed bool) (dstKey key.Public, contents []byte, err error) {
 	if frameLen < keyLen {
 		return zpub, nil, errors.New("short send packet frame")
 	}
@@ -1159,6 +1534,11 @@ func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32) (dstKey key.Publi
 	if _, err := io.ReadFull(br, contents); err != nil {
 		return zpub, nil, err
 	}
+	if compressed {
+		if contents, err = decompressPacket(nil, contents); err != nil {
+			return zpub, nil, err
+		}
+	}
 	s.packetsRecv.Add(1)
 	s.bytesRecv.Add(int64(len(contents)))
 	if disco.LooksLikeDiscoWrapper(contents) {
@@ -1169,6 +1549,43 @@ func (s *Server) recvPacket(br *bufio.Reader, frameLen uint32) (dstKey key.Publi
 	return dstKey, contents, nil
 }
 
+// recvPacketMulti reads the body of a frameSendPacketMulti frame,
+// counting it as one received packet per destination.
+func (s *Server) recvPacketMulti(br *bufio.Reader, frameLen uint32) (dstKeys []key.Public, contents []byte, err error) {
+	if frameLen < 1 {
+		return nil, nil, errors.New("short send packet multi frame")
+	}
+	n, err := br.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 || n > maxSendMultiKeys || frameLen-1 < uint32(n)*keyLen {
+		return nil, nil, fmt.Errorf("bad send packet multi frame: %d keys in %d bytes", n, frameLen)
+	}
+	dstKeys = make([]key.Public, n)
+	for i := range dstKeys {
+		if err := readPublicKey(br, &dstKeys[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	packetLen := frameLen - 1 - uint32(n)*keyLen
+	if packetLen > MaxPacketSize {
+		return nil, nil, fmt.Errorf("data packet longer (%d) than max of %v", packetLen, MaxPacketSize)
+	}
+	contents = make([]byte, packetLen)
+	if _, err := io.ReadFull(br, contents); err != nil {
+		return nil, nil, err
+	}
+	s.packetsRecv.Add(int64(n))
+	s.bytesRecv.Add(int64(n) * int64(len(contents)))
+	if disco.LooksLikeDiscoWrapper(contents) {
+		s.packetsRecvDisco.Add(int64(n))
+	} else {
+		s.packetsRecvOther.Add(int64(n))
+	}
+	return dstKeys, contents, nil
+}
+
 // zpub is the key.Public zero value.
 var zpub key.Public
 
@@ -1199,6 +1616,15 @@ func (s *Server) recvForwardPacket(br *bufio.Reader, frameLen uint32) (srcKey, d
 //
 // (The "s" prefix is to more explicitly distinguish it from Client in derp_client.go)
 type sclient struct {
+	// lastActivity is the time, in Unix nanoseconds, of the last frame
+	// read from or data packet sent to the client.
+	// Atomically accessed; declared first for alignment reasons.
+	lastActivity int64
+
+	// Data packet counters for ClientStats. Atomically accessed.
+	packetsSent, bytesSent int64
+	packetsRecv, bytesRecv int64
+
 	// Static after construction.
 	connNum        int64 // process-wide unique counter, incremented each Accept
 	s              *Server
@@ -1213,25 +1639,39 @@ type sclient struct {
 	discoSendQueue chan pkt         // important packets queued to this client; never closed
 	peerGone       chan key.Public  // write request that a previous sender has disconnected (not used by mesh peers)
 	meshUpdate     chan struct{}    // write request to write peerStateChange
+	healthUpdate   chan struct{}    // write request to send Server.healthProblem; buffered
+	restarting     chan struct{}    // write request to send a restarting frame (see Server.Drain); buffered
 	canMesh        bool             // clientInfo had correct mesh token for inter-region routing
+	protoVersion   int              // protocol version negotiated with the client
 	isDup          syncs.AtomicBool // whether more than 1 sclient for key is connected
 	isDisabled     syncs.AtomicBool // whether sends to this peer are disabled due to active/active dups
+	isHome         syncs.AtomicBool // mirror of preferred, for ClientStats
 
 	// replaceLimiter controls how quickly two connections with
 	// the same client key can kick each other off the server by
 	// taking over ownership of a key.
 	replaceLimiter *rate.Limiter
 
+	// fanoutLimiter limits the bytes the server copies out on the
+	// client's behalf from frameSendPacketMulti, charged once per
+	// destination.
+	fanoutLimiter *rate.Limiter
+
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
 	preferred   bool
 
 	// Owned by sender, not thread-safe.
-	bw *lazyBufioWriter
+	bw      *lazyBufioWriter
+	compBuf []byte // scratch space for compressing packets, if info.CanCompress
 
 	// Guarded by s.mu
 	//
+	// restartIn is the reconnect delay that Drain chose for the
+	// client, sent in its restarting frame.
+	restartIn time.Duration
+
 	// peerStateChange is used by mesh peers (a set of regional
 	// DERP servers) and contains records that need to be sent to
 	// the client for them to update their map of who's connected
@@ -1242,8 +1682,9 @@ type sclient struct {
 // peerConnState represents whether a peer is connected to the server
 // or not.
 type peerConnState struct {
-	peer    key.Public
-	present bool
+	peer      key.Public
+	present   bool
+	endpoints []netaddr.IPPort // if present, the peer's advertised endpoints
 }
 
 // pkt is a request to write a data frame to an sclient.
@@ -1265,6 +1706,7 @@ func (c *sclient) setPreferred(v bool) {
 		return
 	}
 	c.preferred = v
+	c.isHome.Set(v)
 	var homeMove *expvar.Int
 	if v {
 		c.s.curHomeClients.Add(1)
@@ -1327,6 +1769,15 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 	keepAliveTick := time.NewTicker(keepAlive + jitter)
 	defer keepAliveTick.Stop()
 
+	idleTimeout := c.idleTimeout()
+	var idleTimer *time.Timer
+	var idleTimerCh <-chan time.Time // nil if no idle timeout
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idleTimerCh = idleTimer.C
+	}
+
 	var werr error // last write error
 	for {
 		if werr != nil {
@@ -1343,6 +1794,12 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case <-c.healthUpdate:
+			werr = c.sendHealth(c.s.currentHealthProblem())
+			continue
+		case <-c.restarting:
+			werr = c.sendRestarting(c.restartParams())
+			continue
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
@@ -1354,6 +1811,12 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 			continue
+		case <-idleTimerCh:
+			if idle := c.idleDuration(); idle < idleTimeout {
+				idleTimer.Reset(idleTimeout - idle)
+				continue
+			}
+			return c.closeIdle()
 		default:
 			// Flush any writes from the 3 sends above, or from
 			// the blocking loop below.
@@ -1371,6 +1834,10 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case <-c.healthUpdate:
+			werr = c.sendHealth(c.s.currentHealthProblem())
+		case <-c.restarting:
+			werr = c.sendRestarting(c.restartParams())
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
@@ -1379,20 +1846,104 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			c.recordQueueTime(msg.enqueuedAt)
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
+		case <-idleTimerCh:
+			if idle := c.idleDuration(); idle < idleTimeout {
+				idleTimer.Reset(idleTimeout - idle)
+				continue
+			}
+			return c.closeIdle()
 		}
 	}
 }
 
+// idleTimeout returns how long c may be idle before it's closed,
+// or zero if it has no idle timeout.
+func (c *sclient) idleTimeout() time.Duration {
+	if c.canMesh {
+		return 0
+	}
+	return c.s.clientIdleTimeout
+}
+
+// noteActivity records that a frame was just read from or a data
+// packet sent to c.
+func (c *sclient) noteActivity() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// noteRecv records that data packet contents was read from c.
+func (c *sclient) noteRecv(contents []byte) {
+	atomic.AddInt64(&c.packetsRecv, 1)
+	atomic.AddInt64(&c.bytesRecv, int64(len(contents)))
+}
+
+// idleDuration returns how long it's been since the last activity on c.
+func (c *sclient) idleDuration() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+// closeIdle tells c it's being closed for being idle. The caller
+// (sendLoop) then returns, which closes the connection.
+func (c *sclient) closeIdle() error {
+	c.s.idleClientCloses.Add(1)
+	c.logf("closing after %v idle", c.idleTimeout())
+	if err := c.sendHealth("closing idle connection"); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
 func (c *sclient) setWriteDeadline() {
 	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
 }
 
+// isV2 reports whether c negotiated protocol version 2 or later, and
+// so understands frameHealth and frameRestarting, as well as source
+// keys in frameRecvPacket.
+func (c *sclient) isV2() bool { return c.protoVersion >= 2 }
+
+// isV3 reports whether c negotiated protocol version 3 or later, and
+// so may send and receive packets in frameSendPacketMulti and the
+// compressed packet frames, and peers in framePeerPresentEndpoints.
+func (c *sclient) isV3() bool { return c.protoVersion >= 3 }
+
 // sendKeepAlive sends a keep-alive frame, without flushing.
 func (c *sclient) sendKeepAlive() error {
 	c.setWriteDeadline()
 	return writeFrameHeader(c.bw.bw(), frameKeepAlive, 0)
 }
 
+// sendHealth sends a health frame with the given problem, without
+// flushing. Version 1 clients aren't sent anything.
+func (c *sclient) sendHealth(problem string) error {
+	if !c.isV2() {
+		return nil
+	}
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), frameHealth, uint32(len(problem))); err != nil {
+		return err
+	}
+	_, err := c.bw.Write([]byte(problem))
+	return err
+}
+
+// sendRestarting sends a restarting frame, without flushing. Version
+// 1 clients aren't sent anything.
+func (c *sclient) sendRestarting(reconnectIn, tryFor time.Duration) error {
+	if !c.isV2() {
+		return nil
+	}
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), frameRestarting, 8); err != nil {
+		return err
+	}
+	var b [8]byte
+	bin.PutUint32(b[:4], uint32(reconnectIn/time.Millisecond))
+	bin.PutUint32(b[4:], uint32(tryFor/time.Millisecond))
+	_, err := c.bw.Write(b[:])
+	return err
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.Public) error {
 	c.s.peerGoneFrames.Add(1)
@@ -1414,6 +1965,43 @@ func (c *sclient) sendPeerPresent(peer key.Public) error {
 	return err
 }
 
+// sendPeerPresentEndpoints sends a peerPresentEndpoints frame, without flushing.
+func (c *sclient) sendPeerPresentEndpoints(peer key.Public, endpoints []netaddr.IPPort) error {
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), framePeerPresentEndpoints, uint32(keyLen+len(endpoints)*peerEndpointLen)); err != nil {
+		return err
+	}
+	if _, err := c.bw.Write(peer[:]); err != nil {
+		return err
+	}
+	var b [peerEndpointLen]byte
+	for _, ep := range endpoints {
+		ip16 := ep.IP().As16()
+		copy(b[:16], ip16[:])
+		bin.PutUint16(b[16:], ep.Port())
+		if _, err := c.bw.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advertisedEndpoints returns the valid endpoints c advertised when
+// it connected, at most maxPeerEndpoints of them.
+func (c *sclient) advertisedEndpoints() []netaddr.IPPort {
+	var eps []netaddr.IPPort
+	for _, ep := range c.info.Endpoints {
+		if !ep.IsValid() {
+			continue
+		}
+		if len(eps) == maxPeerEndpoints {
+			break
+		}
+		eps = append(eps, ep)
+	}
+	return eps
+}
+
 // sendMeshUpdates drains as many mesh peerStateChange entries as
 // possible into the write buffer WITHOUT flushing or otherwise
 // blocking (as it holds c.s.mu while working). If it can't drain them
@@ -1423,12 +2011,19 @@ func (c *sclient) sendMeshUpdates() error {
 	defer c.s.mu.Unlock()
 
 	writes := 0
+	withEndpoints := c.info.CanPeerPresentEndpoints && c.isV3()
 	for _, pcs := range c.peerStateChange {
-		if c.bw.Available() <= frameHeaderLen+keyLen {
+		frameLen := keyLen
+		if pcs.present && withEndpoints {
+			frameLen += len(pcs.endpoints) * peerEndpointLen
+		}
+		if c.bw.Available() <= frameHeaderLen+frameLen {
 			break
 		}
 		var err error
-		if pcs.present {
+		if pcs.present && withEndpoints {
+			err = c.sendPeerPresentEndpoints(pcs.peer, pcs.endpoints)
+		} else if pcs.present {
 			err = c.sendPeerPresent(pcs.peer)
 		} else {
 			err = c.sendPeerGone(pcs.peer)
@@ -1458,7 +2053,7 @@ func (c *sclient) sendMeshUpdates() error {
 }
 
 // sendPacket writes contents to the client in a RecvPacket frame. If
-// srcKey.IsZero, uses the old DERPv1 framing format, otherwise uses
+// srcKey.IsZero or c speaks version 1, uses the old DERPv1 framing format, otherwise uses
 // DERPv2. The bytes of contents are only valid until this function
 // returns, do not retain slices.
 // It does not flush its bufio.Writer.
@@ -1470,17 +2065,26 @@ func (c *sclient) sendPacket(srcKey key.Public, contents []byte) (err error) {
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			atomic.AddInt64(&c.packetsSent, 1)
+			atomic.AddInt64(&c.bytesSent, int64(len(contents)))
+			c.noteActivity()
 		}
 	}()
 
 	c.setWriteDeadline()
 
-	withKey := !srcKey.IsZero()
-	pktLen := len(contents)
+	withKey := !srcKey.IsZero() && c.isV2()
+	ft, wire := frameRecvPacket, contents
+	if withKey && c.info.CanCompress && c.isV3() {
+		if enc, ok := compressPacket(&c.compBuf, contents); ok {
+			ft, wire = frameRecvPacketCompressed, enc
+		}
+	}
+	pktLen := len(wire)
 	if withKey {
 		pktLen += len(srcKey)
 	}
-	if err = writeFrameHeader(c.bw.bw(), frameRecvPacket, uint32(pktLen)); err != nil {
+	if err = writeFrameHeader(c.bw.bw(), ft, uint32(pktLen)); err != nil {
 		return err
 	}
 	if withKey {
@@ -1489,7 +2093,7 @@ func (c *sclient) sendPacket(srcKey key.Public, contents []byte) (err error) {
 			return err
 		}
 	}
-	_, err = c.bw.Write(contents)
+	_, err = c.bw.Write(wire)
 	return err
 }
 
@@ -1641,6 +2245,10 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("counter_idle_client_closes", &s.idleClientCloses)
+	m.Set("counter_draining_rejects", &s.drainingRejects)
+	m.Set("counter_bearer_token_rejects", &s.bearerTokenRejects)
+	m.Set("counter_client_auth_rejects", &s.clientAuthRejects)
 	m.Set("average_queue_duration_ms", expvar.Func(func() interface{} {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
@@ -1766,6 +2374,68 @@ func parseSSOutput(raw string) map[netaddr.IPPort]BytesSentRecv {
 	return newState
 }
 
+// ClientStat is a snapshot of the data packets a client key has
+// exchanged with the server, as returned by Server.ClientStats.
+type ClientStat struct {
+	PacketsSent int64 // to the client
+	BytesSent   int64
+	PacketsRecv int64 // from the client, including forwarded packets from mesh peers
+	BytesRecv   int64
+
+	// ConnectedSince is when the client's oldest current
+	// connection was accepted.
+	ConnectedSince time.Time
+
+	// Home is whether the client declared this server its home
+	// (preferred) node.
+	Home bool
+}
+
+// ClientStats returns a snapshot of the traffic of each currently
+// connected client key, for attributing relay bandwidth. If a key has
+// more than one connection (see dupPolicy), their counts are summed.
+//
+// It's meant for operators; see ServeDebugClients.
+func (s *Server) ClientStats() map[key.Public]ClientStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[key.Public]ClientStat, len(s.clients))
+	for k, set := range s.clients {
+		var st ClientStat
+		set.ForeachClient(func(c *sclient) {
+			st.PacketsSent += atomic.LoadInt64(&c.packetsSent)
+			st.BytesSent += atomic.LoadInt64(&c.bytesSent)
+			st.PacketsRecv += atomic.LoadInt64(&c.packetsRecv)
+			st.BytesRecv += atomic.LoadInt64(&c.bytesRecv)
+			if st.ConnectedSince.IsZero() || c.connectedAt.Before(st.ConnectedSince) {
+				st.ConnectedSince = c.connectedAt
+			}
+			if c.isHome.Get() {
+				st.Home = true
+			}
+		})
+		m[k] = st
+	}
+	return m
+}
+
+// ServeDebugClients writes ClientStats as a JSON object keyed by
+// each client's hex public key, the form the server logs them in.
+// It's meant to be mounted only on an access-controlled debug handler.
+func (s *Server) ServeDebugClients(w http.ResponseWriter, r *http.Request) {
+	stats := s.ClientStats()
+	m := make(map[string]ClientStat, len(stats))
+	for k, st := range stats {
+		m[fmt.Sprintf("%x", k[:])] = st
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(m); err != nil {
+		s.logf("derp: debug clients: %v", err)
+	}
+}
+
 func (s *Server) ServeDebugTraffic(w http.ResponseWriter, r *http.Request) {
 	prevState := map[netaddr.IPPort]BytesSentRecv{}
 	enc := json.NewEncoder(w)
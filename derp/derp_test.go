@@ -8,7 +8,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	crand "crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
@@ -17,13 +19,18 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"net/http/httptest"
 	"reflect"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/time/rate"
+	"inet.af/netaddr"
 	"tailscale.com/net/nettest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -652,6 +659,64 @@ func TestWatch(t *testing.T) {
 	w3.wantGone(t, c1.pub)
 }
 
+func TestWatchPeerEndpoints(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	eps := []netaddr.IPPort{
+		netaddr.MustParseIPPort("1.2.3.4:567"),
+		{}, // invalid; not forwarded
+		netaddr.MustParseIPPort("[fe80::1]:41641"),
+	}
+	c1 := newTestClient(t, ts, "c1", func(nc net.Conn, priv key.Private, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, Endpoints(eps))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		return c, nil
+	})
+	w1 := newTestClient(t, ts, "w1", func(nc net.Conn, priv key.Private, logf logger.Logf) (*Client, error) {
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(priv, nc, brw, logf, MeshKey("mesh-key"), CanReceivePeerEndpoints(true))
+		if err != nil {
+			return nil, err
+		}
+		waitConnect(t, c)
+		if err := c.WatchConnectionChanges(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+	// Old-style watchers still get plain PeerPresentMessages.
+	w2 := newTestWatcher(t, ts, "w2")
+	w2.wantPresent(t, c1.pub, w1.pub, w2.pub)
+
+	want := []netaddr.IPPort{eps[0], eps[2]}
+	for got := map[key.Public]bool{}; !got[c1.pub] || !got[w1.pub]; {
+		m, err := w1.c.recvTimeout(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pp, ok := m.(PeerPresentWithEndpoints)
+		if !ok {
+			t.Fatalf("unexpected message type %T", m)
+		}
+		got[pp.Key] = true
+		switch pp.Key {
+		case c1.pub:
+			if !reflect.DeepEqual(pp.Endpoints, want) {
+				t.Errorf("c1 endpoints = %v; want %v", pp.Endpoints, want)
+			}
+		case w1.pub:
+			if len(pp.Endpoints) != 0 {
+				t.Errorf("w1 endpoints = %v; want none", pp.Endpoints)
+			}
+		}
+	}
+}
+
 type testFwd int
 
 func (testFwd) ForwardPacket(key.Public, key.Public, []byte) error { panic("not called in tests") }
@@ -779,6 +844,671 @@ func TestForwarderRegistration(t *testing.T) {
 	})
 }
 
+func TestClientIdleTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	ts.s.SetClientIdleTimeout(100 * time.Millisecond)
+
+	c1 := newRegularClient(t, ts, "c1")
+
+	m, err := c1.c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if hm, ok := m.(HealthMessage); !ok || hm.Problem == "" {
+		t.Fatalf("got %#v; want HealthMessage with a problem", m)
+	}
+	if _, err := c1.c.recvTimeout(5 * time.Second); err == nil {
+		t.Fatal("connection still open after idle timeout")
+	}
+	if got := ts.s.idleClientCloses.Value(); got != 1 {
+		t.Errorf("idle closes = %d; want 1", got)
+	}
+
+	// Mesh peers are exempt.
+	if d := (&sclient{s: ts.s, canMesh: true}).idleTimeout(); d != 0 {
+		t.Errorf("mesh peer idle timeout = %v; want 0", d)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c1.c.SendContext(canceled, c2.pub, []byte("nope")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendContext with canceled ctx = %v; want context.Canceled", err)
+	}
+	// The connection is still usable.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c1.c.SendContext(ctx, c2.pub, []byte("hello")); err != nil {
+		t.Fatalf("SendContext: %v", err)
+	}
+	m, err := c2.c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp, ok := m.(ReceivedPacket); !ok || string(rp.Data) != "hello" {
+		t.Errorf("got %#v; want ReceivedPacket of hello", m)
+	}
+
+	// Canceling a ctx after its send returns must not leave a
+	// deadline behind for later sends.
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := c1.c.SendContext(ctx, c2.pub, []byte("ctx"))
+		cancel()
+		if err != nil {
+			t.Fatalf("SendContext %d: %v", i, err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := c1.c.Send(c2.pub, []byte("after")); err != nil {
+			t.Fatalf("Send after canceled SendContext %d: %v", i, err)
+		}
+		for j := 0; j < 2; j++ {
+			if _, err := c2.c.recvTimeout(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSendContextStalledPeer(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+	serverPriv := newPrivateKey(t)
+	sbr := bufio.NewReader(sc)
+	infoRead := make(chan error, 1)
+	go func() {
+		_, n, err := readFrameHeader(sbr)
+		if err == nil {
+			_, err = sbr.Discard(int(n))
+		}
+		infoRead <- err
+	}()
+	c, err := NewClient(newPrivateKey(t), cc, bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc)), t.Logf, ServerPublicKey(serverPriv.Public()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-infoRead; err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody's reading sc, so the write can't start before the
+	// deadline.
+	dst := newPrivateKey(t).Public()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.SendContext(ctx, dst, []byte("stalled")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SendContext to stalled peer = %v; want DeadlineExceeded", err)
+	}
+
+	// Once the peer reads again, both kinds of send work.
+	type frame struct {
+		t    frameType
+		data []byte
+		err  error
+	}
+	frames := make(chan frame, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			b := make([]byte, 1<<10)
+			ft, n, err := readFrame(sbr, uint32(len(b)), b)
+			frames <- frame{ft, b[:n], err}
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.SendContext(ctx, dst, []byte("retried")); err != nil {
+		t.Fatalf("SendContext after stall: %v", err)
+	}
+	if err := c.Send(dst, []byte("buffered")); err != nil {
+		t.Fatalf("Send after stall: %v", err)
+	}
+	for _, want := range []string{"retried", "buffered"} {
+		f := <-frames
+		if f.err != nil {
+			t.Fatal(f.err)
+		}
+		if f.t != frameSendPacket || !bytes.Equal(f.data, append(dst[:], want...)) {
+			t.Errorf("got frame %v %q; want frameSendPacket to %q", f.t, f.data, want)
+		}
+	}
+}
+
+func TestCompressPacket(t *testing.T) {
+	random := make([]byte, 1000)
+	crand.Read(random)
+	wgData := append([]byte{4, 0, 0, 0}, make([]byte, 1000)...)
+	tests := []struct {
+		name   string
+		pkt    []byte
+		wantOK bool
+	}{
+		{"compressible", bytes.Repeat([]byte("derp"), 250), true},
+		{"random", random, false},
+		{"wireguard_data", wgData, false},
+		{"empty", nil, false},
+	}
+	var buf []byte
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, ok := compressPacket(&buf, tt.pkt)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v; want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			got, err := decompressPacket(nil, enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.pkt) {
+				t.Errorf("round trip mismatch")
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	newCompressing := func(name string) *testClient {
+		return newTestClient(t, ts, name, func(nc net.Conn, priv key.Private, logf logger.Logf) (*Client, error) {
+			brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+			c, err := NewClient(priv, nc, brw, logf, Compression(true))
+			if err != nil {
+				return nil, err
+			}
+			waitConnect(t, c)
+			return c, nil
+		})
+	}
+	c1 := newCompressing("c1")
+	c2 := newCompressing("c2")
+	c3 := newRegularClient(t, ts, "c3")
+
+	if !c1.c.serverCompress.Get() {
+		t.Fatal("compression not negotiated")
+	}
+	msg := bytes.Repeat([]byte("derp"), 250)
+	for _, c := range []*testClient{c2, c3} {
+		if err := c1.c.Send(c.pub, msg); err != nil {
+			t.Fatal(err)
+		}
+		m, err := c.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rp, ok := m.(ReceivedPacket)
+		if !ok || rp.Source != c1.pub || !bytes.Equal(rp.Data, msg) {
+			t.Errorf("%s got %#v; want the packet from c1", c.name, m)
+		}
+	}
+}
+
+func TestSetRecvTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c1 := newRegularClient(t, ts, "c1")
+
+	c1.c.SetRecvTimeout(50 * time.Millisecond)
+	start := time.Now()
+	m, err := c1.c.Recv()
+	if err == nil {
+		t.Fatalf("Recv on idle connection = %T; want timeout error", m)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Recv took %v to time out; want about 50ms", d)
+	}
+}
+
+func TestSendMulti(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+	c3 := newRegularClient(t, ts, "c3")
+
+	if !c1.c.serverSendMulti.Get() {
+		t.Fatal("SendMulti not negotiated with the server")
+	}
+	for _, multi := range []bool{true, false} {
+		c1.c.serverSendMulti.Set(multi) // false exercises the fallback
+		msg := fmt.Sprintf("hi multi=%v", multi)
+		if err := c1.c.SendMulti([]key.Public{c2.pub, c3.pub}, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []*testClient{c2, c3} {
+			m, err := c.c.recvTimeout(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rp, ok := m.(ReceivedPacket)
+			if !ok || rp.Source != c1.pub || string(rp.Data) != msg {
+				t.Errorf("%s got %#v; want %q from c1", c.name, m, msg)
+			}
+		}
+	}
+}
+
+func TestSendMultiFanoutLimit(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c1 := newRegularClient(t, ts, "c1")
+
+	// Two full frames of max-size packets are twice the burst, so
+	// the second frame's copies must be dropped.
+	dstKeys := make([]key.Public, 2*maxSendMultiKeys)
+	for i := range dstKeys {
+		dstKeys[i] = newPrivateKey(t).Public()
+	}
+	if err := c1.c.SendMulti(dstKeys, make([]byte, MaxPacketSize)); err != nil {
+		t.Fatal(err)
+	}
+	dropped := ts.s.packetsDroppedReasonCounters[dropReasonFanoutLimit]
+	for deadline := time.Now().Add(5 * time.Second); dropped.Value() < maxSendMultiKeys/2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("fanout_limit drops = %d; want at least %d", dropped.Value(), maxSendMultiKeys/2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+	w1 := newTestWatcher(t, ts, "w1") // mesh peers aren't waited for
+	defer w1.close(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ts.s.Drain(ctx, time.Second, 2*time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("Drain with clients still connected = %v; want DeadlineExceeded", err)
+	}
+	for _, c := range []*testClient{c1, c2} {
+		m, err := c.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rm, ok := m.(ServerRestartingMessage)
+		if !ok {
+			t.Fatalf("%s got %T; want ServerRestartingMessage", c.name, m)
+		}
+		if rm.ReconnectIn < 0 || rm.ReconnectIn >= time.Second || rm.TryFor != 2*time.Second {
+			t.Errorf("%s got %+v; want ReconnectIn in [0, 1s), TryFor 2s", c.name, rm)
+		}
+		c.close(t)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.s.Drain(ctx, time.Second, 2*time.Second); err != nil {
+		t.Fatalf("Drain after clients left = %v", err)
+	}
+}
+
+func TestDrainClosesClients(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c1 := newRegularClient(t, ts, "c1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	start := time.Now()
+	go func() { errc <- ts.s.Drain(ctx, time.Second, time.Second) }()
+
+	// c1 doesn't act on the restarting frame, so Drain must close
+	// it, once the delay it was told has passed.
+	m, err := c1.c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, ok := m.(ServerRestartingMessage)
+	if !ok {
+		t.Fatalf("got %T; want ServerRestartingMessage", m)
+	}
+	if m, err := c1.c.recvTimeout(5 * time.Second); err == nil {
+		t.Fatalf("got %T after restarting frame; want connection closed", m)
+	}
+	if elapsed := time.Since(start); elapsed < rm.ReconnectIn {
+		t.Errorf("closed after %v; want no sooner than its ReconnectIn of %v", elapsed, rm.ReconnectIn)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Drain = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain didn't return after closing clients")
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+
+	if err := c1.c.NotePreferred(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.c.Send(c2.pub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.c.recvTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[key.Public]ClientStat
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got = ts.s.ClientStats()
+		if got[c1.pub].Home && got[c2.pub].PacketsSent == 1 {
+			break
+		}
+	}
+	s1, s2 := got[c1.pub], got[c2.pub]
+	if s1.PacketsRecv != 1 || s1.BytesRecv != 5 || s1.PacketsSent != 0 || !s1.Home {
+		t.Errorf("c1 stats = %+v; want 1 packet (5 bytes) received, home", s1)
+	}
+	if s2.PacketsSent != 1 || s2.BytesSent != 5 || s2.PacketsRecv != 0 || s2.Home {
+		t.Errorf("c2 stats = %+v; want 1 packet (5 bytes) sent, not home", s2)
+	}
+	if s1.ConnectedSince.IsZero() || s1.ConnectedSince.After(time.Now()) {
+		t.Errorf("c1 ConnectedSince = %v", s1.ConnectedSince)
+	}
+
+	rec := httptest.NewRecorder()
+	ts.s.ServeDebugClients(rec, httptest.NewRequest("GET", "/debug/clients", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q; want application/json", ct)
+	}
+	var served map[string]ClientStat
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("decoding debug clients body: %v", err)
+	}
+	if len(served) != 2 {
+		t.Errorf("served %d clients; want 2", len(served))
+	}
+	if st := served[fmt.Sprintf("%x", c1.pub[:])]; st.PacketsRecv != 1 || !st.Home {
+		t.Errorf("served c1 stats = %+v; want 1 packet received, home", st)
+	}
+	if st := served[fmt.Sprintf("%x", c2.pub[:])]; st.PacketsSent != 1 {
+		t.Errorf("served c2 stats = %+v; want 1 packet sent", st)
+	}
+}
+
+func TestBearerTokenVerifier(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	errBadToken := errors.New("bad token")
+	ts.s.SetBearerTokenVerifier(func(_ key.Public, token string) error {
+		if token != "tenant-1" {
+			return errBadToken
+		}
+		return nil
+	})
+	connect := func(name string, opts ...ClientOpt) (*Client, error) {
+		nc, err := net.Dial("tcp", ts.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { nc.Close() })
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		c, err := NewClient(newPrivateKey(t), nc, brw, logger.WithPrefix(t.Logf, name+": "), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.Recv()
+		return c, err
+	}
+
+	if _, err := connect("good", BearerToken("tenant-1")); err != nil {
+		t.Errorf("client with valid token: %v", err)
+	}
+	if _, err := connect("bad", BearerToken("tenant-2")); err == nil {
+		t.Error("client with invalid token was admitted")
+	}
+	if _, err := connect("none"); err == nil {
+		t.Error("client without a token was admitted")
+	}
+	if _, err := connect("mesh", MeshKey("mesh-key")); err != nil {
+		t.Errorf("mesh peer without a token: %v", err)
+	}
+	if got := ts.s.bearerTokenRejects.Value(); got != 2 {
+		t.Errorf("bearer token rejects = %d; want 2", got)
+	}
+}
+
+func TestClientAuthFunc(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+	banned := newPrivateKey(t)
+	s.SetClientAuthFunc(func(k key.Public) error {
+		if k == banned.Public() {
+			return errors.New("banned")
+		}
+		return nil
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	connOut, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connOut.Close()
+	connIn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connIn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Accept(connIn, bufio.NewReadWriter(bufio.NewReader(connIn), bufio.NewWriter(connIn)), "test-client")
+	}()
+	brw := bufio.NewReadWriter(bufio.NewReader(connOut), bufio.NewWriter(connOut))
+	if _, err := NewClient(banned, connOut, brw, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept of banned key didn't return")
+	}
+	if got := s.clientAuthRejects.Value(); got != 1 {
+		t.Errorf("client auth rejects = %d; want 1", got)
+	}
+	if got := s.curClients.Value(); got != 0 {
+		t.Errorf("current clients = %d; want 0", got)
+	}
+	if got := s.packetsRecv.Value(); got != 0 {
+		t.Errorf("packets received = %d; want 0", got)
+	}
+}
+
+func TestSetHealthProblem(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	wantHealth := func(c *testClient, want string) {
+		t.Helper()
+		m, err := c.c.recvTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatalf("%s: recv: %v", c.name, err)
+		}
+		if hm, ok := m.(HealthMessage); !ok || hm.Problem != want {
+			t.Fatalf("%s: got %#v; want HealthMessage{Problem: %q}", c.name, m, want)
+		}
+	}
+
+	ts.s.SetHealthProblem("down for maintenance")
+	wantHealth(c1, "down for maintenance")
+
+	// Clients connecting later get it too.
+	c2 := newRegularClient(t, ts, "c2")
+	wantHealth(c2, "down for maintenance")
+
+	ts.s.SetHealthProblem("")
+	wantHealth(c1, "")
+	wantHealth(c2, "")
+}
+
+func TestSetDraining(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+	ts.s.SetDraining(true)
+
+	// New clients are told why and then disconnected.
+	c3 := newRegularClient(t, ts, "c3")
+	m, err := c3.c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatalf("c3: recv: %v", err)
+	}
+	if hm, ok := m.(HealthMessage); !ok || hm.Problem != drainingProblem {
+		t.Fatalf("c3: got %#v; want HealthMessage{Problem: %q}", m, drainingProblem)
+	}
+	if m, err := c3.c.recvTimeout(5 * time.Second); err == nil {
+		t.Fatalf("c3: got %#v; want connection closed", m)
+	}
+	if got := ts.s.drainingRejects.Value(); got != 1 {
+		t.Errorf("drainingRejects = %d; want 1", got)
+	}
+
+	// Mesh peers are still accepted.
+	newTestWatcher(t, ts, "w1")
+
+	// Existing clients are still served.
+	msg := []byte("hello")
+	if err := c1.c.Send(c2.pub, msg); err != nil {
+		t.Fatal(err)
+	}
+	m, err = c2.c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatalf("c2: recv: %v", err)
+	}
+	if rp, ok := m.(ReceivedPacket); !ok || rp.Source != c1.pub || !bytes.Equal(rp.Data, msg) {
+		t.Fatalf("c2: got %#v; want packet from c1", m)
+	}
+
+	// Once no longer draining, new clients connect normally.
+	ts.s.SetDraining(false)
+	c4 := newRegularClient(t, ts, "c4")
+	if err := c4.c.Send(c2.pub, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.c.recvTimeout(5 * time.Second); err != nil {
+		t.Fatalf("c2: recv from c4: %v", err)
+	}
+}
+
+func TestClientTCPInfo(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	if _, ok := ts.s.ClientTCPInfo(newPrivateKey(t).Public()); ok {
+		t.Error("got TCP info for unknown client")
+	}
+	c1 := newRegularClient(t, ts, "c1")
+	_, ok := ts.s.ClientTCPInfo(c1.pub)
+	if want := runtime.GOOS == "linux"; ok != want {
+		t.Errorf("ClientTCPInfo ok = %v; want %v", ok, want)
+	}
+}
+
+func TestClientTCPInfoTLS(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP info is only implemented on Linux")
+	}
+	if _, ok := interface{}(&tls.Conn{}).(interface{ NetConn() net.Conn }); !ok {
+		t.Skip("*tls.Conn can't be unwrapped before Go 1.18")
+	}
+	pub, priv, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.Accept(nc, bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)), nc.RemoteAddr().String())
+	}()
+
+	nc, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	priv1 := newPrivateKey(t)
+	c, err := NewClient(priv1, nc, bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c)
+	if _, ok := s.ClientTCPInfo(priv1.Public()); !ok {
+		t.Error("no TCP info for a client connected over TLS")
+	}
+}
+
+func TestFetchServerKey(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	k, err := FetchServerKey(ctx, ts.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k != ts.s.PublicKey() {
+		t.Errorf("got key %v; want %v", k.ShortString(), ts.s.PublicKey().ShortString())
+	}
+
+	c := newRegularClient(t, ts, "c1")
+	if got := c.c.ServerPublicKey(); got != k {
+		t.Errorf("client ServerPublicKey = %v; want %v", got.ShortString(), k.ShortString())
+	}
+}
+
 func TestMetaCert(t *testing.T) {
 	priv := newPrivateKey(t)
 	pub := priv.Public()
@@ -1140,7 +1870,27 @@ func BenchmarkSendRecv(b *testing.B) {
 	}
 }
 
+// BenchmarkSendRecvCompressed is BenchmarkSendRecv with Compression
+// negotiated, for compressible and incompressible (random) payloads.
+func BenchmarkSendRecvCompressed(b *testing.B) {
+	for _, size := range []int{100, 1000, 10000} {
+		compressible := bytes.Repeat([]byte("derp"), size/4)
+		random := make([]byte, size)
+		crand.Read(random)
+		b.Run(fmt.Sprintf("compressible/msgsize=%d", size), func(b *testing.B) {
+			benchmarkSendRecv(b, compressible, Compression(true))
+		})
+		b.Run(fmt.Sprintf("random/msgsize=%d", size), func(b *testing.B) {
+			benchmarkSendRecv(b, random, Compression(true))
+		})
+	}
+}
+
 func benchmarkSendRecvSize(b *testing.B, packetSize int) {
+	benchmarkSendRecv(b, make([]byte, packetSize))
+}
+
+func benchmarkSendRecv(b *testing.B, msg []byte, opts ...ClientOpt) {
 	serverPrivateKey := newPrivateKey(b)
 	s := NewServer(serverPrivateKey, logger.Discard)
 	defer s.Close()
@@ -1170,7 +1920,7 @@ func benchmarkSendRecvSize(b *testing.B, packetSize int) {
 	go s.Accept(connIn, brwServer, "test-client")
 
 	brw := bufio.NewReadWriter(bufio.NewReader(connOut), bufio.NewWriter(connOut))
-	client, err := NewClient(key, connOut, brw, logger.Discard)
+	client, err := NewClient(key, connOut, brw, logger.Discard, opts...)
 	if err != nil {
 		b.Fatalf("client: %v", err)
 	}
@@ -1184,7 +1934,6 @@ func benchmarkSendRecvSize(b *testing.B, packetSize int) {
 		}
 	}()
 
-	msg := make([]byte, packetSize)
 	b.SetBytes(int64(len(msg)))
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -1231,6 +1980,138 @@ func waitConnect(t testing.TB, c *Client) {
 		t.Fatalf("client first Recv: %v", err)
 	} else if v, ok := m.(ServerInfoMessage); !ok {
 		t.Fatalf("client first Recv was unexpected type %T", v)
+	} else if v.ProtocolVersion != ProtocolVersion {
+		t.Fatalf("negotiated protocol version = %d; want %d", v.ProtocolVersion, ProtocolVersion)
+	}
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	tests := []struct {
+		name             string
+		peerMin, peerMax int
+		want             int
+		wantErr          bool
+	}{
+		{"old_peer_no_version", 0, 0, 1, false},
+		{"same", minProtocolVersion, ProtocolVersion, ProtocolVersion, false},
+		{"single_version", 1, 1, 1, false},
+		{"newer_peer", 1, ProtocolVersion + 5, ProtocolVersion, false},
+		{"peer_too_new", ProtocolVersion + 1, ProtocolVersion + 5, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateProtocolVersion(tt.peerMin, tt.peerMax)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestV1ClientGetsNoV2Frames tests that a client that only speaks
+// version 1 gets packets without source keys and none of the frame
+// types added since.
+func TestV1ClientGetsNoV2Frames(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	c2 := newRegularClient(t, ts, "c2")
+
+	nc, err := net.Dial("tcp", ts.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	priv := newPrivateKey(t)
+	v1 := &Client{
+		privateKey: priv,
+		publicKey:  priv.Public(),
+		logf:       t.Logf,
+		nc:         nc,
+		br:         bufio.NewReader(nc),
+		bw:         bufio.NewWriter(nc),
+	}
+	if err := v1.recvServerKey(); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := json.Marshal(clientInfo{Version: 1, CanCompress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce [nonceLen]byte
+	msgbox := box.Seal(nil, msg, &nonce, v1.serverKey.B32(), priv.B32())
+	buf := append(append(append([]byte(nil), v1.publicKey[:]...), nonce[:]...), msgbox...)
+	if err := writeFrame(v1.bw, frameClientInfo, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1<<10)
+	ft, fl, err := readFrame(v1.br, 1<<20, b)
+	if err != nil || ft != frameServerInfo {
+		t.Fatalf("first frame = %v, %v; want server info", ft, err)
+	}
+	si, err := v1.parseServerInfo(b[:fl])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.NegotiatedVersion != 1 {
+		t.Errorf("server info = %+v; want negotiated version 1", si)
+	}
+
+	// Wait for the server to register v1 before sending to it.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := ts.s.ClientStats()[v1.publicKey]; ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("v1 client never registered")
+		}
+	}
+	pkt := bytes.Repeat([]byte("derp"), 100) // compressible
+	if err := c2.c.Send(v1.publicKey, pkt); err != nil {
+		t.Fatal(err)
+	}
+	ts.s.SetHealthProblem("unhealthy")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ts.s.Drain(ctx, 0, time.Second)
+
+	gotPacket := false
+	nc.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		b := make([]byte, 1<<16)
+		ft, fl, err := readFrame(v1.br, 1<<20, b)
+		if err != nil {
+			break // deadline, or closed by Drain
+		}
+		switch ft {
+		case frameRecvPacket:
+			if !bytes.Equal(b[:fl], pkt) {
+				t.Errorf("got v1 packet of %d bytes; want %d bytes without a source key", fl, len(pkt))
+			}
+			gotPacket = true
+		case frameKeepAlive:
+		default:
+			t.Errorf("v1 client got frame type %#x", ft)
+		}
+	}
+	if !gotPacket {
+		t.Error("v1 client didn't get the packet")
+	}
+}
+
+func TestClientInfoProtocolVersion(t *testing.T) {
+	// A client predating version ranges only sends Version.
+	old := &clientInfo{Version: ProtocolVersion}
+	if v, err := old.protocolVersion(); err != nil || v != ProtocolVersion {
+		t.Errorf("old client: got (%d, %v); want %d", v, err, ProtocolVersion)
+	}
+	ranged := &clientInfo{Version: ProtocolVersion + 3, MinVersion: 1, MaxVersion: ProtocolVersion + 3}
+	if v, err := ranged.protocolVersion(); err != nil || v != ProtocolVersion {
+		t.Errorf("ranged client: got (%d, %v); want %d", v, err, ProtocolVersion)
 	}
 }
 
@@ -47,10 +47,25 @@ import (
 // Send/Recv will completely re-establish the connection (unless Close
 // has been called).
 type Client struct {
-	TLSConfig *tls.Config        // optional; nil means default
-	DNSCache  *dnscache.Resolver // optional; nil means no caching
-	MeshKey   string             // optional; for trusted clients
-	IsProber  bool               // optional; for probers to optional declare themselves as such
+	TLSConfig   *tls.Config        // optional; nil means default
+	DNSCache    *dnscache.Resolver // optional; nil means no caching
+	MeshKey     string             // optional; for trusted clients
+	BearerToken string             // optional; for servers that authorize clients by token
+	IsProber    bool               // optional; for probers to optional declare themselves as such
+
+	// Endpoints optionally lists ip:ports to advertise to the server
+	// as where this client may be directly reachable. See
+	// derp.Endpoints.
+	Endpoints []netaddr.IPPort
+
+	// CanReceivePeerEndpoints is whether this client, if a watcher,
+	// wants peers' endpoints along with their presence. See
+	// derp.CanReceivePeerEndpoints.
+	CanReceivePeerEndpoints bool
+
+	// Compression is whether to negotiate compression of relayed
+	// packets with the server. See derp.Compression.
+	Compression bool
 
 	privateKey key.Private
 	logf       logger.Logf
@@ -71,6 +86,7 @@ type Client struct {
 	client       *derp.Client
 	connGen      int // incremented once per new connection; valid values are >0
 	serverPubKey key.Public
+	reconnectAt  time.Time // if non-zero, don't dial before this; see SetReconnectAt
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -188,6 +204,9 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	if c.client != nil {
 		return c.client, c.connGen, nil
 	}
+	if !c.reconnectAt.IsZero() && time.Now().Before(c.reconnectAt) {
+		return nil, 0, ErrReconnectPending
+	}
 
 	// timeout is the fallback maximum time (if ctx doesn't limit
 	// it further) to do all of: DNS + TCP + TLS + HTTP Upgrade +
@@ -343,9 +362,13 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	}
 	derpClient, err = derp.NewClient(c.privateKey, httpConn, brw, c.logf,
 		derp.MeshKey(c.MeshKey),
+		derp.BearerToken(c.BearerToken),
 		derp.ServerPublicKey(serverPub),
 		derp.CanAckPings(c.canAckPings),
 		derp.IsProber(c.IsProber),
+		derp.Endpoints(c.Endpoints),
+		derp.CanReceivePeerEndpoints(c.CanReceivePeerEndpoints),
+		derp.Compression(c.Compression),
 	)
 	if err != nil {
 		return nil, 0, err
@@ -794,6 +817,17 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// SetReconnectAt sets the earliest time at which c may dial the
+// server again, such as when the server has announced it's
+// restarting. Until then, any of c's methods that would need to dial
+// fail with ErrReconnectPending instead. An existing connection is
+// unaffected. The zero time removes the restriction.
+func (c *Client) SetReconnectAt(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnectAt = t
+}
+
 // closeForReconnect closes the underlying network connection and
 // zeros out the client field so future calls to Connect will
 // reconnect.
@@ -819,6 +853,10 @@ func (c *Client) closeForReconnect(brokenClient *derp.Client) {
 
 var ErrClientClosed = errors.New("derphttp.Client closed")
 
+// ErrReconnectPending is returned by a Client's methods that would
+// need to dial before the time set by SetReconnectAt.
+var ErrReconnectPending = errors.New("derphttp.Client waiting to reconnect")
+
 func parseMetaCert(certs []*x509.Certificate) (serverPub key.Public, serverProtoVersion int) {
 	for _, cert := range certs {
 		if cn := cert.Subject.CommonName; strings.HasPrefix(cn, "derpkey") {
@@ -5,14 +5,18 @@
 package derphttp
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/types/key"
 )
@@ -154,3 +158,151 @@ func waitConnect(t testing.TB, c *Client) {
 		t.Fatalf("client first Recv was unexpected type %T", v)
 	}
 }
+
+func TestSendBeforeReconnectAtDoesNotDial(t *testing.T) {
+	c, err := NewClient(key.NewPrivate(), "http://derp.invalid/derp", t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var mu sync.Mutex
+	dials := 0
+	c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials++
+		return nil, errors.New("test dial refused")
+	})
+	numDials := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dials
+	}
+
+	c.SetReconnectAt(time.Now().Add(time.Hour))
+	if err := c.Send(key.NewPrivate().Public(), []byte("hi")); err != ErrReconnectPending {
+		t.Errorf("Send before reconnect time = %v; want ErrReconnectPending", err)
+	}
+	if _, err := c.Recv(); err != ErrReconnectPending {
+		t.Errorf("Recv before reconnect time = %v; want ErrReconnectPending", err)
+	}
+	if n := numDials(); n != 0 {
+		t.Fatalf("dialed %d times before reconnect time; want 0", n)
+	}
+
+	c.SetReconnectAt(time.Now().Add(-time.Second))
+	if err := c.Send(key.NewPrivate().Public(), []byte("hi")); err == nil || err == ErrReconnectPending {
+		t.Errorf("Send after reconnect time = %v; want dial error", err)
+	}
+	if n := numDials(); n != 1 {
+		t.Errorf("dialed %d times after reconnect time; want 1", n)
+	}
+}
+
+func TestWatchPeerEndpoints(t *testing.T) {
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("mesh-key")
+	httpsrv := &http.Server{
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Handler:      Handler(s),
+	}
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpsrv.Serve(ln)
+	defer httpsrv.Close()
+	serverURL := "http://" + ln.Addr().String()
+
+	peerPriv := key.NewPrivate()
+	peer, err := NewClient(peerPriv, serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	eps := []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:5")}
+	peer.Endpoints = eps
+	if err := peer.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, peer)
+
+	watcher, err := NewClient(key.NewPrivate(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	watcher.MeshKey = "mesh-key"
+	watcher.CanReceivePeerEndpoints = true
+	if err := watcher.WatchConnectionChanges(); err != nil {
+		t.Fatal(err)
+	}
+	// Unblock Recv if the peer's presence never arrives.
+	timer := time.AfterFunc(10*time.Second, func() { watcher.Close() })
+	defer timer.Stop()
+	for {
+		m, err := watcher.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pp, ok := m.(derp.PeerPresentWithEndpoints)
+		if !ok || pp.Key != peerPriv.Public() {
+			continue
+		}
+		if !reflect.DeepEqual(pp.Endpoints, eps) {
+			t.Errorf("endpoints = %v; want %v", pp.Endpoints, eps)
+		}
+		return
+	}
+}
+
+func TestSendRecvCompressed(t *testing.T) {
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	httpsrv := &http.Server{
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Handler:      Handler(s),
+	}
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpsrv.Serve(ln)
+	defer httpsrv.Close()
+	serverURL := "http://" + ln.Addr().String()
+
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(key.NewPrivate(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Compression = true
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		waitConnect(t, c)
+		clients = append(clients, c)
+	}
+
+	msg := bytes.Repeat([]byte("compressible "), 100)
+	if err := clients[0].Send(clients[1].SelfPublicKey(), msg); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.AfterFunc(10*time.Second, func() { clients[1].Close() })
+	defer timer.Stop()
+	for {
+		m, err := clients[1].Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.(derp.ReceivedPacket); ok {
+			if !bytes.Equal(p.Data, msg) {
+				t.Errorf("got %q; want %q", p.Data, msg)
+			}
+			return
+		}
+	}
+}
@@ -20,6 +20,8 @@ import (
 // If the server's public key is ignoreServerKey, RunWatchConnectionLoop returns.
 //
 // Otherwise, the add and remove funcs are called as clients come & go.
+// That includes peers announced with their endpoints, if c has
+// CanReceivePeerEndpoints set; the endpoints aren't passed to add.
 //
 // infoLogf, if non-nil, is the logger to write periodic status
 // updates about how many peers are on the server. Error log output is
@@ -128,6 +130,8 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 			switch m := m.(type) {
 			case derp.PeerPresentMessage:
 				updatePeer(key.Public(m), true)
+			case derp.PeerPresentWithEndpoints:
+				updatePeer(m.Key, true)
 			case derp.PeerGoneMessage:
 				updatePeer(key.Public(m), false)
 			default:
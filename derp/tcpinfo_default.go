@@ -0,0 +1,13 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package derp
+
+// tcpInfo is only implemented on Linux.
+func tcpInfo(nc Conn) (TCPInfo, bool) {
+	return TCPInfo{}, false
+}
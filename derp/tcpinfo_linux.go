@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// netConner is implemented by conns that wrap another, such as
+// *tls.Conn since Go 1.18.
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// tcpInfo returns the kernel's TCP_INFO statistics for nc, if nc is,
+// or wraps, a TCP connection that exposes its file descriptor.
+func tcpInfo(nc Conn) (TCPInfo, bool) {
+	var c interface{} = nc
+	for {
+		if _, ok := c.(syscall.Conn); ok {
+			break
+		}
+		w, ok := c.(netConner)
+		if !ok {
+			return TCPInfo{}, false
+		}
+		c = w.NetConn()
+	}
+	sc := c.(syscall.Conn)
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return TCPInfo{}, false
+	}
+	var ti *unix.TCPInfo
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		ti, serr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil || serr != nil {
+		return TCPInfo{}, false
+	}
+	return TCPInfo{
+		RTT:         time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:      time.Duration(ti.Rttvar) * time.Microsecond,
+		Retransmits: ti.Total_retrans,
+		Lost:        ti.Lost,
+		SendCwnd:    ti.Snd_cwnd,
+	}, true
+}
@@ -15,15 +15,22 @@
 // and then the inner payload structure is:
 //
 //     messageType    byte  (the MessageType constants below)
-//     messageVersion byte  (0 for now; but always ignore bytes at the end)
+//     messageVersion byte  (0 or 1; always ignore bytes at the end)
 //     message-paylod [...]byte
+//
+// Version 1 messages add a field to the version 0 payload of their
+// type: caps for Ping and Pong, and a TTL for CallMeMaybe. Messages
+// are only sent as version 1 when they need that field; see each
+// type's docs for how peers that predate it parse them.
 package disco
 
 import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"time"
 
 	"inet.af/netaddr"
 )
@@ -44,7 +51,10 @@ const (
 	TypeCallMeMaybe = MessageType(0x03)
 )
 
-const v0 = byte(0)
+const (
+	v0 = byte(0)
+	v1 = byte(1)
+)
 
 var errShort = errors.New("short message")
 
@@ -107,11 +117,42 @@ func appendMsgHeader(b []byte, t MessageType, ver uint8, dataLen int) (all, data
 
 type Ping struct {
 	TxID [12]byte
+
+	// HasCaps is whether the Ping is sent as version 1, with Caps
+	// in a byte between TxID and Payload. Recipients that predate
+	// it take that byte as the start of Payload.
+	HasCaps bool
+
+	// Caps, if HasCaps, is the set of features the sender supports.
+	Caps PingCaps
+
+	// Payload is optional opaque data, at most MaxPingPayloadLen
+	// bytes, that the recipient echoes back in its Pong. It's sent
+	// after the TxID, so recipients that predate it ignore it.
+	Payload []byte
 }
 
+// PingCaps is a bitmask of optional disco features, for negotiating
+// them with a Ping and its Pong: a Ping's Caps are those its sender
+// supports, and a Pong's are those of its Ping's that the Pong's
+// sender supports too. No features are defined yet.
+type PingCaps byte
+
+// MaxPingPayloadLen is the maximum length of Ping.Payload and
+// Pong.Payload. Longer trailing data is ignored when parsing.
+const MaxPingPayloadLen = 32
+
 func (m *Ping) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePing, v0, 12)
-	copy(d, m.TxID[:])
+	if !m.HasCaps {
+		ret, d := appendMsgHeader(b, TypePing, v0, 12+len(m.Payload))
+		d = d[copy(d, m.TxID[:]):]
+		copy(d, m.Payload)
+		return ret
+	}
+	ret, d := appendMsgHeader(b, TypePing, v1, 12+1+len(m.Payload))
+	d = d[copy(d, m.TxID[:]):]
+	d[0] = byte(m.Caps)
+	copy(d[1:], m.Payload)
 	return ret
 }
 
@@ -121,9 +162,25 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	}
 	m = new(Ping)
 	copy(m.TxID[:], p)
+	p = p[12:]
+	if ver >= v1 && len(p) > 0 {
+		m.HasCaps = true
+		m.Caps = PingCaps(p[0])
+		p = p[1:]
+	}
+	m.Payload = parsePayload(p)
 	return m, nil
 }
 
+// parsePayload returns a copy of the trailing bytes p of a Ping or Pong
+// as its payload, or nil if there are none or too many.
+func parsePayload(p []byte) []byte {
+	if len(p) == 0 || len(p) > MaxPingPayloadLen {
+		return nil
+	}
+	return append([]byte(nil), p...)
+}
+
 // CallMeMaybe is a message sent only over DERP to request that the recipient try
 // to open up a magicsock path back to the sender.
 //
@@ -150,24 +207,66 @@ type CallMeMaybe struct {
 	// (And in the future, control will stop distributing endpoints
 	// when clients are suitably new.)
 	MyNumber []netaddr.IPPort
+
+	// TTL, if non-zero, is how long the recipient should consider
+	// MyNumber fresh for. Endpoints that haven't answered a ping by
+	// then can be dropped rather than kept until a later
+	// CallMeMaybe replaces them.
+	//
+	// A non-zero TTL is sent as a version 1 message, which peers
+	// that predate it parse as having no endpoints at all, so it
+	// must only be sent to peers known to support it.
+	// It has millisecond precision.
+	TTL time.Duration
 }
 
 const epLength = 16 + 2 // 16 byte IP address + 2 byte port
 
+// ttlLength is the length of a version 1 CallMeMaybe's TTL, in
+// milliseconds, which precedes its endpoints.
+const ttlLength = 4
+
 func (m *CallMeMaybe) AppendMarshal(b []byte) []byte {
-	ret, p := appendMsgHeader(b, TypeCallMeMaybe, v0, epLength*len(m.MyNumber))
+	if m.TTL <= 0 {
+		ret, p := appendMsgHeader(b, TypeCallMeMaybe, v0, epLength*len(m.MyNumber))
+		m.putEndpoints(p)
+		return ret
+	}
+	ret, p := appendMsgHeader(b, TypeCallMeMaybe, v1, ttlLength+epLength*len(m.MyNumber))
+	ms := m.TTL / time.Millisecond
+	if ms > math.MaxUint32 {
+		ms = math.MaxUint32
+	}
+	binary.BigEndian.PutUint32(p, uint32(ms))
+	m.putEndpoints(p[ttlLength:])
+	return ret
+}
+
+// putEndpoints writes m.MyNumber to p, which must be exactly
+// epLength bytes per endpoint.
+func (m *CallMeMaybe) putEndpoints(p []byte) {
 	for _, ipp := range m.MyNumber {
 		a := ipp.IP().As16()
 		copy(p[:], a[:])
 		binary.BigEndian.PutUint16(p[16:], ipp.Port())
 		p = p[epLength:]
 	}
-	return ret
 }
 
 func parseCallMeMaybe(ver uint8, p []byte) (m *CallMeMaybe, err error) {
 	m = new(CallMeMaybe)
-	if len(p)%epLength != 0 || ver != 0 || len(p) == 0 {
+	switch ver {
+	case v0:
+	case v1:
+		if len(p) < ttlLength {
+			return m, nil
+		}
+		m.TTL = time.Duration(binary.BigEndian.Uint32(p)) * time.Millisecond
+		p = p[ttlLength:]
+	default:
+		return m, nil
+	}
+	if len(p)%epLength != 0 || len(p) == 0 {
 		return m, nil
 	}
 	m.MyNumber = make([]netaddr.IPPort, 0, len(p)/epLength)
@@ -189,16 +288,38 @@ func parseCallMeMaybe(ver uint8, p []byte) (m *CallMeMaybe, err error) {
 type Pong struct {
 	TxID [12]byte
 	Src  netaddr.IPPort // 18 bytes (16+2) on the wire; v4-mapped ipv6 for IPv4
+
+	// HasCaps is whether the Pong is sent as version 1, with Caps
+	// in a byte between Src and Payload. It's set only in reply to
+	// a Ping with HasCaps, whose sender can parse it.
+	HasCaps bool
+
+	// Caps, if HasCaps, is the Caps of the Ping being replied to
+	// that the Pong's sender also supports.
+	Caps PingCaps
+
+	// Payload is the Payload of the Ping being replied to, if any.
+	Payload []byte
 }
 
 const pongLen = 12 + 16 + 2
 
 func (m *Pong) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePong, v0, pongLen)
+	ver, capsLen := v0, 0
+	if m.HasCaps {
+		ver, capsLen = v1, 1
+	}
+	ret, d := appendMsgHeader(b, TypePong, ver, pongLen+capsLen+len(m.Payload))
 	d = d[copy(d, m.TxID[:]):]
 	ip16 := m.Src.IP().As16()
 	d = d[copy(d, ip16[:]):]
 	binary.BigEndian.PutUint16(d, m.Src.Port())
+	d = d[2:]
+	if m.HasCaps {
+		d[0] = byte(m.Caps)
+		d = d[1:]
+	}
+	copy(d, m.Payload)
 	return ret
 }
 
@@ -214,6 +335,13 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 	p = p[16:]
 	port := binary.BigEndian.Uint16(p)
 	m.Src = netaddr.IPPortFrom(srcIP, port)
+	p = p[2:]
+	if ver >= v1 && len(p) > 0 {
+		m.HasCaps = true
+		m.Caps = PingCaps(p[0])
+		p = p[1:]
+	}
+	m.Payload = parsePayload(p)
 	return m, nil
 }
 
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"inet.af/netaddr"
 )
@@ -26,6 +27,24 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "01 00 01 02 03 04 05 06 07 08 09 0a 0b 0c",
 		},
+		{
+			name: "ping_payload",
+			m: &Ping{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Payload: []byte{0xaa, 0xbb},
+			},
+			want: "01 00 01 02 03 04 05 06 07 08 09 0a 0b 0c aa bb",
+		},
+		{
+			name: "ping_caps",
+			m: &Ping{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				HasCaps: true,
+				Caps:    0x05,
+				Payload: []byte{0xaa, 0xbb},
+			},
+			want: "01 01 01 02 03 04 05 06 07 08 09 0a 0b 0c 05 aa bb",
+		},
 		{
 			name: "pong",
 			m: &Pong{
@@ -42,6 +61,26 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "02 00 01 02 03 04 05 06 07 08 09 0a 0b 0c fe d0 00 00 00 00 00 00 00 00 00 00 00 00 00 12 1a 0a",
 		},
+		{
+			name: "pong_payload",
+			m: &Pong{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Src:     mustIPPort("2.3.4.5:1234"),
+				Payload: []byte{0xaa, 0xbb},
+			},
+			want: "02 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 00 00 00 00 00 00 00 00 00 ff ff 02 03 04 05 04 d2 aa bb",
+		},
+		{
+			name: "pong_caps",
+			m: &Pong{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Src:     mustIPPort("2.3.4.5:1234"),
+				HasCaps: true,
+				Caps:    0x01,
+				Payload: []byte{0xaa, 0xbb},
+			},
+			want: "02 01 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 00 00 00 00 00 00 00 00 00 ff ff 02 03 04 05 04 d2 01 aa bb",
+		},
 		{
 			name: "call_me_maybe",
 			m:    &CallMeMaybe{},
@@ -57,6 +96,16 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "03 00 00 00 00 00 00 00 00 00 00 00 ff ff 01 02 03 04 02 37 20 01 00 00 00 00 00 00 00 00 00 00 00 00 34 56 03 15",
 		},
+		{
+			name: "call_me_maybe_ttl",
+			m: &CallMeMaybe{
+				MyNumber: []netaddr.IPPort{
+					netaddr.MustParseIPPort("1.2.3.4:567"),
+				},
+				TTL: 27 * time.Second,
+			},
+			want: "03 01 00 00 69 78 00 00 00 00 00 00 00 00 00 00 ff ff 01 02 03 04 02 37",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
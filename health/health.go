@@ -39,6 +39,7 @@ var (
 	ipnWantRunning          bool
 	anyInterfaceUp          = true // until told otherwise
 	udp4Unbound             bool
+	udpBindErr              = map[string]error{} // "udp4" or "udp6" => why binding failed
 )
 
 // Subsystem is the name of a subsystem whose health can be monitored.
@@ -237,6 +238,29 @@ func SetUDP4Unbound(unbound bool) {
 	selfCheckLocked()
 }
 
+// SetUDPBindError sets or clears (if err is nil) why magicsock
+// failed to bind any UDP port for network, "udp4" or "udp6". The
+// error should include each port tried and why it failed, to tell a
+// port conflict from, say, a sandbox denying the bind.
+func SetUDPBindError(network string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err == nil {
+		delete(udpBindErr, network)
+	} else {
+		udpBindErr[network] = err
+	}
+	selfCheckLocked()
+}
+
+// UDPBindError returns the error set by SetUDPBindError for network,
+// or nil if the last bind attempt succeeded.
+func UDPBindError(network string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return udpBindErr[network]
+}
+
 func timerSelfCheck() {
 	mu.Lock()
 	defer mu.Unlock()
@@ -291,6 +315,9 @@ func overallErrorLocked() error {
 		return fmt.Errorf("haven't heard from home DERP region %v in %v", rid, d)
 	}
 	if udp4Unbound {
+		if err := udpBindErr["udp4"]; err != nil {
+			return fmt.Errorf("no udp4 bind: %w", err)
+		}
 		return errors.New("no udp4 bind")
 	}
 
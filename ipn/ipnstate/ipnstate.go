@@ -21,6 +21,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"tailscale.com/types/opt"
 	"tailscale.com/util/dnsname"
 )
 
@@ -59,6 +60,19 @@ type Status struct {
 
 	Peer map[key.Public]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
+
+	// DERPConns are the DERP connections currently held open,
+	// sorted by region ID.
+	DERPConns []DERPConnStatus `json:",omitempty"`
+}
+
+// DERPConnStatus describes an open connection to a DERP region.
+type DERPConnStatus struct {
+	RegionID   int
+	RegionCode string    `json:",omitempty"`
+	Home       bool      `json:",omitempty"` // whether this is our home DERP region
+	Created    time.Time // time the connection was created
+	LastWrite  time.Time // time of last packet sent to the region
 }
 
 func (s *Status) Peers() []key.Public {
@@ -108,6 +122,33 @@ type PeerStatus struct {
 	// change.
 	Active bool
 
+	// DiscoPingJitter is the smoothed variation in round-trip
+	// time of direct disco pings to this peer. It's only
+	// measured for peers that echo disco ping payloads.
+	DiscoPingJitter time.Duration `json:",omitempty"`
+
+	// DiscoPongsReordered is the number of direct disco pongs
+	// from this peer that arrived out of order.
+	DiscoPongsReordered int64 `json:",omitempty"`
+
+	// RecvLocalAddr is our local address on which a direct UDP
+	// packet from this peer was last received, if known.
+	RecvLocalAddr string `json:",omitempty"`
+
+	// DERPSendDrops is the number of packets to this peer dropped
+	// in the past minute or so because the DERP write queue was
+	// full.
+	DERPSendDrops int64 `json:",omitempty"`
+
+	// UDPSendErrors is the number of direct UDP sends to this
+	// peer that failed in the past minute or so.
+	UDPSendErrors int64 `json:",omitempty"`
+
+	// AsymmetricPath is whether packets are being sent to this
+	// peer over a direct path but its packets have, for several
+	// seconds, arrived only via DERP. It's usually a NAT problem.
+	AsymmetricPath bool `json:",omitempty"`
+
 	PeerAPIURL   []string
 	Capabilities []string `json:",omitempty"`
 
@@ -198,6 +239,18 @@ func (sb *StatusBuilder) AddTailscaleIP(ip netaddr.IP) {
 	sb.st.TailscaleIPs = append(sb.st.TailscaleIPs, ip)
 }
 
+// AddDERPConn adds an open DERP connection to the status.
+func (sb *StatusBuilder) AddDERPConn(dc DERPConnStatus) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: AddDERPConn after Locked")
+		return
+	}
+
+	sb.st.DERPConns = append(sb.st.DERPConns, dc)
+}
+
 // AddPeer adds a peer node to the status.
 //
 // Its PeerStatus is mixed with any previous status already added.
@@ -292,6 +345,24 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if st.Active {
 		e.Active = true
 	}
+	if v := st.DiscoPingJitter; v != 0 {
+		e.DiscoPingJitter = v
+	}
+	if v := st.DiscoPongsReordered; v != 0 {
+		e.DiscoPongsReordered = v
+	}
+	if v := st.RecvLocalAddr; v != "" {
+		e.RecvLocalAddr = v
+	}
+	if v := st.DERPSendDrops; v != 0 {
+		e.DERPSendDrops = v
+	}
+	if v := st.UDPSendErrors; v != 0 {
+		e.UDPSendErrors = v
+	}
+	if st.AsymmetricPath {
+		e.AsymmetricPath = true
+	}
 }
 
 type StatusUpdater interface {
@@ -460,6 +531,15 @@ type PingResult struct {
 	// a ping to the local node.
 	IsLocalIP bool `json:",omitempty"`
 
+	// LocalMappingVariesByDestIP and PeerMappingVariesByDestIP are
+	// whether this node's and the peer's NAT mappings vary by
+	// destination IP ("hard" NAT), per their last netcheck. They're
+	// empty if unknown. When both are true, a direct connection is
+	// unlikely and relaying via DERP is expected.
+	// They are not currently set for TSMP pings.
+	LocalMappingVariesByDestIP opt.Bool `json:",omitempty"`
+	PeerMappingVariesByDestIP  opt.Bool `json:",omitempty"`
+
 	// TODO(bradfitz): details like whether port mapping was used on either side? (Once supported)
 }
 
@@ -21,6 +21,7 @@ import (
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
@@ -81,6 +82,64 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// HostConditions optionally makes entries in Hosts conditional
+	// on the state of the local network links. An entry in Hosts
+	// whose name is in HostConditions is only authoritative while
+	// its condition holds; otherwise queries for it are forwarded
+	// as if it weren't in Hosts.
+	HostConditions map[dnsname.FQDN]LinkCondition
+	// NegativeCacheTTL, if non-zero, is how long NXDOMAIN answers
+	// for names under LocalDomains are cached, so repeated queries
+	// for a nonexistent name skip resolving it again.
+	// The cache is cleared by SetConfig.
+	NegativeCacheTTL time.Duration
+	// ChaosTXT, if non-empty, maps lowercase names to the strings
+	// to answer CHAOS-class TXT queries for them with, such as
+	// "version.bind." or "id.server.", as is conventional for
+	// asking a resolver to identify itself.
+	// If empty, CHAOS-class queries are handled like any other.
+	ChaosTXT map[dnsname.FQDN]string
+	// ChaosAllowFrom is the set of source IPs allowed to query
+	// ChaosTXT. Queries from other sources are refused.
+	ChaosAllowFrom []netaddr.IPPrefix
+}
+
+// LinkCondition is a condition on the state of the local network
+// links, as reported by the link monitor.
+// The zero value never holds.
+type LinkCondition struct {
+	// Interface, if non-empty, is the name of a network interface
+	// that must be present and up.
+	Interface string
+	// Prefix, if non-zero, is a prefix that some up interface must
+	// have an address in. It's how a condition is tied to being
+	// attached to a particular network, such as a corporate LAN.
+	Prefix netaddr.IPPrefix
+}
+
+// holds reports whether c holds in link state st.
+// If both Interface and Prefix are set, both must hold.
+func (c LinkCondition) holds(st *interfaces.State) bool {
+	if st == nil || (c.Interface == "" && c.Prefix.IsZero()) {
+		return false
+	}
+	for name, iface := range st.Interface {
+		if c.Interface != "" && name != c.Interface {
+			continue
+		}
+		if !iface.IsUp() {
+			continue
+		}
+		if c.Prefix.IsZero() {
+			return true
+		}
+		for _, pfx := range st.InterfaceIPs[name] {
+			if c.Prefix.Contains(pfx.IP()) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -185,6 +244,9 @@ type Resolver struct {
 	logf               logger.Logf
 	linkMon            *monitor.Mon     // or nil
 	saveConfigForTests func(cfg Config) // used in tests to capture resolver config
+	// linkState returns the current link state for evaluating
+	// LinkConditions. It returns nil if unknown.
+	linkState func() *interfaces.State
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
 
@@ -204,6 +266,11 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netaddr.IP
 	ipToHost     map[netaddr.IP]dnsname.FQDN
+	hostConds    map[dnsname.FQDN]LinkCondition
+	negTTL       time.Duration              // Config.NegativeCacheTTL
+	negCache     map[dnsname.FQDN]time.Time // NXDOMAIN name => expiry; nil if disabled
+	chaosTXT     map[dnsname.FQDN]string    // Config.ChaosTXT
+	chaosAllow   []netaddr.IPPrefix         // Config.ChaosAllowFrom
 }
 
 type ForwardLinkSelector interface {
@@ -214,7 +281,8 @@ type ForwardLinkSelector interface {
 }
 
 // New returns a new resolver.
-// linkMon optionally specifies a link monitor to use for socket rebinding.
+// linkMon optionally specifies a link monitor to use for socket rebinding
+// and for evaluating Config.HostConditions.
 func New(logf logger.Logf, linkMon *monitor.Mon, linkSel ForwardLinkSelector) *Resolver {
 	r := &Resolver{
 		logf:      logger.WithPrefix(logf, "dns: "),
@@ -225,6 +293,12 @@ func New(logf logger.Logf, linkMon *monitor.Mon, linkSel ForwardLinkSelector) *R
 		hostToIP:  map[dnsname.FQDN][]netaddr.IP{},
 		ipToHost:  map[netaddr.IP]dnsname.FQDN{},
 	}
+	r.linkState = func() *interfaces.State {
+		if r.linkMon == nil {
+			return nil
+		}
+		return r.linkMon.InterfaceState()
+	}
 	r.forwarder = newForwarder(r.logf, r.responses, linkMon, linkSel)
 	return r
 }
@@ -251,9 +325,60 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.hostConds = cfg.HostConditions
+	r.chaosTXT = cfg.ChaosTXT
+	r.chaosAllow = cfg.ChaosAllowFrom
+	r.negTTL = cfg.NegativeCacheTTL
+	r.negCache = nil
+	if r.negTTL > 0 {
+		r.negCache = map[dnsname.FQDN]time.Time{}
+	}
 	return nil
 }
 
+// maxNegCacheEntries is the maximum number of names in the
+// negative cache.
+const maxNegCacheEntries = 256
+
+// negCached reports whether name has an unexpired entry in the
+// negative cache.
+func (r *Resolver) negCached(name dnsname.FQDN) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exp, ok := r.negCache[name]
+	if !ok {
+		return false
+	}
+	if time.Now().After(exp) {
+		delete(r.negCache, name)
+		return false
+	}
+	return true
+}
+
+// addNegCache records in the negative cache, if enabled, that name
+// doesn't exist. If the cache is full of unexpired entries, name
+// isn't added.
+func (r *Resolver) addNegCache(name dnsname.FQDN) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.negCache == nil {
+		return
+	}
+	now := time.Now()
+	if len(r.negCache) >= maxNegCacheEntries {
+		for n, exp := range r.negCache {
+			if now.After(exp) {
+				delete(r.negCache, n)
+			}
+		}
+		if len(r.negCache) >= maxNegCacheEntries {
+			return
+		}
+	}
+	r.negCache[name] = now.Add(r.negTTL)
+}
+
 // Close shuts down the resolver and ensures poll goroutines have exited.
 // The Resolver cannot be used again after Close is called.
 func (r *Resolver) Close() {
@@ -298,11 +423,24 @@ func (r *Resolver) NextResponse() (packet []byte, to netaddr.IPPort, err error)
 	}
 }
 
+// hostAuthoritative reports whether the local hosts map entry for
+// domain should currently be used, per its LinkCondition if any.
+//
+// r.mu must not be held, as it may call the link monitor.
+func (r *Resolver) hostAuthoritative(domain dnsname.FQDN, conds map[dnsname.FQDN]LinkCondition) bool {
+	cond, ok := conds[domain]
+	if !ok {
+		return true
+	}
+	return cond.holds(r.linkState())
+}
+
 // resolveLocal returns an IP for the given domain, if domain is in
 // the local hosts map and has an IP corresponding to the requested
 // typ (A, AAAA, ALL).
 // Returns dns.RCodeRefused to indicate that the local map is not
-// authoritative for domain.
+// authoritative for domain, including when domain's entry has a
+// LinkCondition that doesn't currently hold.
 func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netaddr.IP, dns.RCode) {
 	// Reject .onion domains per RFC 7686.
 	if dnsname.HasSuffix(domain.WithoutTrailingDot(), ".onion") {
@@ -312,9 +450,14 @@ func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netaddr.IP,
 	r.mu.Lock()
 	hosts := r.hostToIP
 	localDomains := r.localDomains
+	conds := r.hostConds
 	r.mu.Unlock()
 
 	addrs, found := hosts[domain]
+	if found && !r.hostAuthoritative(domain, conds) {
+		// Shadowed on this network; let upstreams answer.
+		return netaddr.IP{}, dns.RCodeRefused
+	}
 	if !found {
 		for _, suffix := range localDomains {
 			if suffix.Contains(domain) {
@@ -392,10 +535,16 @@ func (r *Resolver) resolveLocalReverse(name dnsname.FQDN) (dnsname.FQDN, dns.RCo
 	}
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	ret, ok := r.ipToHost[ip]
+	localDomains := r.localDomains
+	conds := r.hostConds
+	r.mu.Unlock()
+
+	if ok && !r.hostAuthoritative(ret, conds) {
+		return "", dns.RCodeRefused
+	}
 	if !ok {
-		for _, suffix := range r.localDomains {
+		for _, suffix := range localDomains {
 			if suffix.Contains(name) {
 				// We are authoritative for this chunk of IP space.
 				return "", dns.RCodeNameError
@@ -410,7 +559,7 @@ func (r *Resolver) resolveLocalReverse(name dnsname.FQDN) (dnsname.FQDN, dns.RCo
 func (r *Resolver) handleQuery(pkt packet) {
 	defer atomic.AddInt32(&r.activeQueriesAtomic, -1)
 
-	out, err := r.respond(pkt.bs)
+	out, err := r.respond(pkt.bs, pkt.addr)
 	if err == errNotOurName {
 		err = r.forwarder.forward(pkt)
 		if err == nil {
@@ -438,6 +587,8 @@ type response struct {
 	Name dnsname.FQDN
 	// IP is the response to an A, AAAA, or ALL query.
 	IP netaddr.IP
+	// TXT is the response to a CHAOS-class TXT query.
+	TXT string
 }
 
 var dnsParserPool = &sync.Pool{
@@ -531,6 +682,26 @@ func marshalPTRRecord(queryName dns.Name, name dnsname.FQDN, builder *dns.Builde
 	return builder.PTRResource(answerHeader, answer)
 }
 
+// marshalTXTRecord serializes a TXT record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalTXTRecord(queryName dns.Name, class dns.Class, txt string, builder *dns.Builder) error {
+	var answer dns.TXTResource
+
+	answerHeader := dns.ResourceHeader{
+		Name:  queryName,
+		Type:  dns.TypeTXT,
+		Class: class,
+		TTL:   0, // identity answers shouldn't be cached
+	}
+	// Each character-string in a TXT record is at most 255 bytes.
+	for len(txt) > 255 {
+		answer.TXT = append(answer.TXT, txt[:255])
+		txt = txt[255:]
+	}
+	answer.TXT = append(answer.TXT, txt)
+	return builder.TXTResource(answerHeader, answer)
+}
+
 // marshalResponse serializes the DNS response into a new buffer.
 func marshalResponse(resp *response) ([]byte, error) {
 	resp.Header.Response = true
@@ -574,6 +745,10 @@ func marshalResponse(resp *response) ([]byte, error) {
 		}
 	case dns.TypePTR:
 		err = marshalPTRRecord(resp.Question.Name, resp.Name, &builder)
+	case dns.TypeTXT:
+		if resp.TXT != "" {
+			err = marshalTXTRecord(resp.Question.Name, resp.Question.Class, resp.TXT, &builder)
+		}
 	}
 	if err != nil {
 		return nil, err
@@ -708,9 +883,49 @@ func (r *Resolver) respondReverse(query []byte, name dnsname.FQDN, resp *respons
 	return marshalResponse(resp)
 }
 
-// respond returns a DNS response to query if it can be resolved locally.
-// Otherwise, it returns errNotOurName.
-func (r *Resolver) respond(query []byte) ([]byte, error) {
+// respondChaos answers a CHAOS-class query from src for name, per
+// Config.ChaosTXT. It reports false if there's no ChaosTXT config, in
+// which case the query should be handled as usual.
+//
+// Other names and types, and queries from sources not in
+// Config.ChaosAllowFrom, are refused rather than forwarded, as an
+// upstream would only identify itself, not us.
+func (r *Resolver) respondChaos(name dnsname.FQDN, src netaddr.IP, resp *response) (_ []byte, ok bool, err error) {
+	r.mu.Lock()
+	txts := r.chaosTXT
+	allow := r.chaosAllow
+	r.mu.Unlock()
+	if len(txts) == 0 {
+		return nil, false, nil
+	}
+
+	allowed := false
+	for _, pfx := range allow {
+		if pfx.Contains(src) {
+			allowed = true
+			break
+		}
+	}
+	txt, found := txts[name]
+	if !allowed || !found || txt == "" || resp.Question.Type != dns.TypeTXT {
+		resp.Header.RCode = dns.RCodeRefused
+	} else {
+		resp.TXT = txt
+	}
+	out, err := marshalResponse(resp)
+	return out, true, err
+}
+
+// respond returns a DNS response to query, from src, if it can be
+// resolved locally. Otherwise, it returns errNotOurName.
+func (r *Resolver) respond(query []byte, src netaddr.IPPort) ([]byte, error) {
+	return r.respondLocal(query, src, true)
+}
+
+// respondLocal is respond, but consults and fills the negative cache
+// only if useNegCache is true. SelfTest doesn't, so that it reports
+// how the current config answers and leaves no entries behind.
+func (r *Resolver) respondLocal(query []byte, src netaddr.IPPort, useNegCache bool) ([]byte, error) {
 	parser := dnsParserPool.Get().(*dnsParser)
 	defer dnsParserPool.Put(parser)
 
@@ -738,6 +953,12 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return marshalResponse(resp)
 	}
 
+	if parser.Question.Class == dns.ClassCHAOS {
+		if out, ok, err := r.respondChaos(name, src.IP(), parser.response()); ok {
+			return out, err
+		}
+	}
+
 	// Always try to handle reverse lookups; delegate inside when not found.
 	// This way, queries for existent nodes do not leak,
 	// but we behave gracefully if non-Tailscale nodes exist in CGNATRange.
@@ -745,13 +966,125 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
+	if useNegCache && r.negCached(name) {
+		resp := parser.response()
+		resp.Header.RCode = dns.RCodeNameError
+		return marshalResponse(resp)
+	}
+
 	ip, rcode := r.resolveLocal(name, parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
 	}
+	if rcode == dns.RCodeNameError && useNegCache {
+		r.addNegCache(name)
+	}
 
 	resp := parser.response()
 	resp.Header.RCode = rcode
 	resp.IP = ip
 	return marshalResponse(resp)
 }
+
+// SelfTestOutcome is how the Resolver handles a query in a SelfTestCase.
+type SelfTestOutcome int
+
+const (
+	// SelfTestLocalHit means the query was answered locally with
+	// success (possibly with no records, e.g. AAAA for an IPv4-only name).
+	SelfTestLocalHit SelfTestOutcome = iota + 1
+	// SelfTestNXDomain means the query was answered locally with NXDOMAIN.
+	SelfTestNXDomain
+	// SelfTestForward means the name isn't ours and the query would be
+	// forwarded upstream.
+	SelfTestForward
+)
+
+func (o SelfTestOutcome) String() string {
+	switch o {
+	case SelfTestLocalHit:
+		return "local-hit"
+	case SelfTestNXDomain:
+		return "nxdomain"
+	case SelfTestForward:
+		return "forward"
+	default:
+		return fmt.Sprintf("SelfTestOutcome(%d)", int(o))
+	}
+}
+
+// SelfTestCase is a query to run through Resolver.SelfTest, along with
+// how it's expected to be handled.
+type SelfTestCase struct {
+	Name dnsname.FQDN
+	Type dns.Type
+	Want SelfTestOutcome
+}
+
+// SelfTestResult is the result of running a SelfTestCase.
+type SelfTestResult struct {
+	Case SelfTestCase
+	// Got is how the query was handled. It is zero if Err is non-nil.
+	Got SelfTestOutcome
+	// Err is non-nil if the query couldn't be answered, or was answered
+	// with an rcode other than success or NXDOMAIN.
+	Err error
+}
+
+// OK reports whether the query was handled as expected.
+func (res SelfTestResult) OK() bool {
+	return res.Err == nil && res.Got == res.Case.Want
+}
+
+// SelfTest runs each case through the Resolver's current configuration
+// and reports how each was handled, so that a caller can check that a
+// newly applied Config behaves as intended. It does no network I/O:
+// queries that would be forwarded are reported as SelfTestForward
+// without being sent upstream.
+func (r *Resolver) SelfTest(cases []SelfTestCase) []SelfTestResult {
+	results := make([]SelfTestResult, len(cases))
+	for i, tc := range cases {
+		results[i].Case = tc
+		results[i].Got, results[i].Err = r.selfTestOne(tc)
+	}
+	return results
+}
+
+func (r *Resolver) selfTestOne(tc SelfTestCase) (SelfTestOutcome, error) {
+	name, err := dns.NewName(tc.Name.WithTrailingDot())
+	if err != nil {
+		return 0, err
+	}
+	b := dns.NewBuilder(nil, dns.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return 0, err
+	}
+	if err := b.Question(dns.Question{Name: name, Type: tc.Type, Class: dns.ClassINET}); err != nil {
+		return 0, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := r.respondLocal(query, netaddr.IPPort{}, false)
+	if err == errNotOurName {
+		return SelfTestForward, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var p dns.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return 0, fmt.Errorf("parsing response: %w", err)
+	}
+	switch h.RCode {
+	case dns.RCodeSuccess:
+		return SelfTestLocalHit, nil
+	case dns.RCodeNameError:
+		return SelfTestNXDomain, nil
+	default:
+		return 0, fmt.Errorf("unexpected rcode %v", h.RCode)
+	}
+}
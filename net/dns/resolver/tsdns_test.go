@@ -15,9 +15,11 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/util/dnsname"
@@ -351,6 +353,188 @@ func TestResolveLocal(t *testing.T) {
 	}
 }
 
+func TestSelfTest(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	r.SetConfig(dnsCfg)
+
+	cases := []SelfTestCase{
+		{"test1.ipn.dev.", dns.TypeA, SelfTestLocalHit},
+		{"test1.ipn.dev.", dns.TypeAAAA, SelfTestLocalHit},
+		{"test3.ipn.dev.", dns.TypeA, SelfTestNXDomain},
+		{"google.com.", dns.TypeA, SelfTestForward},
+		{testipv4Arpa, dns.TypePTR, SelfTestLocalHit},
+		{"google.com.", dns.TypeA, SelfTestLocalHit}, // wrong on purpose
+	}
+	results := r.SelfTest(cases)
+	if len(results) != len(cases) {
+		t.Fatalf("got %d results; want %d", len(results), len(cases))
+	}
+	for i, res := range results[:len(results)-1] {
+		if !res.OK() {
+			t.Errorf("case %d (%v %v): got %v, %v; want %v", i, res.Case.Name, res.Case.Type, res.Got, res.Err, res.Case.Want)
+		}
+	}
+	if last := results[len(results)-1]; last.OK() || last.Got != SelfTestForward {
+		t.Errorf("mismatched case: OK = %v, Got = %v; want not OK, forward", last.OK(), last.Got)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.NegativeCacheTTL = time.Minute
+	r.SetConfig(cfg)
+
+	const name = dnsname.FQDN("test3.ipn.dev.")
+	rcode := func() dns.RCode {
+		t.Helper()
+		b := dns.NewBuilder(nil, dns.Header{})
+		b.StartQuestions()
+		b.Question(dns.Question{Name: dns.MustNewName(name.WithTrailingDot()), Type: dns.TypeA, Class: dns.ClassINET})
+		q, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := r.respond(q, netaddr.IPPort{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p dns.Parser
+		h, err := p.Start(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.RCode
+	}
+
+	// Self-test queries bypass the cache.
+	nx := []SelfTestCase{{name, dns.TypeA, SelfTestNXDomain}}
+	if res := r.SelfTest(nx)[0]; !res.OK() {
+		t.Fatalf("got %v, %v; want NXDOMAIN", res.Got, res.Err)
+	}
+	if r.negCached(name) {
+		t.Fatalf("SelfTest negatively cached %v", name)
+	}
+
+	if got := rcode(); got != dns.RCodeNameError {
+		t.Fatalf("got %v; want NXDOMAIN", got)
+	}
+	if !r.negCached(name) {
+		t.Fatalf("%v not negatively cached", name)
+	}
+	if got := rcode(); got != dns.RCodeNameError {
+		t.Fatalf("cached: got %v; want NXDOMAIN", got)
+	}
+
+	// A cached NXDOMAIN doesn't affect what SelfTest reports.
+	r.mu.Lock()
+	r.hostToIP = map[dnsname.FQDN][]netaddr.IP{name: {testipv4}}
+	r.mu.Unlock()
+	if res := r.SelfTest([]SelfTestCase{{name, dns.TypeA, SelfTestLocalHit}})[0]; !res.OK() {
+		t.Errorf("with cached NXDOMAIN: got %v, %v; want local hit", res.Got, res.Err)
+	}
+	if got := rcode(); got != dns.RCodeNameError {
+		t.Errorf("with cached NXDOMAIN: got %v; want NXDOMAIN from cache", got)
+	}
+
+	r.mu.Lock()
+	r.negCache[name] = time.Now().Add(-time.Second)
+	r.mu.Unlock()
+	if r.negCached(name) {
+		t.Errorf("expired entry still cached")
+	}
+
+	// A new config clears the cache.
+	r.addNegCache(name)
+	cfg.Hosts = map[dnsname.FQDN][]netaddr.IP{name: {testipv4}}
+	r.SetConfig(cfg)
+	if res := r.SelfTest([]SelfTestCase{{name, dns.TypeA, SelfTestLocalHit}})[0]; !res.OK() {
+		t.Errorf("after SetConfig: got %v, %v; want local hit", res.Got, res.Err)
+	}
+}
+
+func TestChaosTXT(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.ChaosTXT = map[dnsname.FQDN]string{"version.bind.": "tailscale 1.2.3"}
+	cfg.ChaosAllowFrom = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.0/10")}
+	r.SetConfig(cfg)
+
+	query := func(name string, typ dns.Type) []byte {
+		b := dns.NewBuilder(nil, dns.Header{})
+		b.StartQuestions()
+		b.Question(dns.Question{Name: dns.MustNewName(name), Type: typ, Class: dns.ClassCHAOS})
+		q, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	allowed := netaddr.MustParseIPPort("100.101.102.103:53")
+	tests := []struct {
+		name     string
+		query    []byte
+		from     netaddr.IPPort
+		wantCode dns.RCode
+		wantTXT  string
+	}{
+		{"allowed", query("version.bind.", dns.TypeTXT), allowed, dns.RCodeSuccess, "tailscale 1.2.3"},
+		{"case_insensitive", query("VERSION.bind.", dns.TypeTXT), allowed, dns.RCodeSuccess, "tailscale 1.2.3"},
+		{"not_allowlisted", query("version.bind.", dns.TypeTXT), netaddr.MustParseIPPort("1.2.3.4:53"), dns.RCodeRefused, ""},
+		{"unknown_name", query("id.server.", dns.TypeTXT), allowed, dns.RCodeRefused, ""},
+		{"not_txt", query("version.bind.", dns.TypeA), allowed, dns.RCodeRefused, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := r.respond(tt.query, tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var p dns.Parser
+			h, err := p.Start(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.RCode != tt.wantCode {
+				t.Fatalf("rcode = %v; want %v", h.RCode, tt.wantCode)
+			}
+			p.SkipAllQuestions()
+			ah, err := p.AnswerHeader()
+			if tt.wantTXT == "" {
+				if err != dns.ErrSectionDone {
+					t.Errorf("got answer %v, err %v; want none", ah, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ah.Class != dns.ClassCHAOS {
+				t.Errorf("answer class = %v; want CHAOS", ah.Class)
+			}
+			txt, err := p.TXTResource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(txt.TXT, ""); got != tt.wantTXT {
+				t.Errorf("TXT = %q; want %q", got, tt.wantTXT)
+			}
+		})
+	}
+
+	// Without ChaosTXT, CHAOS queries are forwarded as before.
+	r.SetConfig(dnsCfg)
+	if _, err := r.respond(query("version.bind.", dns.TypeTXT), allowed); err != errNotOurName {
+		t.Errorf("without ChaosTXT: err = %v; want errNotOurName", err)
+	}
+}
+
 func TestResolveLocalReverse(t *testing.T) {
 	r := newResolver(t)
 	defer r.Close()
@@ -383,6 +567,92 @@ func TestResolveLocalReverse(t *testing.T) {
 	}
 }
 
+func TestResolveLocalHostConditions(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.HostConditions = map[dnsname.FQDN]LinkCondition{
+		"test1.ipn.dev.": {Prefix: netaddr.MustParseIPPrefix("10.1.0.0/16")},
+	}
+	r.SetConfig(cfg)
+
+	offLAN := &interfaces.State{
+		Interface: map[string]interfaces.Interface{
+			"eth0": {Interface: &net.Interface{Name: "eth0", Flags: net.FlagUp}},
+		},
+		InterfaceIPs: map[string][]netaddr.IPPrefix{
+			"eth0": {netaddr.MustParseIPPrefix("192.168.0.5/24")},
+		},
+	}
+	onLAN := &interfaces.State{
+		Interface: map[string]interfaces.Interface{
+			"eth0": {Interface: &net.Interface{Name: "eth0", Flags: net.FlagUp}},
+		},
+		InterfaceIPs: map[string][]netaddr.IPPrefix{
+			"eth0": {netaddr.MustParseIPPrefix("10.1.2.3/16")},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		state *interfaces.State
+		code  dns.RCode
+		rcode dns.RCode // of reverse lookup
+	}{
+		{"no-link-state", nil, dns.RCodeRefused, dns.RCodeRefused},
+		{"off-lan", offLAN, dns.RCodeRefused, dns.RCodeRefused},
+		{"on-lan", onLAN, dns.RCodeSuccess, dns.RCodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.linkState = func() *interfaces.State { return tt.state }
+			if _, code := r.resolveLocal("test1.ipn.dev.", dns.TypeA); code != tt.code {
+				t.Errorf("code = %v; want %v", code, tt.code)
+			}
+			if _, code := r.resolveLocalReverse(testipv4Arpa); code != tt.rcode {
+				t.Errorf("reverse code = %v; want %v", code, tt.rcode)
+			}
+			// Unconditional entries are unaffected.
+			if _, code := r.resolveLocal("test2.ipn.dev.", dns.TypeAAAA); code != dns.RCodeSuccess {
+				t.Errorf("unconditional code = %v; want %v", code, dns.RCodeSuccess)
+			}
+		})
+	}
+}
+
+func TestLinkConditionHolds(t *testing.T) {
+	st := &interfaces.State{
+		Interface: map[string]interfaces.Interface{
+			"eth0":  {Interface: &net.Interface{Name: "eth0", Flags: net.FlagUp}},
+			"wlan0": {Interface: &net.Interface{Name: "wlan0"}}, // down
+		},
+		InterfaceIPs: map[string][]netaddr.IPPrefix{
+			"eth0":  {netaddr.MustParseIPPrefix("10.1.2.3/16")},
+			"wlan0": {netaddr.MustParseIPPrefix("172.16.0.2/24")},
+		},
+	}
+	tests := []struct {
+		name string
+		c    LinkCondition
+		want bool
+	}{
+		{"zero", LinkCondition{}, false},
+		{"iface-up", LinkCondition{Interface: "eth0"}, true},
+		{"iface-down", LinkCondition{Interface: "wlan0"}, false},
+		{"iface-missing", LinkCondition{Interface: "eth1"}, false},
+		{"prefix", LinkCondition{Prefix: netaddr.MustParseIPPrefix("10.1.0.0/16")}, true},
+		{"prefix-on-down-iface", LinkCondition{Prefix: netaddr.MustParseIPPrefix("172.16.0.0/24")}, false},
+		{"iface-and-prefix", LinkCondition{Interface: "eth0", Prefix: netaddr.MustParseIPPrefix("10.0.0.0/8")}, true},
+		{"iface-and-other-prefix", LinkCondition{Interface: "eth0", Prefix: netaddr.MustParseIPPrefix("172.16.0.0/12")}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.c.holds(st); got != tt.want {
+			t.Errorf("%s: holds = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
 func ipv6Works() bool {
 	c, err := net.Listen("tcp", "[::1]:0")
 	if err != nil {
@@ -148,6 +148,10 @@ type Client struct {
 	// in tests to avoid probing the local LAN's router, etc.
 	SkipExternalNetwork bool
 
+	// SkipIPv6, if true, makes the client act as if no interface
+	// had IPv6: it opens no IPv6 sockets and sends no IPv6 probes.
+	SkipIPv6 bool
+
 	// UDPBindAddr, if non-empty, is the address to listen on for UDP.
 	// It defaults to ":0".
 	UDPBindAddr string
@@ -769,6 +773,9 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		c.logf("[v1] interfaces: %v", err)
 		return nil, err
 	}
+	if c.SkipIPv6 {
+		ifState.HaveV6 = false
+	}
 
 	// Create a UDP4 socket used for sending to our discovered IPv4 address.
 	rs.pc4Hair, err = netns.Listener().ListenPacket(ctx, "udp4", ":0")
@@ -47,6 +47,11 @@ type ICMP4Code uint8
 
 const (
 	ICMP4NoCode ICMP4Code = 0
+
+	// ICMP4FragmentationNeeded is the ICMP4Unreachable code
+	// meaning a packet with the DF bit set was too big for the
+	// next hop. See RFC 1191.
+	ICMP4FragmentationNeeded ICMP4Code = 4
 )
 
 // ICMP4Header is an IPv4+ICMPv4 header.
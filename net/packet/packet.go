@@ -398,6 +398,39 @@ func (q *Parsed) IsError() bool {
 	}
 }
 
+// PacketTooBigMTU reports whether q is an ICMPv4 "fragmentation
+// needed" or ICMPv6 "packet too big" message and, if so, the
+// destination of the packet that was too big (from the header the
+// message quotes) and the next-hop MTU it reports. The MTU may be
+// zero if the sender predates RFC 1191.
+//
+// Unlike IsError, it matches ICMPv6 "packet too big", so callers that
+// want it to get through the packet filter must allow it themselves.
+func (q *Parsed) PacketTooBigMTU() (dst netaddr.IP, mtu int, ok bool) {
+	switch q.IPProto {
+	case ipproto.ICMPv4:
+		// 8 bytes of ICMP header, then the quoted IPv4 header.
+		if len(q.b) < q.subofs+8+20 ||
+			ICMP4Type(q.b[q.subofs]) != ICMP4Unreachable ||
+			ICMP4Code(q.b[q.subofs+1]) != ICMP4FragmentationNeeded {
+			return netaddr.IP{}, 0, false
+		}
+		b := q.b[q.subofs+8:]
+		dst = netaddr.IPv4(b[16], b[17], b[18], b[19])
+		return dst, int(binary.BigEndian.Uint16(q.b[q.subofs+6:])), true
+	case ipproto.ICMPv6:
+		// 8 bytes of ICMP header, then the quoted IPv6 header.
+		if len(q.b) < q.subofs+8+40 || ICMP6Type(q.b[q.subofs]) != ICMP6PacketTooBig {
+			return netaddr.IP{}, 0, false
+		}
+		b := q.b[q.subofs+8:]
+		dst, _ = netaddr.FromStdIP(net.IP(b[24:40]))
+		return dst, int(binary.BigEndian.Uint32(q.b[q.subofs+4:])), true
+	default:
+		return netaddr.IP{}, 0, false
+	}
+}
+
 // IsEchoRequest reports whether q is an ICMP Echo Request.
 func (q *Parsed) IsEchoRequest() bool {
 	switch q.IPProto {
@@ -81,6 +81,13 @@ type Wrapper struct {
 	destMACAtomic  atomic.Value // of [6]byte
 	discoKey       atomic.Value // of tailcfg.DiscoKey
 
+	// pathMTUMu guards pathMTU.
+	pathMTUMu sync.Mutex
+	// pathMTU maps destinations to the smallest next-hop MTU
+	// reported for them by accepted inbound ICMP "packet too big"
+	// messages, until the report expires. See PathMTU.
+	pathMTU map[netaddr.IP]pathMTUEntry
+
 	// buffer stores the oldest unconsumed packet from tdev.
 	// It is made a static buffer in order to avoid allocations.
 	buffer [maxBufferSize]byte
@@ -93,6 +100,9 @@ type Wrapper struct {
 	// when that happens; we catch any resulting panics.
 	// This lets us avoid expensive multi-case selects.
 	bufferConsumed chan struct{}
+	// releaseBuffer is sendBufferConsumed as a func value, allocated
+	// once so ReadZeroCopy can hand it out without allocating.
+	releaseBuffer func()
 
 	// closed signals poll (by closing) when the device is closed.
 	closed chan struct{}
@@ -183,6 +193,8 @@ func wrap(logf logger.Logf, tdev tun.Device, isTAP bool) *Wrapper {
 		filterFlags: filter.LogAccepts | filter.LogDrops,
 	}
 
+	tun.releaseBuffer = tun.sendBufferConsumed
+
 	go tun.poll()
 	go tun.pumpEvents()
 	// The buffer starts out consumed.
@@ -307,6 +319,127 @@ func (t *Wrapper) MTU() (int, error) {
 	return t.tdev.MTU()
 }
 
+const (
+	// Minimum path MTUs we'll learn from ICMP, so a forged or broken
+	// "packet too big" can't shrink packets absurdly.
+	minPathMTU4 = 576
+	minPathMTU6 = 1280
+
+	// pathMTUExpiry is how long a learned path MTU is used before
+	// the device MTU is tried again, as suggested by RFC 1191.
+	pathMTUExpiry = 10 * time.Minute
+
+	// maxPathMTUEntries bounds the number of destinations with a
+	// learned path MTU.
+	maxPathMTUEntries = 1024
+)
+
+// pathMTUEntry is a path MTU learned for a destination.
+type pathMTUEntry struct {
+	mtu     int
+	expires time.Time
+}
+
+// PathMTU returns the current estimate of the path MTU for packets
+// sent into the tunnel: the smallest MTU learned for any destination
+// from ICMP "fragmentation needed" / "packet too big" messages
+// received over it in the last pathMTUExpiry, capped by the device
+// MTU. If nothing has been learned, it's the device MTU, or 0 if
+// that's unknown. See PathMTUTo for a single destination.
+//
+// Nothing in this package acts on the estimate; in particular there's
+// no TCP MSS clamping here for it to feed.
+func (t *Wrapper) PathMTU() int {
+	mtu := t.deviceMTU()
+	now := time.Now()
+	t.pathMTUMu.Lock()
+	defer t.pathMTUMu.Unlock()
+	for ip, e := range t.pathMTU {
+		if now.After(e.expires) {
+			delete(t.pathMTU, ip)
+			continue
+		}
+		if mtu == 0 || e.mtu < mtu {
+			mtu = e.mtu
+		}
+	}
+	return mtu
+}
+
+// PathMTUTo is like PathMTU, but only considers what's been learned
+// for packets sent to dst.
+func (t *Wrapper) PathMTUTo(dst netaddr.IP) int {
+	mtu := t.deviceMTU()
+	t.pathMTUMu.Lock()
+	e, ok := t.pathMTU[dst]
+	if ok && time.Now().After(e.expires) {
+		delete(t.pathMTU, dst)
+		ok = false
+	}
+	t.pathMTUMu.Unlock()
+	if ok && (mtu == 0 || e.mtu < mtu) {
+		return e.mtu
+	}
+	return mtu
+}
+
+// deviceMTU returns the MTU of t's underlying device, or 0 if it's
+// unknown.
+func (t *Wrapper) deviceMTU() int {
+	mtu, err := t.tdev.MTU()
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
+
+// notePacketTooBig lowers t's path MTU estimate for the destination
+// of a packet we sent, if p is an ICMP message reporting that the
+// packet was too big.
+//
+// It's only called for packets the filter accepted. ICMPv4
+// "fragmentation needed" is an ICMP error, which the filter always
+// lets through, but ICMPv6 "packet too big" isn't, so it's only
+// learned from peers allowed to send us ICMP.
+func (t *Wrapper) notePacketTooBig(p *packet.Parsed) {
+	dst, mtu, ok := p.PacketTooBigMTU()
+	if !ok || mtu == 0 || dst.IsZero() {
+		return
+	}
+	min := minPathMTU4
+	if p.IPVersion == 6 {
+		min = minPathMTU6
+	}
+	if mtu < min {
+		mtu = min
+	}
+
+	now := time.Now()
+	t.pathMTUMu.Lock()
+	defer t.pathMTUMu.Unlock()
+	old, ok := t.pathMTU[dst]
+	if ok && now.Before(old.expires) && old.mtu < mtu {
+		return
+	}
+	if !ok && len(t.pathMTU) >= maxPathMTUEntries {
+		for ip, e := range t.pathMTU {
+			if now.After(e.expires) {
+				delete(t.pathMTU, ip)
+			}
+		}
+		if len(t.pathMTU) >= maxPathMTUEntries {
+			return
+		}
+	}
+	if t.pathMTU == nil {
+		t.pathMTU = make(map[netaddr.IP]pathMTUEntry)
+	}
+	t.pathMTU[dst] = pathMTUEntry{mtu: mtu, expires: now.Add(pathMTUExpiry)}
+	if old.mtu != mtu {
+		t.logf("learned path MTU %d to %v from %v", mtu, dst, p.Src.IP())
+	}
+}
+
 func (t *Wrapper) Name() (string, error) {
 	return t.tdev.Name()
 }
@@ -462,18 +595,77 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 	}
 	pkt := res.data
 	n := copy(buf[offset:], pkt)
-	// t.buffer has a fixed location in memory.
-	// If the packet is not from t.buffer, then it is an injected packet.
-	// &pkt[0] can be used because empty packets do not reach t.outbound.
-	isInjectedPacket := &pkt[0] != &t.buffer[PacketStartOffset]
+	isInjectedPacket := t.isInjectedPacket(pkt)
 	if !isInjectedPacket {
 		// We are done with t.buffer. Let poll re-use it.
 		t.sendBufferConsumed()
 	}
 
+	if !t.acceptOutbound(buf[offset:offset+n], isInjectedPacket) {
+		// Wireguard considers read errors fatal; pretend nothing was read
+		return 0, nil
+	}
+	t.noteActivity()
+	return n, nil
+}
+
+// ReadZeroCopy is like Read, but rather than copying the next outbound
+// packet into a caller-provided buffer, it returns pkt referencing the
+// Wrapper's own memory. It's for embedders for which that copy matters;
+// everybody else should use Read.
+//
+// The caller owns pkt until it calls release, which it must do exactly
+// once, and must not touch pkt afterwards. Until then, no further packets
+// are read from the underlying device (injected packets still flow), so
+// release should be called promptly. On error, release is nil.
+//
+// Unlike Read, ReadZeroCopy never returns an empty packet: packets
+// dropped by the filter are released internally and it waits for the next one.
+func (t *Wrapper) ReadZeroCopy() (pkt []byte, release func(), err error) {
+	for {
+		res, ok := <-t.outbound
+		if !ok {
+			// Wrapper is closed.
+			return nil, nil, io.EOF
+		}
+		if res.err != nil {
+			return nil, nil, res.err
+		}
+		pkt = res.data
+		isInjectedPacket := t.isInjectedPacket(pkt)
+		release = noopRelease
+		if !isInjectedPacket {
+			// The memory is t.buffer; poll may only re-use it
+			// once the caller is done.
+			release = t.releaseBuffer
+		}
+		if !t.acceptOutbound(pkt, isInjectedPacket) {
+			release()
+			continue
+		}
+		t.noteActivity()
+		return pkt, release, nil
+	}
+}
+
+func noopRelease() {}
+
+// isInjectedPacket reports whether pkt, read from t.outbound, was injected
+// rather than read from the device into t.buffer.
+func (t *Wrapper) isInjectedPacket(pkt []byte) bool {
+	// t.buffer has a fixed location in memory.
+	// If the packet is not from t.buffer, then it is an injected packet.
+	// &pkt[0] can be used because empty packets do not reach t.outbound.
+	return &pkt[0] != &t.buffer[PacketStartOffset]
+}
+
+// acceptOutbound runs the per-packet activity funcs and, for packets read
+// from the device, the outbound filter on pkt. It reports whether pkt
+// should be sent.
+func (t *Wrapper) acceptOutbound(pkt []byte, isInjectedPacket bool) bool {
 	p := parsedPacketPool.Get().(*packet.Parsed)
 	defer parsedPacketPool.Put(p)
-	p.Decode(buf[offset : offset+n])
+	p.Decode(pkt)
 
 	if m, ok := t.destIPActivity.Load().(map[netaddr.IP]func()); ok {
 		if fn := m[p.Dst.IP()]; fn != nil {
@@ -483,15 +675,11 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 
 	// Do not filter injected packets.
 	if !isInjectedPacket && !t.disableFilter {
-		response := t.filterOut(p)
-		if response != filter.Accept {
-			// Wireguard considers read errors fatal; pretend nothing was read
-			return 0, nil
+		if t.filterOut(p) != filter.Accept {
+			return false
 		}
 	}
-
-	t.noteActivity()
-	return n, nil
+	return true
 }
 
 func (t *Wrapper) filterIn(buf []byte) filter.Response {
@@ -579,6 +767,12 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		}
 	}
 
+	// An accepted ICMP "packet too big" refers to a packet we sent
+	// into the tunnel, so learn from it.
+	if p.IPProto == ipproto.ICMPv4 || p.IPProto == ipproto.ICMPv6 {
+		t.notePacketTooBig(p)
+	}
+
 	return filter.Accept
 }
 
@@ -8,9 +8,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	"golang.zx2c4.com/wireguard/tun/tuntest"
@@ -228,6 +230,47 @@ func TestReadAndInject(t *testing.T) {
 	}
 }
 
+func TestReadZeroCopy(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, false)
+	defer tun.Close()
+
+	written := []string{"w0", "w1"}
+	go func() {
+		for _, packet := range written {
+			chtun.Outbound <- []byte(packet)
+		}
+	}()
+	go func() {
+		if err := tun.InjectOutbound([]byte("i0")); err != nil {
+			t.Errorf("InjectOutbound: %v", err)
+		}
+	}()
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(written)+1; i++ {
+		pkt, release, err := tun.ReadZeroCopy()
+		if err != nil {
+			t.Fatalf("read %d: error: %v", i, err)
+		}
+		got := string(pkt)
+		if injected := tun.isInjectedPacket(pkt); injected != strings.HasPrefix(got, "i") {
+			t.Errorf("read %d: %s: isInjectedPacket = %v", i, got, injected)
+		}
+		seen[got] = true
+		release()
+	}
+	for _, packet := range append(written, "i0") {
+		if !seen[packet] {
+			t.Errorf("%s not received", packet)
+		}
+	}
+
+	tun.Close()
+	if _, _, err := tun.ReadZeroCopy(); err != io.EOF {
+		t.Errorf("read after close: err = %v; want EOF", err)
+	}
+}
+
 func TestWriteAndInject(t *testing.T) {
 	chtun, tun := newChannelTUN(t.Logf, false)
 	defer tun.Close()
@@ -518,3 +561,73 @@ func TestFilterDiscoLoop(t *testing.T) {
 		t.Errorf("log output mismatch\n got: %q\nwant: %q\n", got, want)
 	}
 }
+
+func TestPathMTU(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, false)
+	defer tun.Close()
+	tun.SetFilter(filter.NewAllowAllForTest(t.Logf))
+
+	dst1 := netaddr.IPv4(100, 64, 0, 2)
+	dst2 := netaddr.IPv4(100, 64, 0, 3)
+	if got := tun.PathMTUTo(dst1); got != 1500 {
+		t.Fatalf("initial PathMTUTo = %d; want 1500", got)
+	}
+	tooBig := func(dst netaddr.IP, mtu uint16) []byte {
+		h := packet.ICMP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netaddr.IPv4(100, 64, 0, 9),
+				Dst: netaddr.IPv4(100, 64, 0, 1),
+			},
+			Type: packet.ICMP4Unreachable,
+			Code: packet.ICMP4FragmentationNeeded,
+		}
+		quoted := packet.Generate(packet.IP4Header{
+			IPProto: ipproto.UDP,
+			Src:     netaddr.IPv4(100, 64, 0, 1),
+			Dst:     dst,
+		}, nil)
+		rest := make([]byte, 4, 4+len(quoted))
+		binary.BigEndian.PutUint16(rest[2:], mtu)
+		return packet.Generate(h, append(rest, quoted...))
+	}
+	for _, tt := range []struct {
+		mtu  uint16
+		want int
+	}{
+		{1400, 1400},
+		{1450, 1400}, // only ever lowered
+		{100, minPathMTU4},
+	} {
+		if res := tun.filterIn(tooBig(dst1, tt.mtu)); res != filter.Accept {
+			t.Fatalf("filterIn = %v; want Accept", res)
+		}
+		if got := tun.PathMTUTo(dst1); got != tt.want {
+			t.Errorf("after ICMP with MTU %d: PathMTUTo = %d; want %d", tt.mtu, got, tt.want)
+		}
+	}
+	if got := tun.PathMTUTo(dst2); got != 1500 {
+		t.Errorf("PathMTUTo of other destination = %d; want 1500", got)
+	}
+	if got := tun.PathMTU(); got != minPathMTU4 {
+		t.Errorf("PathMTU = %d; want %d", got, minPathMTU4)
+	}
+
+	tun.pathMTUMu.Lock()
+	e := tun.pathMTU[dst1]
+	e.expires = time.Now().Add(-time.Second)
+	tun.pathMTU[dst1] = e
+	tun.pathMTUMu.Unlock()
+	if got := tun.PathMTUTo(dst1); got != 1500 {
+		t.Errorf("PathMTUTo after expiry = %d; want 1500", got)
+	}
+	if got := tun.PathMTU(); got != 1500 {
+		t.Errorf("PathMTU after expiry = %d; want 1500", got)
+	}
+
+	// Packets the filter drops aren't learned from.
+	tun.SetFilter(filter.NewAllowNone(logger.Discard, new(netaddr.IPSet)))
+	tun.filterIn(tooBig(dst2, 1300))
+	if got := tun.PathMTUTo(dst2); got != 1500 {
+		t.Errorf("PathMTUTo after filtered ICMP = %d; want 1500", got)
+	}
+}
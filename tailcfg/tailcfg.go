@@ -1223,6 +1223,19 @@ type Oauth2Token struct {
 const (
 	CapabilityFileSharing = "https://tailscale.com/cap/file-sharing"
 	CapabilityAdmin       = "https://tailscale.com/cap/is-admin"
+
+	// CapabilityDiscoPingPayload means the node echoes back the
+	// optional disco.Ping payload in its disco.Pong. Control is
+	// expected to list it in the Capabilities of peers that do;
+	// until it does, no node sends ping payloads, and the pong
+	// reordering and jitter stats they feed stay zero.
+	CapabilityDiscoPingPayload = "https://tailscale.com/cap/disco-ping-payload"
+
+	// CapabilityDiscoCallMeMaybeTTL means the node parses the
+	// optional disco.CallMeMaybe TTL. Control is expected to list
+	// it in the Capabilities of peers that do; until it does, no
+	// node sends the TTL and call-me-maybe endpoints never expire.
+	CapabilityDiscoCallMeMaybeTTL = "https://tailscale.com/cap/disco-call-me-maybe-ttl"
 )
 
 // SetDNSRequest is a request to add a DNS record.
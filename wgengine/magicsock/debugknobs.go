@@ -34,6 +34,10 @@ var (
 	// on mobile devices, lowers the shutdown interval, and logs more
 	// verbosely about idle measurements.
 	debugReSTUNStopOnIdle, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_RESTUN_STOP_ON_IDLE"))
+	// debugDiscoPingCaps sends disco pings as version 1, carrying a
+	// disco.PingCaps byte for negotiating optional features. It's
+	// experimental until there are features to negotiate.
+	debugDiscoPingCaps, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DISCO_PING_CAPS"))
 	// debugAlwaysDERP disables the use of UDP, forcing all peer communication over DERP.
 	debugAlwaysDERP, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_ALWAYS_USE_DERP"))
 )
@@ -13,6 +13,7 @@ const (
 	debugUseDerpRoute       = false
 	logDerpVerbose          = false
 	debugReSTUNStopOnIdle   = false
+	debugDiscoPingCaps      = false
 	debugAlwaysDERP         = false
 )
 
@@ -0,0 +1,19 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package magicsock
+
+import "net"
+
+// dscpSupported is whether Options.DSCP is honored. Elsewhere,
+// notably Windows, marking needs OS QoS policy rather than a socket
+// option.
+const dscpSupported = false
+
+func setDSCP(pconn net.PacketConn, network string, dscp uint8) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package magicsock
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// dscpSupported is whether Options.DSCP is honored.
+const dscpSupported = true
+
+// setDSCP sets the DSCP of packets sent on pconn, a "udp4" or "udp6"
+// network socket, via IP_TOS or IPV6_TCLASS. The ECN bits are left
+// zero.
+func setDSCP(pconn net.PacketConn, network string, dscp uint8) error {
+	tos := int(dscp) << 2
+	if network == "udp4" {
+		return ipv4.NewPacketConn(pconn).SetTOS(tos)
+	}
+	return ipv6.NewPacketConn(pconn).SetTrafficClass(tos)
+}
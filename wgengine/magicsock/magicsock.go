@@ -8,10 +8,12 @@ package magicsock
 
 import (
 	"bufio"
+	"container/list"
 	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
 	"hash/fnv"
 	"math"
@@ -24,9 +26,13 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/time/rate"
 	"golang.zx2c4.com/wireguard/conn"
 	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
@@ -36,6 +42,7 @@ import (
 	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/metrics"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netcheck"
@@ -50,6 +57,7 @@ import (
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
+	"tailscale.com/types/opt"
 	"tailscale.com/types/wgkey"
 	"tailscale.com/util/uniq"
 	"tailscale.com/version"
@@ -89,6 +97,11 @@ func newPeerInfo() *peerInfo {
 // peerMap is an index of peerInfos by node (WireGuard) key, disco
 // key, and discovered ip:port endpoints.
 //
+// The ip:port keys include the IPv6 zone, as netaddr.IP compares
+// zones, so peers reachable at the same link-local address on
+// different interfaces don't alias each other. Callers must not
+// strip zones from addresses before lookups.
+//
 // Doesn't do any locking, all access must be done with Conn.mu held.
 type peerMap struct {
 	byDiscoKey map[tailcfg.DiscoKey]*peerInfo
@@ -189,6 +202,7 @@ func (m *peerMap) deleteDiscoEndpoint(ep *endpoint) {
 		return
 	}
 	ep.stopAndReset()
+	ep.releaseStableFakeUDPAddr()
 	pi := m.byNodeKey[ep.publicKey]
 	delete(m.byDiscoKey, ep.discoKey)
 	delete(m.byNodeKey, ep.publicKey)
@@ -205,15 +219,69 @@ func (m *peerMap) deleteDiscoEndpoint(ep *endpoint) {
 // A Conn routes UDP packets and actively manages a list of its endpoints.
 // It implements wireguard/conn.Bind.
 type Conn struct {
+	// These counters are accessed atomically; declared first for
+	// alignment reasons.
+
+	// eventsDropped counts ConnEvents dropped because the
+	// consumer of events wasn't keeping up.
+	eventsDropped expvar.Int
+
+	// derpSendQueueFull counts DERP packets dropped because the
+	// region's write queue was full. See DERPSendQueueFull.
+	derpSendQueueFull expvar.Int
+
+	// stats counts the packets and bytes c sends and receives.
+	// See Stats.
+	stats connStats
+
 	// This block mirrors the contents and field order of the Options
 	// struct. Initialized once at construction, then constant.
 
-	logf                   logger.Logf
-	epFunc                 func([]tailcfg.Endpoint)
-	derpActiveFunc         func()
-	idleFunc               func() time.Duration // nil means unknown
-	testOnlyPacketListener nettype.PacketListener
-	noteRecvActivity       func(tailcfg.NodeKey) // or nil, see Options.NoteRecvActivity
+	logf                 logger.Logf
+	epFunc               func([]tailcfg.Endpoint)
+	derpActiveFunc       func()
+	firstDirectPathFunc  func()
+	idleFunc             func() time.Duration // nil means unknown
+	packetListener       nettype.PacketListener
+	noteRecvActivity     func(tailcfg.NodeKey) // or nil, see Options.NoteRecvActivity
+	pongHistoryCount     int                   // always positive, see Options.PongHistoryCount
+	maxActiveDERPConns   int                   // 0 means unlimited, see Options.MaxActiveDERPConns
+	maxPingCandidates    int                   // 0 means unlimited, see Options.MaxPingCandidates
+	derpWriteQueueDepth  int                   // always positive, see Options.DERPWriteQueueDepth
+	trustUDPAddrDuration time.Duration         // always positive, see Options.Timeouts
+	heartbeatInterval    time.Duration         // always positive, see Options.Timeouts
+	upgradeInterval      time.Duration         // always positive, see Options.Timeouts
+	bindAddr             netaddr.IP            // zero means the wildcard, see Options.BindAddr
+	numSockets           int                   // always positive, see Options.NumSockets
+	reSTUNInterval       time.Duration         // always positive, see Options.ReSTUNInterval
+	stunIdleTimeout      time.Duration         // always positive, see Options.STUNIdleTimeout
+	disableIPv6          bool                  // see Options.DisableIPv6
+	dscp                 uint8                 // 0 means unmarked, see Options.DSCP
+	stableFakeUDPAddrs   bool                  // see Options.StableFakeUDPAddrs
+	recordRecvLocalAddrs bool                  // see Options.RecordRecvLocalAddrs
+	raceFirstSend        bool                  // see Options.RaceFirstSend
+	disableDERPRoute     bool                  // see Options.DisableDERPRoute
+
+	// addrFamilyPref is Options.AddressFamilyPreference.
+	addrFamilyPref AddressFamilyPreference
+
+	// advertisedExternalPort is Options.AdvertisedExternalPort.
+	advertisedExternalPort uint16
+
+	// pathChangeFunc is Options.PathChangeFunc, or nil.
+	pathChangeFunc func(tailcfg.NodeKey, PathKind)
+
+	// derpHealthFunc is Options.DERPHealthFunc, or nil.
+	derpHealthFunc func(regionID int, problem string)
+
+	// networkChangeFunc is Options.NetworkChangeFunc, or nil.
+	networkChangeFunc func(NetworkChangeEvent)
+
+	// endpointFilter is Options.EndpointFilter, or nil.
+	endpointFilter func(netaddr.IPPort) bool
+
+	// endpointPriorityFunc is Options.EndpointPriorityFunc, or nil.
+	endpointPriorityFunc func([]tailcfg.Endpoint) []tailcfg.Endpoint
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -224,12 +292,26 @@ type Conn struct {
 	connCtxCancel func()          // closes connCtx
 	donec         <-chan struct{} // connCtx.Done()'s to avoid context.cancelCtx.Done()'s mutex per call
 
+	// events is the buffered channel returned by Events.
+	events chan ConnEvent
+
+	// callMeMaybeLimiter paces outbound CallMeMaybe messages
+	// across all peers. See sendCallMeMaybe.
+	callMeMaybeLimiter *rate.Limiter
+
 	// pconn4 and pconn6 are the underlying UDP sockets used to
 	// send/receive packets for wireguard and other magicsock
 	// protocols.
 	pconn4 *RebindingUDPConn
 	pconn6 *RebindingUDPConn
 
+	// extraPconns4 and extraPconns6 are the additional
+	// receive-only sockets used when Options.NumSockets is more
+	// than one. They share pconn4's and pconn6's ports via
+	// SO_REUSEPORT and are rebound with them by bindSocket.
+	// Their lengths are fixed at construction.
+	extraPconns4, extraPconns6 []*RebindingUDPConn
+
 	// netChecker is the prober that discovers local network
 	// conditions, including the closest DERP relay and NAT mappings.
 	netChecker *netcheck.Client
@@ -238,6 +320,11 @@ type Conn struct {
 	// port mappings from NAT devices.
 	portMapper *portmapper.Client
 
+	// unregisterLinkChange, if non-nil, unregisters the
+	// Options.LinkMonitor callback that refreshes localPrefixes and
+	// reports NetworkChangeLink.
+	unregisterLinkChange func()
+
 	// stunReceiveFunc holds the current STUN packet processing func.
 	// Its Loaded value is always non-nil.
 	stunReceiveFunc atomic.Value // of func(p []byte, fromAddr *net.UDPAddr)
@@ -248,10 +335,11 @@ type Conn struct {
 	// bind is the wireguard-go conn.Bind for Conn.
 	bind *connBind
 
-	// ippEndpoint4 and ippEndpoint6 are owned by receiveIPv4 and
-	// receiveIPv6, respectively, to cache an IPPort->endpoint for
-	// hot flows.
-	ippEndpoint4, ippEndpoint6 ippEndpointCache
+	// receiveIPv4 and receiveIPv6 are the wireguard-go receive funcs
+	// for pconn4 and pconn6, from mkReceiveFunc. receiveIPv4 is set by
+	// initialBind; receiveIPv6 is set once pconn6 is first bound,
+	// which may not be until a Rebind.
+	receiveIPv4, receiveIPv6 conn.ReceiveFunc
 
 	// ============================================================
 	// Fields that must be accessed via atomic load/stores.
@@ -274,6 +362,23 @@ type Conn struct {
 	// port is the preferred port from opts.Port; 0 means auto.
 	port syncs.AtomicUint32
 
+	// eventsWanted is whether Events has been called. Until it
+	// has, no ConnEvents are queued.
+	eventsWanted syncs.AtomicBool
+
+	// noAdvertiseEndpoints is whether direct endpoints are
+	// withheld from peers. See SetAdvertiseEndpoints.
+	noAdvertiseEndpoints syncs.AtomicBool
+
+	// lowPower is whether to save power while idle. See SetLowPower.
+	lowPower syncs.AtomicBool
+
+	// localPrefixes are the subnets of our local interface
+	// addresses, as of NewConn, the last Rebind or the last
+	// Options.LinkMonitor change. Peer endpoints within them are
+	// presumed to be on our LAN. See onLocalSubnet.
+	localPrefixes atomic.Value // of []netaddr.IPPrefix
+
 	// ============================================================
 	// mu guards all following fields; see userspaceEngine lock ordering rules
 	mu     sync.Mutex
@@ -322,6 +427,19 @@ type Conn struct {
 	// in other maps below that are keyed by peer public key.
 	peerSet map[key.Public]struct{}
 
+	// peerKeepAlive holds per-peer overrides of sessionActiveTimeout,
+	// as set by SetPeerKeepAlive. Entries outlive the peer's endpoint.
+	peerKeepAlive map[tailcfg.NodeKey]time.Duration
+
+	// peerForceDERP holds the peers whose traffic is pinned to
+	// DERP, as set by SetForceDERP. Entries outlive the peer's
+	// endpoint.
+	peerForceDERP map[tailcfg.NodeKey]bool
+
+	// endpointUpdates is the channel returned by EndpointUpdates,
+	// or nil if it hasn't been called. Close closes it.
+	endpointUpdates chan []tailcfg.Endpoint
+
 	// discoPrivate is the private naclbox key used for active
 	// discovery traffic. It's created once near (but not during)
 	// construction.
@@ -333,7 +451,12 @@ type Conn struct {
 	peerMap peerMap
 	// sharedDiscoKey is the precomputed nacl/box key for
 	// communication with the peer that has the given DiscoKey.
-	sharedDiscoKey map[tailcfg.DiscoKey]*[32]byte
+	// Entries unused for sharedDiscoKeyIdleTimeout are evicted;
+	// see sharedDiscoKeyLocked.
+	sharedDiscoKey map[tailcfg.DiscoKey]*list.Element // of *sharedDiscoKey in sharedDiscoKeyLRU
+	// sharedDiscoKeyLRU holds the sharedDiscoKey entries, most
+	// recently used first.
+	sharedDiscoKeyLRU list.List
 
 	// netInfoFunc is a callback that provides a tailcfg.NetInfo when
 	// discovered network conditions change.
@@ -350,6 +473,15 @@ type Conn struct {
 	// magicsock could do with any complexity reduction it can get.
 	netInfoLast *tailcfg.NetInfo
 
+	// lastNetCheckReport is the most recent netcheck report, or nil
+	// if none has completed yet. See LastNetcheckReport.
+	lastNetCheckReport *netcheck.Report
+
+	// forcedPreferredDERP, if non-zero, is the home DERP region
+	// updateNetInfo uses instead of running netcheck.
+	// See SetForcedPreferredDERP.
+	forcedPreferredDERP int
+
 	derpMap     *tailcfg.DERPMap // nil (or zero regions/nodes) means DERP is disabled
 	netMap      *netmap.NetworkMap
 	privateKey  key.Private        // WireGuard private key for this node
@@ -359,6 +491,31 @@ type Conn struct {
 	activeDerp  map[int]activeDerp // DERP regionID -> connection to a node in that region
 	prevDerp    map[int]*syncs.WaitGroupChan
 
+	// prevHomeDerp, if non-zero, is the DERP region that was home
+	// before the last home change. Until prevHomeDerpUntil its
+	// connection is treated as a second home: it's kept open and
+	// marked preferred, as peers keep sending to it until they
+	// learn our new home. See noteDERPHomeChangeLocked.
+	prevHomeDerp      int
+	prevHomeDerpUntil time.Time
+
+	// discoSendErrLogs rate limits the logging of failed disco
+	// sends per destination. See logDiscoSendErr.
+	discoSendErrLogs map[netaddr.IPPort]*discoSendErrLog
+
+	// discoRecvErrLogs rate limits the logging of disco messages
+	// that couldn't be opened or parsed, per sender disco key.
+	// See logDiscoRecvErrLocked.
+	discoRecvErrLogs map[tailcfg.DiscoKey]*discoRecvErrLog
+
+	// haveDirectPath is whether any peer has had a direct UDP
+	// bestAddr, for firstDirectPathFunc.
+	haveDirectPath bool
+
+	// derpRegionLatency is the moving average of disco ping round
+	// trips via each DERP region. See noteDERPLatencyLocked.
+	derpRegionLatency map[int]time.Duration
+
 	// derpRoute contains optional alternate routes to use as an
 	// optimization instead of contacting a peer via their home
 	// DERP connection.  If they sent us a message on a different
@@ -382,6 +539,12 @@ type derpRoute struct {
 	dc     *derphttp.Client // don't use directly; see comment above
 }
 
+// derpRouteEnabled reports whether c uses the DERP return path
+// optimization: useDerpRoute, unless Options.DisableDERPRoute was set.
+func (c *Conn) derpRouteEnabled() bool {
+	return !c.disableDERPRoute && useDerpRoute()
+}
+
 // removeDerpPeerRoute removes a DERP route entry previously added by addDerpPeerRoute.
 func (c *Conn) removeDerpPeerRoute(peer key.Public, derpID int, dc *derphttp.Client) {
 	c.mu.Lock()
@@ -444,12 +607,29 @@ type Options struct {
 	// a connection is made to a DERP server.
 	DERPActiveFunc func()
 
+	// FirstDirectPathFunc optionally provides a func to be called,
+	// once per Conn, when a direct UDP path to a peer is first
+	// chosen over DERP. It's run in its own goroutine.
+	FirstDirectPathFunc func()
+
 	// IdleFunc optionally provides a func to return how long
 	// it's been since a TUN packet was sent or received.
 	IdleFunc func() time.Duration
 
-	// TestOnlyPacketListener optionally specifies how to create PacketConns.
-	// Only used by tests.
+	// PacketListener optionally specifies how to create Conn's UDP
+	// sockets, for embedders that run magicsock over a custom
+	// network stack, such as a userspace one or another network
+	// namespace. If nil, sockets are made with netns.Listener.
+	// A PacketListener is responsible for honoring netns itself,
+	// and, with NumSockets above 1, for letting several sockets
+	// bind the same port: Conn doesn't set SO_REUSEPORT on them.
+	// Conn still applies Options.DSCP and RecordRecvLocalAddrs to
+	// the sockets it returns, on a best-effort basis.
+	PacketListener nettype.PacketListener
+
+	// TestOnlyPacketListener is like PacketListener, which takes
+	// precedence over it. It predates PacketListener and remains
+	// for tests.
 	TestOnlyPacketListener nettype.PacketListener
 
 	// NoteRecvActivity, if provided, is a func for magicsock to call
@@ -464,9 +644,235 @@ type Options struct {
 	// not hold Conn.mu while calling it.
 	NoteRecvActivity func(tailcfg.NodeKey)
 
+	// PathChangeFunc, if provided, is called when the path used to
+	// send to a peer switches between direct UDP and DERP,
+	// including when a direct path stops being trusted and sends
+	// fall back to DERP. Consecutive identical states are reported
+	// only once. It's called without magicsock's internal locks
+	// held, but on the packet send and receive paths, so it should
+	// return quickly.
+	PathChangeFunc func(peer tailcfg.NodeKey, newPath PathKind)
+
+	// DERPHealthFunc, if provided, is called when the health of
+	// the connection to a DERP region changes: problem is the
+	// server's own description when it reports one, such as for
+	// maintenance or overload, "connection lost" when the
+	// connection drops, and empty once it's healthy again or
+	// closed. Consecutive identical states are reported only once.
+	// It's called from the region's reader goroutine, which it
+	// must not block for long.
+	DERPHealthFunc func(regionID int, problem string)
+
+	// NetworkChangeFunc, if provided, is called when magicsock
+	// learns the network situation changed and connectivity should
+	// be re-evaluated: the network going up or down (SetNetworkUp),
+	// a major link change reported by LinkMonitor, or the sockets
+	// being rebound. It's called without magicsock's internal locks
+	// held, from the goroutine that noticed the change, which it
+	// must not block for long.
+	NetworkChangeFunc func(NetworkChangeEvent)
+
+	// EndpointFilter, if provided, is consulted for each of this
+	// node's endpoints before they're advertised and each of a
+	// peer's candidate endpoints before it's pinged, whether from
+	// the network map, a call-me-maybe, AddEndpointHint, or an
+	// incoming ping.
+	// Endpoints it returns false for are neither advertised nor
+	// pinged, and pings from them are dropped unanswered, so no
+	// direct path is made via them, for deployments that must not
+	// connect directly to some ranges.
+	// It's called with magicsock's internal locks held, so it must
+	// not block or call back into Conn.
+	EndpointFilter func(netaddr.IPPort) bool
+
+	// EndpointPriorityFunc, if provided, reorders this node's
+	// endpoints before they're advertised, for example to put
+	// local addresses ahead of carrier-grade NAT STUN ones. It's
+	// given endpoints in magicsock's default order (see
+	// determineEndpoints), which it may modify, and returns them
+	// in the order to advertise. Clients since 0.100 don't depend
+	// on the order, but legacy WireGuard peers use only the first
+	// endpoint, so putting an endpoint that isn't globally
+	// reachable first can break connectivity to them.
+	// Any endpoints it adds are still subject to EndpointFilter,
+	// and none are advertised while SetAdvertiseEndpoints is false.
+	EndpointPriorityFunc func([]tailcfg.Endpoint) []tailcfg.Endpoint
+
 	// LinkMonitor is the link monitor to use.
 	// With one, the portmapper won't be used.
 	LinkMonitor *monitor.Mon
+
+	// PongHistoryCount optionally specifies how many recent pong
+	// replies to remember per candidate endpoint of each peer.
+	// Zero means the default of 64.
+	// Each peer keeps this history for each of its candidate
+	// endpoints, so on nodes with thousands of peers, a smaller
+	// value can save a meaningful amount of memory, at the cost of
+	// a shorter window of latency history per path.
+	PongHistoryCount int
+
+	// MaxActiveDERPConns optionally limits how many DERP
+	// connections may be open at once. When a new one is needed
+	// and the limit is reached, the least recently written
+	// non-home connection is closed first. Home connections (two,
+	// briefly, after a home region change) are never closed for
+	// this, and one non-home connection is always permitted
+	// alongside them, so all limits at or below the number of home
+	// connections behave like a limit of one more than it.
+	// Zero means no limit.
+	MaxActiveDERPConns int
+
+	// MaxPingCandidates optionally limits how many of a peer's
+	// candidate endpoints are pinged in each round of path
+	// discovery, for hosts whose peers advertise many addresses.
+	// The current best path and endpoints that recently answered
+	// are pinged first, then those from the network map or
+	// call-me-maybe messages, then those only discovered from
+	// incoming pings. Zero means no limit.
+	MaxPingCandidates int
+
+	// DERPWriteQueueDepth optionally specifies how many packets
+	// may be queued per DERP connection waiting to be written
+	// before further packets are dropped. Zero means the default
+	// of 32; negative values are an error.
+	// A deeper queue absorbs bigger bursts on busy relayed links,
+	// but each queued packet holds a copy of up to a full
+	// WireGuard packet, so it costs memory per DERP connection
+	// and adds latency when the connection can't keep up.
+	DERPWriteQueueDepth int
+
+	// Timeouts optionally overrides the timing of direct path
+	// maintenance. Zero fields keep the defaults.
+	Timeouts Timeouts
+
+	// BindAddr optionally specifies the local IP address to bind
+	// the UDP socket of its address family to, instead of the
+	// wildcard address, for multi-homed hosts with policy routing.
+	// It's kept across rebinds, and only it is advertised as a
+	// local endpoint. The socket of the other family stays bound
+	// to the wildcard address.
+	BindAddr netaddr.IP
+
+	// AdvertisedExternalPort optionally specifies a port that the
+	// router forwards to this node's UDP port, for setups with a
+	// manual port forward to a different external port. When set,
+	// it's advertised on the STUN-discovered public IPv4 address
+	// as a tailcfg.EndpointSTUN4LocalPort endpoint, whatever the
+	// NAT's behavior.
+	AdvertisedExternalPort uint16
+
+	// NumSockets optionally specifies how many UDP sockets per
+	// address family receive packets. With more than one, they
+	// share a port using SO_REUSEPORT, the kernel spreads peers
+	// across them, and wireguard-go reads each from its own
+	// goroutine, so a single read loop isn't the bottleneck at
+	// high packet rates on many-core machines. Sends always use
+	// the first socket. Zero means one. It's only honored on
+	// Linux and is capped at maxNumSockets.
+	NumSockets int
+
+	// ReSTUNInterval optionally specifies the longest time between
+	// the periodic STUN requests that keep this node's NAT mappings
+	// alive and its endpoints current while it's active. Each one is
+	// scheduled at a random point in the final 3/13ths of the
+	// interval (see periodicReSTUNDelay). Zero means 26 seconds, so
+	// re-STUNs come every 20 to 26 seconds, under the 30 second
+	// UDP mapping timeout common on Linux NATs; networks that expire
+	// mappings sooner need a shorter interval. It must be less than
+	// the 2 minute session active timeout, and values under
+	// minReSTUNInterval are raised to it.
+	ReSTUNInterval time.Duration
+
+	// STUNIdleTimeout optionally specifies how long, per IdleFunc,
+	// this node may go without sending or receiving TUN packets
+	// before the periodic STUN requests stop, for embedders that
+	// keep NAT mappings alive on their own cadence. A peer's
+	// SetPeerKeepAlive override extends it, and control can keep
+	// STUN going regardless. Zero means 2 minutes, the session
+	// active timeout; negative values are an error.
+	STUNIdleTimeout time.Duration
+
+	// DisableIPv6, if true, turns off IPv6 in Conn, for hosts whose
+	// IPv6 stack is broken. No IPv6 socket is opened, netcheck
+	// doesn't probe over IPv6, no IPv6 endpoints are advertised,
+	// and packets to peers' IPv6 endpoints are dropped.
+	DisableIPv6 bool
+
+	// DSCP optionally specifies the Differentiated Services Code
+	// Point, 0 through 63, to mark outgoing direct UDP packets
+	// with, for networks that prioritize traffic by it. It's set
+	// with IP_TOS and IPV6_TCLASS on each socket as it's bound,
+	// so it survives rebinds. Zero leaves packets unmarked.
+	// Packets relayed via DERP don't carry the marking end to end,
+	// as they're sent over TCP to the DERP server. It's only
+	// honored on Unix-like systems.
+	DSCP uint8
+
+	// StableFakeUDPAddrs, if true, derives the fake UDP address
+	// each peer is given in wireguard-go from its node key rather
+	// than from process state, so the address a peer appears as in
+	// logs is the same across restarts. See initStableFakeUDPAddr.
+	StableFakeUDPAddrs bool
+
+	// RecordRecvLocalAddrs, if true, asks the kernel for the local
+	// address that each UDP packet was received on (IP_PKTINFO or
+	// equivalent), and reports the most recent per peer in
+	// ipnstate.PeerStatus.RecvLocalAddr. It shows which of a
+	// multi-homed machine's addresses a peer is reaching it on.
+	// Where unsupported, it does nothing.
+	RecordRecvLocalAddrs bool
+
+	// RaceFirstSend, if true, sends the first packet to a peer with
+	// no direct path yet not just via DERP, but also to its two
+	// most promising candidate endpoints, so that if one works,
+	// the session's first packet arrives directly without waiting
+	// for discovery. The peer's WireGuard replay protection drops
+	// whichever copies arrive second.
+	RaceFirstSend bool
+
+	// DisableDERPRoute, if true, turns off the DERP return path
+	// optimization (Issue 150) for this Conn, regardless of the
+	// control flag and TS_DEBUG_ENABLE_DERP_ROUTE: packets to a
+	// peer are always sent via its home DERP region, never via
+	// the region it was last heard from. See useDerpRoute.
+	DisableDERPRoute bool
+
+	// AddressFamilyPreference is which IP family to favor when
+	// choosing between a peer's direct IPv4 and IPv6 paths of
+	// similar latency. The zero value, AddressFamilyAuto, slightly
+	// favors IPv6.
+	AddressFamilyPreference AddressFamilyPreference
+}
+
+// AddressFamilyPreference is how Conn breaks near-ties in latency
+// between a peer's IPv4 and IPv6 paths. See betterAddr.
+type AddressFamilyPreference int
+
+const (
+	// AddressFamilyAuto uses IPv6 unless IPv4 is more than about
+	// 10% faster.
+	AddressFamilyAuto AddressFamilyPreference = iota
+
+	// AddressFamilyPreferV4 uses IPv4 unless IPv6 is more than
+	// twice as fast, for networks with unreliable IPv6.
+	AddressFamilyPreferV4
+
+	// AddressFamilyPreferV6 uses IPv6 unless IPv4 is more than
+	// twice as fast.
+	AddressFamilyPreferV6
+)
+
+// bias returns whether p favors IPv6, and by what percentage the
+// favored family's latency is discounted when compared against the
+// other's.
+func (p AddressFamilyPreference) bias() (preferV6 bool, pct int) {
+	switch p {
+	case AddressFamilyPreferV4:
+		return false, 50
+	case AddressFamilyPreferV6:
+		return true, 50
+	}
+	return true, 10
 }
 
 func (o *Options) logf() logger.Logf {
@@ -483,6 +889,13 @@ func (o *Options) endpointsFunc() func([]tailcfg.Endpoint) {
 	return o.EndpointsFunc
 }
 
+func (o *Options) packetListener() nettype.PacketListener {
+	if o.PacketListener != nil {
+		return o.PacketListener
+	}
+	return o.TestOnlyPacketListener
+}
+
 func (o *Options) derpActiveFunc() func() {
 	if o == nil || o.DERPActiveFunc == nil {
 		return func() {}
@@ -490,17 +903,139 @@ func (o *Options) derpActiveFunc() func() {
 	return o.DERPActiveFunc
 }
 
+// Timeouts are overrides of how Conn maintains direct paths to
+// peers; see Options.Timeouts. On links with high or variable
+// latency, such as satellite, longer durations avoid needlessly
+// falling back to DERP.
+type Timeouts struct {
+	// TrustUDPAddr is how long a direct UDP path is used
+	// exclusively, without also sending via DERP, after its last
+	// pong. Zero means 5 seconds. It's raised to at least twice
+	// Heartbeat so a single late pong doesn't cause a fallback.
+	TrustUDPAddr time.Duration
+
+	// Heartbeat is how often the best direct path to an active
+	// peer is pinged. Zero means 2 seconds; the minimum is
+	// minHeartbeatInterval.
+	Heartbeat time.Duration
+
+	// Upgrade is how often all of an active peer's candidate
+	// paths are pinged looking for a better one. Zero means 1
+	// minute. It's raised to at least Heartbeat.
+	Upgrade time.Duration
+}
+
+// minHeartbeatInterval is the smallest Timeouts.Heartbeat that's
+// honored.
+const minHeartbeatInterval = 250 * time.Millisecond
+
+// timeouts returns the effective trustUDPAddrDuration,
+// heartbeatInterval and upgradeInterval for o.Timeouts.
+func (o *Options) timeouts() (trust, heartbeat, upgrade time.Duration) {
+	trust, heartbeat, upgrade = trustUDPAddrDuration, heartbeatInterval, upgradeInterval
+	if o == nil {
+		return
+	}
+	t := o.Timeouts
+	if t.Heartbeat > 0 {
+		heartbeat = t.Heartbeat
+		if heartbeat < minHeartbeatInterval {
+			heartbeat = minHeartbeatInterval
+		}
+	}
+	if t.TrustUDPAddr > 0 {
+		trust = t.TrustUDPAddr
+	}
+	if trust < 2*heartbeat {
+		trust = 2 * heartbeat
+	}
+	if t.Upgrade > 0 {
+		upgrade = t.Upgrade
+	}
+	if upgrade < heartbeat {
+		upgrade = heartbeat
+	}
+	return
+}
+
+// maxNumSockets is the most receive sockets per address family that
+// Options.NumSockets can ask for.
+const maxNumSockets = 64
+
+func (o *Options) numSockets() int {
+	if o == nil || o.NumSockets <= 1 || !reusePortSupported {
+		return 1
+	}
+	if o.NumSockets > maxNumSockets {
+		return maxNumSockets
+	}
+	return o.NumSockets
+}
+
+const (
+	// defaultReSTUNInterval is the default Options.ReSTUNInterval.
+	defaultReSTUNInterval = 26 * time.Second
+
+	// minReSTUNInterval is the smallest Options.ReSTUNInterval
+	// that's honored.
+	minReSTUNInterval = time.Second
+)
+
+func (o *Options) reSTUNInterval() time.Duration {
+	if o == nil || o.ReSTUNInterval == 0 {
+		return defaultReSTUNInterval
+	}
+	if o.ReSTUNInterval < minReSTUNInterval {
+		return minReSTUNInterval
+	}
+	return o.ReSTUNInterval
+}
+
+func (o *Options) stunIdleTimeout() time.Duration {
+	if o == nil || o.STUNIdleTimeout == 0 {
+		return sessionActiveTimeout
+	}
+	return o.STUNIdleTimeout
+}
+
+func (o *Options) derpWriteQueueDepth() int {
+	if o == nil || o.DERPWriteQueueDepth == 0 {
+		return bufferedDerpWritesBeforeDrop
+	}
+	return o.DERPWriteQueueDepth
+}
+
+func (o *Options) pongHistoryCount() int {
+	if o == nil || o.PongHistoryCount <= 0 {
+		return defaultPongHistoryCount
+	}
+	if o.PongHistoryCount > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return o.PongHistoryCount
+}
+
 // newConn is the error-free, network-listening-side-effect-free based
 // of NewConn. Mostly for tests.
 func newConn() *Conn {
 	c := &Conn{
 		derpRecvCh:     make(chan derpReadResult),
 		derpStarted:    make(chan struct{}),
+		events:         make(chan ConnEvent, connEventBufferSize),
 		peerLastDerp:   make(map[key.Public]int),
 		peerMap:        newPeerMap(),
-		sharedDiscoKey: make(map[tailcfg.DiscoKey]*[32]byte),
+		sharedDiscoKey: make(map[tailcfg.DiscoKey]*list.Element),
 	}
 	c.bind = &connBind{Conn: c, closed: true}
+	c.pongHistoryCount = defaultPongHistoryCount
+	c.derpWriteQueueDepth = bufferedDerpWritesBeforeDrop
+	c.numSockets = 1
+	c.reSTUNInterval = defaultReSTUNInterval
+	c.stunIdleTimeout = sessionActiveTimeout
+	c.trustUDPAddrDuration = trustUDPAddrDuration
+	c.heartbeatInterval = heartbeatInterval
+	c.upgradeInterval = upgradeInterval
+	c.callMeMaybeLimiter = rate.NewLimiter(callMeMaybeRate, callMeMaybeBurst)
 	c.muCond = sync.NewCond(&c.mu)
 	c.networkUp.Set(true) // assume up until told otherwise
 	return c
@@ -512,14 +1047,58 @@ func newConn() *Conn {
 //
 // It doesn't start doing anything until Start is called.
 func NewConn(opts Options) (*Conn, error) {
+	if opts.DERPWriteQueueDepth < 0 {
+		return nil, fmt.Errorf("magicsock: invalid DERPWriteQueueDepth %d", opts.DERPWriteQueueDepth)
+	}
+	if opts.DSCP > 63 {
+		return nil, fmt.Errorf("magicsock: invalid DSCP %d; must be at most 63", opts.DSCP)
+	}
+	if opts.AddressFamilyPreference < AddressFamilyAuto || opts.AddressFamilyPreference > AddressFamilyPreferV6 {
+		return nil, fmt.Errorf("magicsock: invalid AddressFamilyPreference %d", opts.AddressFamilyPreference)
+	}
+	if opts.ReSTUNInterval < 0 || opts.ReSTUNInterval >= sessionActiveTimeout {
+		return nil, fmt.Errorf("magicsock: invalid ReSTUNInterval %v; must be less than %v", opts.ReSTUNInterval, sessionActiveTimeout)
+	}
+	if opts.STUNIdleTimeout < 0 {
+		return nil, fmt.Errorf("magicsock: invalid STUNIdleTimeout %v", opts.STUNIdleTimeout)
+	}
 	c := newConn()
 	c.port.Set(uint32(opts.Port))
 	c.logf = opts.logf()
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
+	c.firstDirectPathFunc = opts.FirstDirectPathFunc
 	c.idleFunc = opts.IdleFunc
-	c.testOnlyPacketListener = opts.TestOnlyPacketListener
+	c.packetListener = opts.packetListener()
 	c.noteRecvActivity = opts.NoteRecvActivity
+	c.pathChangeFunc = opts.PathChangeFunc
+	c.derpHealthFunc = opts.DERPHealthFunc
+	c.networkChangeFunc = opts.NetworkChangeFunc
+	c.endpointFilter = opts.EndpointFilter
+	c.endpointPriorityFunc = opts.EndpointPriorityFunc
+	c.pongHistoryCount = opts.pongHistoryCount()
+	c.maxActiveDERPConns = opts.MaxActiveDERPConns
+	c.maxPingCandidates = opts.MaxPingCandidates
+	c.derpWriteQueueDepth = opts.derpWriteQueueDepth()
+	c.trustUDPAddrDuration, c.heartbeatInterval, c.upgradeInterval = opts.timeouts()
+	c.bindAddr = opts.BindAddr
+	c.advertisedExternalPort = opts.AdvertisedExternalPort
+	c.numSockets = opts.numSockets()
+	c.reSTUNInterval = opts.reSTUNInterval()
+	c.stunIdleTimeout = opts.stunIdleTimeout()
+	c.disableIPv6 = opts.DisableIPv6
+	c.dscp = opts.DSCP
+	for i := 1; i < c.numSockets; i++ {
+		c.extraPconns4 = append(c.extraPconns4, &RebindingUDPConn{pconn: newBlockForeverConn()})
+		if !c.disableIPv6 {
+			c.extraPconns6 = append(c.extraPconns6, &RebindingUDPConn{pconn: newBlockForeverConn()})
+		}
+	}
+	c.stableFakeUDPAddrs = opts.StableFakeUDPAddrs
+	c.recordRecvLocalAddrs = opts.RecordRecvLocalAddrs
+	c.raceFirstSend = opts.RaceFirstSend
+	c.disableDERPRoute = opts.DisableDERPRoute
+	c.addrFamilyPref = opts.AddressFamilyPreference
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), c.onPortMapChanged)
 	if opts.LinkMonitor != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.LinkMonitor.GatewayAndSelfIP)
@@ -528,6 +1107,10 @@ func NewConn(opts Options) (*Conn, error) {
 	if err := c.initialBind(); err != nil {
 		return nil, err
 	}
+	c.updateLocalPrefixes()
+	if opts.LinkMonitor != nil {
+		c.unregisterLinkChange = opts.LinkMonitor.RegisterChangeCallback(c.onLinkChange)
+	}
 
 	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
 	c.donec = c.connCtx.Done()
@@ -535,6 +1118,7 @@ func NewConn(opts Options) (*Conn, error) {
 		Logf:                logger.WithPrefix(c.logf, "netcheck: "),
 		GetSTUNConn4:        func() netcheck.STUNConn { return c.pconn4 },
 		SkipExternalNetwork: inTest(),
+		SkipIPv6:            c.disableIPv6,
 		PortMapper:          c.portMapper,
 	}
 
@@ -576,11 +1160,7 @@ func (c *Conn) updateEndpoints(why string) {
 				return
 			}
 			if c.shouldDoPeriodicReSTUNLocked() {
-				// Pick a random duration between 20
-				// and 26 seconds (just under 30s, a
-				// common UDP NAT timeout on Linux,
-				// etc)
-				d := tstime.RandomDurationBetween(20*time.Second, 26*time.Second)
+				d := c.periodicReSTUNDelay()
 				if t := c.periodicReSTUNTimer; t != nil {
 					if debugReSTUNStopOnIdle {
 						c.logf("resetting existing periodicSTUN to run in %v", d)
@@ -611,11 +1191,37 @@ func (c *Conn) updateEndpoints(why string) {
 		// we should trigger a retry based on the error here?
 		return
 	}
+	if c.endpointPriorityFunc != nil {
+		endpoints = c.prioritizeEndpoints(endpoints)
+	}
 
 	if c.setEndpoints(endpoints) {
 		c.logEndpointChange(endpoints)
 		c.epFunc(endpoints)
+		c.sendEvent(ConnEvent{Type: ConnEventEndpointsChanged, Endpoints: append([]tailcfg.Endpoint(nil), endpoints...)})
+		c.sendEndpointUpdate(endpoints)
+	}
+}
+
+// prioritizeEndpoints returns eps as reordered by
+// Options.EndpointPriorityFunc, minus any it added that
+// determineEndpoints wouldn't have returned: those rejected by
+// Options.EndpointFilter, or all of them if c isn't advertising
+// endpoints.
+//
+// c.mu must NOT be held.
+func (c *Conn) prioritizeEndpoints(eps []tailcfg.Endpoint) []tailcfg.Endpoint {
+	eps = c.endpointPriorityFunc(eps)
+	if c.noAdvertiseEndpoints.Get() {
+		return nil
 	}
+	allowed := eps[:0]
+	for _, ep := range eps {
+		if c.endpointAllowed(ep.Addr) {
+			allowed = append(allowed, ep)
+		}
+	}
+	return allowed
 }
 
 // setEndpoints records the new endpoints, reporting whether they're changed.
@@ -641,6 +1247,8 @@ func (c *Conn) setEndpoints(endpoints []tailcfg.Endpoint) (changed bool) {
 		// skipped during the e2e tests because they depend
 		// too much on the exact sequence of updates.  Fix the
 		// tests. But a protocol rewrite might happen first.
+		// Tests can now get a deterministic sequence without
+		// STUN timing from SetForcedPreferredDERP.
 		c.logf("[v1] magicsock: ignoring pre-DERP map, STUN-less endpoint update: %v", endpoints)
 		return false
 	}
@@ -678,12 +1286,26 @@ func (c *Conn) setNetInfoHavePortMap() {
 func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	c.mu.Lock()
 	dm := c.derpMap
+	forcedDERP := c.forcedPreferredDERP
 	c.mu.Unlock()
 
 	if dm == nil || c.networkDown() {
 		return new(netcheck.Report), nil
 	}
 
+	if forcedDERP != 0 {
+		ni := &tailcfg.NetInfo{
+			DERPLatency:   map[string]float64{},
+			PreferredDERP: forcedDERP,
+			HavePortMap:   c.portMapper.HaveMapping(),
+		}
+		if !c.setNearestDERP(forcedDERP) {
+			ni.PreferredDERP = 0
+		}
+		c.callNetInfoCallback(ni)
+		return &netcheck.Report{PreferredDERP: forcedDERP}, nil
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 
@@ -698,6 +1320,10 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
 
+	c.mu.Lock()
+	c.lastNetCheckReport = report.Clone()
+	c.mu.Unlock()
+
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
 		MappingVariesByDestIP: report.MappingVariesByDestIP,
@@ -739,6 +1365,10 @@ var processStartUnixNano = time.Now().UnixNano()
 // nearest one (for instance, if UDP is blocked and thus STUN latency
 // checks aren't working).
 //
+// It prefers the region that's home to the most peers, so that a
+// client that can only use DERP shares a region with as many of
+// them as possible.
+//
 // c.mu must NOT be held.
 func (c *Conn) pickDERPFallback() int {
 	c.mu.Lock()
@@ -753,26 +1383,62 @@ func (c *Conn) pickDERPFallback() int {
 		return 0
 	}
 
-	// TODO: figure out which DERP region most of our peers are using,
-	// and use that region as our fallback.
-	//
-	// If we already had selected something in the past and it has any
-	// peers, we want to stay on it. If there are no peers at all,
-	// stay on whatever DERP we previously picked. If we need to pick
-	// one and have no peer info, pick a region randomly.
-	//
-	// We used to do the above for legacy clients, but never updated
-	// it for disco.
+	// Count the peers homed in each region we know of.
+	peersIn := map[int]int{}
+	c.peerMap.forEachDiscoEndpoint(func(ep *endpoint) {
+		ep.mu.Lock()
+		id := int(ep.derpAddr.Port())
+		ep.mu.Unlock()
+		if id != 0 && c.derpMap.Regions[id] != nil {
+			peersIn[id]++
+		}
+	})
 
-	if c.myDerp != 0 {
+	// If we already had selected something in the past and it has
+	// any peers, stay on it. If there are no peers at all, stay on
+	// whatever DERP we previously picked.
+	if c.myDerp != 0 && (len(peersIn) == 0 || peersIn[c.myDerp] > 0) {
 		return c.myDerp
 	}
 
+	// Otherwise use the region most of our peers are using,
+	// breaking ties by lowest region ID.
+	best := 0
+	for id, n := range peersIn {
+		if n > peersIn[best] || (n == peersIn[best] && id < best) {
+			best = id
+		}
+	}
+	if best != 0 {
+		return best
+	}
+
+	// No peer info; pick a region randomly.
+
 	h := fnv.New64()
 	h.Write([]byte(fmt.Sprintf("%p/%d", c, processStartUnixNano))) // arbitrary
 	return ids[rand.New(rand.NewSource(int64(h.Sum64()))).Intn(len(ids))]
 }
 
+// periodicReSTUNDelay returns a random delay before the next
+// periodic re-STUN, between 10/13ths of c.reSTUNInterval and all of
+// it. By default that's between 20 and 26 seconds (just under 30s,
+// a common UDP NAT timeout on Linux, etc).
+func (c *Conn) periodicReSTUNDelay() time.Duration {
+	return tstime.RandomDurationBetween(c.reSTUNInterval*10/13, c.reSTUNInterval)
+}
+
+// LastNetcheckReport returns a copy of the most recent netcheck
+// report, or nil if no netcheck has completed yet.
+//
+// Unlike the tailcfg.NetInfo sent to control, the report includes
+// per-region latencies and the raw NAT and port mapping results.
+func (c *Conn) LastNetcheckReport() *netcheck.Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastNetCheckReport.Clone()
+}
+
 // callNetInfoCallback calls the NetInfo callback (if previously
 // registered with SetNetInfoCallback) if ni has substantially changed
 // since the last state.
@@ -837,8 +1503,211 @@ func (c *Conn) LastRecvActivityOfDisco(dk tailcfg.DiscoKey) string {
 	return mono.Since(saw).Round(time.Second).String()
 }
 
+// PeerLatency returns the most recently measured round-trip latency
+// to the peer with node key nk over the path currently used to reach
+// it: the best direct UDP path while it's trusted, else DERP. It
+// doesn't send anything; the latency comes from the last pong
+// received. It reports false if the peer is unknown or no latency
+// has been measured yet.
+func (c *Conn) PeerLatency(nk tailcfg.NodeKey) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	if !ok {
+		return 0, false
+	}
+	return ep.latency(mono.Now())
+}
+
+// TimeSinceDirect returns how long it's been since a pong from the
+// peer with node key nk last arrived over a direct UDP path, which
+// is about how long the peer has been reachable only via DERP if it's
+// been a while. It reports false if the peer is unknown or no direct
+// pong has ever arrived from it.
+func (c *Conn) TimeSinceDirect(nk tailcfg.NodeKey) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	if !ok {
+		return 0, false
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.lastDirectPong.IsZero() {
+		return 0, false
+	}
+	return mono.Since(ep.lastDirectPong), true
+}
+
+// PeerHomeDERP returns the home DERP region that the peer with node
+// key nk advertises in the network map. It reports false if the peer
+// is unknown or has no home region.
+func (c *Conn) PeerHomeDERP(nk tailcfg.NodeKey) (regionID int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	if !ok {
+		return 0, false
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.derpAddr.IsZero() {
+		return 0, false
+	}
+	return int(ep.derpAddr.Port()), true
+}
+
+// EndpointInfo describes one of a peer's candidate direct UDP paths.
+// See Conn.PeerEndpoints.
+type EndpointInfo struct {
+	Addr netaddr.IPPort
+
+	// Latency is that of the last pong received from Addr, or
+	// zero if none has been.
+	Latency time.Duration
+
+	// LastSeen is when the peer was last heard from at Addr, by a
+	// pong or an incoming ping, or zero if it hasn't been.
+	LastSeen time.Time
+
+	// CallMeMaybe is whether the peer advertised Addr in a
+	// call-me-maybe, as opposed to it coming from the network map
+	// or an incoming ping.
+	CallMeMaybe bool
+
+	// Best is whether Addr is the path currently preferred for
+	// sending to the peer.
+	Best bool
+}
+
+// PeerEndpoints returns the candidate direct paths to the peer with
+// node key nk, sorted by address, for diagnosing why a direct path
+// isn't used. It returns nil if the peer is unknown.
+func (c *Conn) PeerEndpoints(nk tailcfg.NodeKey) []EndpointInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	if !ok {
+		return nil
+	}
+	return ep.endpointInfos()
+}
+
+func (de *endpoint) endpointInfos() []EndpointInfo {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	ret := make([]EndpointInfo, 0, len(de.endpointState))
+	for ipp, st := range de.endpointState {
+		ei := EndpointInfo{
+			Addr:        ipp,
+			LastSeen:    st.lastGotPing,
+			CallMeMaybe: de.isCallMeMaybeEP[ipp],
+			Best:        ipp == de.bestAddr.IPPort,
+		}
+		if len(st.recentPongs) > 0 {
+			pr := st.recentPongs[st.recentPong]
+			ei.Latency = pr.latency
+			if t := pr.pongAt.WallTime(); t.After(ei.LastSeen) {
+				ei.LastSeen = t
+			}
+		}
+		ret = append(ret, ei)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i].Addr, ret[j].Addr
+		if a.IP() != b.IP() {
+			return a.IP().Less(b.IP())
+		}
+		return a.Port() < b.Port()
+	})
+	return ret
+}
+
+// DebugString returns a human-readable dump of c's path state, for
+// support and debugging: the active DERP connections and, for each
+// peer, its disco key, candidate endpoints with their latest pong
+// latencies, and its bestAddr and how much longer that's trusted.
+// Keys are abbreviated.
+func (c *Conn) DebugString() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "magicsock: disco=%v home-derp=%v peers=%v\n", c.discoShort, c.myDerp, c.peerMap.nodeCount())
+
+	regions := make([]int, 0, len(c.activeDerp))
+	for regionID := range c.activeDerp {
+		regions = append(regions, regionID)
+	}
+	sort.Ints(regions)
+	now := time.Now()
+	for _, regionID := range regions {
+		ad := c.activeDerp[regionID]
+		fmt.Fprintf(&sb, "derp %v (%s): up %v, last write %v ago\n", regionID, c.derpRegionCodeLocked(regionID),
+			now.Sub(ad.createTime).Round(time.Second), now.Sub(*ad.lastWrite).Round(time.Second))
+	}
+
+	var eps []*endpoint
+	c.peerMap.forEachDiscoEndpoint(func(ep *endpoint) {
+		eps = append(eps, ep)
+	})
+	sort.Slice(eps, func(i, j int) bool {
+		return eps[i].publicKey.ShortString() < eps[j].publicKey.ShortString()
+	})
+	for _, ep := range eps {
+		ep.writeDebugString(&sb)
+	}
+	return sb.String()
+}
+
+// writeDebugString writes de's part of Conn.DebugString to sb.
+func (de *endpoint) writeDebugString(sb *strings.Builder) {
+	// Get the endpoints first, as endpointInfos acquires de.mu.
+	eis := de.endpointInfos()
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	derp := "none"
+	if !de.derpAddr.IsZero() {
+		derp = fmt.Sprint(de.derpAddr.Port())
+	}
+	fmt.Fprintf(sb, "peer %v: disco=%v derp=%v", de.publicKey.ShortString(), de.discoShort, derp)
+	if de.bestAddr.IsZero() {
+		sb.WriteString(" best=none\n")
+	} else {
+		fmt.Fprintf(sb, " best=%v (%v)", de.bestAddr.IPPort, de.bestAddr.latency)
+		if now := mono.Now(); now.Before(de.trustBestAddrUntil) {
+			fmt.Fprintf(sb, " trusted for %v\n", de.trustBestAddrUntil.Sub(now).Round(time.Second))
+		} else {
+			sb.WriteString(" untrusted\n")
+		}
+	}
+	for _, ei := range eis {
+		fmt.Fprintf(sb, "  %v", ei.Addr)
+		if ei.Latency != 0 {
+			fmt.Fprintf(sb, " pong=%v", ei.Latency)
+		} else {
+			sb.WriteString(" no-pong")
+		}
+		if ei.CallMeMaybe {
+			sb.WriteString(" call-me-maybe")
+		}
+		if ei.Best {
+			sb.WriteString(" best")
+		}
+		sb.WriteByte('\n')
+	}
+}
+
 // Ping handles a "tailscale ping" CLI query.
 func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
+	c.PingContext(context.Background(), peer, res, cb)
+}
+
+// PingContext is like Ping, but if ctx is done before a pong
+// arrives, the ping is abandoned and cb is called with res.Err set
+// to ctx's error.
+func (c *Conn) PingContext(ctx context.Context, peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.privateKey.IsZero() {
@@ -864,12 +1733,42 @@ func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnst
 		cb(res)
 		return
 	}
-	ep.cliPing(res, cb)
+	ep.cliPing(ctx, res, cb)
+}
+
+// PingAddr sends a one-off disco ping to ipp, which need not be a
+// known endpoint of the peer with disco key dk, and calls cb with the
+// latency of the pong or, if no pong arrives within
+// pingTimeoutDuration, an error. Unlike Ping, the pong doesn't affect
+// which path is used to reach the peer.
+func (c *Conn) PingAddr(dk tailcfg.DiscoKey, ipp netaddr.IPPort, cb func(*ipnstate.PingResult)) {
+	res := &ipnstate.PingResult{IP: ipp.IP().String()}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.privateKey.IsZero() {
+		res.Err = "local tailscaled stopped"
+		cb(res)
+		return
+	}
+	ep, ok := c.peerMap.endpointForDiscoKey(dk)
+	if !ok || dk.IsZero() {
+		res.Err = "unknown peer"
+		cb(res)
+		return
+	}
+	ep.probePing(ipp, res, cb)
 }
 
-// c.mu must be held
-func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netaddr.IPPort) {
+// populateCLIPingResponseLocked fills in res for a pong from de via
+// ep.
+//
+// c.mu and de.mu must be held.
+func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, de *endpoint, latency time.Duration, ep netaddr.IPPort) {
 	res.LatencySeconds = latency.Seconds()
+	if c.netInfoLast != nil {
+		res.LocalMappingVariesByDestIP = c.netInfoLast.MappingVariesByDestIP
+	}
+	res.PeerMappingVariesByDestIP = de.mappingVariesByDestIP
 	if ep.IP() != derpMagicIPAddr {
 		res.Endpoint = ep.String()
 		return
@@ -889,26 +1788,150 @@ func (c *Conn) derpRegionCodeLocked(regionID int) string {
 	return ""
 }
 
+// PeerDiagnosis is the result of Conn.DiagnosePeer: a snapshot of how
+// well each known path to a peer works.
+type PeerDiagnosis struct {
+	Peer tailcfg.NodeKey
+
+	// Err, if non-empty, is why the peer couldn't be probed.
+	// When set, the rest of the fields are zero.
+	Err string `json:",omitempty"`
+
+	// Paths are the probed paths: the peer's direct candidate
+	// endpoints, sorted, followed by its DERP home (if any).
+	Paths []PathDiagnosis
+
+	// DirectOK is whether any direct (non-DERP) path got a pong.
+	DirectOK bool
+
+	// BestAddr is the direct path in use after probing, and
+	// BestAddrLatency its most recent latency. BestAddr is zero if
+	// traffic goes only over DERP.
+	BestAddr        netaddr.IPPort `json:",omitempty"`
+	BestAddrLatency time.Duration  `json:",omitempty"`
+
+	// BestAddrReason is a human-readable explanation of why
+	// BestAddr was (or wasn't) chosen.
+	BestAddrReason string
+}
+
+// PathDiagnosis is the probe result for a single path to a peer.
+type PathDiagnosis struct {
+	// Addr is the path's address. For DERP paths it's a magic
+	// address; see DERPRegionID.
+	Addr netaddr.IPPort
+
+	// DERPRegionID is non-zero for the DERP path.
+	DERPRegionID int `json:",omitempty"`
+
+	// GotPong is whether the peer replied on this path before the
+	// probe timed out.
+	GotPong bool
+
+	// Latency is the round trip time, if GotPong.
+	Latency time.Duration `json:",omitempty"`
+
+	// PongSrc is the address the peer saw our ping come from, if GotPong.
+	PongSrc netaddr.IPPort `json:",omitempty"`
+}
+
+// DiagnosePeer pings every known candidate endpoint of the peer with
+// node key nk, plus its DERP home, and reports which paths replied.
+// It's a structured version of "tailscale ping" for support tooling.
+//
+// It blocks until every probe has replied or timed out, or ctx is done;
+// probes still outstanding at that point are reported as unanswered.
+//
+// c.mu must NOT be held.
+func (c *Conn) DiagnosePeer(ctx context.Context, nk tailcfg.NodeKey) PeerDiagnosis {
+	d := PeerDiagnosis{Peer: nk}
+	c.mu.Lock()
+	if c.privateKey.IsZero() {
+		c.mu.Unlock()
+		d.Err = "local tailscaled stopped"
+		return d
+	}
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		d.Err = "unknown peer"
+		return d
+	}
+	if !ep.canP2P() {
+		d.Err = "peer does not support discovery pings"
+		return d
+	}
+	ep.diagnose(ctx, &d)
+	return d
+}
+
 // DiscoPublicKey returns the discovery public key.
 func (c *Conn) DiscoPublicKey() tailcfg.DiscoKey {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.discoPrivate.IsZero() {
-		priv := key.NewPrivate()
-		c.discoPrivate = priv
-		c.discoPublic = tailcfg.DiscoKey(priv.Public())
-		c.discoShort = c.discoPublic.ShortString()
-		c.logf("magicsock: disco key = %v", c.discoShort)
+		c.setDiscoPrivateLocked(key.NewPrivate())
 	}
 	return c.discoPublic
 }
 
+// SetDiscoPrivateKeyForTest sets c's disco private key to k, for
+// tests that want reproducible disco keys. It must be called before
+// the disco key is first used, by DiscoPublicKey or disco traffic;
+// after that, it fails unless k is the key already in use. It also
+// fails outside of tests, so a stray call can't pin a production
+// node's disco key.
+func (c *Conn) SetDiscoPrivateKeyForTest(k key.Private) error {
+	if !inTest() {
+		return errors.New("magicsock: SetDiscoPrivateKeyForTest called outside of tests")
+	}
+	if k.IsZero() {
+		return errors.New("magicsock: zero disco private key")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.discoPrivate.IsZero() {
+		if c.discoPrivate == k {
+			return nil
+		}
+		return errors.New("magicsock: disco key already in use")
+	}
+	c.setDiscoPrivateLocked(k)
+	return nil
+}
+
+// setDiscoPrivateLocked sets c's disco private key, and the values
+// derived from it, to priv.
+//
+// c.mu must be held.
+func (c *Conn) setDiscoPrivateLocked(priv key.Private) {
+	c.discoPrivate = priv
+	c.discoPublic = tailcfg.DiscoKey(priv.Public())
+	c.discoShort = c.discoPublic.ShortString()
+	c.logf("magicsock: disco key = %v", c.discoShort)
+}
+
+// SetForcedPreferredDERP makes c use regionID as its home DERP
+// region without running netcheck, so tests' endpoint updates don't
+// depend on STUN timing. As no STUN is done, no STUN endpoints are
+// advertised. A regionID of zero goes back to using netcheck. It
+// takes effect from the next endpoint update. It panics outside of
+// tests.
+func (c *Conn) SetForcedPreferredDERP(regionID int) {
+	if !inTest() {
+		panic("SetForcedPreferredDERP called outside of tests")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forcedPreferredDERP = regionID
+}
+
 // PeerHasDiscoKey reports whether peer k supports discovery keys (client version 0.100.0+).
 func (c *Conn) PeerHasDiscoKey(k tailcfg.NodeKey) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if ep, ok := c.peerMap.endpointForNodeKey(k); ok {
-		return ep.discoKey.IsZero()
+		return !ep.discoKey.IsZero()
 	}
 	return false
 }
@@ -926,8 +1949,10 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 		// No change.
 		return true
 	}
+	old := c.myDerp
 	c.myDerp = derpNum
 	health.SetMagicSockDERPHome(derpNum)
+	c.sendEvent(ConnEvent{Type: ConnEventDERPHomeChanged, DERPRegionID: derpNum})
 
 	if c.privateKey.IsZero() {
 		// No private key yet, so DERP connections won't come up anyway.
@@ -943,20 +1968,52 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 	} else {
 		c.logf("magicsock: home is now derp-%v (%v)", derpNum, c.derpMap.Regions[derpNum].RegionCode)
 	}
-	for i, ad := range c.activeDerp {
-		go ad.c.NotePreferred(i == c.myDerp)
-	}
+	c.noteDERPHomeChangeLocked(old)
 	c.goDerpConnect(derpNum)
 	return true
 }
 
-// startDerpHomeConnectLocked starts connecting to our DERP home, if any.
+// derpDualHomeDuration is how long the previous home DERP connection
+// is kept as a second home after a home change, so packets peers send
+// there before they learn our new home aren't lost.
+const derpDualHomeDuration = 30 * time.Second
+
+// noteDERPHomeChangeLocked starts a dual-home window for the old home
+// DERP region, if it's connected, after c.myDerp changed from old.
+// The connections to both homes are kept open and told they're
+// preferred until the window ends, which cleanStaleDerp handles.
 //
 // c.mu must be held.
-func (c *Conn) startDerpHomeConnectLocked() {
-	c.goDerpConnect(c.myDerp)
-}
-
+func (c *Conn) noteDERPHomeChangeLocked(old int) {
+	c.prevHomeDerp = 0
+	if _, ok := c.activeDerp[old]; ok && old != 0 && old != c.myDerp {
+		c.prevHomeDerp = old
+		c.prevHomeDerpUntil = time.Now().Add(derpDualHomeDuration)
+		c.scheduleCleanStaleDerpLocked()
+	}
+	for i, ad := range c.activeDerp {
+		go ad.c.NotePreferred(c.isDERPHomeLocked(i))
+	}
+}
+
+// isDERPHomeLocked reports whether regionID is our home DERP region,
+// or the previous one during its dual-home window.
+//
+// c.mu must be held.
+func (c *Conn) isDERPHomeLocked(regionID int) bool {
+	if regionID == c.myDerp {
+		return true
+	}
+	return regionID == c.prevHomeDerp && time.Now().Before(c.prevHomeDerpUntil)
+}
+
+// startDerpHomeConnectLocked starts connecting to our DERP home, if any.
+//
+// c.mu must be held.
+func (c *Conn) startDerpHomeConnectLocked() {
+	c.goDerpConnect(c.myDerp)
+}
+
 // goDerpConnect starts a goroutine to start connecting to the given
 // DERP node.
 //
@@ -968,6 +2025,41 @@ func (c *Conn) goDerpConnect(node int) {
 	go c.derpWriteChanOfAddr(netaddr.IPPortFrom(derpMagicIPAddr, uint16(node)), key.Public{})
 }
 
+// stun4LocalPortEndpoints returns the endpoints on our public IPv4
+// address from nr, other than the one STUN found, where a static port
+// mapping on the router might forward to us.
+func (c *Conn) stun4LocalPortEndpoints(nr *netcheck.Report) []netaddr.IPPort {
+	global, err := netaddr.ParseIPPort(nr.GlobalV4)
+	if err != nil {
+		return nil
+	}
+	var eps []netaddr.IPPort
+	// If they're behind a hard NAT and are using a fixed
+	// port locally, assume they might've added a static
+	// port mapping on their router to the same explicit
+	// port that tailscaled is running with. Worst case
+	// it's an invalid candidate mapping.
+	if port := c.port.Get(); nr.MappingVariesByDestIP.EqualBool(true) && port != 0 {
+		eps = append(eps, netaddr.IPPortFrom(global.IP(), uint16(port)))
+	}
+	// A port forward the operator told us about is there
+	// however the NAT behaves.
+	if port := c.advertisedExternalPort; port != 0 {
+		eps = append(eps, netaddr.IPPortFrom(global.IP(), port))
+	}
+	return eps
+}
+
+// endpointAllowed reports whether ipp passes Options.EndpointFilter,
+// for use as one of our endpoints or a peer's, logging if not.
+func (c *Conn) endpointAllowed(ipp netaddr.IPPort) bool {
+	if c.endpointFilter == nil || c.endpointFilter(ipp) {
+		return true
+	}
+	c.logf("[v1] magicsock: endpoint %v rejected by EndpointFilter", ipp)
+	return false
+}
+
 // determineEndpoints returns the machine's endpoint addresses. It
 // does a STUN lookup (via netcheck) to determine its public address.
 //
@@ -980,6 +2072,10 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		c.logf("magicsock.Conn.determineEndpoints: updateNetInfo: %v", err)
 		return nil, err
 	}
+	if c.noAdvertiseEndpoints.Get() {
+		// Relay-only; netcheck above still picks our home DERP.
+		return nil, nil
+	}
 
 	already := make(map[netaddr.IPPort]tailcfg.EndpointType) // endpoint -> how it was found
 	var eps []tailcfg.Endpoint                               // unique endpoints
@@ -992,6 +2088,12 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		if ipp.IsZero() || (debugOmitLocalAddresses && et == tailcfg.EndpointLocal) {
 			return
 		}
+		if c.disableIPv6 && ipp.IP().Is6() {
+			return
+		}
+		if !c.endpointAllowed(ipp) {
+			return
+		}
 		if _, ok := already[ipp]; !ok {
 			already[ipp] = et
 			eps = append(eps, tailcfg.Endpoint{Addr: ipp, Type: et})
@@ -1009,16 +2111,8 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 
 	if nr.GlobalV4 != "" {
 		addAddr(ipp(nr.GlobalV4), tailcfg.EndpointSTUN)
-
-		// If they're behind a hard NAT and are using a fixed
-		// port locally, assume they might've added a static
-		// port mapping on their router to the same explicit
-		// port that tailscaled is running with. Worst case
-		// it's an invalid candidate mapping.
-		if port := c.port.Get(); nr.MappingVariesByDestIP.EqualBool(true) && port != 0 {
-			if ip, _, err := net.SplitHostPort(nr.GlobalV4); err == nil {
-				addAddr(ipp(net.JoinHostPort(ip, strconv.Itoa(int(port)))), tailcfg.EndpointSTUN4LocalPort)
-			}
+		for _, ep := range c.stun4LocalPortEndpoints(nr) {
+			addAddr(ep, tailcfg.EndpointSTUN4LocalPort)
 		}
 	}
 	if nr.GlobalV6 != "" {
@@ -1027,7 +2121,11 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 
 	c.ignoreSTUNPackets()
 
-	if localAddr := c.pconn4.LocalAddr(); localAddr.IP.IsUnspecified() {
+	if ip := c.bindAddr; ip.Is6() && c.pconn6 != nil {
+		// Our IPv6 socket is bound to a particular address per
+		// Options.BindAddr. Offer only that.
+		addAddr(netaddr.IPPortFrom(ip, uint16(c.pconn6.LocalAddr().Port)), tailcfg.EndpointLocal)
+	} else if localAddr := c.pconn4.LocalAddr(); localAddr.IP.IsUnspecified() {
 		ips, loopback, err := interfaces.LocalAddresses()
 		if err != nil {
 			return nil, err
@@ -1040,8 +2138,17 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 			// offline, for example.
 			ips = loopback
 		}
+		v4Port, v6Port := c.LocalPorts()
 		for _, ip := range ips {
-			addAddr(netaddr.IPPortFrom(ip, uint16(localAddr.Port)), tailcfg.EndpointLocal)
+			port := v4Port
+			if ip.Is6() {
+				if v6Port == 0 {
+					// No IPv6 listener to receive on.
+					continue
+				}
+				port = v6Port
+			}
+			addAddr(netaddr.IPPortFrom(ip, port), tailcfg.EndpointLocal)
 		}
 	} else {
 		// Our local endpoint is bound to a particular address.
@@ -1065,6 +2172,42 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 	return eps, nil
 }
 
+// updateLocalPrefixes refreshes c.localPrefixes from the subnets of
+// the machine's non-loopback interface addresses.
+func (c *Conn) updateLocalPrefixes() {
+	ips, _, err := interfaces.LocalAddresses()
+	if err != nil {
+		c.logf("magicsock: LocalAddresses: %v", err)
+		return
+	}
+	var pfxs []netaddr.IPPrefix
+	err = interfaces.ForeachInterfaceAddress(func(_ interfaces.Interface, pfx netaddr.IPPrefix) {
+		for _, ip := range ips {
+			if pfx.IP() == ip {
+				pfxs = append(pfxs, pfx)
+				return
+			}
+		}
+	})
+	if err != nil {
+		c.logf("magicsock: ForeachInterfaceAddress: %v", err)
+		return
+	}
+	c.localPrefixes.Store(pfxs)
+}
+
+// onLocalSubnet reports whether ip is in the same subnet as one of
+// our local interface addresses.
+func (c *Conn) onLocalSubnet(ip netaddr.IP) bool {
+	pfxs, _ := c.localPrefixes.Load().([]netaddr.IPPrefix)
+	for _, pfx := range pfxs {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // endpointSetsEqual reports whether x and y represent the same set of
 // endpoints. The order doesn't matter.
 //
@@ -1098,11 +2241,24 @@ func endpointSetsEqual(x, y []tailcfg.Endpoint) bool {
 }
 
 // LocalPort returns the current IPv4 listener's port number.
+// The IPv6 listener may be on a different port; see LocalPorts.
 func (c *Conn) LocalPort() uint16 {
 	laddr := c.pconn4.LocalAddr()
 	return uint16(laddr.Port)
 }
 
+// LocalPorts returns the current port numbers of the IPv4 and IPv6
+// listeners. They're usually the same, but needn't be, such as when
+// the port in use by one family was taken for the other when
+// rebinding. v6 is zero if there's no IPv6 listener.
+func (c *Conn) LocalPorts() (v4, v6 uint16) {
+	v4 = c.LocalPort()
+	if c.pconn6 != nil {
+		v6 = uint16(c.pconn6.LocalAddr().Port)
+	}
+	return v4, v6
+}
+
 var errNetworkDown = errors.New("magicsock: network down")
 
 func (c *Conn) networkDown() bool { return !c.networkUp.Get() }
@@ -1114,66 +2270,203 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 	return ep.(*endpoint).send(b)
 }
 
+// SendBatch sends bufs to ep and returns how many were sent.
+//
+// Direct UDP packets are written to the socket together, using
+// sendmmsg(2) where available. DERP packets are still queued one at
+// a time.
+func (c *Conn) SendBatch(bufs [][]byte, ep conn.Endpoint) (int, error) {
+	if c.networkDown() {
+		return 0, errNetworkDown
+	}
+	return ep.(*endpoint).sendBatch(bufs)
+}
+
 var errConnClosed = errors.New("Conn closed")
 
 var errDropDerpPacket = errors.New("too many DERP packets queued; dropping")
 
+// sendResult is the outcome of sending one packet with sendAddr.
+type sendResult int
+
+const (
+	// sendOK means the packet was written to a UDP socket or
+	// queued for DERP.
+	sendOK sendResult = iota
+
+	// sendSuppressed means nothing was sent, but it's not an
+	// error: the local machine has no socket for the address's
+	// family, writes to the family are failing while it's known
+	// to be unavailable (see noV4 and noV6), or there's no DERP
+	// connection to send via.
+	sendSuppressed
+
+	// sendDropped means the packet was dropped because its DERP
+	// region's write queue was full. It's returned with
+	// errDropDerpPacket.
+	sendDropped
+
+	// sendFailed means writing the packet failed. It's returned
+	// with the error.
+	sendFailed
+)
+
+func (r sendResult) String() string {
+	switch r {
+	case sendOK:
+		return "ok"
+	case sendSuppressed:
+		return "suppressed"
+	case sendDropped:
+		return "dropped"
+	case sendFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("sendResult(%d)", int(r))
+}
+
+// metricSendResults counts packets to peers and DERP, by their
+// sendResult, that weren't sent. Packets that were sent are
+// counted in Conn's stats instead.
+var metricSendResults = &metrics.LabelMap{Label: "result"}
+
+func init() {
+	expvar.Publish("counter_magicsock_send_not_ok", metricSendResults)
+}
+
+// noteSendResult counts n packets that had the result r.
+func noteSendResult(r sendResult, n int) {
+	if r != sendOK && n > 0 {
+		metricSendResults.Get(r.String()).Add(int64(n))
+	}
+}
+
+var (
+	// metricDERPSendQueueFull counts DERP packets dropped,
+	// process-wide, because a region's write queue was full.
+	metricDERPSendQueueFull expvar.Int
+
+	// metricDERPSendQueueFullRegion is metricDERPSendQueueFull
+	// broken down by DERP region ID.
+	metricDERPSendQueueFullRegion = &metrics.LabelMap{Label: "region"}
+)
+
+func init() {
+	expvar.Publish("counter_magicsock_derp_send_queue_full", &metricDERPSendQueueFull)
+	expvar.Publish("counter_magicsock_derp_send_queue_full_region", metricDERPSendQueueFullRegion)
+}
+
 var udpAddrPool = &sync.Pool{
 	New: func() interface{} { return new(net.UDPAddr) },
 }
 
 // sendUDP sends UDP packet b to ipp.
 // See sendAddr's docs on the return value meanings.
-func (c *Conn) sendUDP(ipp netaddr.IPPort, b []byte) (sent bool, err error) {
+func (c *Conn) sendUDP(ipp netaddr.IPPort, b []byte) (sendResult, error) {
 	ua := udpAddrPool.Get().(*net.UDPAddr)
 	defer udpAddrPool.Put(ua)
 	return c.sendUDPStd(ipp.UDPAddrAt(ua), b)
 }
 
+// sendUDPBatch sends UDP packets bufs to ipp and returns the number
+// sent, and the result for the rest: sendOK if all were sent, or
+// else why bufs[n:] weren't, as for sendUDP. Unsent packets are
+// counted by their result in counter_magicsock_send_not_ok.
+func (c *Conn) sendUDPBatch(ipp netaddr.IPPort, bufs [][]byte) (n int, res sendResult, err error) {
+	ua := udpAddrPool.Get().(*net.UDPAddr)
+	defer udpAddrPool.Put(ua)
+	addr := ipp.UDPAddrAt(ua)
+	switch {
+	case addr.IP.To4() != nil:
+		n, err = c.pconn4.WriteBatchTo(bufs, addr)
+		if err != nil && c.noV4.Get() {
+			err, res = nil, sendSuppressed
+		}
+	case len(addr.IP) == net.IPv6len:
+		if c.pconn6 == nil {
+			noteSendResult(sendSuppressed, len(bufs))
+			return 0, sendSuppressed, nil
+		}
+		n, err = c.pconn6.WriteBatchTo(bufs, addr)
+		if err != nil && c.noV6.Get() {
+			err, res = nil, sendSuppressed
+		}
+	default:
+		panic("bogus sendUDPBatch addr type")
+	}
+	if err != nil {
+		res = sendFailed
+	}
+	noteSendResult(res, len(bufs)-n)
+	if n > 0 {
+		var nbytes int
+		for _, b := range bufs[:n] {
+			nbytes += len(b)
+		}
+		c.stats.udpSentPackets.Add(int64(n))
+		c.stats.udpSentBytes.Add(int64(nbytes))
+	}
+	return n, res, err
+}
+
 // sendUDP sends UDP packet b to addr.
 // See sendAddr's docs on the return value meanings.
-func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
+func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (res sendResult, err error) {
 	switch {
 	case addr.IP.To4() != nil:
 		_, err = c.pconn4.WriteTo(b, addr)
 		if err != nil && c.noV4.Get() {
-			return false, nil
+			return sendSuppressed, nil
 		}
 	case len(addr.IP) == net.IPv6len:
 		if c.pconn6 == nil {
 			// ignore IPv6 dest if we don't have an IPv6 address.
-			return false, nil
+			return sendSuppressed, nil
 		}
 		_, err = c.pconn6.WriteTo(b, addr)
 		if err != nil && c.noV6.Get() {
-			return false, nil
+			return sendSuppressed, nil
 		}
 	default:
 		panic("bogus sendUDPStd addr type")
 	}
-	return err == nil, err
+	if err != nil {
+		return sendFailed, err
+	}
+	c.stats.udpSentPackets.Add(1)
+	c.stats.udpSentBytes.Add(int64(len(b)))
+	return sendOK, nil
 }
 
 // sendAddr sends packet b to addr, which is either a real UDP address
 // or a fake UDP address representing a DERP server (see derpmap.go).
 // The provided public key identifies the recipient.
 //
-// The returned err is whether there was an error writing when it
-// should've worked.
-// The returned sent is whether a packet went out at all.
-// An example of when they might be different: sending to an
-// IPv6 address when the local machine doesn't have IPv6 support
-// returns (false, nil); it's not an error, but nothing was sent.
-func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.Public, b []byte) (sent bool, err error) {
+// The returned res is whether the packet went out at all and, if
+// not, why; see sendResult. The returned err is the error writing
+// when it should've worked, for sendDropped and sendFailed.
+// For example, sending to an IPv6 address when the local machine
+// doesn't have IPv6 support returns (sendSuppressed, nil): nothing
+// was sent, but it's not an error.
+// Packets that weren't sent are counted by their result in
+// counter_magicsock_send_not_ok.
+func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.Public, b []byte) (res sendResult, err error) {
+	defer func() { noteSendResult(res, 1) }()
 	if addr.IP() != derpMagicIPAddr {
 		return c.sendUDP(addr, b)
 	}
 
 	ch := c.derpWriteChanOfAddr(addr, pubKey)
 	if ch == nil {
-		return false, nil
+		return sendSuppressed, nil
 	}
+	return c.queueDERPWrite(ch, addr, pubKey, b)
+}
 
+// queueDERPWrite queues a copy of b to be written to pubKey via ch,
+// the write channel of the DERP connection for addr. It doesn't
+// block: if too many writes are queued, b is dropped.
+func (c *Conn) queueDERPWrite(ch chan<- derpWriteRequest, addr netaddr.IPPort, pubKey key.Public, b []byte) (sendResult, error) {
 	// TODO(bradfitz): this makes garbage for now; we could use a
 	// buffer pool later.  Previously we passed ownership of this
 	// to derpWriteRequest and waited for derphttp.Client.Send to
@@ -1184,18 +2477,43 @@ func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.Public, b []byte) (sent
 
 	select {
 	case <-c.donec:
-		return false, errConnClosed
+		return sendFailed, errConnClosed
 	case ch <- derpWriteRequest{addr, pubKey, pkt}:
-		return true, nil
+		return sendOK, nil
 	default:
 		// Too many writes queued. Drop packet.
-		return false, errDropDerpPacket
+		c.derpSendQueueFull.Add(1)
+		metricDERPSendQueueFull.Add(1)
+		metricDERPSendQueueFullRegion.Get(strconv.Itoa(int(addr.Port()))).Add(1)
+		return sendDropped, errDropDerpPacket
+	}
+}
+
+// SendDERPControl sends b to the node with public key pub via c's
+// connection to DERP region regionID, connecting to the region first
+// if needed, for signaling that reuses established DERP connections.
+// Unlike packets to peers, b is never sent via another region, even
+// if pub was last heard from there. The write is queued, not waited
+// for, and fails if too many writes to the region are already queued.
+func (c *Conn) SendDERPControl(regionID int, pub key.Public, b []byte) error {
+	if regionID <= 0 || regionID > math.MaxUint16 {
+		return fmt.Errorf("magicsock: invalid DERP region %d", regionID)
 	}
+	if len(b) > derp.MaxPacketSize {
+		return fmt.Errorf("magicsock: DERP control message of %d bytes exceeds max of %d", len(b), derp.MaxPacketSize)
+	}
+	addr := netaddr.IPPortFrom(derpMagicIPAddr, uint16(regionID))
+	ch := c.derpWriteChanOfAddr(addr, key.Public{})
+	if ch == nil {
+		return fmt.Errorf("magicsock: no connection to DERP region %d", regionID)
+	}
+	_, err := c.queueDERPWrite(ch, addr, pub, b)
+	return err
 }
 
 // bufferedDerpWritesBeforeDrop is how many packets writes can be
 // queued up the DERP client to write on the wire before we start
-// dropping.
+// dropping, unless overridden by Options.DERPWriteQueueDepth.
 //
 // TODO: this is currently arbitrary. Figure out something better?
 const bufferedDerpWritesBeforeDrop = 32
@@ -1243,7 +2561,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	// perhaps peer's home is Frankfurt, but they dialed our home DERP
 	// node in SF to reach us, so we can reply to them using our
 	// SF connection rather than dialing Frankfurt. (Issue 150)
-	if !peer.IsZero() && useDerpRoute() {
+	if !peer.IsZero() && c.derpRouteEnabled() {
 		if r, ok := c.derpRoute[peer]; ok {
 			if ad, ok := c.activeDerp[r.derpID]; ok && ad.c == r.dc {
 				c.setPeerLastDerpLocked(peer, r.derpID, regionID)
@@ -1253,6 +2571,11 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 		}
 	}
 
+	if c.derpMap == nil || c.derpMap.Regions[regionID] == nil {
+		return nil
+	}
+	c.enforceMaxActiveDERPLocked()
+
 	why := "home-keep-alive"
 	if !peer.IsZero() {
 		why = peerShort(peer)
@@ -1265,9 +2588,6 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 		c.activeDerp = make(map[int]activeDerp)
 		c.prevDerp = make(map[int]*syncs.WaitGroupChan)
 	}
-	if c.derpMap == nil || c.derpMap.Regions[regionID] == nil {
-		return nil
-	}
 
 	// Note that derphttp.NewRegionClient does not dial the server
 	// so it is safe to do under the mu lock.
@@ -1290,7 +2610,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	dc.DNSCache = dnscache.Get()
 
 	ctx, cancel := context.WithCancel(c.connCtx)
-	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
+	ch := make(chan derpWriteRequest, c.derpWriteQueueDepth)
 
 	ad.c = dc
 	ad.writeCh = ch
@@ -1385,6 +2705,54 @@ type derpReadResult struct {
 	copyBuf func(dst []byte) int
 }
 
+const (
+	// derpRestartJitter is the most extra time, beyond a restarting
+	// DERP server's advised ReconnectIn, that we wait before
+	// reconnecting, so the server's clients don't all come back at
+	// once.
+	derpRestartJitter = 2 * time.Second
+
+	// derpRestartRetryInterval is how often we retry connecting to a
+	// restarting DERP server within its advised TryFor.
+	derpRestartRetryInterval = 250 * time.Millisecond
+)
+
+// derpRestart is when to reconnect to a DERP server that announced,
+// with a derp.ServerRestartingMessage, that it's restarting.
+type derpRestart struct {
+	reconnectAt time.Time // when to first try to reconnect
+	tryUntil    time.Time // when to give up and back off as usual
+}
+
+// newDerpRestart returns the derpRestart for m, received at now.
+func newDerpRestart(m derp.ServerRestartingMessage, now time.Time) derpRestart {
+	reconnectAt := now.Add(m.ReconnectIn + time.Duration(rand.Int63n(int64(derpRestartJitter))))
+	return derpRestart{
+		reconnectAt: reconnectAt,
+		tryUntil:    reconnectAt.Add(m.TryFor),
+	}
+}
+
+// wait returns how long, at now, to wait before next trying to
+// reconnect to the restarting server, and whether r still applies.
+// If not, the caller should back off as for any other failure.
+func (r derpRestart) wait(now time.Time) (d time.Duration, ok bool) {
+	if r.reconnectAt.IsZero() {
+		return 0, false
+	}
+	if now.Before(r.reconnectAt) {
+		return r.reconnectAt.Sub(now), true
+	}
+	if now.Before(r.tryUntil) {
+		return derpRestartRetryInterval, true
+	}
+	return 0, false
+}
+
+// derpProblemDisconnected is the problem passed to
+// Options.DERPHealthFunc when a DERP connection is lost.
+const derpProblemDisconnected = "connection lost"
+
 // runDerpReader runs in a goroutine for the life of a DERP
 // connection, handling received packets.
 func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, dc *derphttp.Client, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
@@ -1410,11 +2778,27 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 	defer health.SetDERPRegionConnectedState(regionID, false)
 	defer health.SetDERPRegionHealth(regionID, "")
 
+	// lastProblem is the problem last passed to c.derpHealthFunc.
+	var lastProblem string
+	noteHealth := func(problem string) {
+		if problem == lastProblem {
+			return
+		}
+		lastProblem = problem
+		if c.derpHealthFunc != nil {
+			c.derpHealthFunc(regionID, problem)
+		}
+	}
+	defer noteHealth("")
+
 	// peerPresent is the set of senders we know are present on this
 	// connection, based on messages we've received from the server.
 	peerPresent := map[key.Public]bool{}
 	bo := backoff.NewBackoff(fmt.Sprintf("derp-%d", regionID), c.logf, 5*time.Second)
 	var lastPacketTime time.Time
+	// restart is set when the server says it's restarting, and
+	// replaces bo until we reconnect or it lapses.
+	var restart derpRestart
 
 	for {
 		msg, connGen, err := dc.RecvDetail()
@@ -1439,6 +2823,22 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 			}
 
 			c.logf("magicsock: [%p] derp.Recv(derp-%d): %v", dc, regionID, err)
+			noteHealth(derpProblemDisconnected)
+
+			// If the server told us it was restarting, reconnect when
+			// it asked rather than as soon as the backoff allows.
+			// Our network is fine, so there's no need to re-STUN.
+			if d, ok := restart.wait(time.Now()); ok {
+				t := time.NewTimer(d)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return
+				case <-t.C:
+				}
+				continue
+			}
+			restart = derpRestart{}
 
 			// If our DERP connection broke, it might be because our network
 			// conditions changed. Start that check.
@@ -1465,6 +2865,8 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 		case derp.ServerInfoMessage:
 			health.SetDERPRegionConnectedState(regionID, true)
 			health.SetDERPRegionHealth(regionID, "") // until declared otherwise
+			noteHealth("")
+			restart = derpRestart{}
 			c.logf("magicsock: derp-%d connected; connGen=%v", regionID, connGen)
 			continue
 		case derp.ReceivedPacket:
@@ -1491,6 +2893,15 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 			continue
 		case derp.HealthMessage:
 			health.SetDERPRegionHealth(regionID, m.Problem)
+			noteHealth(m.Problem)
+			continue
+		case derp.ServerRestartingMessage:
+			restart = newDerpRestart(m, now)
+			// Keep writes from dialing early, too, once the
+			// server hangs up.
+			dc.SetReconnectAt(restart.reconnectAt)
+			c.logf("magicsock: derp-%d server restarting; reconnecting in %v, for up to %v", regionID, restart.reconnectAt.Sub(now).Round(time.Millisecond), m.TryFor)
+			continue
 		default:
 			// Ignore.
 			continue
@@ -1533,48 +2944,69 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 			return
 		case wr := <-ch:
 			err := dc.Send(wr.pubKey, wr.b)
-			if err != nil {
+			if err == derphttp.ErrReconnectPending {
+				// The server said it's restarting; dropped
+				// quietly until it's time to come back.
+			} else if err != nil {
 				c.logf("magicsock: derp.Send(%v): %v", wr.addr, err)
+			} else {
+				c.stats.derpSentPackets.Add(1)
+				c.stats.derpSentBytes.Add(int64(len(wr.b)))
 			}
 		}
 	}
 }
 
-// receiveIPv6 receives a UDP IPv6 packet. It is called by wireguard-go.
-func (c *Conn) receiveIPv6(b []byte) (int, conn.Endpoint, error) {
-	health.ReceiveIPv6.Enter()
-	defer health.ReceiveIPv6.Exit()
-	for {
-		n, ipp, err := c.pconn6.ReadFromNetaddr(b)
-		if err != nil {
-			return 0, nil, err
-		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6); ok {
-			return n, ep, nil
-		}
-	}
-}
-
-// receiveIPv4 receives a UDP IPv4 packet. It is called by wireguard-go.
-func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
-	health.ReceiveIPv4.Enter()
-	defer health.ReceiveIPv4.Exit()
-	for {
-		n, ipp, err := c.pconn4.ReadFromNetaddr(b)
-		if err != nil {
-			return 0, nil, err
+// mkReceiveFunc returns a wireguard-go receive func that reads UDP
+// packets from ruc, a socket of the given network ("udp4" or "udp6").
+// If hs is non-nil, calls to the func are tracked in it.
+//
+// The func is only called from one goroutine at a time, so it owns
+// its endpoint cache and control message buffer.
+func (c *Conn) mkReceiveFunc(ruc *RebindingUDPConn, network string, hs *health.ReceiveFuncStats) conn.ReceiveFunc {
+	// cache caches an IPPort->endpoint for hot flows.
+	var cache ippEndpointCache
+	// oob is for reading control messages when recordRecvLocalAddrs
+	// is set. It's nil until first needed.
+	var oob []byte
+	return func(b []byte) (n int, ep conn.Endpoint, err error) {
+		if hs != nil {
+			hs.Enter()
+			defer hs.Exit()
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4); ok {
-			return n, ep, nil
+		for {
+			var ipp netaddr.IPPort
+			var dst netaddr.IP
+			if c.recordRecvLocalAddrs {
+				if oob == nil {
+					if network == "udp4" {
+						oob = ipv4.NewControlMessage(ipv4.FlagDst)
+					} else {
+						oob = ipv6.NewControlMessage(ipv6.FlagDst)
+					}
+				}
+				n, ipp, dst, err = ruc.ReadFromNetaddrDst(b, oob)
+			} else {
+				n, ipp, err = ruc.ReadFromNetaddr(b)
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			if ep, ok := c.receiveIP(b[:n], ipp, dst, &cache); ok {
+				return n, ep, nil
+			}
 		}
 	}
 }
 
-// receiveIP is the shared bits of ReceiveIPv4 and ReceiveIPv6.
+// receiveIP is the shared bits of the funcs from mkReceiveFunc.
+// dst is the local address the packet was received on, if known.
 //
 // ok is whether this read should be reported up to wireguard-go (our
 // caller).
-func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache) (ep *endpoint, ok bool) {
+func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, dst netaddr.IP, cache *ippEndpointCache) (ep *endpoint, ok bool) {
+	c.stats.udpRecvPackets.Add(1)
+	c.stats.udpRecvBytes.Add(int64(len(b)))
 	if stun.Is(b) {
 		c.stunReceiveFunc.Load().(func([]byte, netaddr.IPPort))(b, ipp)
 		return nil, false
@@ -1603,6 +3035,10 @@ func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache)
 		ep = de
 	}
 	ep.noteRecvActivity()
+	ep.noteRecvTransport(false)
+	if !dst.IsZero() {
+		ep.noteRecvLocalAddr(dst)
+	}
 	return ep, true
 }
 
@@ -1640,6 +3076,8 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep *en
 		c.logf("magicsock: %v", err)
 		return 0, nil
 	}
+	c.stats.derpRecvPackets.Add(1)
+	c.stats.derpRecvBytes.Add(int64(n))
 
 	ipp := netaddr.IPPortFrom(derpMagicIPAddr, uint16(regionID))
 	if c.handleDiscoMessage(b[:n], ipp) {
@@ -1657,6 +3095,7 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep *en
 	}
 
 	ep.noteRecvActivity()
+	ep.noteRecvTransport(true)
 	return n, ep
 }
 
@@ -1690,21 +3129,174 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstD
 	c.mu.Unlock()
 
 	pkt = box.SealAfterPrecomputation(pkt, m.AppendMarshal(nil), &nonce, sharedKey)
-	sent, err = c.sendAddr(dst, key.Public(dstKey), pkt)
+	res, err := c.sendAddr(dst, key.Public(dstKey), pkt)
+	sent = res == sendOK
 	if sent {
 		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco) {
 			c.logf("[v1] magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), dstKey.ShortString(), derpStr(dst.String()), disco.MessageSummary(m))
 		}
-	} else if err == nil {
+	} else if res == sendSuppressed {
 		// Can't send. (e.g. no IPv6 locally)
 	} else {
 		if !c.networkDown() {
-			c.logf("magicsock: disco: failed to send %T to %v: %v", m, dst, err)
+			c.logDiscoSendErr(m, dst, err)
 		}
 	}
 	return sent, err
 }
 
+const (
+	// discoSendErrLogInterval is how often a failure to send disco
+	// messages to a given destination is logged, at most.
+	discoSendErrLogInterval = 5 * time.Second
+
+	// maxDiscoSendErrLogs bounds the number of destinations
+	// tracked for discoSendErrLogInterval.
+	maxDiscoSendErrLogs = 256
+
+	// discoRecvErrLogInterval is how often a disco message from a
+	// given sender that can't be opened, or one that can't be
+	// parsed, is logged, at most.
+	discoRecvErrLogInterval = time.Minute
+
+	// maxDiscoRecvErrLogs bounds the number of senders tracked for
+	// discoRecvErrLogInterval.
+	maxDiscoRecvErrLogs = 256
+)
+
+// metricDiscoSendErrLogsSuppressed counts, process-wide, the disco
+// send failures not logged because of discoSendErrLogInterval.
+var metricDiscoSendErrLogsSuppressed expvar.Int
+
+func init() {
+	expvar.Publish("counter_magicsock_disco_send_err_logs_suppressed", &metricDiscoSendErrLogsSuppressed)
+}
+
+// discoSendErrLog is the logging state of failed disco sends to one
+// destination.
+type discoSendErrLog struct {
+	lim        *rate.Limiter
+	suppressed int         // failures not logged since the last one that was
+	flush      *time.Timer // non-nil while suppressed failures await flushDiscoSendErrLog
+}
+
+// logDiscoSendErr logs that sending m to dst failed with err, unless
+// a failure to send to dst was logged within discoSendErrLogInterval.
+// Failures that aren't logged are counted in the next one that is, or
+// by flushDiscoSendErrLog if none is within discoSendErrLogInterval.
+//
+// c.mu must NOT be held.
+func (c *Conn) logDiscoSendErr(m disco.Message, dst netaddr.IPPort, err error) {
+	c.mu.Lock()
+	l, ok := c.discoSendErrLogs[dst]
+	if !ok {
+		if c.discoSendErrLogs == nil || len(c.discoSendErrLogs) >= maxDiscoSendErrLogs {
+			c.discoSendErrLogs = map[netaddr.IPPort]*discoSendErrLog{}
+		}
+		l = &discoSendErrLog{lim: rate.NewLimiter(rate.Every(discoSendErrLogInterval), 1)}
+		c.discoSendErrLogs[dst] = l
+	}
+	if !l.lim.Allow() {
+		l.suppressed++
+		if l.flush == nil {
+			l.flush = time.AfterFunc(discoSendErrLogInterval, func() { c.flushDiscoSendErrLog(dst, l) })
+		}
+		c.mu.Unlock()
+		metricDiscoSendErrLogsSuppressed.Add(1)
+		return
+	}
+	suppressed := l.suppressed
+	l.suppressed = 0
+	if l.flush != nil {
+		l.flush.Stop()
+		l.flush = nil
+	}
+	c.mu.Unlock()
+
+	if suppressed > 0 {
+		c.logf("magicsock: disco: failed to send %T to %v: %v (%d more failures since last logged)", m, dst, err, suppressed)
+		return
+	}
+	c.logf("magicsock: disco: failed to send %T to %v: %v", m, dst, err)
+}
+
+// flushDiscoSendErrLog logs the failures to send to dst that l
+// suppressed, if any still are, so they're reported even if no later
+// failure is logged.
+//
+// c.mu must NOT be held.
+func (c *Conn) flushDiscoSendErrLog(dst netaddr.IPPort, l *discoSendErrLog) {
+	c.mu.Lock()
+	suppressed := l.suppressed
+	l.suppressed = 0
+	l.flush = nil
+	closed := c.closed
+	c.mu.Unlock()
+	if suppressed > 0 && !closed {
+		c.logf("magicsock: disco: %d more failures to send to %v since last logged", suppressed, dst)
+	}
+}
+
+// discoRecvErr is a reason a received disco message couldn't be
+// handled.
+type discoRecvErr int
+
+const (
+	discoRecvErrOpen  discoRecvErr = iota // the naclbox didn't open
+	discoRecvErrParse                     // the box opened, but its message didn't parse
+	numDiscoRecvErrs
+)
+
+func (e discoRecvErr) String() string {
+	switch e {
+	case discoRecvErrOpen:
+		return "failed to open naclbox (wrong rcpt?)"
+	case discoRecvErrParse:
+		return "failed to parse message"
+	default:
+		return fmt.Sprintf("discoRecvErr(%d)", int(e))
+	}
+}
+
+// discoRecvErrLog is the logging state of bad disco messages from one
+// sender, kept per discoRecvErr so that a stream of one doesn't hide
+// the other.
+type discoRecvErrLog struct {
+	lim        [numDiscoRecvErrs]*rate.Limiter
+	suppressed [numDiscoRecvErrs]int // messages not logged since the last one that was
+}
+
+// logDiscoRecvErrLocked logs that a disco message from sender
+// couldn't be handled because of why, unless one from sender was
+// logged for the same reason within discoRecvErrLogInterval. Messages
+// that aren't logged are counted in the next one that is.
+//
+// c.mu must be held.
+func (c *Conn) logDiscoRecvErrLocked(sender tailcfg.DiscoKey, why discoRecvErr) {
+	l, ok := c.discoRecvErrLogs[sender]
+	if !ok {
+		if c.discoRecvErrLogs == nil || len(c.discoRecvErrLogs) >= maxDiscoRecvErrLogs {
+			c.discoRecvErrLogs = map[tailcfg.DiscoKey]*discoRecvErrLog{}
+		}
+		l = new(discoRecvErrLog)
+		for i := range l.lim {
+			l.lim[i] = rate.NewLimiter(rate.Every(discoRecvErrLogInterval), 1)
+		}
+		c.discoRecvErrLogs[sender] = l
+	}
+	if !l.lim[why].Allow() {
+		l.suppressed[why]++
+		return
+	}
+	suppressed := l.suppressed[why]
+	l.suppressed[why] = 0
+	if suppressed > 0 {
+		c.logf("magicsock: disco: %v from %v (%d more since last logged)", why, sender.ShortString(), suppressed)
+		return
+	}
+	c.logf("magicsock: disco: %v from %v", why, sender.ShortString())
+}
+
 // handleDiscoMessage handles a discovery message and reports whether
 // msg was a Tailscale inter-node discovery message.
 //
@@ -1732,6 +3324,15 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 	var sender tailcfg.DiscoKey
 	copy(sender[:], msg[len(disco.Magic):])
 
+	// pathChanged, if non-nil, is a peer whose send path changed
+	// while handling msg, to be reported once c.mu is released.
+	var pathChanged *endpoint
+	defer func() {
+		if pathChanged != nil {
+			pathChanged.reportPathChange()
+		}
+	}()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -1784,10 +3385,14 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 		// Don't log in normal case. Pass on to wireguard, in case
 		// it's actually a wireguard packet (super unlikely,
 		// but).
+		// Count it and log it rarely though, as a steady stream
+		// of these means sender has a stale disco key for us.
+		metricDiscoRecvBoxOpenErrors.Add(1)
 		if debugDisco {
 			c.logf("magicsock: disco: failed to open naclbox from %v (wrong rcpt?)", sender)
+		} else {
+			c.logDiscoRecvErrLocked(sender, discoRecvErrOpen)
 		}
-		// TODO(bradfitz): add some counter for this that logs rarely
 		return
 	}
 
@@ -1799,9 +3404,10 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 		// Couldn't parse it, but it was inside a correctly
 		// signed box, so just ignore it, assuming it's from a
 		// newer version of Tailscale that we don't
-		// understand. Not even worth logging about, lest it
-		// be too spammy for old clients.
-		// TODO(bradfitz): add some counter for this that logs rarely
+		// understand. Only logged rarely, lest it be too
+		// spammy for old clients.
+		metricDiscoRecvParseErrors.Add(1)
+		c.logDiscoRecvErrLocked(sender, discoRecvErrParse)
 		return
 	}
 
@@ -1809,7 +3415,9 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 	case *disco.Ping:
 		c.handlePingLocked(dm, ep, src, sender)
 	case *disco.Pong:
-		ep.handlePongConnLocked(dm, src)
+		if ep.handlePongConnLocked(dm, src) {
+			pathChanged = ep
+		}
 	case *disco.CallMeMaybe:
 		if src.IP() != derpMagicIPAddr {
 			// CallMeMaybe messages should only come via DERP.
@@ -1826,6 +3434,15 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 }
 
 func (c *Conn) handlePingLocked(dm *disco.Ping, de *endpoint, src netaddr.IPPort, sender tailcfg.DiscoKey) {
+	if c.noAdvertiseEndpoints.Get() && src.IP() != derpMagicIPAddr {
+		// Relay-only; don't let the peer find a direct path to us.
+		return
+	}
+	if src.IP() != derpMagicIPAddr && !c.endpointAllowed(src) {
+		// Neither remember nor answer it, so no direct path
+		// forms via src.
+		return
+	}
 	likelyHeartBeat := src == de.lastPingFrom && time.Since(de.lastPingTime) < 5*time.Second
 	de.lastPingFrom = src
 	de.lastPingTime = time.Now()
@@ -1839,9 +3456,14 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, de *endpoint, src netaddr.IPPort
 
 	ipDst := src
 	discoDest := sender
+	// Reply to a version 1 ping in kind, whether or not we send
+	// them, so its sender can tell us from peers that predate them.
 	go c.sendDiscoMessage(ipDst, de.publicKey, discoDest, &disco.Pong{
-		TxID: dm.TxID,
-		Src:  src,
+		TxID:    dm.TxID,
+		Src:     src,
+		HasCaps: dm.HasCaps,
+		Caps:    dm.Caps & discoPingCaps,
+		Payload: dm.Payload,
 	}, discoVerboseLog)
 }
 
@@ -1853,6 +3475,9 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, de *endpoint, src netaddr.IPPort
 // If they do, traffic will just go over DERP for a bit longer until the next
 // discovery round.
 func (c *Conn) enqueueCallMeMaybe(derpAddr netaddr.IPPort, de *endpoint) {
+	if c.noAdvertiseEndpoints.Get() {
+		return
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -1877,11 +3502,53 @@ func (c *Conn) enqueueCallMeMaybe(derpAddr netaddr.IPPort, de *endpoint) {
 		return
 	}
 
+	go c.sendCallMeMaybe(derpAddr, de)
+}
+
+const (
+	// callMeMaybeRate and callMeMaybeBurst limit how quickly
+	// CallMeMaybe messages are sent, across all peers. When many
+	// peers become active at once (e.g. after waking from sleep),
+	// this spreads the burst over a couple seconds rather than
+	// flooding the home DERP connection.
+	callMeMaybeRate  = rate.Limit(50) // per second
+	callMeMaybeBurst = 20
+)
+
+// sendCallMeMaybe sends a CallMeMaybe to de over DERP via derpAddr,
+// first waiting for c.callMeMaybeLimiter. It gives up if c is closed
+// while waiting. The message carries our endpoints as of when it's
+// sent, not as of when it was enqueued.
+func (c *Conn) sendCallMeMaybe(derpAddr netaddr.IPPort, de *endpoint) {
+	r := c.callMeMaybeLimiter.Reserve()
+	if d := r.Delay(); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-c.donec:
+			// Give back the slot so it doesn't delay the
+			// CallMeMaybes that are still to be sent.
+			r.Cancel()
+			return
+		}
+	}
+	if c.noAdvertiseEndpoints.Get() {
+		return
+	}
+	c.mu.Lock()
 	eps := make([]netaddr.IPPort, 0, len(c.lastEndpoints))
 	for _, ep := range c.lastEndpoints {
 		eps = append(eps, ep.Addr)
 	}
-	go de.sendDiscoMessage(derpAddr, &disco.CallMeMaybe{MyNumber: eps}, discoLog)
+	c.mu.Unlock()
+	m := &disco.CallMeMaybe{MyNumber: eps}
+	de.mu.Lock()
+	if de.parsesCallMeMaybeTTL {
+		m.TTL = callMeMaybeTTL
+	}
+	de.mu.Unlock()
+	de.sendDiscoMessage(derpAddr, m, discoLog)
 }
 
 // setAddrToDiscoLocked records that newk is at src.
@@ -1900,32 +3567,104 @@ func (c *Conn) setAddrToDiscoLocked(src netaddr.IPPort, newk tailcfg.DiscoKey) {
 	c.peerMap.setDiscoKeyForIPPort(src, newk)
 }
 
-func (c *Conn) sharedDiscoKeyLocked(k tailcfg.DiscoKey) *[32]byte {
-	if v, ok := c.sharedDiscoKey[k]; ok {
-		return v
-	}
-	shared := new([32]byte)
-	box.Precompute(shared, key.Public(k).B32(), c.discoPrivate.B32())
-	c.sharedDiscoKey[k] = shared
-	return shared
+const (
+	// sharedDiscoKeyIdleTimeout is how long a precomputed shared
+	// disco key can go unused before it's evicted from
+	// Conn.sharedDiscoKey, to be recomputed if needed again.
+	sharedDiscoKeyIdleTimeout = 10 * time.Minute
+
+	// maxSharedDiscoKeys is the most precomputed shared disco keys
+	// kept, regardless of how recently they were used.
+	maxSharedDiscoKeys = 4096
+)
+
+// sharedDiscoKey is a precomputed nacl/box key in Conn.sharedDiscoKey.
+type sharedDiscoKey struct {
+	disco    tailcfg.DiscoKey
+	key      [32]byte
+	lastUsed mono.Time
 }
 
-func (c *Conn) SetNetworkUp(up bool) {
+// sharedDiscoKeyLocked returns the precomputed nacl/box key for
+// communication with the peer that has disco key k, computing it if
+// it's not cached.
+//
+// c.mu must be held.
+func (c *Conn) sharedDiscoKeyLocked(k tailcfg.DiscoKey) *[32]byte {
+	now := mono.Now()
+	if e, ok := c.sharedDiscoKey[k]; ok {
+		v := e.Value.(*sharedDiscoKey)
+		v.lastUsed = now
+		c.sharedDiscoKeyLRU.MoveToFront(e)
+		return &v.key
+	}
+	c.evictSharedDiscoKeysLocked(now)
+	v := &sharedDiscoKey{disco: k, lastUsed: now}
+	box.Precompute(&v.key, key.Public(k).B32(), c.discoPrivate.B32())
+	c.sharedDiscoKey[k] = c.sharedDiscoKeyLRU.PushFront(v)
+	return &v.key
+}
+
+// evictSharedDiscoKeysLocked makes room in c.sharedDiscoKey for a
+// new entry. Starting from the least recently used, it evicts the
+// entries idle longer than sharedDiscoKeyIdleTimeout, and then more
+// if the map is still full.
+//
+// c.mu must be held.
+func (c *Conn) evictSharedDiscoKeysLocked(now mono.Time) {
+	for e := c.sharedDiscoKeyLRU.Back(); e != nil; e = c.sharedDiscoKeyLRU.Back() {
+		v := e.Value.(*sharedDiscoKey)
+		if len(c.sharedDiscoKey) < maxSharedDiscoKeys && now.Sub(v.lastUsed) <= sharedDiscoKeyIdleTimeout {
+			return
+		}
+		c.deleteSharedDiscoKeyLocked(v.disco)
+	}
+}
+
+// deleteSharedDiscoKeyLocked removes k's precomputed nacl/box key,
+// if any, from c.sharedDiscoKey.
+//
+// c.mu must be held.
+func (c *Conn) deleteSharedDiscoKeyLocked(k tailcfg.DiscoKey) {
+	if e, ok := c.sharedDiscoKey[k]; ok {
+		c.sharedDiscoKeyLRU.Remove(e)
+		delete(c.sharedDiscoKey, k)
+	}
+}
+
+func (c *Conn) SetNetworkUp(up bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	if c.networkUp.Get() == up {
+		c.mu.Unlock()
 		return
 	}
 
 	c.logf("magicsock: SetNetworkUp(%v)", up)
 	c.networkUp.Set(up)
 
+	ev := NetworkChangeUp
 	if up {
 		c.startDerpHomeConnectLocked()
 	} else {
+		ev = NetworkChangeDown
 		c.portMapper.NoteNetworkDown()
 		c.closeAllDerpLocked("network-down")
 	}
+	c.mu.Unlock()
+
+	if c.networkChangeFunc != nil {
+		c.networkChangeFunc(ev)
+	}
+}
+
+// onLinkChange is the Options.LinkMonitor callback. It refreshes
+// c.localPrefixes and reports major changes to c.networkChangeFunc,
+// if any.
+func (c *Conn) onLinkChange(changed bool, _ *interfaces.State) {
+	c.updateLocalPrefixes()
+	if changed && c.networkChangeFunc != nil {
+		c.networkChangeFunc(NetworkChangeLink)
+	}
 }
 
 // SetPreferredPort sets the connection's preferred local port.
@@ -1940,6 +3679,9 @@ func (c *Conn) SetPreferredPort(port uint16) {
 		return
 	}
 	c.resetEndpointStates()
+	if c.networkChangeFunc != nil {
+		c.networkChangeFunc(NetworkChangeRebind)
+	}
 }
 
 // SetPrivateKey sets the connection's private key.
@@ -2099,17 +3841,23 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		}
 
 		ep := &endpoint{
-			c:             c,
-			publicKey:     n.Key,
-			sentPing:      map[stun.TxID]sentPing{},
-			endpointState: map[netaddr.IPPort]*endpointState{},
+			c:                    c,
+			publicKey:            n.Key,
+			sentPing:             map[stun.TxID]sentPing{},
+			endpointState:        map[netaddr.IPPort]*endpointState{},
+			sessionActiveTimeout: c.peerKeepAlive[n.Key],
+			forceDERP:            c.peerForceDERP[n.Key],
 		}
 		if !n.DiscoKey.IsZero() {
 			ep.discoKey = n.DiscoKey
 			ep.discoShort = n.DiscoKey.ShortString()
 		}
 		ep.wgEndpoint = (wgkey.Key(n.Key)).HexString()
-		ep.initFakeUDPAddr()
+		if c.stableFakeUDPAddrs {
+			ep.initStableFakeUDPAddr()
+		} else {
+			ep.initFakeUDPAddr()
+		}
 		c.logf("magicsock: created endpoint key=%s: disco=%s; %v", n.Key.ShortString(), n.DiscoKey.ShortString(), logger.ArgWriter(func(w *bufio.Writer) {
 			const derpPrefix = "127.3.3.40:"
 			if strings.HasPrefix(n.DERP, derpPrefix) {
@@ -2151,7 +3899,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 			if !keep[ep.publicKey] {
 				c.peerMap.deleteDiscoEndpoint(ep)
 				if !ep.discoKey.IsZero() {
-					delete(c.sharedDiscoKey, ep.discoKey)
+					c.deleteSharedDiscoKeyLocked(ep.discoKey)
 				}
 			}
 		})
@@ -2179,7 +3927,48 @@ func (c *Conn) closeDerpLocked(node int, why string) {
 		go ad.c.Close()
 		ad.cancel()
 		delete(c.activeDerp, node)
+		if node == c.prevHomeDerp {
+			c.prevHomeDerp = 0
+		}
+	}
+}
+
+// enforceMaxActiveDERPLocked closes the least recently written
+// non-home DERP connections as needed to make room for a new one
+// under c.maxActiveDERPConns. Once only home connections are left,
+// it stops: the new connection is opened regardless, so that a peer
+// off our home region is never unreachable because of the limit.
+//
+// c.mu must be held.
+func (c *Conn) enforceMaxActiveDERPLocked() {
+	if c.maxActiveDERPConns <= 0 {
+		return
+	}
+	for len(c.activeDerp) >= c.maxActiveDERPConns {
+		lru, ok := c.lruNonHomeDerpLocked()
+		if !ok {
+			return
+		}
+		c.closeDerpLocked(lru, "max-conns")
+	}
+}
+
+// lruNonHomeDerpLocked returns the region ID of the non-home DERP
+// connection (per isDERPHomeLocked) that was least recently written,
+// if any.
+//
+// c.mu must be held.
+func (c *Conn) lruNonHomeDerpLocked() (regionID int, ok bool) {
+	var oldest time.Time
+	for i, ad := range c.activeDerp {
+		if c.isDERPHomeLocked(i) {
+			continue
+		}
+		if !ok || ad.lastWrite.Before(oldest) {
+			regionID, oldest, ok = i, *ad.lastWrite, true
+		}
 	}
+	return regionID, ok
 }
 
 // c.mu must be held.
@@ -2232,27 +4021,63 @@ func (c *Conn) cleanStaleDerp() {
 		return
 	}
 	c.derpCleanupTimerArmed = false
+	c.cleanStaleDerpLocked(derpInactiveCleanupTime)
+}
+
+// CloseIdleDERP closes the connections to DERP regions that haven't
+// been written to in olderThan, returning how many it closed. It's
+// like the periodic cleanup of connections idle for a minute, but
+// with a caller-chosen threshold, so that a memory monitor can shed
+// connections sooner under pressure. The connection to the home
+// region, and to the previous home while peers may still use it, is
+// never closed.
+func (c *Conn) CloseIdleDERP(olderThan time.Duration) int {
+	if olderThan < 0 {
+		olderThan = 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0
+	}
+	return c.cleanStaleDerpLocked(olderThan)
+}
 
-	tooOld := time.Now().Add(-derpInactiveCleanupTime)
-	dirty := false
+// cleanStaleDerpLocked closes the DERP connections, other than to
+// home regions, not written to in olderThan, and returns how many it
+// closed. If any others remain open, it schedules cleanStaleDerp.
+//
+// c.mu must be held.
+func (c *Conn) cleanStaleDerpLocked(olderThan time.Duration) (closed int) {
+	tooOld := time.Now().Add(-olderThan)
 	someNonHomeOpen := false
 	for i, ad := range c.activeDerp {
 		if i == c.myDerp {
 			continue
 		}
+		if i == c.prevHomeDerp {
+			if c.isDERPHomeLocked(i) {
+				// Still dual-homed; check again later.
+				someNonHomeOpen = true
+				continue
+			}
+			c.prevHomeDerp = 0
+			go ad.c.NotePreferred(false)
+		}
 		if ad.lastWrite.Before(tooOld) {
 			c.closeDerpLocked(i, "idle")
-			dirty = true
+			closed++
 		} else {
 			someNonHomeOpen = true
 		}
 	}
-	if dirty {
+	if closed > 0 {
 		c.logActiveDerpLocked()
 	}
 	if someNonHomeOpen {
 		c.scheduleCleanStaleDerpLocked()
 	}
+	return closed
 }
 
 func (c *Conn) scheduleCleanStaleDerpLocked() {
@@ -2270,6 +4095,27 @@ func (c *Conn) scheduleCleanStaleDerpLocked() {
 	}
 }
 
+// WaitDERPStarted blocks until c's first DERP connection attempt
+// has finished, which happens once there's a home DERP region to
+// connect to. It returns an error if ctx is done or c is closed
+// first. It's for tests and startup sequencing; most callers
+// shouldn't care, as packets to peers are queued until DERP is up.
+func (c *Conn) WaitDERPStarted(ctx context.Context) error {
+	select {
+	case <-c.derpStarted:
+		return nil
+	default:
+	}
+	select {
+	case <-c.derpStarted:
+		return nil
+	case <-c.donec:
+		return errConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // DERPs reports the number of active DERP connections.
 func (c *Conn) DERPs() int {
 	c.mu.Lock()
@@ -2278,6 +4124,257 @@ func (c *Conn) DERPs() int {
 	return len(c.activeDerp)
 }
 
+// HomeDERP returns our home DERP region's ID and code (such as
+// "nyc"). It returns zero and the empty string if there's no home
+// DERP region yet or DERP is disabled. The code is empty if the
+// region isn't in the current DERP map.
+func (c *Conn) HomeDERP() (regionID int, code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.myDerp == 0 {
+		return 0, ""
+	}
+	return c.myDerp, c.derpRegionCodeOfIDLocked(c.myDerp)
+}
+
+// ConnEventType is the type of a ConnEvent.
+type ConnEventType int
+
+const (
+	// ConnEventPathChanged means that the best direct UDP path to
+	// a peer changed. ConnEvent.Addr is the new path.
+	ConnEventPathChanged ConnEventType = iota + 1
+
+	// ConnEventDERPHomeChanged means that our home DERP region
+	// changed. ConnEvent.DERPRegionID is the new home.
+	ConnEventDERPHomeChanged
+
+	// ConnEventCandidateDiscovered means that a new candidate
+	// endpoint was learned for a peer at runtime, from an incoming
+	// ping or a CallMeMaybe. ConnEvent.Addr is the candidate.
+	ConnEventCandidateDiscovered
+
+	// ConnEventEndpointsChanged means that our own set of endpoints
+	// changed, such as after a NAT rebinding.
+	// ConnEvent.Endpoints is the new set.
+	ConnEventEndpointsChanged
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnEventPathChanged:
+		return "path-changed"
+	case ConnEventDERPHomeChanged:
+		return "derp-home-changed"
+	case ConnEventCandidateDiscovered:
+		return "candidate-discovered"
+	case ConnEventEndpointsChanged:
+		return "endpoints-changed"
+	}
+	return fmt.Sprintf("ConnEventType(%d)", int(t))
+}
+
+// NetworkChangeEvent is a kind of network change, as reported to
+// Options.NetworkChangeFunc.
+type NetworkChangeEvent int
+
+const (
+	// NetworkChangeUp means the network came up. See SetNetworkUp.
+	NetworkChangeUp NetworkChangeEvent = iota + 1
+
+	// NetworkChangeDown means the network went down.
+	NetworkChangeDown
+
+	// NetworkChangeLink means Options.LinkMonitor reported a major
+	// link change, such as an interface or default route changing.
+	NetworkChangeLink
+
+	// NetworkChangeRebind means the UDP sockets were rebound, by
+	// Rebind or SetPreferredPort.
+	NetworkChangeRebind
+)
+
+func (e NetworkChangeEvent) String() string {
+	switch e {
+	case NetworkChangeUp:
+		return "up"
+	case NetworkChangeDown:
+		return "down"
+	case NetworkChangeLink:
+		return "link-change"
+	case NetworkChangeRebind:
+		return "rebind"
+	}
+	return fmt.Sprintf("NetworkChangeEvent(%d)", int(e))
+}
+
+// PathKind is the kind of path used to send to a peer, as reported
+// to Options.PathChangeFunc.
+type PathKind int
+
+const (
+	// PathDirect means packets go to the peer over direct UDP.
+	PathDirect PathKind = iota + 1
+
+	// PathDERP means packets are relayed via DERP, either because
+	// there's no direct path or because it's no longer trusted.
+	PathDERP
+)
+
+func (k PathKind) String() string {
+	switch k {
+	case PathDirect:
+		return "direct"
+	case PathDERP:
+		return "derp"
+	}
+	return fmt.Sprintf("PathKind(%d)", int(k))
+}
+
+// ConnEvent is a connectivity event reported by Conn.Events.
+// Which fields are set depends on Type.
+type ConnEvent struct {
+	Type         ConnEventType
+	Peer         tailcfg.NodeKey    // for per-peer events; zero otherwise
+	Addr         netaddr.IPPort     // for ConnEventPathChanged and ConnEventCandidateDiscovered
+	DERPRegionID int                // for ConnEventDERPHomeChanged
+	Endpoints    []tailcfg.Endpoint // for ConnEventEndpointsChanged; owned by the receiver
+}
+
+// connEventBufferSize is how many ConnEvents can be queued for the
+// consumer of Conn.Events before new ones are dropped.
+const connEventBufferSize = 64
+
+// Events returns a channel of connectivity events: path changes,
+// DERP home changes, newly discovered peer candidates, and changes
+// to our own endpoints.
+//
+// The stream is lossy and best-effort, meant for observability and
+// not for control decisions: if the receiver doesn't keep up, events
+// are dropped (see EventsDropped) rather than blocking magicsock.
+// Events are only queued once Events has been called.
+// The channel is never closed, not even by Close.
+func (c *Conn) Events() <-chan ConnEvent {
+	c.eventsWanted.Set(true)
+	return c.events
+}
+
+// EventsDropped returns the number of ConnEvents dropped because the
+// receiver of Events wasn't keeping up.
+func (c *Conn) EventsDropped() int64 {
+	return c.eventsDropped.Value()
+}
+
+// DERPSendQueueFull returns the number of DERP packets c dropped
+// because the DERP region's write queue was full. The
+// counter_magicsock_derp_send_queue_full_region expvar has the
+// process-wide counts by region.
+func (c *Conn) DERPSendQueueFull() int64 {
+	return c.derpSendQueueFull.Value()
+}
+
+// Stats are the total packets and bytes a Conn has sent and received,
+// directly over UDP and via DERP, including disco and STUN traffic.
+type Stats struct {
+	UDPSentPackets  int64
+	UDPSentBytes    int64
+	UDPRecvPackets  int64
+	UDPRecvBytes    int64
+	DERPSentPackets int64
+	DERPSentBytes   int64
+	DERPRecvPackets int64
+	DERPRecvBytes   int64
+}
+
+// connStats is the counters behind Conn.Stats, updated atomically on
+// the send and receive paths.
+type connStats struct {
+	udpSentPackets, udpSentBytes   expvar.Int
+	udpRecvPackets, udpRecvBytes   expvar.Int
+	derpSentPackets, derpSentBytes expvar.Int
+	derpRecvPackets, derpRecvBytes expvar.Int
+}
+
+// Stats returns the totals of what c has sent and received.
+func (c *Conn) Stats() Stats {
+	s := &c.stats
+	return Stats{
+		UDPSentPackets:  s.udpSentPackets.Value(),
+		UDPSentBytes:    s.udpSentBytes.Value(),
+		UDPRecvPackets:  s.udpRecvPackets.Value(),
+		UDPRecvBytes:    s.udpRecvBytes.Value(),
+		DERPSentPackets: s.derpSentPackets.Value(),
+		DERPSentBytes:   s.derpSentBytes.Value(),
+		DERPRecvPackets: s.derpRecvPackets.Value(),
+		DERPRecvBytes:   s.derpRecvBytes.Value(),
+	}
+}
+
+// sendEvent queues ev for the receiver of c.Events, if any, without
+// blocking.
+//
+// c.mu and endpoint.mu may be held, but need not be.
+func (c *Conn) sendEvent(ev ConnEvent) {
+	if !c.eventsWanted.Get() {
+		return
+	}
+	select {
+	case c.events <- ev:
+	default:
+		c.eventsDropped.Add(1)
+	}
+}
+
+// endpointUpdateBufferSize is how many endpoint updates can be queued
+// for the receiver of Conn.EndpointUpdates.
+const endpointUpdateBufferSize = 8
+
+// EndpointUpdates returns a channel that receives our set of
+// endpoints each time it changes, alongside the Options.EndpointsFunc
+// callback. The receiver owns each slice.
+//
+// If the receiver doesn't keep up, the oldest queued updates are
+// dropped, so the most recent set is always delivered. Updates are
+// only queued once EndpointUpdates has been called; every call
+// returns the same channel. Close closes it.
+func (c *Conn) EndpointUpdates() <-chan []tailcfg.Endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.endpointUpdates == nil {
+		c.endpointUpdates = make(chan []tailcfg.Endpoint, endpointUpdateBufferSize)
+		if c.closed {
+			close(c.endpointUpdates)
+		}
+	}
+	return c.endpointUpdates
+}
+
+// sendEndpointUpdate queues a copy of eps for the receiver of
+// c.EndpointUpdates, if any, without blocking.
+//
+// c.mu must not be held.
+func (c *Conn) sendEndpointUpdate(eps []tailcfg.Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.endpointUpdates == nil || c.closed {
+		return
+	}
+	eps = append([]tailcfg.Endpoint(nil), eps...)
+	for {
+		select {
+		case c.endpointUpdates <- eps:
+			return
+		default:
+		}
+		// Full. Drop the oldest and try again; we're the
+		// only sender, so this terminates.
+		select {
+		case <-c.endpointUpdates:
+		default:
+		}
+	}
+}
+
 // Bind returns the wireguard-go conn.Bind for c.
 func (c *Conn) Bind() conn.Bind {
 	return c.bind
@@ -2304,9 +4401,21 @@ func (c *connBind) Open(ignoredPort uint16) ([]conn.ReceiveFunc, uint16, error)
 		return nil, 0, errors.New("magicsock: connBind already open")
 	}
 	c.closed = false
-	fns := []conn.ReceiveFunc{c.receiveIPv4, c.receiveIPv6, c.receiveDERP}
-	// TODO: Combine receiveIPv4 and receiveIPv6 and receiveIP into a single
-	// closure that closes over a *RebindingUDPConn?
+	fns := []conn.ReceiveFunc{c.receiveIPv4}
+	if c.pconn6 != nil {
+		if c.receiveIPv6 == nil {
+			// IPv6 failed to bind initially but was bound by a Rebind.
+			c.receiveIPv6 = c.mkReceiveFunc(c.pconn6, "udp6", &health.ReceiveIPv6)
+		}
+		fns = append(fns, c.receiveIPv6)
+	}
+	fns = append(fns, c.receiveDERP)
+	for _, ruc := range c.extraPconns4 {
+		fns = append(fns, c.mkReceiveFunc(ruc, "udp4", nil))
+	}
+	for _, ruc := range c.extraPconns6 {
+		fns = append(fns, c.mkReceiveFunc(ruc, "udp6", nil))
+	}
 	return fns, c.LocalPort(), nil
 }
 
@@ -2326,7 +4435,10 @@ func (c *connBind) Close() error {
 	c.closed = true
 	// Unblock all outstanding receives.
 	c.pconn4.Close()
-	c.pconn6.Close()
+	if c.pconn6 != nil {
+		c.pconn6.Close()
+	}
+	c.closeExtraSockets()
 	// Send an empty read result to unblock receiveDERP,
 	// which will then check connBind.Closed.
 	c.derpRecvCh <- derpReadResult{}
@@ -2354,20 +4466,28 @@ func (c *Conn) Close() error {
 	}
 	c.stopPeriodicReSTUNTimerLocked()
 	c.portMapper.Close()
+	if c.unregisterLinkChange != nil {
+		c.unregisterLinkChange()
+	}
 
 	c.peerMap.forEachDiscoEndpoint(func(ep *endpoint) {
 		ep.stopAndReset()
+		ep.releaseStableFakeUDPAddr()
 	})
 
 	c.closed = true
 	c.connCtxCancel()
 	c.closeAllDerpLocked("conn-close")
+	if c.endpointUpdates != nil {
+		close(c.endpointUpdates)
+	}
 	// Ignore errors from c.pconnN.Close.
 	// They will frequently have been closed already by a call to connBind.Close.
 	if c.pconn6 != nil {
 		c.pconn6.Close()
 	}
 	c.pconn4.Close()
+	c.closeExtraSockets()
 
 	// Wait on goroutines updating right at the end, once everything is
 	// already closed. We want everything else in the Conn to be
@@ -2402,11 +4522,156 @@ func (c *Conn) goroutinesRunningLocked() bool {
 	return false
 }
 
-func maxIdleBeforeSTUNShutdown() time.Duration {
+// maxIdleBeforeSTUNShutdownLocked returns how long c may be idle
+// before periodic STUN stops: Options.STUNIdleTimeout, or 45 seconds
+// when debugging that with TS_DEBUG_RESTUN_STOP_ON_IDLE, extended to
+// the longest SetPeerKeepAlive override of a current peer.
+//
+// c.mu must be held.
+func (c *Conn) maxIdleBeforeSTUNShutdownLocked() time.Duration {
+	max := c.stunIdleTimeout
 	if debugReSTUNStopOnIdle {
-		return 45 * time.Second
+		max = 45 * time.Second
+	}
+	for nk, d := range c.peerKeepAlive {
+		if _, ok := c.peerMap.endpointForNodeKey(nk); ok && d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// SetAdvertiseEndpoints sets whether c tells peers about its direct
+// (STUN, port-mapped, and local) endpoints. It's true by default.
+// When false, c reports no endpoints, sends no CallMeMaybe messages
+// or direct pings, and ignores pings that don't arrive via DERP, so
+// peers reach it only via DERP. That suits a node meant
+// to be relay-only, such as a hardened jump host.
+func (c *Conn) SetAdvertiseEndpoints(v bool) {
+	if c.noAdvertiseEndpoints.Get() == !v {
+		return
+	}
+	c.noAdvertiseEndpoints.Set(!v)
+	c.ReSTUN("advertise-endpoints-changed")
+}
+
+// SetLowPower sets whether c saves power while the TUN device is
+// idle, so heartbeats don't keep the radios of battery-powered
+// devices awake. Once Options.IdleFunc reports 10 seconds without TUN
+// activity, each active peer's heartbeat pings are sent every 30
+// seconds instead of every heartbeat interval, and no full pings to
+// look for better paths are sent. The next packet sent to a peer
+// restores its normal cadence. It does nothing without an IdleFunc.
+func (c *Conn) SetLowPower(v bool) {
+	c.lowPower.Set(v)
+}
+
+// lowPowerIdle reports whether c is in low power mode and idle.
+// See SetLowPower.
+func (c *Conn) lowPowerIdle() bool {
+	if !c.lowPower.Get() || c.idleFunc == nil {
+		return false
+	}
+	return c.idleFunc() >= lowPowerIdleTime
+}
+
+// SetPeerKeepAlive sets how long after the last packet sent to the
+// peer with node key nk its direct path is kept alive with heartbeats,
+// overriding the default of sessionActiveTimeout. A longer duration
+// keeps the path warm for peers with infrequent but important
+// traffic, so each burst doesn't have to rediscover it. Periodic
+// STUN also continues while the engine is idle for up to d.
+//
+// A d of zero or less restores the default. The override survives
+// network map updates, including nk being temporarily removed.
+func (c *Conn) SetPeerKeepAlive(nk tailcfg.NodeKey, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d <= 0 {
+		d = 0
+		delete(c.peerKeepAlive, nk)
+	} else {
+		if c.peerKeepAlive == nil {
+			c.peerKeepAlive = map[tailcfg.NodeKey]time.Duration{}
+		}
+		c.peerKeepAlive[nk] = d
+	}
+	if ep, ok := c.peerMap.endpointForNodeKey(nk); ok {
+		ep.mu.Lock()
+		ep.sessionActiveTimeout = d
+		ep.mu.Unlock()
+	}
+}
+
+// AddEndpointHint adds ipp as a candidate direct endpoint for the peer
+// with node key nk and pings it right away, for when the peer's
+// address is known out of band and waiting for a CallMeMaybe would be
+// slower. Like candidates discovered at runtime, a hint is forgotten
+// once it's gone sessionActiveTimeout without the peer pinging us
+// from it.
+func (c *Conn) AddEndpointHint(nk tailcfg.NodeKey, ipp netaddr.IPPort) {
+	if ipp.IsZero() || ipp.IP() == derpMagicIPAddr || !c.endpointAllowed(ipp) {
+		return
+	}
+	c.mu.Lock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		c.logf("[v1] magicsock: ignoring endpoint hint %v for unknown peer %v", ipp, nk.ShortString())
+		return
+	}
+	if !ep.canP2P() {
+		return
+	}
+	ep.addCandidateEndpoint(ipp)
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.forceDERP {
+		// Keep the hint for when it's cleared, but don't ping it.
+		return
+	}
+	ep.startPingLocked(ipp, mono.Now(), pingDiscovery, nil)
+}
+
+// ResetPeerPath stops trusting the current direct path to the peer
+// with node key nk, so that the next send to it also goes via DERP
+// and rediscovers paths. It's like the reset done for all peers on a
+// link change, but for just one peer whose network is known to have
+// changed. Unknown peers are ignored.
+func (c *Conn) ResetPeerPath(nk tailcfg.NodeKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ep, ok := c.peerMap.endpointForNodeKey(nk); ok {
+		ep.noteConnectivityChange()
+	}
+}
+
+// SetForceDERP sets whether traffic to the peer with node key nk is
+// pinned to DERP. While forced, no direct paths are discovered or
+// used for nk, even if one was already established. Clearing it
+// resumes normal discovery on the next send. The setting survives
+// network map updates, including nk being temporarily removed.
+func (c *Conn) SetForceDERP(nk tailcfg.NodeKey, force bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if force {
+		if c.peerForceDERP == nil {
+			c.peerForceDERP = map[tailcfg.NodeKey]bool{}
+		}
+		c.peerForceDERP[nk] = true
+	} else {
+		delete(c.peerForceDERP, nk)
+	}
+	if ep, ok := c.peerMap.endpointForNodeKey(nk); ok {
+		ep.mu.Lock()
+		ep.forceDERP = force
+		if !force {
+			// Don't wait for upgradeInterval to rediscover paths.
+			ep.lastFullPing = 0
+		}
+		ep.mu.Unlock()
 	}
-	return sessionActiveTimeout
 }
 
 func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
@@ -2423,7 +4688,7 @@ func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
 		if debugReSTUNStopOnIdle {
 			c.logf("magicsock: periodicReSTUN: idle for %v", idleFor.Round(time.Second))
 		}
-		if idleFor > maxIdleBeforeSTUNShutdown() {
+		if idleFor > c.maxIdleBeforeSTUNShutdownLocked() {
 			if c.netMap != nil && c.netMap.Debug != nil && c.netMap.Debug.ForceBackgroundSTUN {
 				// Overridden by control.
 				return true
@@ -2436,9 +4701,21 @@ func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
 
 func (c *Conn) onPortMapChanged() { c.ReSTUN("portmap-changed") }
 
+// reSTUNReasons counts ReSTUN calls, process-wide, by their why string.
+// It includes calls that are ignored because the Conn is closed or
+// stopped.
+var reSTUNReasons = &metrics.LabelMap{Label: "reason"}
+
+func init() {
+	expvar.Publish("counter_magicsock_restun_reason", reSTUNReasons)
+}
+
 // ReSTUN triggers an address discovery.
-// The provided why string is for debug logging only.
+// The provided why string is for debug logging and the
+// counter_magicsock_restun_reason expvar.
 func (c *Conn) ReSTUN(why string) {
+	reSTUNReasons.Get(why).Add(1)
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.closed {
@@ -2476,10 +4753,18 @@ func (c *Conn) initialBind() error {
 	if err := c.bindSocket(&c.pconn4, "udp4", keepCurrentPort); err != nil {
 		return fmt.Errorf("magicsock: initialBind IPv4 failed: %w", err)
 	}
+	c.receiveIPv4 = c.mkReceiveFunc(c.pconn4, "udp4", &health.ReceiveIPv4)
+	// The port mapper only maps IPv4, so it wants the IPv4 port even
+	// if IPv6's differs.
 	c.portMapper.SetLocalPort(c.LocalPort())
+	if c.disableIPv6 {
+		return nil
+	}
 	if err := c.bindSocket(&c.pconn6, "udp6", keepCurrentPort); err != nil {
 		c.logf("magicsock: ignoring IPv6 bind failure: %v", err)
+		return nil
 	}
+	c.receiveIPv6 = c.mkReceiveFunc(c.pconn6, "udp6", &health.ReceiveIPv6)
 	return nil
 }
 
@@ -2487,11 +4772,72 @@ func (c *Conn) initialBind() error {
 // The network must be "udp4" or "udp6".
 func (c *Conn) listenPacket(network string, port uint16) (net.PacketConn, error) {
 	ctx := context.Background() // unused without DNS name to resolve
-	addr := net.JoinHostPort("", fmt.Sprint(port))
-	if c.testOnlyPacketListener != nil {
-		return c.testOnlyPacketListener.ListenPacket(ctx, network, addr)
+	host := ""
+	if ip := c.bindAddr; !ip.IsZero() && (ip.Is4() && network == "udp4" || ip.Is6() && network == "udp6") {
+		host = ip.String()
+	}
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+	if c.packetListener != nil {
+		return c.packetListener.ListenPacket(ctx, network, addr)
+	}
+	lc := netns.Listener()
+	if c.numSockets > 1 {
+		nsControl := lc.Control
+		lc.Control = func(network, address string, rc syscall.RawConn) error {
+			if nsControl != nil {
+				if err := nsControl(network, address, rc); err != nil {
+					return err
+				}
+			}
+			return setReusePort(network, address, rc)
+		}
+	}
+	return lc.ListenPacket(ctx, network, addr)
+}
+
+// extraSockets returns c.extraPconns4 or c.extraPconns6 according to
+// network.
+func (c *Conn) extraSockets(network string) []*RebindingUDPConn {
+	if network == "udp4" {
+		return c.extraPconns4
+	}
+	return c.extraPconns6
+}
+
+// bindExtraSockets rebinds the extra receive sockets for network to
+// port, which the primary socket was just bound to. A zero port
+// means the primary socket isn't bound, so neither are they.
+// It's called by bindSocket with the primary socket's lock held, so
+// all of a family's sockets are replaced together.
+func (c *Conn) bindExtraSockets(network string, port uint16) {
+	for _, ruc := range c.extraSockets(network) {
+		ruc.mu.Lock()
+		ruc.closeLocked()
+		ruc.dstFamily = 0
+		var pconn net.PacketConn = newBlockForeverConn()
+		if port != 0 {
+			var err error
+			if pconn, err = c.listenPacket(network, port); err != nil {
+				c.logf("magicsock: unable to bind extra %v socket on port %d: %v", network, port, err)
+				pconn = newBlockForeverConn()
+			} else if c.recordRecvLocalAddrs {
+				ruc.dstFamily = enableDstControlMessages(pconn, network)
+			}
+		}
+		ruc.setConnLocked(pconn)
+		ruc.mu.Unlock()
+	}
+}
+
+// closeExtraSockets closes c's extra receive sockets, unblocking
+// their receives.
+func (c *Conn) closeExtraSockets() {
+	for _, ruc := range c.extraPconns4 {
+		ruc.Close()
+	}
+	for _, ruc := range c.extraPconns6 {
+		ruc.Close()
 	}
-	return netns.Listener().ListenPacket(ctx, network, addr)
 }
 
 // bindSocket initializes rucPtr if necessary and binds a UDP socket to it.
@@ -2510,10 +4856,12 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	// from the perspective of ruc receive functions.
 	ruc.mu.Lock()
 	defer ruc.mu.Unlock()
+	ruc.dstFamily = 0
 
 	if debugAlwaysDERP {
 		c.logf("disabled %v per TS_DEBUG_ALWAYS_USE_DERP", network)
-		ruc.pconn = newBlockForeverConn()
+		ruc.setConnLocked(newBlockForeverConn())
+		c.bindExtraSockets(network, 0)
 		return nil
 	}
 
@@ -2534,6 +4882,7 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	uniq.ModifySlice(&ports, func(i, j int) bool { return ports[i] == ports[j] })
 
 	var pconn net.PacketConn
+	var bindErrs []string // of each port tried, for health
 	for _, port := range ports {
 		// Close the existing conn, in case it is sitting on the port we want.
 		err := ruc.closeLocked()
@@ -2544,13 +4893,24 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 		pconn, err = c.listenPacket(network, port)
 		if err != nil {
 			c.logf("magicsock: unable to bind %v port %d: %v", network, port, err)
+			bindErrs = append(bindErrs, fmt.Sprintf("port %d: %v", port, err))
 			continue
 		}
 		// Success.
-		ruc.pconn = pconn
+		ruc.setConnLocked(pconn)
+		if c.dscp != 0 && dscpSupported {
+			if err := setDSCP(pconn, network, c.dscp); err != nil {
+				c.logf("magicsock: setting DSCP %d on %v socket: %v", c.dscp, network, err)
+			}
+		}
+		if c.recordRecvLocalAddrs {
+			ruc.dstFamily = enableDstControlMessages(pconn, network)
+		}
 		if network == "udp4" {
 			health.SetUDP4Unbound(false)
 		}
+		health.SetUDPBindError(network, nil)
+		c.bindExtraSockets(network, uint16(ruc.localAddrLocked().Port))
 		return nil
 	}
 
@@ -2558,11 +4918,14 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	// Set pconn to a dummy conn whose reads block until closed.
 	// This keeps the receive funcs alive for a future in which
 	// we get a link change and we can try binding again.
-	ruc.pconn = newBlockForeverConn()
+	ruc.setConnLocked(newBlockForeverConn())
+	c.bindExtraSockets(network, 0)
 	if network == "udp4" {
 		health.SetUDP4Unbound(true)
 	}
-	return fmt.Errorf("failed to bind any ports (tried %v)", ports)
+	err := fmt.Errorf("failed to bind any ports (tried %v): %s", ports, strings.Join(bindErrs, "; "))
+	health.SetUDPBindError(network, err)
+	return err
 }
 
 type currentPortFate uint8
@@ -2579,6 +4942,9 @@ func (c *Conn) rebind(curPortFate currentPortFate) error {
 		return fmt.Errorf("magicsock: Rebind IPv4 failed: %w", err)
 	}
 	c.portMapper.SetLocalPort(c.LocalPort())
+	if c.disableIPv6 {
+		return nil
+	}
 	if err := c.bindSocket(&c.pconn6, "udp6", curPortFate); err != nil {
 		c.logf("magicsock: Rebind ignoring IPv6 bind failure: %v", err)
 	}
@@ -2592,6 +4958,7 @@ func (c *Conn) Rebind() {
 		c.logf("%w", err)
 		return
 	}
+	c.updateLocalPrefixes()
 
 	c.mu.Lock()
 	c.closeAllDerpLocked("rebind")
@@ -2601,6 +4968,9 @@ func (c *Conn) Rebind() {
 	c.mu.Unlock()
 
 	c.resetEndpointStates()
+	if c.networkChangeFunc != nil {
+		c.networkChangeFunc(NetworkChangeRebind)
+	}
 }
 
 // resetEndpointStates resets the preferred address for all peers.
@@ -2658,33 +5028,102 @@ func (c *Conn) ParseEndpoint(nodeKeyStr string) (conn.Endpoint, error) {
 type RebindingUDPConn struct {
 	mu    sync.Mutex
 	pconn net.PacketConn
+
+	// dstFamily is 4 or 6 if pconn is a *net.UDPConn that's been
+	// set up to deliver packets' destination addresses as control
+	// messages of that IP family, else 0. See ReadFromNetaddrDst.
+	dstFamily int
+
+	// readDeadline and writeDeadline are the deadlines last set
+	// with SetReadDeadline and SetWriteDeadline, re-applied to
+	// each new pconn by setConnLocked.
+	readDeadline  time.Time
+	writeDeadline time.Time
 }
 
-// currentConn returns c's current pconn.
-func (c *RebindingUDPConn) currentConn() net.PacketConn {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.pconn
+// setConnLocked makes pconn c's current connection, applying c's
+// deadlines to it.
+//
+// c.mu must be held.
+func (c *RebindingUDPConn) setConnLocked(pconn net.PacketConn) {
+	c.pconn = pconn
+	// Errors are ignored: blockForeverConn doesn't support
+	// deadlines, and there's no caller to report them to.
+	if !c.readDeadline.IsZero() {
+		pconn.SetReadDeadline(c.readDeadline)
+	}
+	if !c.writeDeadline.IsZero() {
+		pconn.SetWriteDeadline(c.writeDeadline)
+	}
 }
 
-// ReadFrom reads a packet from c into b.
-// It returns the number of bytes copied and the source address.
-func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	for {
-		pconn := c.currentConn()
-		n, addr, err := pconn.ReadFrom(b)
-		if err != nil && pconn != c.currentConn() {
-			continue
-		}
-		return n, addr, err
+// SetDeadline sets c's read and write deadlines, like
+// net.PacketConn.SetDeadline. See SetReadDeadline.
+func (c *RebindingUDPConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	if c.pconn == nil {
+		return errNilPConn
 	}
+	return c.pconn.SetDeadline(t)
 }
 
-// ReadFromNetaddr reads a packet from c into b.
-// It returns the number of bytes copied and the return address.
+// SetReadDeadline sets the deadline for reads from c, like
+// net.PacketConn.SetReadDeadline. Unlike a deadline set on the
+// current connection directly, it also applies to the connections
+// that replace it when c is rebound. It affects all of c's readers,
+// including a Conn's receive functions, so it's only for sockets
+// whose reads are otherwise idle, or a zero t to clear it.
+func (c *RebindingUDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.pconn == nil {
+		return errNilPConn
+	}
+	return c.pconn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes to c, like
+// net.PacketConn.SetWriteDeadline. Like SetReadDeadline, it's
+// re-applied when c is rebound.
+func (c *RebindingUDPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	if c.pconn == nil {
+		return errNilPConn
+	}
+	return c.pconn.SetWriteDeadline(t)
+}
+
+// currentConn returns c's current pconn.
+func (c *RebindingUDPConn) currentConn() net.PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pconn
+}
+
+// ReadFrom reads a packet from c into b.
+// It returns the number of bytes copied and the source address.
+func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		pconn := c.currentConn()
+		n, addr, err := pconn.ReadFrom(b)
+		if err != nil && pconn != c.currentConn() {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// ReadFromNetaddr reads a packet from c into b.
+// It returns the number of bytes copied and the return address.
 // It is identical to c.ReadFrom, except that it returns a netaddr.IPPort instead of a net.Addr.
 // ReadFromNetaddr is designed to work with specific underlying connection types.
 // If c's underlying connection returns a non-*net.UPDAddr return address, ReadFromNetaddr will return an error.
+// The returned ipp keeps the IPv6 zone of link-local senders.
 // ReadFromNetaddr exists because it removes an allocation per read,
 // when c's underlying connection is a net.UDPConn.
 func (c *RebindingUDPConn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort, err error) {
@@ -2726,6 +5165,83 @@ func (c *RebindingUDPConn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort,
 	}
 }
 
+// ReadFromNetaddrDst is like ReadFromNetaddr, but also returns the
+// local IP address the packet was sent to, if known. The address is
+// only known if c's connection was set up by enableDstControlMessages.
+// oob is scratch space for the control message, from
+// ipv4.NewControlMessage or ipv6.NewControlMessage for c's family.
+func (c *RebindingUDPConn) ReadFromNetaddrDst(b, oob []byte) (n int, ipp netaddr.IPPort, dst netaddr.IP, err error) {
+	for {
+		c.mu.Lock()
+		pconn, family := c.pconn, c.dstFamily
+		c.mu.Unlock()
+
+		udpConn, ok := pconn.(*net.UDPConn)
+		if !ok || family == 0 {
+			n, ipp, err = c.ReadFromNetaddr(b)
+			return n, ipp, netaddr.IP{}, err
+		}
+		var oobn int
+		var pAddr *net.UDPAddr
+		n, oobn, _, pAddr, err = udpConn.ReadMsgUDP(b, oob)
+		if err != nil {
+			if pconn != c.currentConn() {
+				continue
+			}
+			return 0, netaddr.IPPort{}, netaddr.IP{}, err
+		}
+		ipp, ok = netaddr.FromStdAddr(pAddr.IP, pAddr.Port, pAddr.Zone)
+		if !ok {
+			return 0, netaddr.IPPort{}, netaddr.IP{}, errors.New("netaddr.FromStdAddr failed")
+		}
+		return n, ipp, parseDstControlMessage(family, oob[:oobn]), nil
+	}
+}
+
+// enableDstControlMessages asks the kernel to deliver the destination
+// address of each packet received on pconn, a "udp4" or "udp6"
+// network socket, as a control message. It returns the IP family
+// (4 or 6) to parse them as, or 0 if that's unsupported.
+func enableDstControlMessages(pconn net.PacketConn, network string) (family int) {
+	if _, ok := pconn.(*net.UDPConn); !ok {
+		return 0
+	}
+	switch network {
+	case "udp4":
+		if ipv4.NewPacketConn(pconn).SetControlMessage(ipv4.FlagDst, true) == nil {
+			return 4
+		}
+	case "udp6":
+		if ipv6.NewPacketConn(pconn).SetControlMessage(ipv6.FlagDst, true) == nil {
+			return 6
+		}
+	}
+	return 0
+}
+
+// parseDstControlMessage returns the destination address in oob, a
+// control message of the given IP family, or the zero IP if there
+// isn't one.
+func parseDstControlMessage(family int, oob []byte) netaddr.IP {
+	var dst net.IP
+	switch family {
+	case 4:
+		var cm ipv4.ControlMessage
+		if cm.Parse(oob) != nil {
+			return netaddr.IP{}
+		}
+		dst = cm.Dst
+	case 6:
+		var cm ipv6.ControlMessage
+		if cm.Parse(oob) != nil {
+			return netaddr.IP{}
+		}
+		dst = cm.Dst
+	}
+	ip, _ := netaddr.FromStdIP(dst)
+	return ip
+}
+
 func (c *RebindingUDPConn) LocalAddr() *net.UDPAddr {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -2773,6 +5289,35 @@ func (c *RebindingUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	}
 }
 
+// WriteBatchTo writes bufs to addr, batching them into as few
+// syscalls as the platform allows. It returns the number of packets
+// written.
+func (c *RebindingUDPConn) WriteBatchTo(bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	sent := 0
+	for sent < len(bufs) {
+		pconn := c.currentConn()
+		n, err := writeBatch(pconn, bufs[sent:], addr)
+		sent += n
+		if err != nil {
+			if pconn != c.currentConn() {
+				continue
+			}
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// writeBatchLoop writes bufs to addr on pconn one at a time.
+func writeBatchLoop(pconn net.PacketConn, bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	for i, b := range bufs {
+		if _, err := pconn.WriteTo(b, addr); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
 func newBlockForeverConn() *blockForeverConn {
 	c := new(blockForeverConn)
 	c.cond = sync.NewCond(&c.mu)
@@ -2930,8 +5475,13 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	})
 
 	c.foreachActiveDerpSortedLocked(func(node int, ad activeDerp) {
-		// TODO(bradfitz): add to ipnstate.StatusBuilder
-		//f("<li><b>derp-%v</b>: cr%v,wr%v</li>", node, simpleDur(now.Sub(ad.createTime)), simpleDur(now.Sub(*ad.lastWrite)))
+		sb.AddDERPConn(ipnstate.DERPConnStatus{
+			RegionID:   node,
+			RegionCode: c.derpRegionCodeOfIDLocked(node),
+			Home:       node == c.myDerp,
+			Created:    ad.createTime,
+			LastWrite:  *ad.lastWrite,
+		})
 	})
 }
 
@@ -2949,6 +5499,8 @@ type endpoint struct {
 	// atomically accessed; declared first for alignment reasons
 	lastRecv              mono.Time
 	numStopAndResetAtomic int64
+	lastRecvUDP           mono.Time // last direct packet from peer, to about a second; see noteRecvTransport
+	lastRecvDERP          mono.Time // likewise, via DERP
 
 	// These fields are initialized once and never modified.
 	c          *Conn
@@ -2958,10 +5510,19 @@ type endpoint struct {
 	fakeWGAddr netaddr.IPPort   // the UDP address we tell wireguard-go we're using
 	wgEndpoint string           // string from ParseEndpoint, holds a JSON-serialized wgcfg.Endpoints
 
+	// recvLocalAddr is the local address on which a direct UDP
+	// packet from the peer was last received, if known.
+	// See Options.RecordRecvLocalAddrs.
+	recvLocalAddr atomic.Value // of netaddr.IP
+
 	// Owned by Conn.mu:
 	lastPingFrom netaddr.IPPort
 	lastPingTime time.Time
 
+	// pathReportMu serializes calls to Conn.pathChangeFunc for
+	// this peer. See reportPathChange.
+	pathReportMu sync.Mutex
+
 	// mu protects all following fields.
 	mu sync.Mutex // Lock ordering: Conn.mu, then endpoint.mu
 
@@ -2969,6 +5530,38 @@ type endpoint struct {
 	lastSend       mono.Time      // last time there was outgoing packets sent to this peer (from wireguard-go)
 	lastFullPing   mono.Time      // last time we pinged all endpoints
 	derpAddr       netaddr.IPPort // fallback/bootstrap path, if non-zero (non-zero for well-behaved clients)
+	path           PathKind       // path implied by the addresses last picked for sending; zero if none
+	lastPath       PathKind       // last path passed to Conn.pathChangeFunc; zero if none
+
+	// asymmetricSince is when the peer was first seen sending only
+	// via DERP while we send to it directly, or zero if it's not.
+	// asymmetricLogged is whether that's lasted asymmetricPathDelay
+	// and been logged. See checkAsymmetricPathLocked.
+	asymmetricSince  mono.Time
+	asymmetricLogged bool
+
+	// heartbeatLowPower is whether heartBeatTimer was set for
+	// lowPowerHeartbeatInterval rather than the normal interval.
+	heartbeatLowPower bool
+
+	// lastDirectPong is when a pong last arrived over direct UDP,
+	// or zero if none has. It's kept across stopAndReset. See
+	// Conn.TimeSinceDirect.
+	lastDirectPong mono.Time
+
+	// racedFirstSend is whether a send has been raced to candidate
+	// endpoints since the last stopAndReset, per
+	// Options.RaceFirstSend.
+	racedFirstSend bool
+
+	// sessionActiveTimeout, if non-zero, overrides the
+	// sessionActiveTimeout constant for this peer.
+	// See Conn.SetPeerKeepAlive.
+	sessionActiveTimeout time.Duration
+
+	// forceDERP is whether all traffic to this peer goes via DERP,
+	// with no direct path discovery. See Conn.SetForceDERP.
+	forceDERP bool
 
 	bestAddr           addrLatency // best non-DERP path; zero if none
 	bestAddrAt         mono.Time   // time best address re-confirmed
@@ -2977,12 +5570,59 @@ type endpoint struct {
 	endpointState      map[netaddr.IPPort]*endpointState
 	isCallMeMaybeEP    map[netaddr.IPPort]bool
 
-	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+	// derpLatency is the latency of the last pong received via
+	// DERP, or 0 if none.
+	derpLatency time.Duration
+
+	// echoesPingPayload is whether the peer advertises
+	// tailcfg.CapabilityDiscoPingPayload, in which case direct
+	// pings carry a sequence number payload (see appendPingPayload)
+	// that's used to measure reordering and jitter.
+	echoesPingPayload bool
+	nextPingSeq       uint32        // sequence number for the next payload-carrying ping
+	maxPongSeq        uint32        // highest sequence number seen in a pong
+	pongsReordered    int64         // number of pongs with seq < maxPongSeq
+	lastPongLatency   time.Duration // latency of the last payload-carrying pong; 0 if none
+	pingJitter        time.Duration // smoothed mean deviation between consecutive pong latencies
+
+	// pingCaps is the disco.PingCaps the peer last agreed to in a
+	// version 1 pong. See debugDiscoPingCaps.
+	pingCaps disco.PingCaps
+
+	// parsesCallMeMaybeTTL is whether the peer advertises
+	// tailcfg.CapabilityDiscoCallMeMaybeTTL, in which case the
+	// call-me-maybes we send it carry callMeMaybeTTL.
+	parsesCallMeMaybeTTL bool
+
+	// mappingVariesByDestIP is whether the peer's NAT mappings vary
+	// by destination IP, per the NetInfo in its Hostinfo, or empty
+	// if unknown. It's reported in CLI ping results.
+	mappingVariesByDestIP opt.Bool
+
+	// sendErrWindowStart is when the current send backpressure
+	// window began. derpSendDrops and udpSendErrs count this
+	// peer's failed sends within it. See noteSendFailure.
+	sendErrWindowStart mono.Time
+	derpSendDrops      int64 // DERP packets dropped due to a full write queue
+	udpSendErrs        int64 // UDP sends that returned an error
+
+	pendingCLIPings []*pendingCLIPing // any outstanding "tailscale ping" commands running
 }
 
 type pendingCLIPing struct {
 	res *ipnstate.PingResult
 	cb  func(*ipnstate.PingResult)
+
+	// done, if non-nil, is closed once the ping is no longer
+	// pending, to stop watching its context for cancellation.
+	done chan struct{}
+}
+
+// finish notes that pp is no longer pending.
+func (pp *pendingCLIPing) finish() {
+	if pp.done != nil {
+		close(pp.done)
+	}
 }
 
 const (
@@ -2993,13 +5633,23 @@ const (
 	sessionActiveTimeout = 2 * time.Minute
 
 	// upgradeInterval is how often we try to upgrade to a better path
-	// even if we have some non-DERP route that works.
+	// even if we have some non-DERP route that works, unless
+	// overridden by Options.Timeouts.
 	upgradeInterval = 1 * time.Minute
 
 	// heartbeatInterval is how often pings to the best UDP address
-	// are sent.
+	// are sent, unless overridden by Options.Timeouts.
 	heartbeatInterval = 2 * time.Second
 
+	// lowPowerHeartbeatInterval is how often pings to the best UDP
+	// address are sent while in low power mode and idle. See
+	// Conn.SetLowPower.
+	lowPowerHeartbeatInterval = 30 * time.Second
+
+	// lowPowerIdleTime is how long the TUN device must be idle
+	// before low power mode takes effect.
+	lowPowerIdleTime = 10 * time.Second
+
 	// discoPingInterval is the minimum time between pings
 	// to an endpoint. (Except in the case of CallMeMaybe frames
 	// resetting the counter, as the first pings likely didn't through
@@ -3011,7 +5661,8 @@ const (
 	pingTimeoutDuration = 5 * time.Second
 
 	// trustUDPAddrDuration is how long we trust a UDP address as the exclusive
-	// path (without using DERP) without having heard a Pong reply.
+	// path (without using DERP) without having heard a Pong reply,
+	// unless overridden by Options.Timeouts.
 	trustUDPAddrDuration = 5 * time.Second
 
 	// goodEnoughLatency is the latency at or under which we don't
@@ -3030,6 +5681,13 @@ const (
 	// STUN-derived endpoint valid for. UDP NAT mappings typically
 	// expire at 30 seconds, so this is a few seconds shy of that.
 	endpointsFreshEnoughDuration = 27 * time.Second
+
+	// callMeMaybeTTL is the disco.CallMeMaybe TTL we send to peers
+	// that support it. Our endpoints are only sent when fresher
+	// than endpointsFreshEnoughDuration, and the peer pings them
+	// as soon as it gets them, so any that haven't answered by
+	// then probably never will.
+	callMeMaybeTTL = endpointsFreshEnoughDuration
 )
 
 // endpointState is some state and history for a specific endpoint of
@@ -3051,7 +5709,13 @@ type endpointState struct {
 	// was advertised last via a call-me-maybe disco message.
 	callMeMaybeTime time.Time
 
-	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
+	// callMeMaybeExpires, if non-zero, is when this endpoint is
+	// dropped, per the TTL of the call-me-maybe that advertised
+	// it, unless a pong from it clears it first or it's also in
+	// the network map.
+	callMeMaybeExpires time.Time
+
+	recentPongs []pongReply // ring buffer up to Conn.pongHistoryCount entries; nil until first pong
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
@@ -3062,28 +5726,44 @@ type endpointState struct {
 const indexSentinelDeleted = -1
 
 // shouldDeleteLocked reports whether we should delete this endpoint.
-func (st *endpointState) shouldDeleteLocked() bool {
+// activeTimeout is the owning endpoint's sessionActiveTimeoutLocked.
+func (st *endpointState) shouldDeleteLocked(activeTimeout time.Duration) bool {
 	switch {
 	case !st.callMeMaybeTime.IsZero():
-		return false
+		// Advertised via call-me-maybe. The TTL only applies if
+		// that's the sole source, not if it's also in the network map.
+		return st.index == indexSentinelDeleted && !st.callMeMaybeExpires.IsZero() && time.Now().After(st.callMeMaybeExpires)
 	case st.lastGotPing.IsZero():
 		// This was an endpoint from the network map. Is it still in the network map?
 		return st.index == indexSentinelDeleted
 	default:
 		// This was an endpoint discovered at runtime.
-		return time.Since(st.lastGotPing) > sessionActiveTimeout
+		return time.Since(st.lastGotPing) > activeTimeout
+	}
+}
+
+// sessionActiveTimeoutLocked returns how long since the last send we
+// keep de's session alive.
+//
+// de.mu must be held.
+func (de *endpoint) sessionActiveTimeoutLocked() time.Duration {
+	if de.sessionActiveTimeout > 0 {
+		return de.sessionActiveTimeout
 	}
+	return sessionActiveTimeout
 }
 
 func (de *endpoint) deleteEndpointLocked(ep netaddr.IPPort) {
 	delete(de.endpointState, ep)
+	delete(de.isCallMeMaybeEP, ep)
 	if de.bestAddr.IPPort == ep {
 		de.bestAddr = addrLatency{}
 	}
 }
 
-// pongHistoryCount is how many pongReply values we keep per endpointState
-const pongHistoryCount = 64
+// defaultPongHistoryCount is how many pongReply values we keep per
+// endpointState, unless overridden by Options.PongHistoryCount.
+const defaultPongHistoryCount = 64
 
 type pongReply struct {
 	latency time.Duration
@@ -3097,6 +5777,11 @@ type sentPing struct {
 	at      mono.Time
 	timer   *time.Timer // timeout timer
 	purpose discoPingPurpose
+	hasCaps bool // whether the ping was sent as version 1, with disco.PingCaps
+
+	// onPong, if non-nil, is called with endpoint.mu held when the
+	// pong arrives. It's not called on timeout.
+	onPong func(latency time.Duration, pongSrc netaddr.IPPort)
 }
 
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
@@ -3110,6 +5795,65 @@ func (de *endpoint) initFakeUDPAddr() {
 	de.fakeWGAddr = netaddr.IPPortFrom(netaddr.IPFrom16(addr), 12345)
 }
 
+// stableFakeAddrs tracks the fake UDP addresses handed out by
+// initStableFakeUDPAddr, to keep them unique within the process.
+var stableFakeAddrs struct {
+	sync.Mutex
+	m map[netaddr.IPPort]*endpoint
+}
+
+// initStableFakeUDPAddr is like initFakeUDPAddr, but derives the
+// address from a hash of de.publicKey, so a given peer gets the same
+// address in each run. In the rare case that address is already in
+// use in this process (by another Conn with the same peer, or a hash
+// collision), it rehashes with a counter until it finds a free one.
+// The last byte of the address is 1, so these never collide with
+// initFakeUDPAddr's addresses.
+func (de *endpoint) initStableFakeUDPAddr() {
+	stableFakeAddrs.Lock()
+	defer stableFakeAddrs.Unlock()
+	if stableFakeAddrs.m == nil {
+		stableFakeAddrs.m = map[netaddr.IPPort]*endpoint{}
+	}
+	for i := 0; ; i++ {
+		h := fnv.New64a()
+		h.Write(de.publicKey[:])
+		if i > 0 {
+			fmt.Fprintf(h, "%d", i)
+		}
+		var addr [16]byte
+		addr[0] = 0xfd
+		addr[1] = 0x00
+		binary.BigEndian.PutUint64(addr[2:], h.Sum64())
+		addr[15] = 1
+		ipp := netaddr.IPPortFrom(netaddr.IPFrom16(addr), 12345)
+		if _, ok := stableFakeAddrs.m[ipp]; !ok {
+			stableFakeAddrs.m[ipp] = de
+			de.fakeWGAddr = ipp
+			return
+		}
+	}
+}
+
+// releaseStableFakeUDPAddr makes de's fake UDP address available for
+// reuse, if it came from initStableFakeUDPAddr.
+func (de *endpoint) releaseStableFakeUDPAddr() {
+	stableFakeAddrs.Lock()
+	defer stableFakeAddrs.Unlock()
+	if stableFakeAddrs.m[de.fakeWGAddr] == de {
+		delete(stableFakeAddrs.m, de.fakeWGAddr)
+	}
+}
+
+// noteRecvLocalAddr records that a packet from de was received on
+// local address ip.
+func (de *endpoint) noteRecvLocalAddr(ip netaddr.IP) {
+	// Only store on change, to not allocate per packet.
+	if old, _ := de.recvLocalAddr.Load().(netaddr.IP); old != ip {
+		de.recvLocalAddr.Store(ip)
+	}
+}
+
 // noteRecvActivity records receive activity on de, and invokes
 // Conn.noteRecvActivity no more than once every 10s.
 func (de *endpoint) noteRecvActivity() {
@@ -3124,6 +5868,70 @@ func (de *endpoint) noteRecvActivity() {
 	}
 }
 
+// noteRecvTransport records that a packet from de was received via
+// DERP or, if !viaDERP, directly. To keep the receive path cheap, the
+// time is only updated to about a second.
+func (de *endpoint) noteRecvTransport(viaDERP bool) {
+	t := &de.lastRecvUDP
+	if viaDERP {
+		t = &de.lastRecvDERP
+	}
+	now := mono.Now()
+	if now.Sub(t.LoadAtomic()) > time.Second {
+		t.StoreAtomic(now)
+	}
+}
+
+const (
+	// asymmetricPathWindow is how recently a packet must have
+	// been received via DERP, and not directly, for a peer's path
+	// to be asymmetric.
+	asymmetricPathWindow = 5 * time.Second
+
+	// asymmetricPathDelay is how long a path must stay asymmetric
+	// before it's logged and reported.
+	asymmetricPathDelay = 5 * time.Second
+)
+
+// isAsymmetricLocked reports whether we're sending to de only over a
+// direct path while its packets arrive only via DERP.
+//
+// de.mu must be held.
+func (de *endpoint) isAsymmetricLocked(now mono.Time) bool {
+	if udpAddr, derpAddr := de.addrForSendLocked(now); udpAddr.IsZero() || !derpAddr.IsZero() {
+		return false
+	}
+	lastDERP := de.lastRecvDERP.LoadAtomic()
+	if lastDERP.IsZero() || now.Sub(lastDERP) > asymmetricPathWindow {
+		return false
+	}
+	lastUDP := de.lastRecvUDP.LoadAtomic()
+	return lastUDP.IsZero() || now.Sub(lastUDP) > asymmetricPathWindow
+}
+
+// checkAsymmetricPathLocked updates whether de's path is asymmetric,
+// logging when that's lasted asymmetricPathDelay and when it ends.
+//
+// de.mu must be held.
+func (de *endpoint) checkAsymmetricPathLocked(now mono.Time) {
+	if !de.isAsymmetricLocked(now) {
+		if de.asymmetricLogged {
+			de.c.logf("magicsock: disco: path to %v (%v) no longer asymmetric", de.publicKey.ShortString(), de.discoShort)
+		}
+		de.asymmetricSince = 0
+		de.asymmetricLogged = false
+		return
+	}
+	if de.asymmetricSince.IsZero() {
+		de.asymmetricSince = now
+	}
+	if !de.asymmetricLogged && now.Sub(de.asymmetricSince) >= asymmetricPathDelay {
+		de.asymmetricLogged = true
+		udpAddr, _ := de.addrForSendLocked(now)
+		de.c.logf("magicsock: disco: asymmetric path to %v (%v): sending direct to %v, but receiving only via DERP for %v", de.publicKey.ShortString(), de.discoShort, udpAddr, now.Sub(de.asymmetricSince).Round(time.Second))
+	}
+}
+
 // String exists purely so wireguard-go internals can log.Printf("%v")
 // its internal conn.Endpoints and we don't end up with data races
 // from fmt (via log) reading mutex fields and such.
@@ -3153,6 +5961,9 @@ func (de *endpoint) canP2P() bool {
 //
 // de.mu must be held.
 func (de *endpoint) addrForSendLocked(now mono.Time) (udpAddr, derpAddr netaddr.IPPort) {
+	if de.forceDERP {
+		return netaddr.IPPort{}, de.derpAddr
+	}
 	udpAddr = de.bestAddr.IPPort
 	if udpAddr.IsZero() || now.After(de.trustBestAddrUntil) {
 		// We had a bestAddr but it expired so send both to it
@@ -3162,7 +5973,54 @@ func (de *endpoint) addrForSendLocked(now mono.Time) (udpAddr, derpAddr netaddr.
 	return
 }
 
-// heartbeat is called every heartbeatInterval to keep the best UDP path alive,
+// latency returns the latency of de's current path as of now.
+// See Conn.PeerLatency.
+func (de *endpoint) latency(now mono.Time) (time.Duration, bool) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if !de.bestAddr.IsZero() && de.bestAddr.latency > 0 && !now.After(de.trustBestAddrUntil) {
+		return de.bestAddr.latency, true
+	}
+	if de.derpLatency > 0 {
+		return de.derpLatency, true
+	}
+	return 0, false
+}
+
+// notePathLocked records the path implied by the addresses returned
+// by addrForSendLocked. It reports whether that's a change not yet
+// passed to de.c.pathChangeFunc, in which case the caller must call
+// reportPathChange once it has released de.mu and Conn.mu.
+//
+// de.mu must be held.
+func (de *endpoint) notePathLocked(udpAddr, derpAddr netaddr.IPPort) (changed bool) {
+	switch {
+	case !derpAddr.IsZero():
+		de.path = PathDERP
+	case !udpAddr.IsZero():
+		de.path = PathDirect
+	}
+	return de.path != de.lastPath && de.c.pathChangeFunc != nil
+}
+
+// reportPathChange calls de.c.pathChangeFunc with the path last
+// recorded by notePathLocked, if it hasn't been passed already.
+//
+// Neither de.mu nor Conn.mu may be held.
+func (de *endpoint) reportPathChange() {
+	de.pathReportMu.Lock()
+	defer de.pathReportMu.Unlock()
+	de.mu.Lock()
+	path := de.path
+	changed := path != de.lastPath
+	de.lastPath = path
+	de.mu.Unlock()
+	if changed && path != 0 && de.c.pathChangeFunc != nil {
+		de.c.pathChangeFunc(de.publicKey, path)
+	}
+}
+
+// heartbeat is called every Conn.heartbeatInterval to keep the best UDP path alive,
 // or kick off discovery of other paths.
 func (de *endpoint) heartbeat() {
 	de.mu.Lock()
@@ -3170,7 +6028,7 @@ func (de *endpoint) heartbeat() {
 
 	de.heartBeatTimer = nil
 
-	if !de.canP2P() {
+	if !de.canP2P() || de.c.noAdvertiseEndpoints.Get() {
 		// Cannot form p2p connections, no heartbeating necessary.
 		return
 	}
@@ -3180,9 +6038,11 @@ func (de *endpoint) heartbeat() {
 		return
 	}
 
-	if mono.Since(de.lastSend) > sessionActiveTimeout {
+	if mono.Since(de.lastSend) > de.sessionActiveTimeoutLocked() {
 		// Session's idle. Stop heartbeating.
 		de.c.logf("[v1] magicsock: disco: ending heartbeats for idle session to %v (%v)", de.publicKey.ShortString(), de.discoShort)
+		de.asymmetricSince = 0
+		de.asymmetricLogged = false
 		return
 	}
 
@@ -3190,14 +6050,22 @@ func (de *endpoint) heartbeat() {
 	udpAddr, _ := de.addrForSendLocked(now)
 	if !udpAddr.IsZero() {
 		// We have a preferred path. Ping that every 2 seconds.
-		de.startPingLocked(udpAddr, now, pingHeartbeat)
+		de.startPingLocked(udpAddr, now, pingHeartbeat, nil)
 	}
 
-	if de.wantFullPingLocked(now) {
+	de.checkAsymmetricPathLocked(now)
+
+	lowPower := de.c.lowPowerIdle()
+	if !lowPower && de.wantFullPingLocked(now) {
 		de.sendPingsLocked(now, true)
 	}
 
-	de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+	interval := de.c.heartbeatInterval
+	if lowPower {
+		interval = lowPowerHeartbeatInterval
+	}
+	de.heartbeatLowPower = lowPower
+	de.heartBeatTimer = time.AfterFunc(interval, de.heartbeat)
 }
 
 // wantFullPingLocked reports whether we should ping to all our peers looking for
@@ -3205,7 +6073,7 @@ func (de *endpoint) heartbeat() {
 //
 // de.mu must be held.
 func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
-	if !de.canP2P() {
+	if !de.canP2P() || de.forceDERP {
 		return false
 	}
 	if de.bestAddr.IsZero() || de.lastFullPing.IsZero() {
@@ -3217,7 +6085,7 @@ func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
 	if de.bestAddr.latency <= goodEnoughLatency {
 		return false
 	}
-	if now.Sub(de.lastFullPing) >= upgradeInterval {
+	if now.Sub(de.lastFullPing) >= de.c.upgradeInterval {
 		return true
 	}
 	return false
@@ -3225,58 +6093,236 @@ func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
 
 func (de *endpoint) noteActiveLocked() {
 	de.lastSend = mono.Now()
+	if de.heartbeatLowPower && de.heartBeatTimer != nil && de.heartBeatTimer.Stop() {
+		// Traffic's back; resume the normal heartbeat cadence.
+		de.heartBeatTimer = nil
+		de.heartbeatLowPower = false
+	}
 	if de.heartBeatTimer == nil && de.canP2P() {
-		de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+		de.heartBeatTimer = time.AfterFunc(de.c.heartbeatInterval, de.heartbeat)
 	}
 }
 
 // cliPing starts a ping for the "tailscale ping" command. res is value to call cb with,
-// already partially filled.
-func (de *endpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
+// already partially filled. If ctx is done first, the ping is
+// abandoned with cancelCLIPing.
+func (de *endpoint) cliPing(ctx context.Context, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
-	de.pendingCLIPings = append(de.pendingCLIPings, pendingCLIPing{res, cb})
+	pp := &pendingCLIPing{res: res, cb: cb}
+	if ctx.Done() != nil {
+		pp.done = make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				de.cancelCLIPing(pp, ctx.Err())
+			case <-pp.done:
+			}
+		}()
+	}
+	de.pendingCLIPings = append(de.pendingCLIPings, pp)
 
 	now := mono.Now()
 	udpAddr, derpAddr := de.addrForSendLocked(now)
 	if !derpAddr.IsZero() {
-		de.startPingLocked(derpAddr, now, pingCLI)
+		de.startPingLocked(derpAddr, now, pingCLI, nil)
 	}
 	if !udpAddr.IsZero() && now.Before(de.trustBestAddrUntil) {
 		// Already have an active session, so just ping the address we're using.
 		// Otherwise "tailscale ping" results to a node on the local network
 		// can look like they're bouncing between, say 10.0.0.0/9 and the peer's
 		// IPv6 address, both 1ms away, and it's random who replies first.
-		de.startPingLocked(udpAddr, now, pingCLI)
-	} else if de.canP2P() {
+		de.startPingLocked(udpAddr, now, pingCLI, nil)
+	} else if de.canP2P() && !de.forceDERP {
 		for ep := range de.endpointState {
-			de.startPingLocked(ep, now, pingCLI)
+			de.startPingLocked(ep, now, pingCLI, nil)
 		}
 	}
 	de.noteActiveLocked()
 }
 
-func (de *endpoint) send(b []byte) error {
+// cancelCLIPing abandons pp, if it's still pending, calling its
+// callback with err. CLI pings are shared by all pending "tailscale
+// ping" commands, so the last one to go also stops the outstanding
+// CLI pings' timers.
+func (de *endpoint) cancelCLIPing(pp *pendingCLIPing, err error) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	i := -1
+	for j, p := range de.pendingCLIPings {
+		if p == pp {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		// Already answered or reset.
+		return
+	}
+	de.pendingCLIPings = append(de.pendingCLIPings[:i], de.pendingCLIPings[i+1:]...)
+	if len(de.pendingCLIPings) == 0 {
+		de.pendingCLIPings = nil
+		for txid, sp := range de.sentPing {
+			if sp.purpose == pingCLI {
+				de.removeSentPingLocked(txid, sp)
+			}
+		}
+	}
+	pp.res.Err = err.Error()
+	go pp.cb(pp.res)
+}
+
+// probePing implements Conn.PingAddr. res is the value to call cb
+// with, already partially filled.
+func (de *endpoint) probePing(ipp netaddr.IPPort, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	// Whichever of the pong and the timeout comes first stops the
+	// timer and reports the result.
+	timeout := time.AfterFunc(pingTimeoutDuration, func() {
+		res.Err = fmt.Sprintf("no pong from %v after %v", ipp, pingTimeoutDuration)
+		cb(res)
+	})
+	de.startPingLocked(ipp, mono.Now(), pingProbe, func(latency time.Duration, pongSrc netaddr.IPPort) {
+		if !timeout.Stop() {
+			return
+		}
+		de.c.populateCLIPingResponseLocked(res, de, latency, ipp)
+		go cb(res)
+	})
+}
+
+// diagnose implements Conn.DiagnosePeer, filling in d.
+func (de *endpoint) diagnose(ctx context.Context, d *PeerDiagnosis) {
+	type pathResult struct {
+		i       int
+		latency time.Duration
+		pongSrc netaddr.IPPort
+	}
+
+	de.mu.Lock()
+	addrs := make([]netaddr.IPPort, 0, len(de.endpointState)+1)
+	for ep := range de.endpointState {
+		addrs = append(addrs, ep)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+	if !de.derpAddr.IsZero() {
+		addrs = append(addrs, de.derpAddr)
+	}
+	// Buffered so onPong, which runs with de.mu held, never blocks.
+	results := make(chan pathResult, len(addrs))
 	now := mono.Now()
+	for i, ep := range addrs {
+		i := i
+		pd := PathDiagnosis{Addr: ep}
+		if ep.IP() == derpMagicIPAddr {
+			pd.DERPRegionID = int(ep.Port())
+		}
+		d.Paths = append(d.Paths, pd)
+		de.startPingLocked(ep, now, pingCLI, func(latency time.Duration, pongSrc netaddr.IPPort) {
+			results <- pathResult{i, latency, pongSrc}
+		})
+	}
+	de.noteActiveLocked()
+	de.mu.Unlock()
+
+	timeout := time.NewTimer(pingTimeoutDuration)
+	defer timeout.Stop()
+	for pending := len(addrs); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			pd := &d.Paths[r.i]
+			pd.GotPong = true
+			pd.Latency = r.latency
+			pd.PongSrc = r.pongSrc
+			if pd.DERPRegionID == 0 {
+				d.DirectOK = true
+			}
+		case <-timeout.C:
+			pending = 0
+		case <-ctx.Done():
+			pending = 0
+		}
+	}
 
 	de.mu.Lock()
-	udpAddr, derpAddr := de.addrForSendLocked(now)
-	if de.canP2P() && (udpAddr.IsZero() || now.After(de.trustBestAddrUntil)) {
+	defer de.mu.Unlock()
+	d.BestAddr = de.bestAddr.IPPort
+	d.BestAddrLatency = de.bestAddr.latency
+	switch {
+	case de.bestAddr.IsZero() && d.DirectOK:
+		d.BestAddrReason = "direct path replied but was not selected"
+	case de.bestAddr.IsZero():
+		d.BestAddrReason = "no direct path replied; using DERP"
+	case mono.Now().Before(de.trustBestAddrUntil):
+		d.BestAddrReason = fmt.Sprintf("lowest latency direct path, confirmed %v ago", mono.Since(de.bestAddrAt).Round(time.Millisecond))
+	default:
+		d.BestAddrReason = "direct path not recently confirmed; also using DERP"
+	}
+}
+
+// addrsForSend returns the addresses to send a packet to de on,
+// starting discovery pings first if the direct path needs them.
+func (de *endpoint) addrsForSend() (udpAddr, derpAddr netaddr.IPPort) {
+	now := mono.Now()
+
+	de.mu.Lock()
+	if !de.canP2P() {
+		// Without disco, the peer is only ever reached via DERP,
+		// and there are no paths to pick between, discover,
+		// or keep alive.
+		de.lastSend = now
+		derpAddr = de.derpAddr
+	} else {
+		udpAddr, derpAddr = de.selectAddrsForSendLocked(now)
+	}
+	pathChanged := de.notePathLocked(udpAddr, derpAddr)
+	de.mu.Unlock()
+	if pathChanged {
+		de.reportPathChange()
+	}
+	return udpAddr, derpAddr
+}
+
+// selectAddrsForSendLocked is addrsForSend for peers that support
+// disco: it picks the path(s) to send on at now, starting discovery
+// if there's no trusted direct path, and notes the send.
+//
+// de.mu must be held.
+func (de *endpoint) selectAddrsForSendLocked(now mono.Time) (udpAddr, derpAddr netaddr.IPPort) {
+	udpAddr, derpAddr = de.addrForSendLocked(now)
+	if udpAddr.IsZero() || now.After(de.trustBestAddrUntil) {
 		de.sendPingsLocked(now, true)
 	}
 	de.noteActiveLocked()
-	de.mu.Unlock()
+	return udpAddr, derpAddr
+}
 
+func (de *endpoint) send(b []byte) error {
+	udpAddr, derpAddr := de.addrsForSend()
 	if udpAddr.IsZero() && derpAddr.IsZero() {
 		return errors.New("no UDP or DERP addr")
 	}
 	var err error
 	if !udpAddr.IsZero() {
 		_, err = de.c.sendAddr(udpAddr, key.Public(de.publicKey), b)
+		if err != nil {
+			de.noteSendFailure(false)
+		}
+	} else if de.c.raceFirstSend {
+		for _, ipp := range de.firstSendRaceAddrs() {
+			// Best effort; DERP below is the path we count on.
+			de.c.sendAddr(ipp, key.Public(de.publicKey), b)
+		}
 	}
 	if !derpAddr.IsZero() {
-		if ok, _ := de.c.sendAddr(derpAddr, key.Public(de.publicKey), b); ok && err != nil {
+		res, _ := de.c.sendAddr(derpAddr, key.Public(de.publicKey), b)
+		if res == sendDropped {
+			de.noteSendFailure(true)
+		}
+		if res == sendOK && err != nil {
 			// UDP failed but DERP worked, so good enough:
 			return nil
 		}
@@ -3284,6 +6330,109 @@ func (de *endpoint) send(b []byte) error {
 	return err
 }
 
+// firstSendRaceCandidates is how many candidate endpoints the first
+// send to a peer goes to with Options.RaceFirstSend.
+const firstSendRaceCandidates = 2
+
+// firstSendRaceAddrs returns the candidate endpoints to also send
+// the current packet to per Options.RaceFirstSend: the most
+// promising few, if this is the first send since de was last reset
+// and it has never had a direct path. Otherwise it returns nil.
+// Like sendPingsLocked, it skips candidates that are due for deletion
+// or rejected by Options.EndpointFilter, and sends nothing direct
+// while endpoints aren't being advertised.
+func (de *endpoint) firstSendRaceAddrs() []netaddr.IPPort {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.racedFirstSend || !de.bestAddr.IsZero() || de.forceDERP || de.c.noAdvertiseEndpoints.Get() {
+		return nil
+	}
+	de.racedFirstSend = true
+
+	now := mono.Now()
+	sactive := de.sessionActiveTimeoutLocked()
+	eps := make([]netaddr.IPPort, 0, len(de.endpointState))
+	for ep, st := range de.endpointState {
+		if st.shouldDeleteLocked(sactive) || !de.c.endpointAllowed(ep) {
+			continue
+		}
+		eps = append(eps, ep)
+	}
+	// By rank, and then those on our local subnets first, as in
+	// sendPingsLocked.
+	sort.Slice(eps, func(i, j int) bool {
+		ri, rj := de.pingCandidateRankLocked(eps[i], now, sactive), de.pingCandidateRankLocked(eps[j], now, sactive)
+		if ri != rj {
+			return ri < rj
+		}
+		if li, lj := de.c.onLocalSubnet(eps[i].IP()), de.c.onLocalSubnet(eps[j].IP()); li != lj {
+			return li
+		}
+		return eps[i].String() < eps[j].String()
+	})
+	if len(eps) > firstSendRaceCandidates {
+		eps = eps[:firstSendRaceCandidates]
+	}
+	return eps
+}
+
+// sendBatch is like send, but for several packets. It returns the
+// number of bufs sent.
+func (de *endpoint) sendBatch(bufs [][]byte) (int, error) {
+	udpAddr, derpAddr := de.addrsForSend()
+	if udpAddr.IsZero() && derpAddr.IsZero() {
+		return 0, errors.New("no UDP or DERP addr")
+	}
+	var n int
+	var err error
+	if !udpAddr.IsZero() {
+		n, _, err = de.c.sendUDPBatch(udpAddr, bufs)
+		if err != nil {
+			de.noteSendFailure(false)
+		}
+	}
+	if !derpAddr.IsZero() {
+		derpSent := 0
+		for _, b := range bufs {
+			res, _ := de.c.sendAddr(derpAddr, key.Public(de.publicKey), b)
+			if res == sendDropped {
+				de.noteSendFailure(true)
+			}
+			if res == sendOK {
+				derpSent++
+			}
+		}
+		if derpSent > n {
+			// UDP failed or was short but DERP worked, so good enough:
+			return derpSent, nil
+		}
+	}
+	return n, err
+}
+
+// sendErrWindow is the length of the window over which an
+// endpoint's failed sends are counted for ipnstate.PeerStatus.
+const sendErrWindow = time.Minute
+
+// noteSendFailure records a failed send to de: a DERP packet dropped
+// because the region's write queue was full if derpDrop, otherwise a
+// UDP send error.
+func (de *endpoint) noteSendFailure(derpDrop bool) {
+	now := mono.Now()
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if now.Sub(de.sendErrWindowStart) >= sendErrWindow {
+		de.sendErrWindowStart = now
+		de.derpSendDrops = 0
+		de.udpSendErrs = 0
+	}
+	if derpDrop {
+		de.derpSendDrops++
+	} else {
+		de.udpSendErrs++
+	}
+}
+
 func (de *endpoint) pingTimeout(txid stun.TxID) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
@@ -3291,6 +6440,7 @@ func (de *endpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
+	metricDiscoPingTimeouts.Add(1)
 	if debugDisco || de.bestAddr.IsZero() || mono.Now().After(de.trustBestAddrUntil) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
@@ -3314,17 +6464,70 @@ func (de *endpoint) removeSentPingLocked(txid stun.TxID, sp sentPing) {
 	delete(de.sentPing, txid)
 }
 
-// sendDiscoPing sends a ping with the provided txid to ep.
+// sendDiscoPing sends a ping with the provided txid and optional
+// payload to ep.
 //
 // The caller (startPingLocked) should've already been recorded the ping in
 // sentPing and set up the timer.
-func (de *endpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, logLevel discoLogLevel) {
-	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid)}, logLevel)
+func (de *endpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, hasCaps bool, payload []byte, logLevel discoLogLevel) {
+	ping := &disco.Ping{TxID: [12]byte(txid), Payload: payload}
+	if hasCaps {
+		ping.HasCaps = true
+		ping.Caps = discoPingCaps
+	}
+	sent, _ := de.sendDiscoMessage(ep, ping, logLevel)
 	if !sent {
 		de.forgetPing(txid)
 	}
 }
 
+var (
+	// metricDiscoPingsSent counts disco pings sent, process-wide,
+	// by their discoPingPurpose.
+	metricDiscoPingsSent = &metrics.LabelMap{Label: "purpose"}
+
+	// metricDiscoPongsRecv counts disco pongs received, process-wide,
+	// in reply to pings we sent.
+	metricDiscoPongsRecv expvar.Int
+
+	// metricDiscoPingTimeouts counts disco pings sent, process-wide,
+	// that went unanswered for pingTimeoutDuration.
+	metricDiscoPingTimeouts expvar.Int
+
+	// metricDiscoRecvBoxOpenErrors counts disco-looking packets,
+	// process-wide, from known peers whose naclbox couldn't be
+	// opened, usually because the sender has a stale disco key.
+	metricDiscoRecvBoxOpenErrors expvar.Int
+
+	// metricDiscoRecvParseErrors counts disco messages,
+	// process-wide, that opened but couldn't be parsed.
+	metricDiscoRecvParseErrors expvar.Int
+
+	// discoMetrics holds the disco metrics above. See Metrics.
+	discoMetrics = new(expvar.Map).Init()
+)
+
+func init() {
+	for name, v := range map[string]expvar.Var{
+		"counter_magicsock_disco_pings_sent":           metricDiscoPingsSent,
+		"counter_magicsock_disco_pongs_recv":           &metricDiscoPongsRecv,
+		"counter_magicsock_disco_ping_timeouts":        &metricDiscoPingTimeouts,
+		"counter_magicsock_disco_recv_box_open_errors": &metricDiscoRecvBoxOpenErrors,
+		"counter_magicsock_disco_recv_parse_errors":    &metricDiscoRecvParseErrors,
+	} {
+		expvar.Publish(name, v)
+		discoMetrics.Set(name, v)
+	}
+}
+
+// Metrics returns magicsock's process-wide disco ping, pong and
+// receive error counters, keyed by the same names they're published under with
+// expvar. A collapsing ratio of pongs received to pings sent means
+// NAT traversal is failing. Callers must not modify the returned map.
+func Metrics() *expvar.Map {
+	return discoMetrics
+}
+
 // discoPingPurpose is the reason why a discovery ping message was sent.
 type discoPingPurpose int
 
@@ -3341,13 +6544,19 @@ const (
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingProbe means that the ping was sent by Conn.PingAddr to
+	// measure an address's latency. Its pong changes no path state.
+	pingProbe
 )
 
-func (de *endpoint) startPingLocked(ep netaddr.IPPort, now mono.Time, purpose discoPingPurpose) {
+// startPingLocked sends a disco ping to ep. If onPong is non-nil, it's
+// called upon receiving the pong; see sentPing.onPong.
+func (de *endpoint) startPingLocked(ep netaddr.IPPort, now mono.Time, purpose discoPingPurpose, onPong func(latency time.Duration, pongSrc netaddr.IPPort)) {
 	if !de.canP2P() {
 		panic("tried to disco ping a peer that can't disco")
 	}
-	if purpose != pingCLI {
+	if purpose != pingCLI && purpose != pingProbe {
 		st, ok := de.endpointState[ep]
 		if !ok {
 			// Shouldn't happen. But don't ping an endpoint that's
@@ -3364,26 +6573,104 @@ func (de *endpoint) startPingLocked(ep netaddr.IPPort, now mono.Time, purpose di
 		at:      now,
 		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
 		purpose: purpose,
+		hasCaps: debugDiscoPingCaps,
+		onPong:  onPong,
 	}
+	metricDiscoPingsSent.Get(purpose.String()).Add(1)
 	logLevel := discoLog
 	if purpose == pingHeartbeat {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, txid, logLevel)
+	var payload []byte
+	if de.echoesPingPayload && ep.IP() != derpMagicIPAddr {
+		de.nextPingSeq++
+		payload = appendPingPayload(nil, de.nextPingSeq)
+	}
+	go de.sendDiscoPing(ep, txid, debugDiscoPingCaps, payload, logLevel)
+}
+
+// pingPayloadLen is the length of the disco ping payload we send to
+// peers with tailcfg.CapabilityDiscoPingPayload.
+const pingPayloadLen = 4
+
+// discoPingCaps is the set of disco.PingCaps features this node
+// supports, sent in its version 1 pings and agreed to in its pongs.
+const discoPingCaps disco.PingCaps = 0
+
+// appendPingPayload appends to b the disco ping payload for the ping
+// with sequence number seq.
+func appendPingPayload(b []byte, seq uint32) []byte {
+	var a [pingPayloadLen]byte
+	binary.BigEndian.PutUint32(a[:], seq)
+	return append(b, a[:]...)
+}
+
+// parsePingPayload parses a payload made by appendPingPayload.
+func parsePingPayload(b []byte) (seq uint32, ok bool) {
+	if len(b) != pingPayloadLen {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
+
+// notePongPayloadLocked updates the reordering and jitter stats
+// from the echoed payload of a direct pong that took latency to
+// arrive. It does nothing if payload wasn't made by appendPingPayload.
+//
+// de.mu must be held.
+func (de *endpoint) notePongPayloadLocked(payload []byte, latency time.Duration) {
+	seq, ok := parsePingPayload(payload)
+	if !ok {
+		return
+	}
+	if seq < de.maxPongSeq {
+		de.pongsReordered++
+	} else {
+		de.maxPongSeq = seq
+	}
+	if de.lastPongLatency != 0 {
+		d := latency - de.lastPongLatency
+		if d < 0 {
+			d = -d
+		}
+		// Smoothed like RFC 3550's interarrival jitter.
+		de.pingJitter += (d - de.pingJitter) / 16
+	}
+	de.lastPongLatency = latency
 }
 
 func (de *endpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
+	if de.forceDERP || de.c.noAdvertiseEndpoints.Get() {
+		// Neither ping nor ask the peer to ping us directly.
+		return
+	}
 	de.lastFullPing = now
-	var sentAny bool
+	var eps []netaddr.IPPort
 	for ep, st := range de.endpointState {
-		if st.shouldDeleteLocked() {
+		if st.shouldDeleteLocked(de.sessionActiveTimeoutLocked()) {
 			de.deleteEndpointLocked(ep)
 			continue
 		}
 		if !st.lastPing.IsZero() && now.Sub(st.lastPing) < discoPingInterval {
 			continue
 		}
+		eps = append(eps, ep)
+	}
+	if max := de.c.maxPingCandidates; max > 0 && len(eps) > max {
+		sactive := de.sessionActiveTimeoutLocked()
+		sort.SliceStable(eps, func(i, j int) bool {
+			return de.pingCandidateRankLocked(eps[i], now, sactive) < de.pingCandidateRankLocked(eps[j], now, sactive)
+		})
+		eps = eps[:max]
+	}
+	// Ping candidates on our local subnets first, as they're
+	// likely the best path and so the first to answer.
+	sort.SliceStable(eps, func(i, j int) bool {
+		return de.c.onLocalSubnet(eps[i].IP()) && !de.c.onLocalSubnet(eps[j].IP())
+	})
 
+	var sentAny bool
+	for _, ep := range eps {
 		firstPing := !sentAny
 		sentAny = true
 
@@ -3391,7 +6678,7 @@ func (de *endpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 			de.c.logf("[v1] magicsock: disco: send, starting discovery for %v (%v)", de.publicKey.ShortString(), de.discoShort)
 		}
 
-		de.startPingLocked(ep, now, pingDiscovery)
+		de.startPingLocked(ep, now, pingDiscovery, nil)
 	}
 	derpAddr := de.derpAddr
 	if sentAny && sendCallMeMaybe && !derpAddr.IsZero() {
@@ -3404,6 +6691,29 @@ func (de *endpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 	}
 }
 
+// pingCandidateRankLocked returns where ep, one of de's candidate
+// endpoints, goes in the order sendPingsLocked pings them in when
+// limited by Options.MaxPingCandidates, and in the choice of
+// firstSendRaceAddrs. Lower ranks go first.
+//
+// de.mu must be held.
+func (de *endpoint) pingCandidateRankLocked(ep netaddr.IPPort, now mono.Time, activeTimeout time.Duration) int {
+	st := de.endpointState[ep]
+	switch {
+	case ep == de.bestAddr.IPPort:
+		return 0
+	case len(st.recentPongs) > 0 && now.Sub(st.recentPongs[st.recentPong].pongAt) < activeTimeout:
+		// Recently answered.
+		return 1
+	case st.lastGotPing.IsZero():
+		// From the network map or a call-me-maybe.
+		return 2
+	default:
+		// Only discovered from its pings to us.
+		return 3
+	}
+}
+
 func (de *endpoint) sendDiscoMessage(dst netaddr.IPPort, dm disco.Message, logLevel discoLogLevel) (sent bool, err error) {
 	return de.c.sendDiscoMessage(dst, de.publicKey, de.discoKey, dm, logLevel)
 }
@@ -3420,6 +6730,20 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 	} else {
 		de.derpAddr, _ = netaddr.ParseIPPort(n.DERP)
 	}
+	de.echoesPingPayload = false
+	de.parsesCallMeMaybeTTL = false
+	de.mappingVariesByDestIP = ""
+	if ni := n.Hostinfo.NetInfo; ni != nil {
+		de.mappingVariesByDestIP = ni.MappingVariesByDestIP
+	}
+	for _, c := range n.Capabilities {
+		switch c {
+		case tailcfg.CapabilityDiscoPingPayload:
+			de.echoesPingPayload = true
+		case tailcfg.CapabilityDiscoCallMeMaybeTTL:
+			de.parsesCallMeMaybeTTL = true
+		}
+	}
 
 	for _, st := range de.endpointState {
 		st.index = indexSentinelDeleted // assume deleted until updated in next loop
@@ -3434,6 +6758,9 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 			de.c.logf("magicsock: bogus netmap endpoint %q", epStr)
 			continue
 		}
+		if !de.c.endpointAllowed(ipp) {
+			continue
+		}
 		if st, ok := de.endpointState[ipp]; ok {
 			st.index = int16(i)
 		} else {
@@ -3444,7 +6771,7 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 	// Now delete anything unless it's still in the network map or
 	// was a recently discovered endpoint.
 	for ep, st := range de.endpointState {
-		if st.shouldDeleteLocked() {
+		if st.shouldDeleteLocked(de.sessionActiveTimeoutLocked()) {
 			de.deleteEndpointLocked(ep)
 		}
 	}
@@ -3456,6 +6783,10 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 // This is called once we've already verified that we got a valid
 // discovery message from de via ep.
 func (de *endpoint) addCandidateEndpoint(ep netaddr.IPPort) {
+	if !de.c.endpointAllowed(ep) {
+		return
+	}
+
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
@@ -3473,11 +6804,12 @@ func (de *endpoint) addCandidateEndpoint(ep netaddr.IPPort) {
 	de.endpointState[ep] = &endpointState{
 		lastGotPing: time.Now(),
 	}
+	de.c.sendEvent(ConnEvent{Type: ConnEventCandidateDiscovered, Peer: de.publicKey, Addr: ep})
 
 	// If for some reason this gets very large, do some cleanup.
 	if size := len(de.endpointState); size > 100 {
 		for ep, st := range de.endpointState {
-			if st.shouldDeleteLocked() {
+			if st.shouldDeleteLocked(de.sessionActiveTimeoutLocked()) {
 				de.deleteEndpointLocked(ep)
 			}
 		}
@@ -3497,8 +6829,9 @@ func (de *endpoint) noteConnectivityChange() {
 }
 
 // handlePongConnLocked handles a Pong message (a reply to an earlier ping).
-// It should be called with the Conn.mu held.
-func (de *endpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) {
+// It should be called with the Conn.mu held. It reports whether the
+// pong changed de's path; see notePathLocked.
+func (de *endpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) (pathChanged bool) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
@@ -3509,11 +6842,27 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) {
 		// This is not a pong for a ping we sent. Ignore.
 		return
 	}
+	metricDiscoPongsRecv.Add(1)
 	de.removeSentPingLocked(m.TxID, sp)
 
+	payload := m.Payload
+	if m.HasCaps {
+		de.pingCaps = m.Caps
+	} else if sp.hasCaps && len(payload) > 0 {
+		// The peer predates disco.PingCaps, so took our caps byte as
+		// the start of the payload it echoed.
+		payload = payload[1:]
+	}
+
 	now := mono.Now()
 	latency := now.Sub(sp.at)
 
+	if sp.purpose == pingProbe {
+		de.c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got probe pong tx=%x latency=%v", de.c.discoShort, de.discoShort, de.publicKey.ShortString(), src, m.TxID[:6], latency.Round(time.Millisecond))
+		sp.onPong(latency, m.Src)
+		return
+	}
+
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
 		if !ok {
@@ -3522,13 +6871,22 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) {
 		}
 
 		de.c.setAddrToDiscoLocked(src, de.discoKey)
+		de.lastDirectPong = now
 
+		// It answered, so it's not a stale call-me-maybe endpoint.
+		st.callMeMaybeExpires = time.Time{}
 		st.addPongReplyLocked(pongReply{
 			latency: latency,
 			pongAt:  now,
 			from:    src,
 			pongSrc: m.Src,
-		})
+		}, de.c.pongHistoryCount)
+		de.notePongPayloadLocked(payload, latency)
+	} else {
+		de.derpLatency = latency
+		if src == sp.to {
+			de.c.noteDERPLatencyLocked(int(src.Port()), latency)
+		}
 	}
 
 	if sp.purpose != pingHeartbeat {
@@ -3539,8 +6897,13 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) {
 		}))
 	}
 
+	if sp.onPong != nil {
+		sp.onPong(latency, m.Src)
+	}
+
 	for _, pp := range de.pendingCLIPings {
-		de.c.populateCLIPingResponseLocked(pp.res, latency, sp.to)
+		de.c.populateCLIPingResponseLocked(pp.res, de, latency, sp.to)
+		pp.finish()
 		go pp.cb(pp.res)
 	}
 	de.pendingCLIPings = nil
@@ -3548,16 +6911,69 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) {
 	// Promote this pong response to our current best address if it's lower latency.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
-		thisPong := addrLatency{sp.to, latency}
-		if betterAddr(thisPong, de.bestAddr) {
+		thisPong := addrLatency{sp.to, latency, de.c.onLocalSubnet(sp.to.IP())}
+		if betterAddr(thisPong, de.bestAddr, de.c.addrFamilyPref) {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
 			de.bestAddr = thisPong
+			de.c.sendEvent(ConnEvent{Type: ConnEventPathChanged, Peer: de.publicKey, Addr: sp.to})
+			de.c.noteDirectPathLocked()
 		}
 		if de.bestAddr.IPPort == thisPong.IPPort {
 			de.bestAddr.latency = latency
 			de.bestAddrAt = now
-			de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+			de.trustBestAddrUntil = now.Add(de.c.trustUDPAddrDuration)
 		}
+		pathChanged = de.notePathLocked(de.addrForSendLocked(now))
+	}
+	return pathChanged
+}
+
+// derpLatencyEWMAShift sets the weight of each new round trip in
+// Conn.derpRegionLatency to 1/(1<<derpLatencyEWMAShift).
+const derpLatencyEWMAShift = 2
+
+// noteDERPLatencyLocked folds a disco ping round trip of latency, to
+// a peer and back via DERP region regionID, into the region's moving
+// average.
+//
+// c.mu must be held.
+func (c *Conn) noteDERPLatencyLocked(regionID int, latency time.Duration) {
+	old, ok := c.derpRegionLatency[regionID]
+	if !ok {
+		if c.derpRegionLatency == nil {
+			c.derpRegionLatency = map[int]time.Duration{}
+		}
+		c.derpRegionLatency[regionID] = latency
+		return
+	}
+	c.derpRegionLatency[regionID] = old + (latency-old)>>derpLatencyEWMAShift
+}
+
+// DERPRegionLatency returns an exponentially weighted moving average
+// of the round trip times of disco pings sent to peers via DERP
+// region regionID and answered the same way, and whether there have
+// been any. Unlike netcheck's DERP latencies, it's updated from
+// traffic as it happens. As each round trip includes the path from
+// the region to the peer, it's an upper bound on the latency to the
+// region itself.
+func (c *Conn) DERPRegionLatency(regionID int) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.derpRegionLatency[regionID]
+	return d, ok
+}
+
+// noteDirectPathLocked notes that a peer's bestAddr was set to a
+// direct UDP path, calling c.firstDirectPathFunc the first time.
+//
+// c.mu must be held.
+func (c *Conn) noteDirectPathLocked() {
+	if c.haveDirectPath {
+		return
+	}
+	c.haveDirectPath = true
+	if f := c.firstDirectPathFunc; f != nil {
+		go f()
 	}
 }
 
@@ -3565,10 +6981,13 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) {
 type addrLatency struct {
 	netaddr.IPPort
 	latency time.Duration
+	onLAN   bool // whether IPPort is on one of our local subnets
 }
 
 // betterAddr reports whether a is a better addr to use than b.
-func betterAddr(a, b addrLatency) bool {
+// Between an IPv4 and an IPv6 address of similar latency, pref
+// decides which is better.
+func betterAddr(a, b addrLatency, pref AddressFamilyPreference) bool {
 	if a.IPPort == b.IPPort {
 		return false
 	}
@@ -3578,35 +6997,72 @@ func betterAddr(a, b addrLatency) bool {
 	if a.IsZero() {
 		return false
 	}
-	if a.IP().Is6() && b.IP().Is4() {
-		// Prefer IPv6 for being a bit more robust, as long as
-		// the latencies are roughly equivalent.
-		if a.latency/10*9 < b.latency {
-			return true
+	if a.onLAN != b.onLAN {
+		// Strongly prefer LAN paths: they're almost always
+		// better, even if a pong happened to be slow.
+		lan, other := a, b
+		if b.onLAN {
+			lan, other = b, a
 		}
-	} else if a.IP().Is4() && b.IP().Is6() {
-		if betterAddr(b, a) {
-			return false
+		if lan.latency < other.latency*2 {
+			return a.onLAN
+		}
+	}
+	if a.IP().Is4() != b.IP().Is4() {
+		// By default, prefer IPv6 for being a bit more robust,
+		// as long as the latencies are roughly equivalent.
+		preferV6, pct := pref.bias()
+		preferred, other := a, b
+		if b.IP().Is6() == preferV6 {
+			preferred, other = b, a
 		}
+		if preferred.latency/100*time.Duration(100-pct) < other.latency {
+			return a == preferred
+		}
+		return a == other
 	}
 	return a.latency < b.latency
 }
 
+// addPongReplyLocked adds r to st's ring buffer of recent pongs,
+// which holds up to max entries. The buffer grows as pongs arrive,
+// so candidates that never reply don't pay for it.
+//
 // endpoint.mu must be held.
-func (st *endpointState) addPongReplyLocked(r pongReply) {
-	if n := len(st.recentPongs); n < pongHistoryCount {
+func (st *endpointState) addPongReplyLocked(r pongReply, max int) {
+	if n := len(st.recentPongs); n < max {
 		st.recentPong = uint16(n)
 		st.recentPongs = append(st.recentPongs, r)
 		return
 	}
 	i := st.recentPong + 1
-	if i == pongHistoryCount {
+	if int(i) >= max {
 		i = 0
 	}
 	st.recentPongs[i] = r
 	st.recentPong = i
 }
 
+// ipv6LinkLocalZones returns the names of the machine's up,
+// non-loopback interfaces that have an IPv6 link-local address. They're
+// the zones used to ping a peer's link-local candidates.
+// It's a var for testing.
+var ipv6LinkLocalZones = func() ([]string, error) {
+	var zones []string
+	err := interfaces.ForeachInterface(func(i interfaces.Interface, pfxs []netaddr.IPPrefix) {
+		if !i.IsUp() || i.IsLoopback() {
+			return
+		}
+		for _, pfx := range pfxs {
+			if ip := pfx.IP(); ip.Is6() && ip.IsLinkLocalUnicast() {
+				zones = append(zones, i.Name)
+				return
+			}
+		}
+	})
+	return zones, err
+}
+
 // handleCallMeMaybe handles a CallMeMaybe discovery message via
 // DERP. The contract for use of this message is that the peer has
 // already sent to us via UDP, so their stateful firewall should be
@@ -3626,20 +7082,55 @@ func (de *endpoint) handleCallMeMaybe(m *disco.CallMeMaybe) {
 	if de.isCallMeMaybeEP == nil {
 		de.isCallMeMaybeEP = map[netaddr.IPPort]bool{}
 	}
-	var newEPs []netaddr.IPPort
+	var candidates []netaddr.IPPort
+	var zones []string // of our interfaces, for link-local candidates; nil until needed
 	for _, ep := range m.MyNumber {
 		if ep.IP().Is6() && ep.IP().IsLinkLocalUnicast() {
-			// We send these out, but ignore them for now.
-			// TODO: teach the ping code to ping on all interfaces
-			// for these.
+			// A link-local address is only reachable via the
+			// right interface, which the peer can't tell us, so
+			// try it with each of our interfaces as the zone.
+			// Whichever answers becomes bestAddr, zone and all,
+			// so later sends use the same interface.
+			if zones == nil {
+				var err error
+				if zones, err = ipv6LinkLocalZones(); err != nil {
+					de.c.logf("magicsock: disco: listing interfaces for link-local candidates: %v", err)
+				}
+				if zones == nil {
+					zones = []string{}
+				}
+			}
+			for _, zone := range zones {
+				candidates = append(candidates, netaddr.IPPortFrom(ep.IP().WithZone(zone), ep.Port()))
+			}
+			continue
+		}
+		candidates = append(candidates, ep)
+	}
+
+	var expires time.Time
+	if m.TTL > 0 {
+		expires = now.Add(m.TTL)
+	}
+	var newEPs []netaddr.IPPort
+	for _, ep := range candidates {
+		if !de.c.endpointAllowed(ep) {
 			continue
 		}
 		de.isCallMeMaybeEP[ep] = true
 		if es, ok := de.endpointState[ep]; ok {
 			es.callMeMaybeTime = now
+			if len(es.recentPongs) == 0 {
+				es.callMeMaybeExpires = expires
+			}
 		} else {
-			de.endpointState[ep] = &endpointState{callMeMaybeTime: now}
+			de.endpointState[ep] = &endpointState{
+				callMeMaybeTime:    now,
+				callMeMaybeExpires: expires,
+				index:              indexSentinelDeleted, // not in the network map
+			}
 			newEPs = append(newEPs, ep)
+			de.c.sendEvent(ConnEvent{Type: ConnEventCandidateDiscovered, Peer: de.publicKey, Addr: ep})
 		}
 	}
 	if len(newEPs) > 0 {
@@ -3677,6 +7168,16 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	defer de.mu.Unlock()
 
 	ps.Relay = de.c.derpRegionCodeOfIDLocked(int(de.derpAddr.Port()))
+	ps.DiscoPingJitter = de.pingJitter
+	ps.DiscoPongsReordered = de.pongsReordered
+	if ip, _ := de.recvLocalAddr.Load().(netaddr.IP); !ip.IsZero() {
+		ps.RecvLocalAddr = ip.String()
+	}
+	if mono.Now().Sub(de.sendErrWindowStart) < sendErrWindow {
+		ps.DERPSendDrops = de.derpSendDrops
+		ps.UDPSendErrors = de.udpSendErrs
+	}
+	ps.AsymmetricPath = de.asymmetricLogged
 
 	if de.lastSend.IsZero() {
 		return
@@ -3684,7 +7185,7 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 
 	now := mono.Now()
 	ps.LastWrite = de.lastSend.WallTime()
-	ps.Active = now.Sub(de.lastSend) < sessionActiveTimeout
+	ps.Active = now.Sub(de.lastSend) < de.sessionActiveTimeoutLocked()
 
 	if udpAddr, derpAddr := de.addrForSendLocked(now); !udpAddr.IsZero() && derpAddr.IsZero() {
 		ps.CurAddr = udpAddr.String()
@@ -3709,6 +7210,10 @@ func (de *endpoint) stopAndReset() {
 	de.bestAddr = addrLatency{}
 	de.bestAddrAt = 0
 	de.trustBestAddrUntil = 0
+	de.lastPongLatency = 0
+	de.derpLatency = 0
+	de.path = 0
+	de.lastPath = 0
 	for _, es := range de.endpointState {
 		es.lastPing = 0
 	}
@@ -3720,6 +7225,13 @@ func (de *endpoint) stopAndReset() {
 		de.heartBeatTimer.Stop()
 		de.heartBeatTimer = nil
 	}
+	de.heartbeatLowPower = false
+	de.racedFirstSend = false
+	de.asymmetricSince = 0
+	de.asymmetricLogged = false
+	for _, pp := range de.pendingCLIPings {
+		pp.finish()
+	}
 	de.pendingCLIPings = nil
 }
 
@@ -10,32 +10,46 @@ import (
 	crand "crypto/rand"
 	"crypto/tls"
 	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 	"unsafe"
 
 	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/time/rate"
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/disco"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
+	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/natlab"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -440,9 +454,46 @@ func TestPickDERPFallback(t *testing.T) {
 		t.Errorf("not sticky: got %v; want %v", got, someNode)
 	}
 
-	// TODO: test that disco-based clients changing to a new DERP
-	// region causes this fallback to also move, once disco clients
-	// have fixed DERP fallback logic.
+	// Test that the region most peers use is preferred, and that
+	// the previous pick is dropped once it has no peers.
+	for i, region := range []int{2, 5, 5, 7, 5, 2} {
+		c.peerMap.upsertDiscoEndpoint(&endpoint{
+			c:         c,
+			publicKey: tailcfg.NodeKey{0: byte(i + 1)},
+			discoKey:  tailcfg.DiscoKey{0: byte(i + 1)},
+			derpAddr:  netaddr.IPPortFrom(derpMagicIPAddr, uint16(region)),
+		})
+	}
+	if got := c.pickDERPFallback(); got != 5 {
+		t.Errorf("with peers: got %v; want 5", got)
+	}
+
+	// But a previous pick that has peers is sticky.
+	c.myDerp = 7
+	if got := c.pickDERPFallback(); got != 7 {
+		t.Errorf("sticky with peers: got %v; want 7", got)
+	}
+}
+
+func TestLastNetcheckReport(t *testing.T) {
+	c := newConn()
+	if r := c.LastNetcheckReport(); r != nil {
+		t.Fatalf("LastNetcheckReport before any netcheck = %+v; want nil", r)
+	}
+	c.lastNetCheckReport = &netcheck.Report{
+		UDP:           true,
+		HairPinning:   "true",
+		PreferredDERP: 1,
+		RegionLatency: map[int]time.Duration{1: 10 * time.Millisecond},
+	}
+	r := c.LastNetcheckReport()
+	if !reflect.DeepEqual(r, c.lastNetCheckReport) {
+		t.Fatalf("LastNetcheckReport = %+v; want %+v", r, c.lastNetCheckReport)
+	}
+	r.RegionLatency[1] = time.Second
+	if got := c.lastNetCheckReport.RegionLatency[1]; got != 10*time.Millisecond {
+		t.Errorf("mutating returned report changed Conn's copy; latency now %v", got)
+	}
 }
 
 // TestDeviceStartStop exercises the startup and shutdown logic of
@@ -646,6 +697,94 @@ func TestNoDiscoKey(t *testing.T) {
 	}
 }
 
+func TestDiagnosePeer(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	derpMap, cleanup := runDERPAndStun(t, t.Logf, localhostListener{}, netaddr.IPv4(127, 0, 0, 1))
+	defer cleanup()
+
+	m1 := newMagicStack(t, t.Logf, localhostListener{}, derpMap)
+	defer m1.Close()
+	m2 := newMagicStack(t, t.Logf, localhostListener{}, derpMap)
+	defer m2.Close()
+
+	if d := m1.conn.DiagnosePeer(context.Background(), tailcfg.NodeKey(m2.Public())); d.Err != "unknown peer" {
+		t.Fatalf("before mesh: Err = %q; want unknown peer", d.Err)
+	}
+
+	cleanupMesh := meshStacks(t.Logf, nil, m1, m2)
+	defer cleanupMesh()
+
+	for {
+		if s1 := m1.Status(); len(s1.Peer) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	d := m1.conn.DiagnosePeer(ctx, tailcfg.NodeKey(m2.Public()))
+	if d.Err != "" {
+		t.Fatalf("DiagnosePeer: %v", d.Err)
+	}
+	if len(d.Paths) == 0 {
+		t.Fatal("no paths probed")
+	}
+	if !d.DirectOK {
+		t.Errorf("direct path not OK: %+v", d)
+	}
+	if d.BestAddr.IsZero() {
+		t.Errorf("no best addr after probing: %+v", d)
+	}
+}
+
+func TestPingAddr(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	derpMap, cleanup := runDERPAndStun(t, t.Logf, localhostListener{}, netaddr.IPv4(127, 0, 0, 1))
+	defer cleanup()
+
+	m1 := newMagicStack(t, t.Logf, localhostListener{}, derpMap)
+	defer m1.Close()
+	m2 := newMagicStack(t, t.Logf, localhostListener{}, derpMap)
+	defer m2.Close()
+
+	ping := func(dk tailcfg.DiscoKey, ipp netaddr.IPPort) <-chan *ipnstate.PingResult {
+		ch := make(chan *ipnstate.PingResult, 1)
+		m1.conn.PingAddr(dk, ipp, func(res *ipnstate.PingResult) { ch <- res })
+		return ch
+	}
+	m2Addr := netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), m2.conn.LocalPort())
+	if res := <-ping(m2.conn.DiscoPublicKey(), m2Addr); res.Err != "unknown peer" {
+		t.Fatalf("before mesh: Err = %q; want unknown peer", res.Err)
+	}
+
+	cleanupMesh := meshStacks(t.Logf, nil, m1, m2)
+	defer cleanupMesh()
+
+	for {
+		if s1 := m1.Status(); len(s1.Peer) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An address nothing answers on times out; m2's address replies.
+	blackhole := ping(m2.conn.DiscoPublicKey(), netaddr.MustParseIPPort("127.0.0.1:1"))
+	res := <-ping(m2.conn.DiscoPublicKey(), m2Addr)
+	if res.Err != "" {
+		t.Fatalf("PingAddr(%v): %v", m2Addr, res.Err)
+	}
+	if res.Endpoint != m2Addr.String() || res.LatencySeconds <= 0 {
+		t.Errorf("PingAddr(%v) = %+v; want its latency", m2Addr, res)
+	}
+	if res := <-blackhole; res.Err == "" {
+		t.Errorf("PingAddr to black hole = %+v; want timeout error", res)
+	}
+}
+
 func TestActiveDiscovery(t *testing.T) {
 	t.Run("simple_internet", func(t *testing.T) {
 		t.Parallel()
@@ -1122,6 +1261,19 @@ func Test32bitAlignment(t *testing.T) {
 	if off := unsafe.Offsetof(de.lastRecv); off%8 != 0 {
 		t.Fatalf("endpoint.lastRecv is not 8-byte aligned")
 	}
+	var c Conn
+	for name, off := range map[string]uintptr{
+		"eventsDropped":     unsafe.Offsetof(c.eventsDropped),
+		"derpSendQueueFull": unsafe.Offsetof(c.derpSendQueueFull),
+		"stats":             unsafe.Offsetof(c.stats),
+	} {
+		if off%8 != 0 {
+			t.Errorf("Conn.%s is not 8-byte aligned", name)
+		}
+	}
+	c.eventsDropped.Add(1) // verify these don't panic on 32-bit
+	c.derpSendQueueFull.Add(1)
+	c.stats.derpRecvBytes.Add(1)
 
 	de.noteRecvActivity() // verify this doesn't panic on 32-bit
 	if called != 1 {
@@ -1151,6 +1303,79 @@ func newTestConn(t testing.TB) *Conn {
 	return conn
 }
 
+// newTestEndpoint returns an endpoint on c for a new peer that
+// speaks disco and has no known endpoints yet.
+func newTestEndpoint(c *Conn) *endpoint {
+	return &endpoint{
+		c:             c,
+		publicKey:     tailcfg.NodeKey(key.NewPrivate().Public()),
+		discoKey:      tailcfg.DiscoKey(key.NewPrivate().Public()),
+		sentPing:      map[stun.TxID]sentPing{},
+		endpointState: map[netaddr.IPPort]*endpointState{},
+	}
+}
+
+func TestSTUN4LocalPortEndpoints(t *testing.T) {
+	hardNAT := &netcheck.Report{GlobalV4: "1.2.3.4:1000"}
+	hardNAT.MappingVariesByDestIP.Set(true)
+	easyNAT := &netcheck.Report{GlobalV4: "1.2.3.4:1000"}
+	easyNAT.MappingVariesByDestIP.Set(false)
+	tests := []struct {
+		name         string
+		port         uint32
+		externalPort uint16
+		nr           *netcheck.Report
+		want         []netaddr.IPPort
+	}{
+		{"easy-nat", 41641, 0, easyNAT, nil},
+		{"hard-nat-fixed-port", 41641, 0, hardNAT, []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:41641")}},
+		{"hard-nat-random-port", 0, 0, hardNAT, nil},
+		{"external-port", 0, 5000, easyNAT, []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:5000")}},
+		{"both", 41641, 5000, hardNAT, []netaddr.IPPort{
+			netaddr.MustParseIPPort("1.2.3.4:41641"),
+			netaddr.MustParseIPPort("1.2.3.4:5000"),
+		}},
+		{"no-stun", 41641, 5000, &netcheck.Report{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConn()
+			c.port.Set(tt.port)
+			c.advertisedExternalPort = tt.externalPort
+			if got := c.stun4LocalPortEndpoints(tt.nr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalPorts(t *testing.T) {
+	// With no port requested, each family's socket gets its own
+	// ephemeral port, which generally differ.
+	conn, err := NewConn(Options{
+		Logf:                   t.Logf,
+		TestOnlyPacketListener: localhostListener{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	v4, v6 := conn.LocalPorts()
+	if v4 == 0 || v4 != conn.LocalPort() {
+		t.Errorf("v4 port = %v; want LocalPort %v", v4, conn.LocalPort())
+	}
+	if conn.pconn6 == nil {
+		if v6 != 0 {
+			t.Errorf("v6 port = %v with no IPv6 socket; want 0", v6)
+		}
+		return
+	}
+	if want := uint16(conn.pconn6.LocalAddr().Port); v6 != want {
+		t.Errorf("v6 port = %v; want %v", v6, want)
+	}
+}
+
 // addTestEndpoint sets conn's network map to a single peer expected
 // to receive packets from sendConn (or DERP), and returns that peer's
 // nodekey and discokey.
@@ -1179,6 +1404,12 @@ func addTestEndpoint(tb testing.TB, conn *Conn, sendConn net.PacketConn) (tailcf
 }
 
 func setUpReceiveFrom(tb testing.TB) (roundTrip func()) {
+	return setUpReceiveFromFunc(tb, func(c *Conn) conn.ReceiveFunc { return c.receiveIPv4 })
+}
+
+// setUpReceiveFromFunc is like setUpReceiveFrom, but receives with
+// the func that recvFunc returns for the Conn's IPv4 socket.
+func setUpReceiveFromFunc(tb testing.TB, recvFunc func(*Conn) conn.ReceiveFunc) (roundTrip func()) {
 	if b, ok := tb.(*testing.B); ok {
 		b.ReportAllocs()
 	}
@@ -1201,11 +1432,12 @@ func setUpReceiveFrom(tb testing.TB) (roundTrip func()) {
 		sendBuf[i] = 'x'
 	}
 	buf := make([]byte, 2<<10)
+	receive := recvFunc(conn)
 	return func() {
 		if _, err := sendConn.WriteTo(sendBuf, dstAddr); err != nil {
 			tb.Fatalf("WriteTo: %v", err)
 		}
-		n, ep, err := conn.receiveIPv4(buf)
+		n, ep, err := receive(buf)
 		if err != nil {
 			tb.Fatal(err)
 		}
@@ -1283,6 +1515,26 @@ func BenchmarkReceiveFrom(b *testing.B) {
 	}
 }
 
+// BenchmarkReceiveFuncs compares the receive func of the primary
+// IPv4 socket with one built the way Options.NumSockets's extra
+// sockets' are, which share mkReceiveFunc but skip health tracking.
+func BenchmarkReceiveFuncs(b *testing.B) {
+	for _, bb := range []struct {
+		name     string
+		recvFunc func(*Conn) conn.ReceiveFunc
+	}{
+		{"primary", func(c *Conn) conn.ReceiveFunc { return c.receiveIPv4 }},
+		{"extra", func(c *Conn) conn.ReceiveFunc { return c.mkReceiveFunc(c.pconn4, "udp4", nil) }},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			roundTrip := setUpReceiveFromFunc(b, bb.recvFunc)
+			for i := 0; i < b.N; i++ {
+				roundTrip()
+			}
+		})
+	}
+}
+
 func BenchmarkReceiveFrom_Native(b *testing.B) {
 	b.ReportAllocs()
 	recvConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
@@ -1315,6 +1567,276 @@ func BenchmarkReceiveFrom_Native(b *testing.B) {
 	}
 }
 
+func TestNumSockets(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT sockets not supported on " + runtime.GOOS)
+	}
+	c, err := NewConn(Options{Logf: t.Logf, NumSockets: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkPorts := func() {
+		t.Helper()
+		if len(c.extraPconns4) != 2 {
+			t.Fatalf("got %d extra IPv4 sockets; want 2", len(c.extraPconns4))
+		}
+		port := c.pconn4.LocalAddr().Port
+		for i, ruc := range c.extraPconns4 {
+			if got := ruc.LocalAddr().Port; got != port {
+				t.Errorf("extra IPv4 socket %d on port %d; want %d", i, got, port)
+			}
+		}
+	}
+	checkPorts()
+	if err := c.rebind(keepCurrentPort); err != nil {
+		t.Fatal(err)
+	}
+	checkPorts()
+
+	fns, _, err := c.bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fns), 3+2+2; got != want {
+		t.Errorf("got %d receive funcs; want %d", got, want)
+	}
+}
+
+// BenchmarkReceiveNumSockets measures how many packets per second
+// Options.NumSockets receive sockets can pass up through magicsock's
+// receive funcs, with the load spread across several senders.
+func BenchmarkReceiveNumSockets(b *testing.B) {
+	if !reusePortSupported {
+		b.Skip("SO_REUSEPORT sockets not supported on " + runtime.GOOS)
+	}
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets-%d", n), func(b *testing.B) {
+			c, err := NewConn(Options{Logf: logger.Discard, NumSockets: n})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.pconn4.LocalAddr().Port}
+
+			// Each sender is a known path to the same peer, so
+			// receiveIP passes its packets up. Using several
+			// lets SO_REUSEPORT spread them across sockets.
+			const senders = 8
+			var sendConns []*net.UDPConn
+			for i := 0; i < senders; i++ {
+				sc, err := net.DialUDP("udp4", nil, dst)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer sc.Close()
+				sendConns = append(sendConns, sc)
+			}
+			_, discoKey := addTestEndpoint(b, c, sendConns[0])
+			for _, sc := range sendConns[1:] {
+				c.addValidDiscoPathForTest(discoKey, netaddr.MustParseIPPort(sc.LocalAddr().String()))
+			}
+
+			// credits bounds the packets in flight so the
+			// senders don't overrun the receive buffers. Each
+			// received packet gives one back.
+			const window = 16
+			credits := make(chan struct{}, senders*window)
+			for i := 0; i < cap(credits); i++ {
+				credits <- struct{}{}
+			}
+
+			fns := []conn.ReceiveFunc{c.receiveIPv4}
+			for _, ruc := range c.extraPconns4 {
+				fns = append(fns, c.mkReceiveFunc(ruc, "udp4", nil))
+			}
+			var received int64
+			var rwg sync.WaitGroup
+			defer rwg.Wait()
+			defer c.Close() // unblocks the receivers before rwg.Wait
+			for _, receive := range fns {
+				rwg.Add(1)
+				go func(receive conn.ReceiveFunc) {
+					defer rwg.Done()
+					buf := make([]byte, 2<<10)
+					for {
+						if _, _, err := receive(buf); err != nil {
+							return
+						}
+						atomic.AddInt64(&received, 1)
+						select {
+						case credits <- struct{}{}:
+						default:
+						}
+					}
+				}(receive)
+			}
+
+			pkt := make([]byte, 1<<10)
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for _, sc := range sendConns {
+				wg.Add(1)
+				go func(sc *net.UDPConn) {
+					defer wg.Done()
+					lost := time.NewTimer(time.Second)
+					defer lost.Stop()
+					for j := 0; j < b.N/senders+1; j++ {
+						select {
+						case <-credits:
+						case <-lost.C:
+							// Presume a packet was dropped
+							// and its credit won't return.
+						}
+						if !lost.Stop() {
+							select {
+							case <-lost.C:
+							default:
+							}
+						}
+						lost.Reset(time.Second)
+						sc.Write(pkt)
+					}
+				}(sc)
+			}
+			wg.Wait()
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&received))/b.Elapsed().Seconds(), "rxpkts/s")
+		})
+	}
+}
+
+// newLoopbackSendEndpoint returns an endpoint on c with a trusted
+// direct path to a new loopback UDP socket, which it also returns.
+func newLoopbackSendEndpoint(tb testing.TB, c *Conn) (*endpoint, net.PacketConn) {
+	tb.Helper()
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { peer.Close() })
+	ua := peer.LocalAddr().(*net.UDPAddr)
+	ipp, _ := netaddr.FromStdAddr(ua.IP, ua.Port, "")
+	de := newTestEndpoint(c)
+	de.endpointState[ipp] = &endpointState{}
+	de.bestAddr = addrLatency{IPPort: ipp, latency: time.Millisecond}
+	de.trustBestAddrUntil = mono.Now().Add(time.Hour)
+	tb.Cleanup(func() {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		if de.heartBeatTimer != nil {
+			de.heartBeatTimer.Stop()
+			de.heartBeatTimer = nil
+		}
+	})
+	return de, peer
+}
+
+func TestSendBatch(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	de, peer := newLoopbackSendEndpoint(t, c)
+
+	want := []string{"one", "two", "three"}
+	var bufs [][]byte
+	for _, s := range want {
+		bufs = append(bufs, []byte(s))
+	}
+	n, err := c.SendBatch(bufs, de)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bufs) {
+		t.Fatalf("SendBatch = %d; want %d", n, len(bufs))
+	}
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	for _, w := range want {
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != w {
+			t.Errorf("got packet %q; want %q", got, w)
+		}
+	}
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	const batchSize = 32
+	pkt := make([]byte, 1<<10)
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = pkt
+	}
+	run := func(b *testing.B, send func(c *Conn, de *endpoint) error) {
+		c := newTestConn(b)
+		defer c.Close()
+		c.logf = logger.Discard
+		de, peer := newLoopbackSendEndpoint(b, c)
+		go func() {
+			buf := make([]byte, 2<<10)
+			for {
+				if _, _, err := peer.ReadFrom(buf); err != nil {
+					return
+				}
+			}
+		}()
+		b.SetBytes(int64(len(pkt) * batchSize))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := send(c, de); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("single", func(b *testing.B) {
+		run(b, func(c *Conn, de *endpoint) error {
+			for _, buf := range bufs {
+				if err := c.Send(buf, de); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	b.Run("batch", func(b *testing.B) {
+		run(b, func(c *Conn, de *endpoint) error {
+			_, err := c.SendBatch(bufs, de)
+			return err
+		})
+	})
+}
+
+func BenchmarkAddrsForSendNoDisco(b *testing.B) {
+	// The same disco-less peer, via addrsForSend's DERP-only fast
+	// path and via the path selection it skips.
+	de := &endpoint{
+		c:         newConn(),
+		publicKey: tailcfg.NodeKey(key.NewPrivate().Public()),
+		derpAddr:  netaddr.IPPortFrom(derpMagicIPAddr, 1),
+	}
+	defer de.stopAndReset()
+	b.Run("fast-path", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			de.addrsForSend()
+		}
+	})
+	b.Run("path-selection", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			now := mono.Now()
+			de.mu.Lock()
+			de.selectAddrsForSendLocked(now)
+			de.mu.Unlock()
+		}
+	})
+}
+
 // Test that a netmap update where node changes its node key but
 // doesn't change its disco key doesn't result in a broken state.
 //
@@ -1498,62 +2020,2793 @@ func TestEndpointSetsEqual(t *testing.T) {
 
 }
 
-func TestBetterAddr(t *testing.T) {
-	const ms = time.Millisecond
-	al := func(ipps string, d time.Duration) addrLatency {
-		return addrLatency{netaddr.MustParseIPPort(ipps), d}
+func TestRebindingUDPConnDeadline(t *testing.T) {
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
 	}
-	zero := addrLatency{}
-	tests := []struct {
-		a, b addrLatency
-		want bool
-	}{
-		{a: zero, b: zero, want: false},
-		{a: al("10.0.0.2:123", 5*ms), b: zero, want: true},
-		{a: zero, b: al("10.0.0.2:123", 5*ms), want: false},
-		{a: al("10.0.0.2:123", 5*ms), b: al("1.2.3.4:555", 6*ms), want: true},
-		{a: al("10.0.0.2:123", 5*ms), b: al("10.0.0.2:123", 10*ms), want: false}, // same IPPort
-
-		// Prefer IPv6 if roughly equivalent:
-		{
-			a:    al("[2001::5]:123", 100*ms),
-			b:    al("1.2.3.4:555", 91*ms),
-			want: true,
-		},
-		{
-			a:    al("1.2.3.4:555", 91*ms),
-			b:    al("[2001::5]:123", 100*ms),
-			want: false,
-		},
-		// But not if IPv4 is much faster:
-		{
-			a:    al("[2001::5]:123", 100*ms),
-			b:    al("1.2.3.4:555", 30*ms),
-			want: false,
-		},
-		{
-			a:    al("1.2.3.4:555", 30*ms),
-			b:    al("[2001::5]:123", 100*ms),
-			want: true,
-		},
+	ruc := &RebindingUDPConn{pconn: listen()}
+	defer ruc.Close()
+	if err := ruc.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
 	}
-	for _, tt := range tests {
-		got := betterAddr(tt.a, tt.b)
-		if got != tt.want {
-			t.Errorf("betterAddr(%+v, %+v) = %v; want %v", tt.a, tt.b, got, tt.want)
-			continue
-		}
-		gotBack := betterAddr(tt.b, tt.a)
-		if got && gotBack {
-			t.Errorf("betterAddr(%+v, %+v) and betterAddr(%+v, %+v) both unexpectedly true", tt.a, tt.b, tt.b, tt.a)
-		}
+	isTimeout := func(err error) bool {
+		ne, ok := err.(net.Error)
+		return ok && ne.Timeout()
+	}
+	buf := make([]byte, 100)
+	if _, _, err := ruc.ReadFrom(buf); !isTimeout(err) {
+		t.Fatalf("ReadFrom = %v; want timeout", err)
+	}
+
+	// As if rebound: the new socket gets the same deadline.
+	ruc.mu.Lock()
+	ruc.closeLocked()
+	ruc.setConnLocked(listen())
+	ruc.mu.Unlock()
+	if _, _, err := ruc.ReadFrom(buf); !isTimeout(err) {
+		t.Fatalf("after rebind, ReadFrom = %v; want timeout", err)
 	}
 
+	// Clearing the deadline lets reads succeed again.
+	if err := ruc.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	sender := listen()
+	defer sender.Close()
+	if _, err := sender.WriteTo([]byte("hello"), ruc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := ruc.ReadFrom(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("ReadFrom = %q, %v; want hello", buf[:n], err)
+	}
 }
 
-func epStrings(eps []tailcfg.Endpoint) (ret []string) {
-	for _, ep := range eps {
-		ret = append(ret, ep.Addr.String())
+func TestReadFromNetaddrDst(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	family := enableDstControlMessages(pc, "udp4")
+	if runtime.GOOS == "linux" && family != 4 {
+		t.Fatalf("enableDstControlMessages = %v; want 4", family)
+	}
+	ruc := &RebindingUDPConn{pconn: pc, dstFamily: family}
+
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.WriteTo([]byte("hello"), pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, src, dst, err := ruc.ReadFromNetaddrDst(buf, ipv4.NewControlMessage(ipv4.FlagDst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Errorf("read %q; want hello", got)
+	}
+	if want := netaddr.MustParseIPPort(sender.LocalAddr().String()); src != want {
+		t.Errorf("src = %v; want %v", src, want)
+	}
+	if family != 0 && dst != netaddr.IPv4(127, 0, 0, 1) {
+		t.Errorf("dst = %v; want 127.0.0.1", dst)
+	}
+}
+
+// zonedPacketConn is a net.PacketConn whose reads come from a
+// fixed link-local address with a zone.
+type zonedPacketConn struct {
+	net.PacketConn // nil; only ReadFrom is used
+	from           *net.UDPAddr
+}
+
+func (c zonedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return copy(b, "hello"), c.from, nil
+}
+
+func TestReadFromNetaddrZone(t *testing.T) {
+	ruc := &RebindingUDPConn{pconn: zonedPacketConn{
+		from: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 41641, Zone: "eth0"},
+	}}
+	_, src, err := ruc.ReadFromNetaddr(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netaddr.MustParseIPPort("[fe80::1%eth0]:41641"); src != want {
+		t.Errorf("src = %v; want %v", src, want)
+	}
+}
+
+// Tests that two peers at the same link-local ip:port on different
+// interfaces don't alias each other.
+func TestPeerMapIPPortZones(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	m := newPeerMap()
+	newEP := func() *endpoint {
+		ep := newTestEndpoint(c)
+		m.upsertDiscoEndpoint(ep)
+		return ep
+	}
+	epA, epB := newEP(), newEP()
+	onEth0 := netaddr.MustParseIPPort("[fe80::1%eth0]:41641")
+	onWlan0 := netaddr.MustParseIPPort("[fe80::1%wlan0]:41641")
+	m.setDiscoKeyForIPPort(onEth0, epA.discoKey)
+	m.setDiscoKeyForIPPort(onWlan0, epB.discoKey)
+
+	if got, _ := m.endpointForIPPort(onEth0); got != epA {
+		t.Errorf("endpointForIPPort(%v) = %p; want %p", onEth0, got, epA)
+	}
+	if got, _ := m.endpointForIPPort(onWlan0); got != epB {
+		t.Errorf("endpointForIPPort(%v) = %p; want %p", onWlan0, got, epB)
+	}
+	if got, ok := m.endpointForIPPort(netaddr.MustParseIPPort("[fe80::1]:41641")); ok {
+		t.Errorf("zoneless lookup = %p; want none", got)
+	}
+
+	// Deleting one peer leaves the other's mapping alone.
+	m.deleteDiscoEndpoint(epA)
+	if _, ok := m.endpointForIPPort(onEth0); ok {
+		t.Errorf("%v still mapped after deleting its peer", onEth0)
+	}
+	if got, _ := m.endpointForIPPort(onWlan0); got != epB {
+		t.Errorf("after delete, endpointForIPPort(%v) = %p; want %p", onWlan0, got, epB)
+	}
+}
+
+func TestStableFakeUDPAddr(t *testing.T) {
+	nk := tailcfg.NodeKey(key.NewPrivate().Public())
+	de1 := &endpoint{publicKey: nk}
+	de1.initStableFakeUDPAddr()
+	defer de1.releaseStableFakeUDPAddr()
+
+	// The same key, as seen from another Conn in this process,
+	// gets a different address.
+	de2 := &endpoint{publicKey: nk}
+	de2.initStableFakeUDPAddr()
+	if de1.fakeWGAddr == de2.fakeWGAddr {
+		t.Fatalf("duplicate fake addr %v", de1.fakeWGAddr)
+	}
+	de2.releaseStableFakeUDPAddr()
+
+	// Once released, the key's address is reused.
+	de3 := &endpoint{publicKey: nk}
+	de3.initStableFakeUDPAddr()
+	defer de3.releaseStableFakeUDPAddr()
+	if de3.fakeWGAddr != de2.fakeWGAddr {
+		t.Errorf("fake addr after release = %v; want %v", de3.fakeWGAddr, de2.fakeWGAddr)
+	}
+
+	// And it's disjoint from the pointer-based scheme.
+	if b := de1.fakeWGAddr.IP().As16(); b[0] != 0xfd || b[15] != 1 {
+		t.Errorf("unexpected stable fake addr %v", de1.fakeWGAddr)
+	}
+}
+
+func TestEnforceMaxActiveDERP(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.myDerp = 1
+	c.maxActiveDERPConns = 3
+	c.activeDerp = make(map[int]activeDerp)
+	now := time.Now()
+	for _, v := range []struct {
+		region int
+		ago    time.Duration
+	}{
+		{1, time.Hour}, // home; never evicted
+		{2, time.Second},
+		{3, time.Minute},
+	} {
+		lastWrite := now.Add(-v.ago)
+		c.activeDerp[v.region] = activeDerp{
+			c:          derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil }),
+			cancel:     func() {},
+			lastWrite:  &lastWrite,
+			createTime: now,
+		}
+	}
+
+	c.enforceMaxActiveDERPLocked()
+	if _, ok := c.activeDerp[3]; ok {
+		t.Error("least recently written region 3 still open")
+	}
+	if len(c.activeDerp) != 2 {
+		t.Errorf("got %d active DERP conns; want 2", len(c.activeDerp))
+	}
+
+	// At a limit of 1, region 2 is closed to make room, leaving the
+	// home connection for the new one to join.
+	c.maxActiveDERPConns = 1
+	c.enforceMaxActiveDERPLocked()
+	if _, ok := c.activeDerp[1]; !ok || len(c.activeDerp) != 1 {
+		t.Errorf("got active regions %v; want only home region 1", c.activeDerp)
+	}
+}
+
+func TestMaxActiveDERPBoundary(t *testing.T) {
+	// With the home connection and region 2 open, making room for a
+	// third region closes region 2 at a limit of 2 (or less, as
+	// that's at or below the one home connection), but not at a
+	// limit of 3.
+	for _, tt := range []struct {
+		max      int
+		keepTwo  bool
+		wantOpen int
+	}{
+		{1, false, 1},
+		{2, false, 1},
+		{3, true, 2},
+	} {
+		c := newConn()
+		c.logf = t.Logf
+		c.myDerp = 1
+		c.maxActiveDERPConns = tt.max
+		lastWrite := time.Now()
+		c.activeDerp = make(map[int]activeDerp)
+		for _, region := range []int{1, 2} {
+			c.activeDerp[region] = activeDerp{
+				c:          derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil }),
+				cancel:     func() {},
+				lastWrite:  &lastWrite,
+				createTime: lastWrite,
+			}
+		}
+		c.enforceMaxActiveDERPLocked()
+		if _, ok := c.activeDerp[1]; !ok {
+			t.Errorf("limit %d: home connection closed", tt.max)
+		}
+		if _, ok := c.activeDerp[2]; ok != tt.keepTwo {
+			t.Errorf("limit %d: region 2 kept = %v; want %v", tt.max, ok, tt.keepTwo)
+		}
+		if len(c.activeDerp) != tt.wantOpen {
+			t.Errorf("limit %d: %d conns open; want %d", tt.max, len(c.activeDerp), tt.wantOpen)
+		}
+	}
+}
+
+func TestUpdateStatusDERPConns(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.myDerp = 2
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "nyc"},
+			2: {RegionID: 2, RegionCode: "sfo"},
+		},
+	}
+	c.activeDerp = make(map[int]activeDerp)
+	created := time.Now().Add(-time.Hour)
+	for _, region := range []int{2, 1} {
+		lastWrite := created.Add(time.Duration(region) * time.Minute)
+		c.activeDerp[region] = activeDerp{
+			c:          derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil }),
+			cancel:     func() {},
+			lastWrite:  &lastWrite,
+			createTime: created,
+		}
+	}
+
+	var sb ipnstate.StatusBuilder
+	c.UpdateStatus(&sb)
+	got := sb.Status().DERPConns
+	want := []ipnstate.DERPConnStatus{
+		{RegionID: 1, RegionCode: "nyc", Created: created, LastWrite: created.Add(time.Minute)},
+		{RegionID: 2, RegionCode: "sfo", Home: true, Created: created, LastWrite: created.Add(2 * time.Minute)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DERPConns = %+v; want %+v", got, want)
+	}
+}
+
+func TestHomeDERP(t *testing.T) {
+	c := newConn()
+	if id, code := c.HomeDERP(); id != 0 || code != "" {
+		t.Errorf("HomeDERP with no home = %v, %q; want 0, \"\"", id, code)
+	}
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1, RegionCode: "nyc"}},
+	}
+	c.myDerp = 1
+	if id, code := c.HomeDERP(); id != 1 || code != "nyc" {
+		t.Errorf("HomeDERP = %v, %q; want 1, \"nyc\"", id, code)
+	}
+}
+
+func TestDerpRestart(t *testing.T) {
+	now := time.Now()
+	if _, ok := (derpRestart{}).wait(now); ok {
+		t.Fatal("zero derpRestart applies")
+	}
+	m := derp.ServerRestartingMessage{ReconnectIn: 10 * time.Second, TryFor: 5 * time.Second}
+	for i := 0; i < 100; i++ {
+		r := newDerpRestart(m, now)
+		d, ok := r.wait(now)
+		if !ok || d < m.ReconnectIn || d >= m.ReconnectIn+derpRestartJitter {
+			t.Fatalf("wait right after restart message = %v, %v; want in [%v, %v)", d, ok, m.ReconnectIn, m.ReconnectIn+derpRestartJitter)
+		}
+		if got := r.tryUntil.Sub(r.reconnectAt); got != m.TryFor {
+			t.Fatalf("try window = %v; want %v", got, m.TryFor)
+		}
+		if d, ok := r.wait(r.reconnectAt.Add(time.Second)); !ok || d != derpRestartRetryInterval {
+			t.Fatalf("wait within TryFor = %v, %v; want %v", d, ok, derpRestartRetryInterval)
+		}
+		if _, ok := r.wait(r.tryUntil); ok {
+			t.Fatal("restart still applies after TryFor")
+		}
+	}
+}
+
+func TestDerpRestartReconnect(t *testing.T) {
+	const reconnectIn = 500 * time.Millisecond
+	var (
+		mu        sync.Mutex
+		advised   time.Duration // from runDerpReader's restarting log
+		advisedAt time.Time
+	)
+	connectLogged := make(chan struct{}, 10)
+	logf := func(format string, args ...interface{}) {
+		t.Logf(format, args...)
+		msg := fmt.Sprintf(format, args...)
+		if strings.Contains(msg, "derp-1 connected") {
+			select {
+			case connectLogged <- struct{}{}:
+			default:
+			}
+		}
+		const prefix = "derp-1 server restarting; reconnecting in "
+		if i := strings.Index(msg, prefix); i >= 0 {
+			s := msg[i+len(prefix):]
+			if j := strings.IndexByte(s, ','); j >= 0 {
+				s = s[:j]
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				t.Errorf("bad restart log %q: %v", msg, err)
+			}
+			mu.Lock()
+			advised, advisedAt = d, time.Now()
+			mu.Unlock()
+		}
+	}
+	reconnected := make(chan time.Time, 10)
+	d, _, _ := newDERPTestConn(t, Options{
+		Logf: logf,
+		DERPHealthFunc: func(regionID int, problem string) {
+			if problem == "" {
+				reconnected <- time.Now()
+			}
+		},
+	})
+	select {
+	case <-connectLogged:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for DERP connection")
+	}
+
+	// Drain sends the restarting frame, then closes our connection
+	// after reconnectIn. The server keeps rejecting us until
+	// SetDraining(false), as a restarted server would.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.Drain(ctx, reconnectIn, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d.SetDraining(false)
+
+	var at time.Time
+	select {
+	case at = <-reconnected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for reconnect")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if advisedAt.IsZero() {
+		t.Fatal("restarting message not handled")
+	}
+	// The advised delay is rounded to the millisecond when logged.
+	// At the latest we reconnect a retry or two after the server
+	// stops rejecting us, shortly after closing our connection.
+	got := at.Sub(advisedAt)
+	min := advised - time.Millisecond
+	max := advised + reconnectIn + 2*derpRestartRetryInterval + time.Second
+	if got < min || got > max {
+		t.Errorf("reconnected %v after restarting message; want in [%v, %v]", got, min, max)
+	}
+}
+
+// newDERPTestConn returns a DERP server, closed with httpsrv, and a
+// Conn connected to it as region 1, configured by opts.
+func newDERPTestConn(t *testing.T, opts Options) (*derp.Server, *httptest.Server, *Conn) {
+	t.Helper()
+	var serverPrivateKey key.Private
+	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	d := derp.NewServer(serverPrivateKey, t.Logf)
+	httpsrv := httptest.NewUnstartedServer(derphttp.Handler(d))
+	httpsrv.Config.ErrorLog = logger.StdLogger(t.Logf)
+	httpsrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	httpsrv.StartTLS()
+	t.Cleanup(func() {
+		httpsrv.Close()
+		d.Close()
+	})
+
+	opts.TestOnlyPacketListener = localhostListener{}
+	c, err := NewConn(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDERPMap(&tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes: []*tailcfg.DERPNode{{
+					Name:             "t1",
+					RegionID:         1,
+					HostName:         "test-node.unused",
+					IPv4:             "127.0.0.1",
+					IPv6:             "none",
+					STUNPort:         -1,
+					DERPPort:         httpsrv.Listener.Addr().(*net.TCPAddr).Port,
+					InsecureForTests: true,
+				}},
+			},
+		},
+	})
+	privateKey, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetPrivateKey(privateKey); err != nil {
+		t.Fatal(err)
+	}
+	c.goDerpConnect(1)
+	return d, httpsrv, c
+}
+
+func TestDERPHealthFunc(t *testing.T) {
+	type event struct {
+		regionID int
+		problem  string
+	}
+	events := make(chan event, 10)
+	d, httpsrv, _ := newDERPTestConn(t, Options{
+		Logf: t.Logf,
+		DERPHealthFunc: func(regionID int, problem string) {
+			events <- event{regionID, problem}
+		},
+	})
+
+	waitEvent := func(want event) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got event %+v; want %+v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for event %+v", want)
+		}
+	}
+	// Connecting healthy reports nothing; changes are reported once.
+	d.SetHealthProblem("overloaded")
+	waitEvent(event{1, "overloaded"})
+	d.SetHealthProblem("")
+	waitEvent(event{1, ""})
+
+	httpsrv.CloseClientConnections()
+	waitEvent(event{1, derpProblemDisconnected})
+	waitEvent(event{1, ""}) // reconnected
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestCloseIdleDERP(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "home"},
+			2: {RegionID: 2, RegionCode: "idle"},
+			3: {RegionID: 3, RegionCode: "recent"},
+		},
+	}
+	c.myDerp = 1
+	c.activeDerp = make(map[int]activeDerp)
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.derpCleanupTimer != nil {
+			c.derpCleanupTimer.Stop()
+		}
+	}()
+	now := time.Now()
+	for region, lastWrite := range map[int]time.Time{
+		1: now.Add(-time.Hour),
+		2: now.Add(-30 * time.Second),
+		3: now,
+	} {
+		lastWrite := lastWrite
+		c.activeDerp[region] = activeDerp{
+			c:          derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil }),
+			writeCh:    make(chan derpWriteRequest, 1),
+			cancel:     func() {},
+			lastWrite:  &lastWrite,
+			createTime: now.Add(-time.Hour),
+		}
+	}
+
+	if n := c.CloseIdleDERP(10 * time.Second); n != 1 {
+		t.Errorf("CloseIdleDERP closed %d connections; want 1", n)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for region, wantOpen := range map[int]bool{1: true, 2: false, 3: true} {
+		if _, open := c.activeDerp[region]; open != wantOpen {
+			t.Errorf("region %d open = %v; want %v", region, open, wantOpen)
+		}
+	}
+}
+
+func TestSendDERPControl(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewPrivate()
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "one"},
+		},
+	}
+	lastWrite := time.Now()
+	writeCh := make(chan derpWriteRequest, 1)
+	c.activeDerp = map[int]activeDerp{
+		1: {
+			c:          derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil }),
+			writeCh:    writeCh,
+			cancel:     func() {},
+			lastWrite:  &lastWrite,
+			createTime: lastWrite,
+		},
+	}
+	peer := key.NewPrivate().Public()
+	msg := []byte("hello")
+
+	if err := c.SendDERPControl(1, peer, msg); err != nil {
+		t.Fatal(err)
+	}
+	msg[0] = 'j' // the message must have been copied
+	if wr := <-writeCh; wr.pubKey != peer || string(wr.b) != "hello" || wr.addr.Port() != 1 {
+		t.Errorf("queued write = %+v; want hello to %v via region 1", wr, peer)
+	}
+
+	writeCh <- derpWriteRequest{} // fill the queue
+	if err := c.SendDERPControl(1, peer, msg); err != errDropDerpPacket {
+		t.Errorf("with full queue, err = %v; want %v", err, errDropDerpPacket)
+	}
+	if err := c.SendDERPControl(2, peer, msg); err == nil {
+		t.Error("unknown region: got nil error")
+	}
+	if err := c.SendDERPControl(1, peer, make([]byte, derp.MaxPacketSize+1)); err == nil {
+		t.Error("oversized message: got nil error")
+	}
+}
+
+func TestDERPHomeChangeDualHome(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewPrivate()
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "old"},
+			2: {RegionID: 2, RegionCode: "new"},
+			3: {RegionID: 3, RegionCode: "other"},
+		},
+	}
+	c.myDerp = 1
+	c.activeDerp = make(map[int]activeDerp)
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.derpCleanupTimer != nil {
+			c.derpCleanupTimer.Stop()
+		}
+	}()
+	idle := time.Now().Add(-time.Hour)
+	for _, region := range []int{1, 2, 3} {
+		lastWrite := idle
+		c.activeDerp[region] = activeDerp{
+			c:          derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil }),
+			writeCh:    make(chan derpWriteRequest, 1),
+			cancel:     func() {},
+			lastWrite:  &lastWrite,
+			createTime: idle,
+		}
+	}
+	oldAddr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	peer := key.NewPrivate().Public()
+	before := c.derpWriteChanOfAddr(oldAddr, peer)
+
+	// Roam: region 2 becomes home mid-stream.
+	c.mu.Lock()
+	c.myDerp = 2
+	c.noteDERPHomeChangeLocked(1)
+	*c.activeDerp[1].lastWrite = idle
+	c.mu.Unlock()
+
+	if after := c.derpWriteChanOfAddr(oldAddr, peer); after == nil || after != before {
+		t.Fatal("old home DERP connection not writable after home change")
+	}
+	c.mu.Lock()
+	*c.activeDerp[1].lastWrite = idle
+	c.maxActiveDERPConns = 3
+	c.enforceMaxActiveDERPLocked()
+	if _, ok := c.activeDerp[1]; !ok {
+		t.Fatal("old home evicted during dual-home window")
+	}
+	if _, ok := c.activeDerp[3]; ok {
+		t.Error("non-home region 3 kept over the dual-homed old home")
+	}
+	c.mu.Unlock()
+	c.cleanStaleDerp()
+	c.mu.Lock()
+	if _, ok := c.activeDerp[1]; !ok {
+		t.Fatal("old home closed as idle during dual-home window")
+	}
+
+	// End the window.
+	c.prevHomeDerpUntil = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+	c.cleanStaleDerp()
+	c.mu.Lock()
+	if _, ok := c.activeDerp[1]; ok {
+		t.Error("idle old home still open after dual-home window")
+	}
+	if c.prevHomeDerp != 0 {
+		t.Errorf("prevHomeDerp = %v after window; want 0", c.prevHomeDerp)
+	}
+	if _, ok := c.activeDerp[2]; !ok {
+		t.Error("new home closed")
+	}
+	c.mu.Unlock()
+}
+
+func TestEndpointUpdates(t *testing.T) {
+	c := newTestConn(t)
+	ch := c.EndpointUpdates()
+	if ch2 := c.EndpointUpdates(); ch2 != ch {
+		t.Fatal("EndpointUpdates returned a different channel")
+	}
+
+	// Overflow the buffer: the oldest updates are dropped.
+	for i := 0; i < endpointUpdateBufferSize+2; i++ {
+		c.sendEndpointUpdate([]tailcfg.Endpoint{{Addr: netaddr.IPPortFrom(netaddr.IPv4(1, 2, 3, 4), uint16(i))}})
+	}
+	eps := <-ch
+	if len(eps) != 1 || eps[0].Addr.Port() != 2 {
+		t.Errorf("first update = %v; want port 2", eps)
+	}
+
+	c.Close()
+	for range ch {
+		// Drain the rest; the loop ends once Close closed ch.
+	}
+	if _, ok := <-c.EndpointUpdates(); ok {
+		t.Error("EndpointUpdates channel not closed after Close")
+	}
+}
+
+func TestSendResultSuppressed(t *testing.T) {
+	c := newConn() // no IPv6 socket
+	v6 := netaddr.MustParseIPPort("[::1]:1")
+	before := metricSendResults.Get("suppressed").Value()
+
+	if res, err := c.sendAddr(v6, key.Public{}, []byte("one")); res != sendSuppressed || err != nil {
+		t.Errorf("sendAddr = %v, %v; want suppressed, nil", res, err)
+	}
+	n, res, err := c.sendUDPBatch(v6, [][]byte{[]byte("a"), []byte("b")})
+	if n != 0 || res != sendSuppressed || err != nil {
+		t.Errorf("sendUDPBatch = %v, %v, %v; want 0, suppressed, nil", n, res, err)
+	}
+	// No DERP connection to send via.
+	derpAddr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	if res, err := c.sendAddr(derpAddr, key.Public{}, []byte("one")); res != sendSuppressed || err != nil {
+		t.Errorf("sendAddr via DERP = %v, %v; want suppressed, nil", res, err)
+	}
+	if got := metricSendResults.Get("suppressed").Value() - before; got != 4 {
+		t.Errorf("suppressed counter = %d; want 4", got)
+	}
+}
+
+func TestDERPSendQueueFull(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.networkUp.Set(true)
+	c.privateKey = key.NewPrivate()
+	c.derpMap = &tailcfg.DERPMap{}
+	writeCh := make(chan derpWriteRequest, 1)
+	lastWrite := time.Now()
+	c.activeDerp = map[int]activeDerp{
+		7: {writeCh: writeCh, lastWrite: &lastWrite, createTime: lastWrite},
+	}
+
+	addr := netaddr.IPPortFrom(derpMagicIPAddr, 7)
+	before := metricDERPSendQueueFullRegion.Get("7").Value()
+	if res, err := c.sendAddr(addr, key.Public{}, []byte("one")); res != sendOK || err != nil {
+		t.Fatalf("first send = %v, %v; want ok", res, err)
+	}
+	for i := 0; i < 2; i++ {
+		if res, err := c.sendAddr(addr, key.Public{}, []byte("drop")); res != sendDropped || err != errDropDerpPacket {
+			t.Fatalf("send %d = %v, %v; want dropped, errDropDerpPacket", i, res, err)
+		}
+	}
+	if got := c.DERPSendQueueFull(); got != 2 {
+		t.Errorf("DERPSendQueueFull = %d; want 2", got)
+	}
+	if got := metricDERPSendQueueFullRegion.Get("7").Value() - before; got != 2 {
+		t.Errorf("region 7 drops = %d; want 2", got)
+	}
+}
+
+// addrRecordingListener is a localhostListener that records the
+// addresses it's asked to listen on.
+type addrRecordingListener struct {
+	addrs []string // "network address"
+}
+
+func (l *addrRecordingListener) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	l.addrs = append(l.addrs, network+" "+address)
+	return localhostListener{}.ListenPacket(ctx, network, address)
+}
+
+func TestPacketListener(t *testing.T) {
+	l, testOnly := new(addrRecordingListener), new(addrRecordingListener)
+	c, err := NewConn(Options{
+		Logf:                   t.Logf,
+		PacketListener:         l,
+		TestOnlyPacketListener: testOnly,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got, want := strings.Join(l.addrs, ","), "udp4 :0,udp6 :0"; got != want {
+		t.Errorf("PacketListener got listens %q; want %q", got, want)
+	}
+	if len(testOnly.addrs) != 0 {
+		t.Errorf("TestOnlyPacketListener got listens %q; want none", testOnly.addrs)
+	}
+}
+
+func TestDisableIPv6(t *testing.T) {
+	l := new(addrRecordingListener)
+	c, err := NewConn(Options{
+		Logf:                   t.Logf,
+		TestOnlyPacketListener: l,
+		DisableIPv6:            true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.rebind(dropCurrentPort); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range l.addrs {
+		if strings.HasPrefix(a, "udp6 ") {
+			t.Errorf("listened on %q with IPv6 disabled", a)
+		}
+	}
+	if c.pconn6 != nil {
+		t.Error("pconn6 is non-nil")
+	}
+	if c.netChecker.GetSTUNConn6 != nil {
+		t.Error("netcheck given an IPv6 STUN conn")
+	}
+	if !c.netChecker.SkipIPv6 {
+		t.Error("netcheck not told to skip IPv6")
+	}
+	fns, _, err := c.Bind().Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns) != 2 {
+		t.Errorf("got %d receive funcs; want 2 (IPv4 and DERP)", len(fns))
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	if _, err := NewConn(Options{Logf: t.Logf, DSCP: 64}); err == nil {
+		t.Error("NewConn with DSCP 64 succeeded; want error")
+	}
+	if !dscpSupported {
+		t.Skip("DSCP marking not supported on " + runtime.GOOS)
+	}
+	const dscp = 46 // Expedited Forwarding
+	c, err := NewConn(Options{
+		Logf:                   t.Logf,
+		TestOnlyPacketListener: localhostListener{},
+		DSCP:                   dscp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Check it's set on the initial sockets and again after a rebind.
+	for i := 0; i < 2; i++ {
+		tos, err := ipv4.NewPacketConn(c.pconn4.currentConn()).TOS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tos != dscp<<2 {
+			t.Errorf("IPv4 TOS = %#x; want %#x", tos, dscp<<2)
+		}
+		if err := c.rebind(dropCurrentPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBindAddr(t *testing.T) {
+	l := new(addrRecordingListener)
+	c := newConn()
+	c.logf = t.Logf
+	c.packetListener = l
+	c.bindAddr = netaddr.MustParseIP("127.0.0.1")
+
+	// Bind, then rebind as on a link change.
+	for i := 0; i < 2; i++ {
+		if err := c.bindSocket(&c.pconn4, "udp4", keepCurrentPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer c.pconn4.Close()
+	if got := c.pconn4.LocalAddr().IP.String(); got != "127.0.0.1" {
+		t.Errorf("bound to %v; want 127.0.0.1", got)
+	}
+
+	// The IPv6 socket isn't affected by an IPv4 BindAddr.
+	if pc, err := c.listenPacket("udp6", 0); err == nil {
+		pc.Close()
+	}
+
+	if len(l.addrs) != 3 {
+		t.Fatalf("got listens %q; want 3", l.addrs)
+	}
+	for _, a := range l.addrs[:2] {
+		if !strings.HasPrefix(a, "udp4 127.0.0.1:") {
+			t.Errorf("listened on %q; want BindAddr", a)
+		}
+	}
+	if got, want := l.addrs[2], "udp6 :0"; got != want {
+		t.Errorf("listened on %q; want %q", got, want)
+	}
+}
+
+// denyingListener is a PacketListener that fails with EACCES while
+// deny is set.
+type denyingListener struct {
+	deny bool
+}
+
+func (l *denyingListener) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if l.deny {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("bind", syscall.EACCES)}
+	}
+	return localhostListener{}.ListenPacket(ctx, network, address)
+}
+
+func TestBindSocketHealth(t *testing.T) {
+	l := &denyingListener{deny: true}
+	c := newConn()
+	c.logf = t.Logf
+	c.packetListener = l
+	c.port.Set(12345)
+	defer func() {
+		if c.pconn4 != nil {
+			c.pconn4.Close()
+		}
+	}()
+
+	if err := c.bindSocket(&c.pconn4, "udp4", keepCurrentPort); err == nil {
+		t.Fatal("bind succeeded; want failure")
+	}
+	err := health.UDPBindError("udp4")
+	if err == nil {
+		t.Fatal("no health bind error after failed bind")
+	}
+	for _, want := range []string{"port 12345: ", "port 0: ", "permission denied"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("health bind error %q doesn't contain %q", err, want)
+		}
+	}
+
+	l.deny = false
+	if err := c.bindSocket(&c.pconn4, "udp4", keepCurrentPort); err != nil {
+		t.Fatal(err)
+	}
+	if err := health.UDPBindError("udp4"); err != nil {
+		t.Errorf("health bind error after successful bind = %v; want nil", err)
+	}
+}
+
+func TestOptionsTimeouts(t *testing.T) {
+	tests := []struct {
+		name                      string
+		in                        Timeouts
+		trust, heartbeat, upgrade time.Duration
+	}{
+		{"defaults", Timeouts{}, trustUDPAddrDuration, heartbeatInterval, upgradeInterval},
+		{"negative", Timeouts{-1, -1, -1}, trustUDPAddrDuration, heartbeatInterval, upgradeInterval},
+		{"satellite", Timeouts{TrustUDPAddr: 30 * time.Second, Heartbeat: 10 * time.Second}, 30 * time.Second, 10 * time.Second, upgradeInterval},
+		{"trust_raised", Timeouts{Heartbeat: 10 * time.Second}, 20 * time.Second, 10 * time.Second, upgradeInterval},
+		{"heartbeat_min", Timeouts{Heartbeat: time.Millisecond}, trustUDPAddrDuration, minHeartbeatInterval, upgradeInterval},
+		{"upgrade_raised", Timeouts{Heartbeat: 2 * time.Minute}, 4 * time.Minute, 2 * time.Minute, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Options{Timeouts: tt.in}
+			trust, heartbeat, upgrade := o.timeouts()
+			if trust != tt.trust || heartbeat != tt.heartbeat || upgrade != tt.upgrade {
+				t.Errorf("got %v, %v, %v; want %v, %v, %v", trust, heartbeat, upgrade, tt.trust, tt.heartbeat, tt.upgrade)
+			}
+		})
+	}
+}
+
+func TestReSTUNInterval(t *testing.T) {
+	for _, d := range []time.Duration{-time.Second, sessionActiveTimeout} {
+		if c, err := NewConn(Options{Logf: t.Logf, ReSTUNInterval: d}); err == nil {
+			c.Close()
+			t.Errorf("NewConn with ReSTUNInterval %v succeeded; want error", d)
+		}
+	}
+
+	tests := []struct {
+		in       time.Duration
+		min, max time.Duration
+	}{
+		{0, 20 * time.Second, 26 * time.Second},
+		{13 * time.Second, 10 * time.Second, 13 * time.Second},
+		{time.Millisecond, minReSTUNInterval * 10 / 13, minReSTUNInterval},
+	}
+	for _, tt := range tests {
+		c := newConn()
+		c.reSTUNInterval = (&Options{ReSTUNInterval: tt.in}).reSTUNInterval()
+		for i := 0; i < 100; i++ {
+			if d := c.periodicReSTUNDelay(); d < tt.min || d > tt.max {
+				t.Fatalf("ReSTUNInterval %v: delay %v not in [%v, %v]", tt.in, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestSTUNIdleTimeout(t *testing.T) {
+	if debugReSTUNStopOnIdle {
+		t.Skip("TS_DEBUG_RESTUN_STOP_ON_IDLE overrides STUNIdleTimeout")
+	}
+	if c, err := NewConn(Options{Logf: t.Logf, STUNIdleTimeout: -time.Second}); err == nil {
+		c.Close()
+		t.Error("NewConn with negative STUNIdleTimeout succeeded; want error")
+	}
+
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewPrivate()
+	c.peerSet = map[key.Public]struct{}{key.NewPrivate().Public(): {}}
+	c.idleFunc = func() time.Duration { return 3 * time.Minute }
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shouldDoPeriodicReSTUNLocked() {
+		t.Error("STUN continues after 3m idle with default timeout")
+	}
+	c.stunIdleTimeout = (&Options{STUNIdleTimeout: 5 * time.Minute}).stunIdleTimeout()
+	if !c.shouldDoPeriodicReSTUNLocked() {
+		t.Error("STUN stopped after 3m idle with 5m timeout")
+	}
+	c.stunIdleTimeout = (&Options{STUNIdleTimeout: time.Minute}).stunIdleTimeout()
+	if c.shouldDoPeriodicReSTUNLocked() {
+		t.Error("STUN continues after 3m idle with 1m timeout")
+	}
+	c.netMap = &netmap.NetworkMap{Debug: &tailcfg.Debug{ForceBackgroundSTUN: true}}
+	if !c.shouldDoPeriodicReSTUNLocked() {
+		t.Error("STUN stopped despite ForceBackgroundSTUN")
+	}
+}
+
+func TestDERPWriteQueueDepth(t *testing.T) {
+	// burstDrops returns how many of a burst of 100 DERP packets
+	// are dropped with the given queue depth.
+	burstDrops := func(depth int) int64 {
+		c := newConn()
+		c.logf = t.Logf
+		c.derpActiveFunc = func() {}
+		c.derpWriteQueueDepth = depth
+		c.privateKey = key.NewPrivate()
+		c.derpMap = &tailcfg.DERPMap{
+			Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1, RegionCode: "test"}},
+		}
+		c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
+		defer c.connCtxCancel()
+		c.donec = c.connCtx.Done()
+
+		// Make the new connection wait for a previous generation
+		// that never finishes, so nothing drains the queue.
+		c.activeDerp = make(map[int]activeDerp)
+		c.prevDerp = map[int]*syncs.WaitGroupChan{1: syncs.NewWaitGroupChan()}
+
+		addr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+		for i := 0; i < 100; i++ {
+			c.sendAddr(addr, key.Public{}, []byte("burst"))
+		}
+		return c.DERPSendQueueFull()
+	}
+	if got, want := burstDrops(bufferedDerpWritesBeforeDrop), int64(100-bufferedDerpWritesBeforeDrop); got != want {
+		t.Errorf("default depth dropped %d; want %d", got, want)
+	}
+	if got := burstDrops(100); got != 0 {
+		t.Errorf("depth 100 dropped %d; want 0", got)
+	}
+
+	if _, err := NewConn(Options{Logf: t.Logf, DERPWriteQueueDepth: -1}); err == nil {
+		t.Error("NewConn with negative DERPWriteQueueDepth succeeded")
+	}
+}
+
+func TestNoAdvertiseEndpointsSkipsCallMeMaybe(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.noAdvertiseEndpoints.Set(true)
+	de := newTestEndpoint(c)
+
+	// With stale endpoints this would normally register a
+	// callback to send a CallMeMaybe once they're refreshed.
+	c.enqueueCallMeMaybe(netaddr.IPPortFrom(derpMagicIPAddr, 1), de)
+	if len(c.onEndpointRefreshed) != 0 {
+		t.Error("CallMeMaybe queued while not advertising endpoints")
+	}
+}
+
+func TestNoAdvertiseEndpointsSendsNoDirectDisco(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	c.noAdvertiseEndpoints.Set(true)
+	de, peer := newLoopbackSendEndpoint(t, c)
+	src := de.bestAddr.IPPort
+
+	c.mu.Lock()
+	c.handlePingLocked(&disco.Ping{TxID: stun.NewTxID()}, de, src, de.discoKey)
+	c.mu.Unlock()
+	de.mu.Lock()
+	de.lastSend = mono.Now()
+	de.sendPingsLocked(mono.Now(), false)
+	de.mu.Unlock()
+	de.heartbeat()
+
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := peer.ReadFrom(buf); err == nil {
+		t.Fatalf("got %d byte packet while not advertising endpoints", n)
+	}
+
+	// Once advertising again, the same pings go out.
+	c.noAdvertiseEndpoints.Set(false)
+	de.mu.Lock()
+	de.sendPingsLocked(mono.Now(), false)
+	de.mu.Unlock()
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := peer.ReadFrom(buf); err != nil {
+		t.Fatalf("no ping after re-enabling endpoints: %v", err)
+	}
+}
+
+func TestOnLocalSubnet(t *testing.T) {
+	c := newConn()
+	if c.onLocalSubnet(netaddr.MustParseIP("192.168.1.5")) {
+		t.Error("on local subnet before any prefixes known")
+	}
+	c.localPrefixes.Store([]netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.2/24")})
+	if !c.onLocalSubnet(netaddr.MustParseIP("192.168.1.5")) {
+		t.Error("192.168.1.5 not on local subnet 192.168.1.2/24")
+	}
+	if c.onLocalSubnet(netaddr.MustParseIP("192.168.2.5")) {
+		t.Error("192.168.2.5 unexpectedly on local subnet")
+	}
+}
+
+func TestBetterAddr(t *testing.T) {
+	const ms = time.Millisecond
+	al := func(ipps string, d time.Duration) addrLatency {
+		return addrLatency{IPPort: netaddr.MustParseIPPort(ipps), latency: d}
+	}
+	lan := func(ipps string, d time.Duration) addrLatency {
+		a := al(ipps, d)
+		a.onLAN = true
+		return a
+	}
+	zero := addrLatency{}
+	tests := []struct {
+		a, b addrLatency
+		want bool
+	}{
+		{a: zero, b: zero, want: false},
+		{a: al("10.0.0.2:123", 5*ms), b: zero, want: true},
+		{a: zero, b: al("10.0.0.2:123", 5*ms), want: false},
+		{a: al("10.0.0.2:123", 5*ms), b: al("1.2.3.4:555", 6*ms), want: true},
+		{a: al("10.0.0.2:123", 5*ms), b: al("10.0.0.2:123", 10*ms), want: false}, // same IPPort
+
+		// Prefer IPv6 if roughly equivalent:
+		{
+			a:    al("[2001::5]:123", 100*ms),
+			b:    al("1.2.3.4:555", 91*ms),
+			want: true,
+		},
+		{
+			a:    al("1.2.3.4:555", 91*ms),
+			b:    al("[2001::5]:123", 100*ms),
+			want: false,
+		},
+		// But not if IPv4 is much faster:
+		{
+			a:    al("[2001::5]:123", 100*ms),
+			b:    al("1.2.3.4:555", 30*ms),
+			want: false,
+		},
+		{
+			a:    al("1.2.3.4:555", 30*ms),
+			b:    al("[2001::5]:123", 100*ms),
+			want: true,
+		},
+		// Prefer LAN even if somewhat slower:
+		{
+			a:    lan("192.168.1.5:555", 15*ms),
+			b:    al("1.2.3.4:555", 10*ms),
+			want: true,
+		},
+		{
+			a:    al("[2001::5]:123", 10*ms),
+			b:    lan("192.168.1.5:555", 15*ms),
+			want: false,
+		},
+		// But not if it's much slower:
+		{
+			a:    lan("192.168.1.5:555", 50*ms),
+			b:    al("1.2.3.4:555", 10*ms),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		got := betterAddr(tt.a, tt.b, AddressFamilyAuto)
+		if got != tt.want {
+			t.Errorf("betterAddr(%+v, %+v) = %v; want %v", tt.a, tt.b, got, tt.want)
+			continue
+		}
+		gotBack := betterAddr(tt.b, tt.a, AddressFamilyAuto)
+		if got && gotBack {
+			t.Errorf("betterAddr(%+v, %+v) and betterAddr(%+v, %+v) both unexpectedly true", tt.a, tt.b, tt.b, tt.a)
+		}
+	}
+
+}
+
+func TestBetterAddrFamilyPreference(t *testing.T) {
+	const ms = time.Millisecond
+	al := func(ipps string, d time.Duration) addrLatency {
+		return addrLatency{IPPort: netaddr.MustParseIPPort(ipps), latency: d}
+	}
+	tests := []struct {
+		name   string
+		pref   AddressFamilyPreference
+		v4, v6 time.Duration
+		want6  bool // whether the IPv6 addr is better
+	}{
+		{"auto_tie", AddressFamilyAuto, 100 * ms, 100 * ms, true},
+		{"auto_v6_slightly_slower", AddressFamilyAuto, 95 * ms, 100 * ms, true},
+		{"auto_v4_much_faster", AddressFamilyAuto, 80 * ms, 100 * ms, false},
+		{"v4_tie", AddressFamilyPreferV4, 100 * ms, 100 * ms, false},
+		{"v4_v4_slower", AddressFamilyPreferV4, 150 * ms, 100 * ms, false},
+		{"v4_v6_much_faster", AddressFamilyPreferV4, 100 * ms, 40 * ms, true},
+		{"v6_tie", AddressFamilyPreferV6, 100 * ms, 100 * ms, true},
+		{"v6_v6_slower", AddressFamilyPreferV6, 70 * ms, 100 * ms, true},
+		{"v6_v4_much_faster", AddressFamilyPreferV6, 40 * ms, 100 * ms, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v4 := al("1.2.3.4:555", tt.v4)
+			v6 := al("[2001::5]:123", tt.v6)
+			if got := betterAddr(v6, v4, tt.pref); got != tt.want6 {
+				t.Errorf("betterAddr(v6, v4) = %v; want %v", got, tt.want6)
+			}
+			if got := betterAddr(v4, v6, tt.pref); got != !tt.want6 {
+				t.Errorf("betterAddr(v4, v6) = %v; want %v", got, !tt.want6)
+			}
+		})
+	}
+}
+
+func epStrings(eps []tailcfg.Endpoint) (ret []string) {
+	for _, ep := range eps {
+		ret = append(ret, ep.Addr.String())
+	}
+	return
+}
+
+func TestConnEvents(t *testing.T) {
+	c := newConn()
+
+	// Nothing is queued until Events is called.
+	c.sendEvent(ConnEvent{Type: ConnEventDERPHomeChanged, DERPRegionID: 1})
+	if got := c.EventsDropped(); got != 0 {
+		t.Fatalf("dropped before Events = %d; want 0", got)
+	}
+
+	ch := c.Events()
+	for i := 0; i < connEventBufferSize+3; i++ {
+		c.sendEvent(ConnEvent{Type: ConnEventDERPHomeChanged, DERPRegionID: i})
+	}
+	if got := c.EventsDropped(); got != 3 {
+		t.Errorf("dropped = %d; want 3", got)
+	}
+	ev := <-ch
+	if ev.Type != ConnEventDERPHomeChanged || ev.DERPRegionID != 0 {
+		t.Errorf("first event = %+v; want derp-home-changed to 0", ev)
+	}
+}
+
+func TestReSTUNReasonCounter(t *testing.T) {
+	c := newConn()
+	c.closed = true // so ReSTUN doesn't start an endpoint update
+
+	before := reSTUNReasons.Get("test-reason").Value()
+	c.ReSTUN("test-reason")
+	c.ReSTUN("test-reason")
+	if got := reSTUNReasons.Get("test-reason").Value() - before; got != 2 {
+		t.Errorf("test-reason count went up by %d; want 2", got)
+	}
+}
+
+func TestRaceFirstSend(t *testing.T) {
+	// firstDirect sends a packet to a new peer with no direct path
+	// and returns how long it took to arrive at the peer's candidate
+	// endpoint, if it did.
+	firstDirect := func(t *testing.T, race bool) (time.Duration, bool) {
+		c := newTestConn(t)
+		defer c.Close()
+		c.raceFirstSend = race
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		de := newTestEndpoint(c)
+		de.derpAddr = netaddr.IPPortFrom(derpMagicIPAddr, 1)
+		de.endpointState[netaddr.MustParseIPPort(pc.LocalAddr().String())] = &endpointState{}
+		defer de.stopAndReset()
+
+		payload := []byte("first packet")
+		start := time.Now()
+		if err := de.send(payload); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(start.Add(time.Second))
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return 0, false
+			}
+			if bytes.HasPrefix(buf[:n], []byte(disco.Magic)) {
+				continue // the discovery ping
+			}
+			if !bytes.Equal(buf[:n], payload) {
+				t.Fatalf("got unexpected packet %q", buf[:n])
+			}
+			return time.Since(start), true
+		}
+	}
+
+	if _, ok := firstDirect(t, false); ok {
+		t.Error("first packet sent directly without RaceFirstSend")
+	}
+	d, ok := firstDirect(t, true)
+	if !ok {
+		t.Fatal("first packet not sent directly with RaceFirstSend")
+	}
+	t.Logf("time to first direct packet: %v", d)
+}
+
+func TestFirstSendRaceAddrsSkipsUnusable(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	good := netaddr.MustParseIPPort("1.0.0.1:1")
+	filtered := netaddr.MustParseIPPort("1.0.0.2:1")
+	stale := netaddr.MustParseIPPort("1.0.0.3:1")
+	c.endpointFilter = func(ipp netaddr.IPPort) bool { return ipp != filtered }
+	de := newTestEndpoint(c)
+	de.endpointState[good] = &endpointState{}
+	de.endpointState[filtered] = &endpointState{}
+	de.endpointState[stale] = &endpointState{lastGotPing: time.Now().Add(-time.Hour)}
+	defer de.stopAndReset()
+
+	if got := de.firstSendRaceAddrs(); len(got) != 1 || got[0] != good {
+		t.Errorf("race addrs = %v; want only %v", got, good)
+	}
+
+	de.racedFirstSend = false
+	c.noAdvertiseEndpoints.Set(true)
+	if got := de.firstSendRaceAddrs(); got != nil {
+		t.Errorf("race addrs with endpoints not advertised = %v; want none", got)
+	}
+}
+
+func TestMaxPingCandidates(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	c.maxPingCandidates = 3
+
+	now := mono.Now()
+	best := netaddr.MustParseIPPort("1.0.0.1:1")
+	ponged := netaddr.MustParseIPPort("1.0.0.2:1")
+	netmap := netaddr.MustParseIPPort("1.0.0.3:1")
+	discovered := netaddr.MustParseIPPort("1.0.0.4:1")
+	pongedState := &endpointState{}
+	pongedState.addPongReplyLocked(pongReply{latency: time.Millisecond, pongAt: now}, defaultPongHistoryCount)
+	de := newTestEndpoint(c)
+	de.endpointState[discovered] = &endpointState{lastGotPing: time.Now()}
+	de.endpointState[netmap] = &endpointState{}
+	de.endpointState[ponged] = pongedState
+	de.endpointState[best] = &endpointState{}
+	de.bestAddr = addrLatency{IPPort: best, latency: time.Millisecond}
+	defer de.stopAndReset()
+
+	de.mu.Lock()
+	de.sendPingsLocked(now, false)
+	var pinged []netaddr.IPPort
+	for ep, st := range de.endpointState {
+		if !st.lastPing.IsZero() {
+			pinged = append(pinged, ep)
+		}
+	}
+	de.mu.Unlock()
+	sort.Slice(pinged, func(i, j int) bool { return pinged[i].String() < pinged[j].String() })
+	if want := []netaddr.IPPort{best, ponged, netmap}; !reflect.DeepEqual(pinged, want) {
+		t.Errorf("pinged %v; want %v", pinged, want)
+	}
+}
+
+func TestDebugString(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.discoShort = "d:self"
+	regionID := 3
+	lastWrite := time.Now()
+	c.activeDerp = map[int]activeDerp{
+		regionID: {lastWrite: &lastWrite, createTime: time.Now()},
+	}
+	ponged := &endpointState{}
+	ponged.addPongReplyLocked(pongReply{latency: 10 * time.Millisecond, pongAt: mono.Now()}, defaultPongHistoryCount)
+	directEP := netaddr.MustParseIPPort("1.2.3.4:5")
+	cmmEP := netaddr.MustParseIPPort("5.6.7.8:9")
+	de := &endpoint{
+		c:          c,
+		publicKey:  tailcfg.NodeKey(key.NewPrivate().Public()),
+		discoShort: "d:peer",
+		derpAddr:   netaddr.IPPortFrom(derpMagicIPAddr, uint16(regionID)),
+		endpointState: map[netaddr.IPPort]*endpointState{
+			directEP: ponged,
+			cmmEP:    {callMeMaybeTime: time.Now()},
+		},
+		isCallMeMaybeEP:    map[netaddr.IPPort]bool{cmmEP: true},
+		bestAddr:           addrLatency{IPPort: directEP, latency: 10 * time.Millisecond},
+		trustBestAddrUntil: mono.Now().Add(time.Minute),
+	}
+	c.peerMap.upsertDiscoEndpoint(de)
+
+	got := c.DebugString()
+	t.Logf("DebugString:\n%s", got)
+	for _, want := range []string{
+		"disco=d:self",
+		"derp 3 (): up 0s",
+		"peer " + de.publicKey.ShortString() + ": disco=d:peer derp=3 best=1.2.3.4:5 (10ms) trusted for 1m0s\n",
+		"  1.2.3.4:5 pong=10ms best\n",
+		"  5.6.7.8:9 no-pong call-me-maybe\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("DebugString missing %q", want)
+		}
+	}
+}
+
+func TestPeerEndpoints(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	netmapEP := netaddr.MustParseIPPort("1.2.3.4:5")
+	cmmEP := netaddr.MustParseIPPort("5.6.7.8:9")
+	pingedEP := netaddr.MustParseIPPort("[2001::1]:2")
+	gotPing := time.Now().Add(-time.Minute)
+	ponged := &endpointState{}
+	ponged.addPongReplyLocked(pongReply{latency: 20 * time.Millisecond, pongAt: mono.Now()}, defaultPongHistoryCount)
+	ponged.addPongReplyLocked(pongReply{latency: 10 * time.Millisecond, pongAt: mono.Now()}, defaultPongHistoryCount)
+	de := &endpoint{
+		c:         c,
+		publicKey: tailcfg.NodeKey(key.NewPrivate().Public()),
+		endpointState: map[netaddr.IPPort]*endpointState{
+			netmapEP: ponged,
+			cmmEP:    {callMeMaybeTime: time.Now()},
+			pingedEP: {lastGotPing: gotPing},
+		},
+		isCallMeMaybeEP: map[netaddr.IPPort]bool{cmmEP: true},
+		bestAddr:        addrLatency{IPPort: netmapEP, latency: 10 * time.Millisecond},
+	}
+	c.peerMap.upsertDiscoEndpoint(de)
+
+	if got := c.PeerEndpoints(tailcfg.NodeKey(key.NewPrivate().Public())); got != nil {
+		t.Errorf("PeerEndpoints of unknown peer = %+v; want nil", got)
+	}
+	got := c.PeerEndpoints(de.publicKey)
+	if len(got) != 3 {
+		t.Fatalf("got %d endpoints; want 3: %+v", len(got), got)
+	}
+	if got[0].Addr != netmapEP || got[0].Latency != 10*time.Millisecond || !got[0].Best || got[0].LastSeen.IsZero() {
+		t.Errorf("ponged endpoint = %+v; want best with 10ms latency and LastSeen set", got[0])
+	}
+	if got[1].Addr != cmmEP || !got[1].CallMeMaybe || got[1].Best || !got[1].LastSeen.IsZero() {
+		t.Errorf("call-me-maybe endpoint = %+v; want CallMeMaybe, never seen", got[1])
+	}
+	if got[2].Addr != pingedEP || !got[2].LastSeen.Equal(gotPing) || got[2].CallMeMaybe {
+		t.Errorf("pinged endpoint = %+v; want LastSeen %v", got[2], gotPing)
+	}
+}
+
+func TestPeerHasDiscoKey(t *testing.T) {
+	c := newConn()
+	discoPeer := newTestEndpoint(c)
+	legacy := &endpoint{
+		c:         c,
+		publicKey: tailcfg.NodeKey(key.NewPrivate().Public()),
+	}
+	c.peerMap.upsertDiscoEndpoint(discoPeer)
+	c.peerMap.upsertDiscoEndpoint(legacy)
+
+	if !c.PeerHasDiscoKey(discoPeer.publicKey) {
+		t.Error("PeerHasDiscoKey = false for peer with disco key")
+	}
+	if c.PeerHasDiscoKey(legacy.publicKey) {
+		t.Error("PeerHasDiscoKey = true for legacy peer")
+	}
+	if c.PeerHasDiscoKey(tailcfg.NodeKey(key.NewPrivate().Public())) {
+		t.Error("PeerHasDiscoKey = true for unknown peer")
+	}
+}
+
+func TestPongPingCaps(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	direct := netaddr.MustParseIPPort("127.0.0.1:1")
+	de := newTestEndpoint(c)
+	de.endpointState[direct] = &endpointState{}
+	defer de.stopAndReset()
+	c.mu.Lock()
+	c.peerMap.upsertDiscoEndpoint(de)
+	c.mu.Unlock()
+	pong := func(m *disco.Pong) {
+		txid := stun.NewTxID()
+		m.TxID = txid
+		m.Src = direct
+		de.mu.Lock()
+		de.sentPing[txid] = sentPing{to: direct, at: mono.Now(), timer: time.NewTimer(time.Hour), purpose: pingDiscovery, hasCaps: true}
+		de.mu.Unlock()
+		c.mu.Lock()
+		de.handlePongConnLocked(m, direct)
+		c.mu.Unlock()
+	}
+
+	// A peer that predates disco.PingCaps echoes our caps byte
+	// as part of the payload.
+	pong(&disco.Pong{Payload: append([]byte{byte(discoPingCaps)}, appendPingPayload(nil, 7)...)})
+	de.mu.Lock()
+	if de.maxPongSeq != 7 {
+		t.Errorf("maxPongSeq = %v after old peer's pong; want 7", de.maxPongSeq)
+	}
+	de.mu.Unlock()
+
+	pong(&disco.Pong{HasCaps: true, Caps: 0x01, Payload: appendPingPayload(nil, 8)})
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.maxPongSeq != 8 {
+		t.Errorf("maxPongSeq = %v after new peer's pong; want 8", de.maxPongSeq)
+	}
+	if de.pingCaps != 0x01 {
+		t.Errorf("pingCaps = %v; want 1", de.pingCaps)
+	}
+}
+
+func TestTimeSinceDirect(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	direct := netaddr.MustParseIPPort("127.0.0.1:1")
+	de := newTestEndpoint(c)
+	de.derpAddr = netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	de.endpointState[direct] = &endpointState{}
+	defer de.stopAndReset()
+	c.mu.Lock()
+	c.peerMap.upsertDiscoEndpoint(de)
+	c.mu.Unlock()
+	// pong has a ping sent at sentAt to, and answered from, addr.
+	pong := func(addr netaddr.IPPort, sentAt mono.Time) {
+		txid := stun.NewTxID()
+		de.mu.Lock()
+		de.sentPing[txid] = sentPing{to: addr, at: sentAt, timer: time.NewTimer(time.Hour), purpose: pingDiscovery}
+		de.mu.Unlock()
+		c.mu.Lock()
+		de.handlePongConnLocked(&disco.Pong{TxID: txid, Src: addr}, addr)
+		c.mu.Unlock()
+	}
+
+	if _, ok := c.TimeSinceDirect(tailcfg.NodeKey(key.NewPrivate().Public())); ok {
+		t.Error("got time since direct for unknown peer")
+	}
+	pong(de.derpAddr, mono.Now())
+	if _, ok := c.TimeSinceDirect(de.publicKey); ok {
+		t.Error("got time since direct after only a DERP pong")
+	}
+	pong(direct, mono.Now())
+	d, ok := c.TimeSinceDirect(de.publicKey)
+	if !ok || d > time.Minute {
+		t.Errorf("after direct pong, TimeSinceDirect = %v, %v; want small, true", d, ok)
+	}
+	pong(de.derpAddr, mono.Now())
+	if d2, ok := c.TimeSinceDirect(de.publicKey); !ok || d2 < d {
+		t.Errorf("after later DERP pong, TimeSinceDirect = %v, %v; want at least %v, true", d2, ok, d)
+	}
+}
+
+func TestPeerHomeDERP(t *testing.T) {
+	c := newConn()
+	nk := tailcfg.NodeKey(key.NewPrivate().Public())
+	de := newTestEndpoint(c)
+	de.publicKey = nk
+	c.peerMap.upsertDiscoEndpoint(de)
+
+	if _, ok := c.PeerHomeDERP(tailcfg.NodeKey(key.NewPrivate().Public())); ok {
+		t.Error("got home DERP for unknown peer")
+	}
+	if _, ok := c.PeerHomeDERP(nk); ok {
+		t.Error("got home DERP for peer with none")
+	}
+	de.derpAddr = netaddr.IPPortFrom(derpMagicIPAddr, 7)
+	if got, ok := c.PeerHomeDERP(nk); !ok || got != 7 {
+		t.Errorf("PeerHomeDERP = %v, %v; want 7, true", got, ok)
+	}
+}
+
+func TestPeerLatency(t *testing.T) {
+	c := newConn()
+	nk := tailcfg.NodeKey(key.NewPrivate().Public())
+	de := newTestEndpoint(c)
+	de.publicKey = nk
+	c.peerMap.upsertDiscoEndpoint(de)
+
+	if _, ok := c.PeerLatency(tailcfg.NodeKey(key.NewPrivate().Public())); ok {
+		t.Error("got latency for unknown peer")
+	}
+	if _, ok := c.PeerLatency(nk); ok {
+		t.Error("got latency before any pong")
+	}
+
+	de.derpLatency = 80 * time.Millisecond
+	if got, ok := c.PeerLatency(nk); !ok || got != 80*time.Millisecond {
+		t.Errorf("relayed latency = %v, %v; want 80ms", got, ok)
+	}
+
+	de.bestAddr = addrLatency{IPPort: netaddr.MustParseIPPort("1.2.3.4:567"), latency: 5 * time.Millisecond}
+	de.trustBestAddrUntil = mono.Now().Add(time.Minute)
+	if got, ok := c.PeerLatency(nk); !ok || got != 5*time.Millisecond {
+		t.Errorf("direct latency = %v, %v; want 5ms", got, ok)
+	}
+
+	// Once the direct path is no longer trusted, we're back to DERP.
+	de.trustBestAddrUntil = mono.Now().Add(-time.Second)
+	if got, ok := c.PeerLatency(nk); !ok || got != 80*time.Millisecond {
+		t.Errorf("latency after direct path expired = %v, %v; want 80ms", got, ok)
+	}
+}
+
+func TestAddEndpointHint(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	nk := tailcfg.NodeKey(key.NewPrivate().Public())
+	de := newTestEndpoint(c)
+	de.publicKey = nk
+	c.mu.Lock()
+	c.peerMap.upsertDiscoEndpoint(de)
+	c.mu.Unlock()
+
+	hint := netaddr.MustParseIPPort("127.0.0.1:1")
+	c.AddEndpointHint(tailcfg.NodeKey(key.NewPrivate().Public()), hint) // unknown peer; ignored
+	c.AddEndpointHint(nk, hint)
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	st, ok := de.endpointState[hint]
+	if !ok {
+		t.Fatalf("hint %v not added as a candidate", hint)
+	}
+	if st.lastGotPing.IsZero() {
+		t.Error("hint added without lastGotPing; it would never expire")
+	}
+	var pinged bool
+	for _, sp := range de.sentPing {
+		pinged = pinged || sp.to == hint
+	}
+	if !pinged {
+		t.Errorf("hint %v not pinged", hint)
+	}
+
+	de.forceDERP = true
+	de.mu.Unlock()
+	forced := netaddr.MustParseIPPort("127.0.0.1:2")
+	c.AddEndpointHint(nk, forced)
+	de.mu.Lock()
+	for _, sp := range de.sentPing {
+		if sp.to == forced {
+			t.Errorf("hint %v pinged while forced to DERP", forced)
+		}
+	}
+}
+
+func TestLowPowerHeartbeat(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	// TUN idleness is measured against a fake clock, which the test
+	// advances rather than waiting.
+	clock := &tstest.Clock{}
+	lastActivity := clock.Now()
+	c.idleFunc = func() time.Duration { return clock.Now().Sub(lastActivity) }
+	udpAddr := netaddr.MustParseIPPort("127.0.0.1:1")
+	de := newTestEndpoint(c)
+	de.endpointState[udpAddr] = &endpointState{}
+	de.bestAddr = addrLatency{IPPort: udpAddr, latency: time.Millisecond}
+	de.trustBestAddrUntil = mono.Now().Add(time.Hour)
+	de.lastSend = mono.Now()
+	defer de.stopAndReset()
+
+	// beat runs one heartbeat, as its timer would, and reports
+	// whether it sent full pings and was rescheduled at the low
+	// power cadence.
+	beat := func() (fullPing, lowPower bool) {
+		de.mu.Lock()
+		if de.heartBeatTimer != nil {
+			de.heartBeatTimer.Stop()
+		}
+		de.lastFullPing = 0 // always want a full ping
+		de.mu.Unlock()
+		de.heartbeat()
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		if de.heartBeatTimer == nil {
+			t.Fatal("heartbeat not rescheduled")
+		}
+		return !de.lastFullPing.IsZero(), de.heartbeatLowPower
+	}
+
+	// Idle, but low power mode is off.
+	clock.Advance(time.Minute)
+	if fullPing, lowPower := beat(); !fullPing || lowPower {
+		t.Errorf("normal mode, idle: fullPing=%v, lowPower=%v; want true, false", fullPing, lowPower)
+	}
+
+	c.SetLowPower(true)
+	lastActivity = clock.Now()
+	clock.Advance(lowPowerIdleTime - time.Second)
+	if fullPing, lowPower := beat(); !fullPing || lowPower {
+		t.Errorf("low power, not yet idle: fullPing=%v, lowPower=%v; want true, false", fullPing, lowPower)
+	}
+	clock.Advance(time.Second)
+	if fullPing, lowPower := beat(); fullPing || !lowPower {
+		t.Errorf("low power, idle: fullPing=%v, lowPower=%v; want false, true", fullPing, lowPower)
+	}
+
+	// The next send restores the normal cadence.
+	lastActivity = clock.Now()
+	de.mu.Lock()
+	de.noteActiveLocked()
+	lowPower := de.heartbeatLowPower
+	de.mu.Unlock()
+	if lowPower {
+		t.Error("still in low power cadence after send")
+	}
+	if fullPing, lowPower := beat(); !fullPing || lowPower {
+		t.Errorf("low power, active: fullPing=%v, lowPower=%v; want true, false", fullPing, lowPower)
+	}
+}
+
+func TestFirstDirectPathFunc(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	calls := make(chan bool, 2)
+	c.firstDirectPathFunc = func() { calls <- true }
+
+	// pong has a new peer answer a ping to its direct address.
+	pong := func() {
+		to := netaddr.MustParseIPPort("127.0.0.1:1")
+		de := newTestEndpoint(c)
+		de.endpointState[to] = &endpointState{}
+		defer de.stopAndReset()
+		de.mu.Lock()
+		de.startPingLocked(to, mono.Now(), pingCLI, nil)
+		var txid stun.TxID
+		for txid = range de.sentPing {
+		}
+		de.mu.Unlock()
+		c.mu.Lock()
+		de.handlePongConnLocked(&disco.Pong{TxID: txid, Src: to}, to)
+		c.mu.Unlock()
+		if de.bestAddr.IPPort != to {
+			t.Fatalf("bestAddr = %v; want %v", de.bestAddr, to)
+		}
+	}
+
+	pong()
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FirstDirectPathFunc not called")
+	}
+	pong()
+	select {
+	case <-calls:
+		t.Error("FirstDirectPathFunc called again for second direct path")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAsymmetricPath(t *testing.T) {
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	udpAddr := netaddr.MustParseIPPort("1.2.3.4:5")
+	now := mono.Now()
+	de := newTestEndpoint(c)
+	de.derpAddr = netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	de.endpointState[udpAddr] = &endpointState{}
+	de.bestAddr = addrLatency{IPPort: udpAddr, latency: time.Millisecond}
+	de.trustBestAddrUntil = now.Add(time.Hour)
+	asymmetric := func() bool {
+		var ps ipnstate.PeerStatus
+		de.populatePeerStatus(&ps)
+		return ps.AsymmetricPath
+	}
+
+	// Receiving via DERP while sending direct is asymmetric, but
+	// only reported once it lasts.
+	de.noteRecvTransport(true)
+	de.mu.Lock()
+	de.checkAsymmetricPathLocked(now)
+	de.mu.Unlock()
+	if asymmetric() || len(logs) != 0 {
+		t.Fatalf("reported asymmetric immediately; logs: %q", logs)
+	}
+	de.mu.Lock()
+	de.asymmetricSince = now.Add(-asymmetricPathDelay)
+	de.checkAsymmetricPathLocked(now)
+	de.mu.Unlock()
+	if !asymmetric() || len(logs) != 1 || !strings.Contains(logs[0], "asymmetric path") {
+		t.Fatalf("not reported asymmetric after %v; logs: %q", asymmetricPathDelay, logs)
+	}
+
+	// A direct packet from the peer ends it.
+	de.noteRecvTransport(false)
+	de.mu.Lock()
+	de.checkAsymmetricPathLocked(mono.Now())
+	de.mu.Unlock()
+	if asymmetric() || len(logs) != 2 {
+		t.Errorf("still asymmetric after direct receive; logs: %q", logs)
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if _, err := c.sendUDPStd(pc.LocalAddr().(*net.UDPAddr), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	junk := []byte("not wireguard")
+	c.receiveIP(junk, netaddr.MustParseIPPort("127.0.0.1:1"), netaddr.IP{}, new(ippEndpointCache))
+	c.processDERPReadResult(derpReadResult{
+		regionID: 1,
+		n:        len(junk),
+		copyBuf:  func(dst []byte) int { return copy(dst, junk) },
+	}, make([]byte, 100))
+
+	want := Stats{
+		UDPSentPackets:  1,
+		UDPSentBytes:    int64(len("hello")),
+		UDPRecvPackets:  1,
+		UDPRecvBytes:    int64(len(junk)),
+		DERPRecvPackets: 1,
+		DERPRecvBytes:   int64(len(junk)),
+	}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats = %+v; want %+v", got, want)
+	}
+}
+
+func TestSetForcedPreferredDERP(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	c.SetForcedPreferredDERP(2)
+	c.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "one", Nodes: []*tailcfg.DERPNode{{Name: "1a", RegionID: 1, HostName: "invalid.", STUNPort: -1}}},
+		2: {RegionID: 2, RegionCode: "two", Nodes: []*tailcfg.DERPNode{{Name: "2a", RegionID: 2, HostName: "invalid.", STUNPort: -1}}},
+	}})
+
+	report, err := c.updateNetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PreferredDERP != 2 {
+		t.Errorf("report.PreferredDERP = %v; want 2", report.PreferredDERP)
+	}
+	c.mu.Lock()
+	myDerp := c.myDerp
+	c.mu.Unlock()
+	if myDerp != 2 {
+		t.Errorf("myDerp = %v; want 2", myDerp)
+	}
+}
+
+func TestSetDiscoPrivateKeyForTest(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	k := key.NewPrivate()
+	if err := c.SetDiscoPrivateKeyForTest(k); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.DiscoPublicKey(), tailcfg.DiscoKey(k.Public()); got != want {
+		t.Errorf("DiscoPublicKey = %v; want %v", got, want)
+	}
+	if err := c.SetDiscoPrivateKeyForTest(k); err != nil {
+		t.Errorf("setting the same key again: %v", err)
+	}
+	if err := c.SetDiscoPrivateKeyForTest(key.NewPrivate()); err == nil {
+		t.Error("replacing the key in use succeeded")
+	}
+
+	os.Setenv("IN_TS_TEST", "0")
+	defer os.Setenv("IN_TS_TEST", "1")
+	c2 := newConn()
+	c2.logf = t.Logf
+	if err := c2.SetDiscoPrivateKeyForTest(key.NewPrivate()); err == nil {
+		t.Error("SetDiscoPrivateKeyForTest succeeded outside of tests")
+	}
+}
+
+func TestDERPRegionLatency(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	derpAddr := netaddr.IPPortFrom(derpMagicIPAddr, 7)
+	de := newTestEndpoint(c)
+	de.derpAddr = derpAddr
+	defer de.stopAndReset()
+	// pong has a ping via region 7 answered, via src, after latency.
+	pong := func(src netaddr.IPPort, latency time.Duration) {
+		txid := stun.NewTxID()
+		de.mu.Lock()
+		de.sentPing[txid] = sentPing{
+			to:      derpAddr,
+			at:      mono.Now().Add(-latency),
+			timer:   time.NewTimer(time.Hour),
+			purpose: pingCLI,
+		}
+		de.mu.Unlock()
+		c.mu.Lock()
+		de.handlePongConnLocked(&disco.Pong{TxID: txid}, src)
+		c.mu.Unlock()
+	}
+
+	if _, ok := c.DERPRegionLatency(7); ok {
+		t.Fatal("got latency before any pong")
+	}
+	pong(derpAddr, 100*time.Millisecond)
+	pong(derpAddr, 20*time.Millisecond)
+	pong(netaddr.IPPortFrom(derpMagicIPAddr, 8), time.Second) // via another region; ignored
+	got, ok := c.DERPRegionLatency(7)
+	if !ok {
+		t.Fatal("no latency after pongs")
+	}
+	// 100ms, then a quarter of the way to 20ms.
+	if want := 80 * time.Millisecond; got < want || got > want+5*time.Millisecond {
+		t.Errorf("DERPRegionLatency = %v; want about %v", got, want)
+	}
+	if _, ok := c.DERPRegionLatency(8); ok {
+		t.Error("got latency for region 8, which only answered a ping sent via another")
+	}
+}
+
+func TestDiscoMetrics(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	de := newTestEndpoint(c)
+	to := netaddr.MustParseIPPort("127.0.0.1:1")
+	// ping starts a CLI ping to to and returns its txid.
+	ping := func() stun.TxID {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		de.startPingLocked(to, mono.Now(), pingCLI, nil)
+		for txid := range de.sentPing {
+			return txid
+		}
+		t.Fatal("no ping sent")
+		return stun.TxID{}
+	}
+	intVar := func(name string) int64 {
+		return Metrics().Get(name).(*expvar.Int).Value()
+	}
+	pingsSent := func() int64 {
+		return metricDiscoPingsSent.Get(pingCLI.String()).Value()
+	}
+
+	sent0, pongs0, timeouts0 := pingsSent(), intVar("counter_magicsock_disco_pongs_recv"), intVar("counter_magicsock_disco_ping_timeouts")
+
+	txid := ping()
+	c.mu.Lock()
+	de.handlePongConnLocked(&disco.Pong{TxID: txid, Src: to}, to)
+	c.mu.Unlock()
+	de.pingTimeout(ping())
+
+	if got := pingsSent() - sent0; got != 2 {
+		t.Errorf("CLI pings sent = %d; want 2", got)
+	}
+	if got := intVar("counter_magicsock_disco_pongs_recv") - pongs0; got != 1 {
+		t.Errorf("pongs received = %d; want 1", got)
+	}
+	if got := intVar("counter_magicsock_disco_ping_timeouts") - timeouts0; got != 1 {
+		t.Errorf("ping timeouts = %d; want 1", got)
+	}
+}
+
+func TestCallMeMaybeLinkLocal(t *testing.T) {
+	defer func(old func() ([]string, error)) { ipv6LinkLocalZones = old }(ipv6LinkLocalZones)
+	ipv6LinkLocalZones = func() ([]string, error) { return []string{"eth0", "wlan0"}, nil }
+
+	c := newTestConn(t)
+	defer c.Close()
+	de := newTestEndpoint(c)
+	de.handleCallMeMaybe(&disco.CallMeMaybe{MyNumber: []netaddr.IPPort{
+		netaddr.MustParseIPPort("[fe80::1]:41641"),
+		netaddr.MustParseIPPort("1.2.3.4:5"),
+	}})
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	var got []string
+	for ep := range de.endpointState {
+		got = append(got, ep.String())
+	}
+	sort.Strings(got)
+	want := []string{"1.2.3.4:5", "[fe80::1%eth0]:41641", "[fe80::1%wlan0]:41641"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates = %q; want %q", got, want)
+	}
+}
+
+func TestLogDiscoSendErr(t *testing.T) {
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	a := netaddr.MustParseIPPort("1.2.3.4:5")
+	b := netaddr.MustParseIPPort("5.6.7.8:9")
+	m := &disco.Ping{}
+	errSend := errors.New("no route")
+
+	suppressed0 := metricDiscoSendErrLogsSuppressed.Value()
+	for i := 0; i < 10; i++ {
+		c.logDiscoSendErr(m, a, errSend)
+	}
+	c.logDiscoSendErr(m, b, errSend)
+	if len(logs) != 2 {
+		t.Fatalf("got %d log lines; want 1 per destination: %q", len(logs), logs)
+	}
+	if got := metricDiscoSendErrLogsSuppressed.Value() - suppressed0; got != 9 {
+		t.Errorf("suppressed counter = %d; want 9", got)
+	}
+
+	// Once a's interval passes, its next failure is logged with a
+	// count of those suppressed.
+	c.mu.Lock()
+	c.discoSendErrLogs[a].lim = rate.NewLimiter(rate.Inf, 1)
+	c.mu.Unlock()
+	c.logDiscoSendErr(m, a, errSend)
+	if len(logs) != 3 || !strings.Contains(logs[2], "9 more failures") {
+		t.Errorf("logs = %q; want third to count 9 more failures", logs)
+	}
+
+	// Failures suppressed with none logged after them are
+	// summarized by the flush timer.
+	for i := 0; i < 3; i++ {
+		c.logDiscoSendErr(m, b, errSend)
+	}
+	c.mu.Lock()
+	l := c.discoSendErrLogs[b]
+	if l.flush == nil {
+		t.Fatal("no flush timer after suppressed failures")
+	}
+	l.flush.Stop() // flush now instead
+	c.mu.Unlock()
+	c.flushDiscoSendErrLog(b, l)
+	if len(logs) != 4 || !strings.Contains(logs[3], "3 more failures to send to "+b.String()) {
+		t.Errorf("logs = %q; want fourth to summarize 3 more failures to %v", logs, b)
+	}
+	c.flushDiscoSendErrLog(b, l)
+	if len(logs) != 4 {
+		t.Errorf("second flush logged %q", logs[4:])
+	}
+}
+
+func TestLogDiscoRecvErr(t *testing.T) {
+	c := newConn()
+	var logs []string
+	c.logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	c.privateKey = key.NewPrivate()
+	ourPub := key.Public(c.DiscoPublicKey())
+
+	peerPriv := key.NewPrivate()
+	peerPub := tailcfg.DiscoKey(peerPriv.Public())
+	c.peerMap.upsertDiscoEndpoint(&endpoint{
+		publicKey: tailcfg.NodeKey(key.NewPrivate().Public()),
+		discoKey:  peerPub,
+	})
+
+	seal := func(payload []byte, to key.Public) []byte {
+		var nonce [disco.NonceLen]byte
+		crand.Read(nonce[:])
+		pkt := append([]byte(disco.Magic), peerPub[:]...)
+		pkt = append(pkt, nonce[:]...)
+		return box.Seal(pkt, payload, &nonce, to.B32(), peerPriv.B32())
+	}
+
+	// Sealed to a stale disco key of ours.
+	stale := seal((&disco.Ping{}).AppendMarshal(nil), key.NewPrivate().Public())
+	openErrs0 := metricDiscoRecvBoxOpenErrors.Value()
+	for i := 0; i < 10; i++ {
+		if !c.handleDiscoMessage(stale, netaddr.IPPort{}) {
+			t.Fatal("stale disco message not treated as disco")
+		}
+	}
+	if got := metricDiscoRecvBoxOpenErrors.Value() - openErrs0; got != 10 {
+		t.Errorf("box open errors = %d; want 10", got)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "failed to open naclbox") {
+		t.Fatalf("logs = %q; want one naclbox failure", logs)
+	}
+
+	// Parse failures are limited separately, so the first is
+	// logged despite the open failures.
+	garbage := seal([]byte("why hello"), ourPub)
+	parseErrs0 := metricDiscoRecvParseErrors.Value()
+	c.handleDiscoMessage(garbage, netaddr.IPPort{})
+	c.handleDiscoMessage(garbage, netaddr.IPPort{})
+	if got := metricDiscoRecvParseErrors.Value() - parseErrs0; got != 2 {
+		t.Errorf("parse errors = %d; want 2", got)
+	}
+	if len(logs) != 2 || !strings.Contains(logs[1], "failed to parse") || strings.Contains(logs[1], "more") {
+		t.Fatalf("logs = %q; want second to be a lone parse failure", logs)
+	}
+
+	// Once the interval passes, the next open failure is logged with
+	// a count of those suppressed, not including parse failures.
+	c.mu.Lock()
+	c.discoRecvErrLogs[peerPub].lim[discoRecvErrOpen] = rate.NewLimiter(rate.Inf, 1)
+	c.mu.Unlock()
+	c.handleDiscoMessage(stale, netaddr.IPPort{})
+	if len(logs) != 3 || !strings.Contains(logs[2], "failed to open naclbox") || !strings.Contains(logs[2], "9 more") {
+		t.Errorf("logs = %q; want third to be a naclbox failure counting 9 more", logs)
+	}
+}
+
+func TestWaitDERPStarted(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+
+	// No DERP map, so DERP never starts.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.WaitDERPStarted(ctx); err != context.DeadlineExceeded {
+		t.Errorf("before DERP = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	close(c.derpStarted) // as if the first DERP connection finished
+	if err := c.WaitDERPStarted(context.Background()); err != nil {
+		t.Errorf("after DERP started = %v; want nil", err)
+	}
+
+	c2 := newTestConn(t)
+	c2.Close()
+	if err := c2.WaitDERPStarted(context.Background()); err != errConnClosed {
+		t.Errorf("after Close = %v; want %v", err, errConnClosed)
+	}
+}
+
+func TestDisableDERPRoute(t *testing.T) {
+	c := newConn()
+	if got, want := c.derpRouteEnabled(), useDerpRoute(); got != want {
+		t.Errorf("derpRouteEnabled = %v; want useDerpRoute (%v)", got, want)
+	}
+	c.disableDERPRoute = true
+	if c.derpRouteEnabled() {
+		t.Error("derpRouteEnabled = true with DisableDERPRoute set")
+	}
+}
+
+func TestDisableDERPRouteWriteChan(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewPrivate()
+	// Region 2, the peer's home, isn't in the map, so no new
+	// connection can be made to it.
+	c.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1, RegionCode: "test"}},
+	}
+	dc := derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil })
+	lastWrite := time.Now()
+	writeCh := make(chan derpWriteRequest, 1)
+	c.activeDerp = map[int]activeDerp{1: {
+		c:          dc,
+		writeCh:    writeCh,
+		cancel:     func() {},
+		lastWrite:  &lastWrite,
+		createTime: lastWrite,
+	}}
+	// The peer was last heard from via region 1.
+	peer := key.NewPrivate().Public()
+	c.derpRoute = map[key.Public]derpRoute{peer: {derpID: 1, dc: dc}}
+
+	peerHome := netaddr.IPPortFrom(derpMagicIPAddr, 2)
+	if useDerpRoute() {
+		if got := c.derpWriteChanOfAddr(peerHome, peer); got != writeCh {
+			t.Error("region 1's return path not used with the DERP route enabled")
+		}
+	}
+	c.disableDERPRoute = true
+	if got := c.derpWriteChanOfAddr(peerHome, peer); got != nil {
+		t.Error("region 1's return path used with DisableDERPRoute set")
+	}
+}
+
+func TestCLIPingMappingVaries(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	de := &endpoint{c: c, endpointState: map[netaddr.IPPort]*endpointState{}}
+	ipp := netaddr.MustParseIPPort("1.2.3.4:5")
+
+	res := new(ipnstate.PingResult)
+	c.populateCLIPingResponseLocked(res, de, time.Millisecond, ipp)
+	if res.LocalMappingVariesByDestIP != "" || res.PeerMappingVariesByDestIP != "" {
+		t.Errorf("with no NetInfo, got local %q, peer %q; want both empty", res.LocalMappingVariesByDestIP, res.PeerMappingVariesByDestIP)
+	}
+
+	c.netInfoLast = &tailcfg.NetInfo{MappingVariesByDestIP: "true"}
+	de.updateFromNode(&tailcfg.Node{
+		Hostinfo: tailcfg.Hostinfo{NetInfo: &tailcfg.NetInfo{MappingVariesByDestIP: "false"}},
+	})
+	res = new(ipnstate.PingResult)
+	c.populateCLIPingResponseLocked(res, de, time.Millisecond, ipp)
+	if !res.LocalMappingVariesByDestIP.EqualBool(true) || !res.PeerMappingVariesByDestIP.EqualBool(false) {
+		t.Errorf("got local %q, peer %q; want true, false", res.LocalMappingVariesByDestIP, res.PeerMappingVariesByDestIP)
+	}
+}
+
+func TestCLIPingCancel(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	de := newTestEndpoint(c)
+	de.endpointState[netaddr.MustParseIPPort("127.0.0.1:1")] = &endpointState{}
+	defer de.stopAndReset()
+
+	numCLIPings := func() (pending, sent int) {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		for _, sp := range de.sentPing {
+			if sp.purpose == pingCLI {
+				sent++
+			}
+		}
+		return len(de.pendingCLIPings), sent
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	got1 := make(chan *ipnstate.PingResult, 1)
+	got2 := make(chan *ipnstate.PingResult, 1)
+	de.cliPing(ctx1, new(ipnstate.PingResult), func(res *ipnstate.PingResult) { got1 <- res })
+	de.cliPing(ctx2, new(ipnstate.PingResult), func(res *ipnstate.PingResult) { got2 <- res })
+	if pending, sent := numCLIPings(); pending != 2 || sent == 0 {
+		t.Fatalf("pending, sent = %d, %d; want 2, >0", pending, sent)
+	}
+
+	// Canceling one leaves the pings running for the other.
+	cancel1()
+	select {
+	case res := <-got1:
+		if res.Err != context.Canceled.Error() {
+			t.Errorf("canceled ping Err = %q; want %q", res.Err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for canceled ping's callback")
+	}
+	if pending, sent := numCLIPings(); pending != 1 || sent == 0 {
+		t.Errorf("after first cancel, pending, sent = %d, %d; want 1, >0", pending, sent)
+	}
+
+	// Canceling the last one stops the pings too.
+	cancel2()
+	select {
+	case <-got2:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for canceled ping's callback")
+	}
+	if pending, sent := numCLIPings(); pending != 0 || sent != 0 {
+		t.Errorf("after last cancel, pending, sent = %d, %d; want 0, 0", pending, sent)
+	}
+}
+
+func TestSendCallMeMaybeClosedCancelsReservation(t *testing.T) {
+	c := newConn()
+	c.callMeMaybeLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	c.callMeMaybeLimiter.Allow() // use up the burst
+	donec := make(chan struct{})
+	close(donec)
+	c.donec = donec
+
+	// Each of these waits behind the empty limiter, then gives up
+	// because c is closed. None should keep its reservation.
+	for i := 0; i < 3; i++ {
+		c.sendCallMeMaybe(netaddr.IPPortFrom(derpMagicIPAddr, 1), nil)
+	}
+	if d := c.callMeMaybeLimiter.Reserve().Delay(); d > time.Hour {
+		t.Errorf("next CallMeMaybe delayed %v; want at most 1h", d)
+	}
+}
+
+func TestCallMeMaybeTTL(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	de := newTestEndpoint(c)
+	answered := netaddr.MustParseIPPort("127.0.0.1:1")
+	dead := netaddr.MustParseIPPort("127.0.0.1:2")
+	inNetmap := netaddr.MustParseIPPort("127.0.0.1:3")
+	de.endpointState[inNetmap] = &endpointState{index: 0}
+	de.handleCallMeMaybe(&disco.CallMeMaybe{MyNumber: []netaddr.IPPort{answered, dead, inNetmap}, TTL: time.Minute})
+
+	de.mu.Lock()
+	var txid stun.TxID
+	for id, sp := range de.sentPing {
+		if sp.to == answered {
+			txid = id
+		}
+	}
+	de.mu.Unlock()
+	c.mu.Lock()
+	de.handlePongConnLocked(&disco.Pong{TxID: txid, Src: answered}, answered)
+	c.mu.Unlock()
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	for _, st := range de.endpointState {
+		if !st.callMeMaybeExpires.IsZero() {
+			st.callMeMaybeExpires = time.Now().Add(-time.Second) // as if the TTL passed
+		}
+	}
+	if de.endpointState[answered].shouldDeleteLocked(sessionActiveTimeout) {
+		t.Errorf("endpoint %v that answered a ping would be deleted after TTL", answered)
+	}
+	if !de.endpointState[dead].shouldDeleteLocked(sessionActiveTimeout) {
+		t.Errorf("unanswered endpoint %v kept after TTL", dead)
+	}
+	if de.endpointState[inNetmap].shouldDeleteLocked(sessionActiveTimeout) {
+		t.Errorf("network map endpoint %v would be deleted after call-me-maybe TTL", inNetmap)
+	}
+}
+
+func TestNetworkChangeFunc(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	c, err := NewConn(Options{
+		Logf:                   t.Logf,
+		Port:                   pickPort(t),
+		TestOnlyPacketListener: localhostListener{},
+		NetworkChangeFunc: func(ev NetworkChangeEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, ev.String())
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetNetworkUp(false)
+	c.SetNetworkUp(false) // no change, so not reported
+	c.SetNetworkUp(true)
+	c.Rebind()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"down", "up", "rebind"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("network changes = %q; want %q", got, want)
+	}
+}
+
+func TestNetworkChangeLink(t *testing.T) {
+	c := newConn()
+	var got []NetworkChangeEvent
+	c.networkChangeFunc = func(ev NetworkChangeEvent) { got = append(got, ev) }
+
+	c.onLinkChange(false, nil) // minor change; not reported
+	c.onLinkChange(true, nil)
+	if want := []NetworkChangeEvent{NetworkChangeLink}; !reflect.DeepEqual(got, want) {
+		t.Errorf("network changes = %v; want %v", got, want)
+	}
+	if c.localPrefixes.Load() == nil {
+		t.Error("link change didn't refresh local prefixes")
+	}
+}
+
+func TestEndpointPriorityFunc(t *testing.T) {
+	// The priority func reverses the default order and puts first
+	// an endpoint, so there's always something to advertise.
+	// Endpoint updates are serialized, so each EndpointsFunc call
+	// follows the EndpointPriorityFunc call that set defaultOrder.
+	first := tailcfg.Endpoint{Addr: netaddr.MustParseIPPort("192.0.2.1:1"), Type: tailcfg.EndpointLocal}
+	var defaultOrder []tailcfg.Endpoint
+	errc := make(chan error, 1)
+	c, err := NewConn(Options{
+		Logf:                   t.Logf,
+		Port:                   pickPort(t),
+		TestOnlyPacketListener: localhostListener{},
+		EndpointsFunc: func(got []tailcfg.Endpoint) {
+			var err error
+			want := []tailcfg.Endpoint{first}
+			for i := len(defaultOrder) - 1; i >= 0; i-- {
+				want = append(want, defaultOrder[i])
+			}
+			if !reflect.DeepEqual(got, want) {
+				err = fmt.Errorf("advertised %v; want %v, from default order %v", got, want, defaultOrder)
+			}
+			select {
+			case errc <- err:
+			default:
+			}
+		},
+		EndpointPriorityFunc: func(eps []tailcfg.Endpoint) []tailcfg.Endpoint {
+			defaultOrder = append([]tailcfg.Endpoint(nil), eps...)
+			for i, j := 0, len(eps)-1; i < j; i, j = i+1, j-1 {
+				eps[i], eps[j] = eps[j], eps[i]
+			}
+			return append([]tailcfg.Endpoint{first}, eps...)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.ReSTUN("test")
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for endpoints")
+	}
+}
+
+func TestEndpointPriorityFuncFiltered(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	public := tailcfg.Endpoint{Addr: netaddr.MustParseIPPort("1.2.3.4:1"), Type: tailcfg.EndpointSTUN}
+	private := tailcfg.Endpoint{Addr: netaddr.MustParseIPPort("10.0.0.1:1"), Type: tailcfg.EndpointLocal}
+	c.endpointFilter = func(ipp netaddr.IPPort) bool { return ipp != private.Addr }
+	c.endpointPriorityFunc = func(eps []tailcfg.Endpoint) []tailcfg.Endpoint {
+		return append([]tailcfg.Endpoint{private}, eps...)
+	}
+
+	if got, want := c.prioritizeEndpoints([]tailcfg.Endpoint{public}), []tailcfg.Endpoint{public}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v without the filtered endpoint", got, want)
+	}
+	c.noAdvertiseEndpoints.Set(true)
+	if got := c.prioritizeEndpoints(nil); len(got) != 0 {
+		t.Errorf("got %v while not advertising endpoints; want none", got)
+	}
+}
+
+func TestEndpointFilter(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	private := netaddr.MustParseIPPrefix("10.0.0.0/8")
+	c.endpointFilter = func(ipp netaddr.IPPort) bool { return !private.Contains(ipp.IP()) }
+	de := newTestEndpoint(c)
+	defer de.stopAndReset()
+
+	de.updateFromNode(&tailcfg.Node{
+		Key:       de.publicKey,
+		DiscoKey:  de.discoKey,
+		Endpoints: []string{"10.0.0.1:1", "1.2.3.4:1"},
+	})
+	de.handleCallMeMaybe(&disco.CallMeMaybe{MyNumber: []netaddr.IPPort{
+		netaddr.MustParseIPPort("10.0.0.2:1"),
+		netaddr.MustParseIPPort("1.2.3.4:2"),
+	}})
+	de.addCandidateEndpoint(netaddr.MustParseIPPort("10.0.0.3:1"))
+	de.addCandidateEndpoint(netaddr.MustParseIPPort("1.2.3.4:3"))
+	c.mu.Lock()
+	c.peerMap.upsertDiscoEndpoint(de)
+	c.mu.Unlock()
+	c.AddEndpointHint(de.publicKey, netaddr.MustParseIPPort("10.0.0.4:1"))
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	var got []string
+	for ipp := range de.endpointState {
+		got = append(got, ipp.String())
+	}
+	for _, sp := range de.sentPing {
+		if private.Contains(sp.to.IP()) {
+			t.Errorf("pinged filtered endpoint %v", sp.to)
+		}
+	}
+	sort.Strings(got)
+	if want := []string{"1.2.3.4:1", "1.2.3.4:2", "1.2.3.4:3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("candidate endpoints = %q; want %q", got, want)
+	}
+}
+
+func TestEndpointFilterDropsPing(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	de, peer := newLoopbackSendEndpoint(t, c)
+	src := de.bestAddr.IPPort
+	c.endpointFilter = func(ipp netaddr.IPPort) bool { return ipp != src }
+
+	c.mu.Lock()
+	c.handlePingLocked(&disco.Ping{TxID: stun.NewTxID()}, de, src, de.discoKey)
+	_, mapped := c.peerMap.endpointForIPPort(src)
+	c.mu.Unlock()
+	if mapped {
+		t.Errorf("ping from filtered %v mapped it to a peer", src)
+	}
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := peer.ReadFrom(buf); err == nil {
+		t.Fatalf("got %d byte reply to a ping from a filtered endpoint", n)
+	}
+
+	c.endpointFilter = nil
+	c.mu.Lock()
+	c.handlePingLocked(&disco.Ping{TxID: stun.NewTxID()}, de, src, de.discoKey)
+	c.mu.Unlock()
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := peer.ReadFrom(buf); err != nil {
+		t.Fatalf("no pong once unfiltered: %v", err)
+	}
+}
+
+func TestSharedDiscoKeyEviction(t *testing.T) {
+	c := newConn()
+	c.discoPrivate = key.NewPrivate()
+	newKey := func() tailcfg.DiscoKey { return tailcfg.DiscoKey(key.NewPrivate().Public()) }
+
+	// Under churn, the cache stays bounded and keeps the keys in use.
+	hot := newKey()
+	for i := 0; i < maxSharedDiscoKeys*2; i++ {
+		c.sharedDiscoKeyLocked(hot)
+		c.sharedDiscoKeyLocked(newKey())
+		if n := len(c.sharedDiscoKey); n > maxSharedDiscoKeys {
+			t.Fatalf("after %d keys, cache has %d entries; want at most %d", i, n, maxSharedDiscoKeys)
+		}
+	}
+	if _, ok := c.sharedDiscoKey[hot]; !ok {
+		t.Error("in-use key was evicted")
+	}
+
+	// Idle keys are evicted on the next miss, and recomputed the
+	// same on demand.
+	want := *c.sharedDiscoKeyLocked(hot)
+	idle := mono.Now().Add(-sharedDiscoKeyIdleTimeout - time.Second)
+	for _, e := range c.sharedDiscoKey {
+		e.Value.(*sharedDiscoKey).lastUsed = idle
+	}
+	c.sharedDiscoKeyLocked(newKey())
+	if n := len(c.sharedDiscoKey); n != 1 {
+		t.Errorf("after idle sweep, cache has %d entries; want 1", n)
+	}
+	if got := *c.sharedDiscoKeyLocked(hot); got != want {
+		t.Error("recomputed shared key differs")
+	}
+}
+
+func TestResetPeerPath(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	newEP := func() *endpoint {
+		udpAddr := netaddr.MustParseIPPort("1.2.3.4:567")
+		de := newTestEndpoint(c)
+		de.derpAddr = netaddr.IPPortFrom(derpMagicIPAddr, 1)
+		de.endpointState[udpAddr] = &endpointState{}
+		de.bestAddr = addrLatency{IPPort: udpAddr, latency: time.Millisecond}
+		de.trustBestAddrUntil = mono.Now().Add(time.Hour)
+		c.peerMap.upsertDiscoEndpoint(de)
+		return de
+	}
+	reset, other := newEP(), newEP()
+
+	c.ResetPeerPath(tailcfg.NodeKey(key.NewPrivate().Public())) // unknown peer; ignored
+	c.ResetPeerPath(reset.publicKey)
+
+	now := mono.Now()
+	for _, tt := range []struct {
+		de       *endpoint
+		wantDERP bool
+	}{
+		{reset, true},
+		{other, false},
+	} {
+		tt.de.mu.Lock()
+		_, derp := tt.de.addrForSendLocked(now)
+		tt.de.mu.Unlock()
+		if got := !derp.IsZero(); got != tt.wantDERP {
+			t.Errorf("peer %v: sending via DERP = %v; want %v", tt.de.publicKey.ShortString(), got, tt.wantDERP)
+		}
+	}
+}
+
+func TestSetForceDERP(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	nk := tailcfg.NodeKey(key.NewPrivate().Public())
+	udpAddr := netaddr.MustParseIPPort("1.2.3.4:567")
+	derpAddr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	de := newTestEndpoint(c)
+	de.publicKey = nk
+	de.derpAddr = derpAddr
+	de.endpointState[udpAddr] = &endpointState{}
+	de.bestAddr = addrLatency{IPPort: udpAddr, latency: time.Millisecond}
+	c.peerMap.upsertDiscoEndpoint(de)
+
+	c.SetForceDERP(nk, true)
+	if err := de.send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	de.mu.Lock()
+	if de.heartBeatTimer != nil {
+		de.heartBeatTimer.Stop()
+		de.heartBeatTimer = nil
+	}
+	for _, sp := range de.sentPing {
+		t.Errorf("sent disco ping to %v while forced to DERP", sp.to)
+	}
+	now := mono.Now()
+	if de.wantFullPingLocked(now) {
+		t.Error("wantFullPingLocked while forced to DERP")
+	}
+	if udp, derp := de.addrForSendLocked(now); !udp.IsZero() || derp != derpAddr {
+		t.Errorf("addrForSendLocked = %v, %v; want only %v", udp, derp, derpAddr)
+	}
+	de.mu.Unlock()
+
+	c.SetForceDERP(nk, false)
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if !de.wantFullPingLocked(now) {
+		t.Error("not wanting full ping after clearing force")
+	}
+	if udp, _ := de.addrForSendLocked(now); udp != udpAddr {
+		t.Errorf("addrForSendLocked UDP = %v after clearing force; want %v", udp, udpAddr)
+	}
+}
+
+func TestSetPeerKeepAlive(t *testing.T) {
+	c := newConn()
+	nk := tailcfg.NodeKey(key.NewPrivate().Public())
+	de := newTestEndpoint(c)
+	de.publicKey = nk
+	c.peerMap.upsertDiscoEndpoint(de)
+
+	if got := de.sessionActiveTimeoutLocked(); got != sessionActiveTimeout {
+		t.Fatalf("default timeout = %v; want %v", got, sessionActiveTimeout)
+	}
+	c.SetPeerKeepAlive(nk, 10*time.Minute)
+	if got := de.sessionActiveTimeoutLocked(); got != 10*time.Minute {
+		t.Errorf("overridden timeout = %v; want 10m", got)
+	}
+	if got := c.maxIdleBeforeSTUNShutdownLocked(); got != 10*time.Minute {
+		t.Errorf("STUN idle max = %v; want 10m", got)
+	}
+
+	// A runtime-discovered endpoint outlives the default timeout.
+	st := &endpointState{lastGotPing: time.Now().Add(-5 * time.Minute)}
+	if st.shouldDeleteLocked(de.sessionActiveTimeoutLocked()) {
+		t.Error("candidate deleted despite keep-alive override")
+	}
+
+	c.SetPeerKeepAlive(nk, 0)
+	if got := de.sessionActiveTimeoutLocked(); got != sessionActiveTimeout {
+		t.Errorf("reset timeout = %v; want %v", got, sessionActiveTimeout)
+	}
+	if !st.shouldDeleteLocked(de.sessionActiveTimeoutLocked()) {
+		t.Error("candidate kept after keep-alive override removed")
+	}
+}
+
+func TestNotePongPayload(t *testing.T) {
+	de := &endpoint{}
+	for i, tt := range []struct {
+		seq     uint32
+		latency time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{3, 26 * time.Millisecond},
+		{2, 10 * time.Millisecond}, // reordered
+		{4, 10 * time.Millisecond},
+	} {
+		payload := appendPingPayload(nil, tt.seq)
+		if seq, ok := parsePingPayload(payload); !ok || seq != tt.seq {
+			t.Fatalf("%d: parsePingPayload = %v, %v; want %v, true", i, seq, ok, tt.seq)
+		}
+		de.notePongPayloadLocked(payload, tt.latency)
+	}
+	if de.pongsReordered != 1 {
+		t.Errorf("pongsReordered = %v; want 1", de.pongsReordered)
+	}
+	if want := time.Duration(1816407); de.pingJitter != want {
+		t.Errorf("pingJitter = %v; want %v", de.pingJitter, want)
+	}
+
+	// Payloads we didn't make are ignored.
+	de.notePongPayloadLocked([]byte("foo"), time.Second)
+	if de.lastPongLatency != 10*time.Millisecond {
+		t.Errorf("lastPongLatency = %v after foreign payload; want 10ms", de.lastPongLatency)
+	}
+}
+
+func TestPathChangeFunc(t *testing.T) {
+	c := newConn()
+	var got []PathKind
+	c.pathChangeFunc = func(_ tailcfg.NodeKey, path PathKind) {
+		got = append(got, path)
+	}
+	de := &endpoint{c: c}
+	derpAddr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	udpAddr := netaddr.MustParseIPPort("1.2.3.4:567")
+
+	note := func(udpAddr, derpAddr netaddr.IPPort) {
+		if de.notePathLocked(udpAddr, derpAddr) {
+			de.reportPathChange()
+		}
+	}
+
+	note(netaddr.IPPort{}, netaddr.IPPort{}) // no path; not reported
+	note(netaddr.IPPort{}, derpAddr)
+	note(netaddr.IPPort{}, derpAddr)
+	note(udpAddr, netaddr.IPPort{})
+	note(udpAddr, netaddr.IPPort{})
+	note(udpAddr, derpAddr) // direct path no longer trusted
+	want := []PathKind{PathDERP, PathDirect, PathDERP}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got path changes %v; want %v", got, want)
+	}
+
+	// After a reset, the current path is reported again.
+	de.lastPath = 0
+	note(udpAddr, derpAddr)
+	if len(got) != 4 || got[3] != PathDERP {
+		t.Errorf("got path changes %v after reset; want trailing %v", got, PathDERP)
+	}
+}
+
+func TestPathChangeFuncUnlocked(t *testing.T) {
+	c := newTestConn(t)
+	defer c.Close()
+	de := newTestEndpoint(c)
+	de.derpAddr = netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	defer de.stopAndReset()
+	c.mu.Lock()
+	c.peerMap.upsertDiscoEndpoint(de)
+	c.mu.Unlock()
+
+	var got []PathKind
+	c.pathChangeFunc = func(peer tailcfg.NodeKey, path PathKind) {
+		// This would deadlock if called with c.mu or de.mu held.
+		c.PeerLatency(peer)
+		got = append(got, path)
+	}
+	de.addrsForSend()
+	if want := []PathKind{PathDERP}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got path changes %v; want %v", got, want)
+	}
+}
+
+func TestNoteSendFailure(t *testing.T) {
+	de := &endpoint{c: newConn()}
+	de.noteSendFailure(true)
+	de.noteSendFailure(true)
+	de.noteSendFailure(false)
+
+	var ps ipnstate.PeerStatus
+	de.populatePeerStatus(&ps)
+	if ps.DERPSendDrops != 2 || ps.UDPSendErrors != 1 {
+		t.Errorf("got %d DERP drops, %d UDP errors; want 2, 1", ps.DERPSendDrops, ps.UDPSendErrors)
+	}
+
+	// Once the window has passed, old failures are forgotten.
+	de.sendErrWindowStart -= mono.Time(sendErrWindow)
+	ps = ipnstate.PeerStatus{}
+	de.populatePeerStatus(&ps)
+	if ps.DERPSendDrops != 0 || ps.UDPSendErrors != 0 {
+		t.Errorf("got %d DERP drops, %d UDP errors after window; want 0, 0", ps.DERPSendDrops, ps.UDPSendErrors)
+	}
+	de.noteSendFailure(false)
+	if de.derpSendDrops != 0 || de.udpSendErrs != 1 {
+		t.Errorf("new window has %d DERP drops, %d UDP errors; want 0, 1", de.derpSendDrops, de.udpSendErrs)
+	}
+}
+
+func TestAddPongReplyRingSize(t *testing.T) {
+	var st endpointState
+	if st.recentPongs != nil {
+		t.Fatal("recentPongs allocated before first pong")
+	}
+	const max = 3
+	for i := 1; i <= 5; i++ {
+		st.addPongReplyLocked(pongReply{latency: time.Duration(i)}, max)
+	}
+	if len(st.recentPongs) != max {
+		t.Fatalf("len = %d; want %d", len(st.recentPongs), max)
+	}
+	if got := st.recentPongs[st.recentPong].latency; got != 5 {
+		t.Errorf("most recent latency = %v; want 5", got)
+	}
+
+	if got := (&Options{}).pongHistoryCount(); got != defaultPongHistoryCount {
+		t.Errorf("default pongHistoryCount = %d; want %d", got, defaultPongHistoryCount)
+	}
+	if got := (&Options{PongHistoryCount: 8}).pongHistoryCount(); got != 8 {
+		t.Errorf("pongHistoryCount = %d; want 8", got)
 	}
-	return
 }
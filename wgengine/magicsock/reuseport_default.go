@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package magicsock
+
+import "syscall"
+
+// reusePortSupported is whether Options.NumSockets greater than one
+// is honored. Only Linux spreads packets across SO_REUSEPORT sockets.
+const reusePortSupported = false
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
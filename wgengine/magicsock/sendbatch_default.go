@@ -0,0 +1,14 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package magicsock
+
+import "net"
+
+func writeBatch(pconn net.PacketConn, bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	return writeBatchLoop(pconn, bufs, addr)
+}
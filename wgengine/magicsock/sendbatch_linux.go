@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// writeBatch writes bufs to addr on pconn using a single sendmmsg(2)
+// call when pconn is a *net.UDPConn. It returns the number of packets
+// written, which may be fewer than len(bufs).
+func writeBatch(pconn net.PacketConn, bufs [][]byte, addr *net.UDPAddr) (int, error) {
+	uc, ok := pconn.(*net.UDPConn)
+	if !ok {
+		return writeBatchLoop(pconn, bufs, addr)
+	}
+	msgs := make([]ipv4.Message, len(bufs))
+	for i := range bufs {
+		msgs[i].Buffers = bufs[i : i+1]
+		msgs[i].Addr = addr
+	}
+	if addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(uc).WriteBatch(msgs, 0)
+	}
+	return ipv6.NewPacketConn(uc).WriteBatch(msgs, 0)
+}